@@ -22,8 +22,12 @@ const (
 	SOUND_NELLYMOSER            = 6
 	SOUND_ALAW                  = 7
 	SOUND_MULAW                 = 8
+	SOUND_EXHEADER              = 9 //Enhanced RTMP, 后面是FourCC
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_MP3_8KHZ              = 14
+	//不是FLV的SoundFormat, 由Enhanced RTMP的FourCC ac-3得到
+	SOUND_AC3 = 16
 
 	SOUND_5_5Khz = 0
 	SOUND_11Khz  = 1
@@ -23,6 +23,7 @@ type Ts struct {
 	ExtInf           string
 	Duration         int64 //毫秒
 	Size             int64
+	Discontinuity    bool //前面有#EXT-X-DISCONTINUITY
 
 	TsUrl     string
 	LocalFile string
@@ -47,9 +48,10 @@ type M3u8 struct {
 	M3u8Entries []*M3u8Entry
 
 	//second m3u8
-	Version   string
-	Sequence  int64
-	TsEntries []*Ts
+	Version        string
+	Sequence       int64
+	TargetDuration int64 //秒
+	TsEntries      []*Ts
 }
 
 func NewM3u8(m3u8Url string) *M3u8 {
@@ -63,6 +65,7 @@ func NewM3u8(m3u8Url string) *M3u8 {
 func (m3u8 *M3u8) Parse(m3u8String string) {
 	m3u8.M3u8String = m3u8String
 	lines := utils.SplitLine(m3u8String)
+	discontinuity := false
 	for i := range lines {
 		line := lines[i]
 
@@ -82,10 +85,23 @@ func (m3u8 *M3u8) Parse(m3u8String string) {
 			}
 		}
 
+		//targetduration
+		{
+			index := strings.LastIndex(line, "#EXT-X-TARGETDURATION:")
+			if index >= 0 {
+				m3u8.TargetDuration, _ = strconv.ParseInt(strings.TrimSpace(line[index+len("#EXT-X-TARGETDURATION:"):]), 10, 64)
+			}
+		}
+
+		//discontinuity, 作用于下一个ts
+		if strings.TrimSpace(line) == "#EXT-X-DISCONTINUITY" {
+			discontinuity = true
+		}
+
 		//ts
 		{
 			index := strings.LastIndex(line, "#EXTINF:")
-			if index >= 0 {
+			if index >= 0 && i+1 < len(lines) {
 				durationString := line[index+len("#EXTINF:"):]
 				titleString := ""
 				commaIndex := strings.LastIndex(durationString, ",")
@@ -121,6 +137,8 @@ func (m3u8 *M3u8) Parse(m3u8String string) {
 				ts.Name = path.Base(ts.UrlInfo.Path)
 				ts.RelativeToParent = PathRelativeTo(ts.UrlInfo.Path, m3u8.UrlInfo.Path)
 				ts.Duration = duration
+				ts.Discontinuity = discontinuity
+				discontinuity = false
 				m3u8.TsEntries = append(m3u8.TsEntries, ts)
 			}
 		}
@@ -128,7 +146,7 @@ func (m3u8 *M3u8) Parse(m3u8String string) {
 		//m3u8
 		{
 			index := strings.LastIndex(line, "#EXT-X-STREAM-INF:")
-			if index >= 0 {
+			if index >= 0 && i+1 < len(lines) {
 				entry := &M3u8Entry{}
 
 				bandIndex := strings.LastIndex(line, "BANDWIDTH=")
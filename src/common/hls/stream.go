@@ -9,7 +9,6 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"product_code/check_stream/antileech"
 	"sort"
 	"strings"
 	"sync"
@@ -335,7 +334,8 @@ func (stream *Stream) DownloadM3u8() (m3u8 *M3u8, err error) {
 	if stream.AntileechRemote != "" {
 		headers := http.Header{}
 		headers.Set("Strm-Uri", stream.M3u8Url)
-		m3u8String, err = httputils.HttpGet(antileech.AntileechUrl(stream.AntileechRemote), stream.Timeout, headers)
+		//防盗链服务通过Strm-Uri头得到原始地址
+		m3u8String, err = httputils.HttpGet(stream.AntileechRemote, stream.Timeout, headers)
 	} else {
 		m3u8String, err = httputils.HttpGet(stream.M3u8Url, stream.Timeout, nil)
 	}
@@ -42,10 +42,11 @@ type StaticPushInfo struct {
 }
 
 type StaticPullInfo struct {
-	Type   string
-	Source string
-	App    string
-	Stream string
+	Type    string
+	Source  string
+	App     string
+	Stream  string
+	Headers map[string]string //http-flv拉流时附加的请求头, 例如Referer, User-Agent, Cookie
 }
 
 type ServerInfo struct {
@@ -56,12 +57,88 @@ type ServerInfo struct {
 	Static_push     []StaticPushInfo
 	Static_pull     []StaticPullInfo
 	Sub_static_push []SubStaticPush
+	Hls             HlsInfo
+}
+
+//应用的HLS配置
+type HlsInfo struct {
+	SegmentDuration int            `json:"segmentDuration"` //分片目标时长(秒), 默认3, 在关键帧处切片
+	PlaylistLength  int            `json:"playlistLength"`  //播放列表中的分片数, 默认3
+	Dir             string         `json:"dir"`             //分片保存目录, 为空时分片只保存在内存中
+	Retain          int            `json:"retain"`          //分片离开播放列表后在磁盘上保留的个数, 默认与播放列表相同
+	PartDuration    int            `json:"partDuration"`    //LL-HLS部分分片时长(毫秒), 0表示不开启
+	Fmp4            bool           `json:"fmp4"`            //同时生成fMP4(CMAF)分片, 提供HLS(.cmaf.m3u8)和DASH(.mpd)
+	AudioOnly       bool           `json:"audioOnly"`       //同时生成纯音频TS分片, .m3u8为主播放列表(.av.m3u8和.audio.m3u8)
+	Encrypt         HlsEncryptInfo `json:"encrypt"`         //分片加密
+	SessionTimeout  int            `json:"sessionTimeout"`  //观看会话没有请求后过期时间(秒), 默认30
+	IssueSession    bool           `json:"issueSession"`    //第一次请求播放列表时分配会话ID(session参数), 否则由IP和User-Agent得到
+	RepublishGrace  int            `json:"republishGrace"`  //推流断开后保留播放列表的时间(秒), 期间重新推流时分片序号连续, 默认30, 小于0表示不保留
+	Mode            string         `json:"mode"`            //always: 推流时开始切片, ondemand: 第一次请求播放列表时开始切片, 默认always
+	IdleTimeout     int            `json:"idleTimeout"`     //ondemand模式没有观看者后停止切片的时间(分钟), 默认5
+}
+
+//HLS切片模式
+const (
+	HlsModeAlways   = "always"
+	HlsModeOnDemand = "ondemand"
+)
+
+//HLS分片加密, 密钥由本地目录或HTTP密钥服务提供
+type HlsEncryptInfo struct {
+	Method      string `json:"method"`      //AES-128或SAMPLE-AES, 为空时不加密
+	Rotate      int    `json:"rotate"`      //每N个分片更换密钥, 0表示不更换
+	KeyDir      string `json:"keyDir"`      //本地密钥目录, 没有配置密钥服务时使用
+	KeyService  string `json:"keyService"`  //HTTP密钥服务地址
+	TokenSecret string `json:"tokenSecret"` //播放token签名密钥, 为空时不检查token
 }
 
 type EngineInfo struct {
 	Ffmpeg string
 }
 
+//录制保存规则, 可以配置在全局, 房间或推流点上, 推流点优先
+type RetentionInfo struct {
+	MaxAge         int     `json:"maxAge"`         //录制最长保存时间(小时), 0表示不限制
+	MaxSize        int64   `json:"maxSize"`        //录制最大总大小(MB), 0表示不限制
+	MinFreePercent float64 `json:"minFreePercent"` //磁盘最小剩余空间百分比, 低于时删除最早的录制
+}
+
+type RecordInfo struct {
+	SegmentDuration     int           `json:"segmentDuration"`     //录制分段时长(秒), 0表示不按时长分段
+	SegmentSize         int64         `json:"segmentSize"`         //录制分段大小(MB), 0表示不按大小分段
+	Catalog             string        `json:"catalog"`             //录制索引文件
+	ChecksumWorkers     int           `json:"checksumWorkers"`     //计算md5的并发数
+	Retention           RetentionInfo `json:"retention"`           //默认保存规则
+	CriticalFreePercent float64       `json:"criticalFreePercent"` //磁盘剩余空间低于此百分比时拒绝新的录制
+	JanitorInterval     int           `json:"janitorInterval"`     //清理检查间隔(秒)
+	VodDuration         int           `json:"vodDuration"`         //点播分片目标时长(秒)
+	Journal             string        `json:"journal"`             //正在录制的文件日志, 异常退出后启动时恢复
+}
+
+//录制上传到对象存储
+type StorageInfo struct {
+	Type        string `json:"type"`        //local或s3, 默认local
+	Endpoint    string `json:"endpoint"`    //http://127.0.0.1:9000
+	Region      string `json:"region"`      //默认us-east-1
+	Bucket      string `json:"bucket"`      //桶名称
+	Prefix      string `json:"prefix"`      //对象名称前缀模板, 默认{room}/{project}/{push}/{date}
+	AccessKey   string `json:"accessKey"`   //访问密钥
+	SecretKey   string `json:"secretKey"`   //私有密钥
+	PathStyle   bool   `json:"pathStyle"`   //使用endpoint/bucket/key形式的地址, MinIO需要
+	PublicUrl   string `json:"publicUrl"`   //回看地址的root, 为空时使用endpoint
+	PartSize    int64  `json:"partSize"`    //分片上传的分片大小(MB), 最小5
+	Queue       string `json:"queue"`       //上传队列文件
+	Workers     int    `json:"workers"`     //上传并发数
+	MaxRetry    int    `json:"maxRetry"`    //最大重试次数, 0表示一直重试
+	DeleteLocal bool   `json:"deleteLocal"` //上传并校验成功后删除本地文件
+}
+
+//直播剪辑
+type ClipInfo struct {
+	Dir    string `json:"dir"`    //剪辑文件保存目录
+	Buffer int    `json:"buffer"` //直播缓存时长(秒), 用于剪辑还没有录制完成的部分, 0表示不缓存
+}
+
 type ServerCfg struct {
 	StaticAddr bool   `json:"staticAddr"`
 	Notifyurl  string `json:"notifyUrl"`
@@ -76,6 +153,9 @@ type ServerCfg struct {
 	Chunksize    int          `json:"chunkSize"`
 	EngineEnable string       `json:"engineEnable"`
 	Engine       EngineInfo   `json:"engine"`
+	Record       RecordInfo   `json:"record"`
+	Clip         ClipInfo     `json:"clip"`
+	Storage      StorageInfo  `json:"storage"`
 	Servers      []ServerInfo `json:"servers"`
 }
 
@@ -88,11 +168,25 @@ type Url struct {
 	SavePath   string        `json:"savePath"`
 	SaveUrl    string        `json:"saveUrl"`
 	RequestUrl string        `json:"requestUrl"`
+	//录制格式 ts/flv/mp4/fmp4, 默认flv
+	RecordFormat string `json:"recordFormat"`
+	//推流点的保存规则
+	Retention *RetentionInfo `json:"retention"`
+}
+
+//定时录制时段, Finish早于Start表示跨过午夜
+type ScheduleInfo struct {
+	Days   []int  `json:"days"`   //星期几(1-7, 7为星期日), 为空表示每天
+	Start  string `json:"start"`  //开始时间 09:00
+	Finish string `json:"finish"` //结束时间 18:00
 }
 
 type Live struct {
-	LiveId string `json:"liveId"`
-	Urls   []Url  `json:"urls"`
+	LiveId    string         `json:"liveId"`
+	Urls      []Url          `json:"urls"`
+	Retention *RetentionInfo `json:"retention"` //房间的保存规则
+	Schedules []ScheduleInfo `json:"schedules"` //定时录制, 配置后只在时段内录制
+	HlsMode   string         `json:"hlsMode"`   //房间的HLS切片模式, 为空时使用应用的配置
 }
 
 type LivesCfg struct {
@@ -120,6 +214,10 @@ type PushStreamUrl struct {
 	SaveUrl    string        `json:"saveUrl"`    //保存回看的Url的root
 	RequestUrl string        `json:"requestUrl"` //请求的URL（只针对球机有用）
 	Replays    []*Replay     `json:"replays"`    //回看
+	//录制格式 ts/flv/mp4/fmp4
+	RecordFormat string `json:"recordFormat"`
+	//保存规则
+	Retention RetentionInfo `json:"retention"`
 
 }
 
@@ -157,18 +255,6 @@ type ReplayRooms struct {
 	Rooms []*ReplayRoom `json:"replays"`
 }
 
-type FileToMd5 struct {
-	FilePath string `json:"filePath"` //直播房间ID
-	Size     int64  `json:"size"`     //直播房间ID
-	MD5      string `json:"Md5"`      //注册节点地址
-	Start    string `json:"start"`    //视频起始时间
-	Finish   string `json:"finish"`   //视频结束时间
-}
-
-type Md5s struct {
-	Files []*FileToMd5 `json:"files"`
-}
-
 var RtmpServercfg ServerCfg
 var LiveRtmpcfg LivesCfg
 var isStaticPushEnable bool
@@ -369,6 +455,119 @@ func GetEngineEnable() string {
 	return RtmpServercfg.EngineEnable
 }
 
+//得到应用的HLS配置, 没有配置的项使用默认值
+func GetHlsInfo(app string) HlsInfo {
+	var info HlsInfo
+	for _, serverinfo := range RtmpServercfg.Servers {
+		if serverinfo.Servername == app {
+			info = serverinfo.Hls
+			break
+		}
+	}
+	if info.SegmentDuration <= 0 {
+		info.SegmentDuration = 3
+	}
+	if info.PlaylistLength <= 0 {
+		info.PlaylistLength = 3
+	}
+	if info.Retain <= 0 {
+		info.Retain = info.PlaylistLength
+	}
+	if info.SessionTimeout <= 0 {
+		info.SessionTimeout = 30
+	}
+	if info.RepublishGrace == 0 {
+		info.RepublishGrace = 30
+	}
+	if info.Mode != HlsModeOnDemand {
+		info.Mode = HlsModeAlways
+	}
+	if info.IdleTimeout <= 0 {
+		info.IdleTimeout = 5
+	}
+	return info
+}
+
+func GetRecordSegmentDuration() int {
+	return RtmpServercfg.Record.SegmentDuration
+}
+
+func GetRecordSegmentSize() int64 {
+	return RtmpServercfg.Record.SegmentSize * 1024 * 1024
+}
+
+func GetRecordCatalog() string {
+	if RtmpServercfg.Record.Catalog == "" {
+		return "catalog.json"
+	}
+	return RtmpServercfg.Record.Catalog
+}
+
+func GetRecordJournal() string {
+	if RtmpServercfg.Record.Journal == "" {
+		return "journal.json"
+	}
+	return RtmpServercfg.Record.Journal
+}
+
+func GetRecordRetention() RetentionInfo {
+	return RtmpServercfg.Record.Retention
+}
+
+func GetRecordCriticalFreePercent() float64 {
+	return RtmpServercfg.Record.CriticalFreePercent
+}
+
+func GetRecordJanitorInterval() int {
+	if RtmpServercfg.Record.JanitorInterval <= 0 {
+		return 60
+	}
+	return RtmpServercfg.Record.JanitorInterval
+}
+
+func GetRecordVodDuration() int {
+	if RtmpServercfg.Record.VodDuration <= 0 {
+		return 6
+	}
+	return RtmpServercfg.Record.VodDuration
+}
+
+func GetClipDir() string {
+	if RtmpServercfg.Clip.Dir == "" {
+		return "clips"
+	}
+	return RtmpServercfg.Clip.Dir
+}
+
+func GetClipBuffer() int {
+	return RtmpServercfg.Clip.Buffer
+}
+
+func GetStorage() StorageInfo {
+	storage := RtmpServercfg.Storage
+	if storage.Type == "" {
+		storage.Type = "local"
+	}
+	if storage.Queue == "" {
+		storage.Queue = "upload.json"
+	}
+	if storage.Workers <= 0 {
+		storage.Workers = 2
+	}
+	return storage
+}
+
+func GetNotifyUrl() string {
+	return RtmpServercfg.Notifyurl
+}
+
+func GetRecordChecksumWorkers() int {
+	if RtmpServercfg.Record.ChecksumWorkers <= 0 {
+		return 2
+	}
+	return RtmpServercfg.Record.ChecksumWorkers
+}
+
 func GetStaticPullList() (pullInfoList []StaticPullInfo, bRet bool) {
 	pullInfoList = nil
 	bRet = false
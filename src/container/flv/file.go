@@ -0,0 +1,256 @@
+package flv
+
+import (
+	"av"
+	"errors"
+	"os"
+	"protocol/amf"
+	"strings"
+	"utils/pio"
+)
+
+const (
+	flvHeaderLen  = 9
+	prevTagLen    = 4
+	flvBodyOffset = flvHeaderLen + prevTagLen
+
+	//metaReserveLen 文件开头onMetaData的数据长度, 不足部分用padding属性填充, 结束时在原位置改写
+	metaReserveLen = 32 * 1024
+	metaPadding    = "padding"
+)
+
+var errMetaDataTooLarge = errors.New("flv: metadata too large")
+
+//FileMuxer 写FLV文件, 记录关键帧位置, 结束时改写文件开头带有duration和keyframes的onMetaData
+type FileMuxer struct {
+	f         *os.File
+	name      string
+	buf       []byte
+	size      int64
+	metaEnd   int64
+	metadata  amf.Object
+	hasVideo  bool
+	hasAudio  bool
+	lastTs    uint32
+	keyTimes  []float64
+	keyOffset []int64
+}
+
+func NewFileMuxer(name string) (*FileMuxer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &FileMuxer{
+		f:    f,
+		name: name,
+		buf:  make([]byte, headerLen),
+	}
+
+	if _, err := f.Write(flvHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	pio.PutI32BE(m.buf[:4], 0)
+	if _, err := f.Write(m.buf[:4]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	m.size = flvBodyOffset
+
+	//预留定长的onMetaData
+	data, err := padMetaData(amf.Object{})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := m.writeTag(av.TAG_SCRIPTDATAAMF0, 0, data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	m.metaEnd = m.size
+
+	return m, nil
+}
+
+//Name 文件名
+func (m *FileMuxer) Name() string {
+	return m.name
+}
+
+//Size 当前文件大小
+func (m *FileMuxer) Size() int64 {
+	return m.size
+}
+
+//Duration 当前时长(毫秒)
+func (m *FileMuxer) Duration() uint32 {
+	return m.lastTs
+}
+
+//WriteMetaData 记录onMetaData, 在写入音视频之前调用时写入文件开头预留的位置
+func (m *FileMuxer) WriteMetaData(data []byte) error {
+	name, args, err := amf.DecodeDataMessage(data)
+	if err != nil {
+		return err
+	}
+	if name != amf.OnMetaData || len(args) == 0 {
+		return nil
+	}
+	obj, ok := args[0].(amf.Object)
+	if !ok {
+		return nil
+	}
+	m.metadata = obj
+	if m.size != m.metaEnd {
+		return nil
+	}
+	return m.writeMetaData(obj)
+}
+
+//writeMetaData 改写文件开头预留的onMetaData, tag头和长度不变
+func (m *FileMuxer) writeMetaData(meta amf.Object) error {
+	data, err := padMetaData(meta)
+	if err != nil {
+		return err
+	}
+	_, err = m.f.WriteAt(data, flvBodyOffset+headerLen)
+	return err
+}
+
+//padMetaData 编码onMetaData, 用padding属性填充到metaReserveLen
+func padMetaData(meta amf.Object) ([]byte, error) {
+	obj := amf.Object{}
+	for k, v := range meta {
+		obj[k] = v
+	}
+	obj[metaPadding] = ""
+	data, err := amf.EncodeDataMessage(amf.OnMetaData, obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > metaReserveLen {
+		return nil, errMetaDataTooLarge
+	}
+	obj[metaPadding] = strings.Repeat(" ", metaReserveLen-len(data))
+	return amf.EncodeDataMessage(amf.OnMetaData, obj)
+}
+
+//WritePacket 写入音视频包, 时间戳由调用者保证从0开始
+func (m *FileMuxer) WritePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return m.WriteMetaData(p.Data)
+	}
+
+	typeID := uint8(av.TAG_AUDIO)
+	if p.IsVideo {
+		typeID = av.TAG_VIDEO
+		m.hasVideo = true
+		if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() && !vh.IsSeq() {
+			m.keyTimes = append(m.keyTimes, float64(p.TimeStamp)/1000)
+			m.keyOffset = append(m.keyOffset, m.size)
+		}
+	} else {
+		m.hasAudio = true
+	}
+
+	if p.TimeStamp > m.lastTs {
+		m.lastTs = p.TimeStamp
+	}
+	return m.writeTag(typeID, p.TimeStamp, p.Data)
+}
+
+func (m *FileMuxer) writeTag(typeID uint8, timestamp uint32, data []byte) error {
+	h := m.buf[:headerLen]
+	dataLen := len(data)
+
+	pio.PutU8(h[0:1], typeID)
+	pio.PutI24BE(h[1:4], int32(dataLen))
+	pio.PutI24BE(h[4:7], int32(timestamp&0xffffff))
+	pio.PutU8(h[7:8], uint8(timestamp>>24&0xff))
+	pio.PutI24BE(h[8:11], 0)
+
+	if _, err := m.f.Write(h); err != nil {
+		return err
+	}
+	if _, err := m.f.Write(data); err != nil {
+		return err
+	}
+	pio.PutI32BE(h[:4], int32(dataLen+headerLen))
+	if _, err := m.f.Write(h[:4]); err != nil {
+		return err
+	}
+
+	m.size += int64(headerLen + dataLen + prevTagLen)
+	return nil
+}
+
+//Close 关闭文件, 不重写onMetaData
+func (m *FileMuxer) Close() error {
+	return m.f.Close()
+}
+
+//Finalize 改写onMetaData(duration, filesize, keyframes)后关闭文件, 保存为dst
+func (m *FileMuxer) Finalize(dst string) error {
+	if err := m.finalize(); err != nil {
+		m.f.Close()
+		return err
+	}
+	if err := m.f.Close(); err != nil {
+		return err
+	}
+
+	if dst != m.name {
+		if err := os.Rename(m.name, dst); err != nil {
+			return err
+		}
+	}
+	m.name = dst
+	return nil
+}
+
+//finalize 关键帧太多时隔step个取一个, 直到onMetaData不超过预留长度
+func (m *FileMuxer) finalize() error {
+	for step := 1; ; step *= 2 {
+		err := m.writeMetaData(m.finalMetaData(step, m.size))
+		if err != errMetaDataTooLarge || step >= len(m.keyTimes) {
+			return err
+		}
+	}
+}
+
+func (m *FileMuxer) finalMetaData(step int, fileSize int64) amf.Object {
+	meta := amf.Object{}
+	for k, v := range m.metadata {
+		switch k {
+		case "duration", "filesize", "lasttimestamp", "lastkeyframetimestamp", "keyframes", metaPadding:
+		default:
+			meta[k] = v
+		}
+	}
+
+	times := make(amf.Array, 0, len(m.keyTimes))
+	positions := make(amf.Array, 0, len(m.keyOffset))
+	for i := 0; i < len(m.keyTimes); i += step {
+		times = append(times, m.keyTimes[i])
+		positions = append(positions, float64(m.keyOffset[i]))
+	}
+
+	meta["duration"] = float64(m.lastTs) / 1000
+	meta["lasttimestamp"] = float64(m.lastTs) / 1000
+	meta["filesize"] = float64(fileSize)
+	meta["hasVideo"] = m.hasVideo
+	meta["hasAudio"] = m.hasAudio
+	meta["hasMetadata"] = true
+	meta["hasKeyframes"] = len(m.keyTimes) > 0
+	meta["canSeekToEnd"] = true
+	if len(m.keyTimes) > 0 {
+		meta["lastkeyframetimestamp"] = m.keyTimes[len(m.keyTimes)-1]
+	}
+	meta["keyframes"] = amf.Object{
+		"times":         times,
+		"filepositions": positions,
+	}
+	return meta
+}
@@ -0,0 +1,286 @@
+package flv
+
+import (
+	"av"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol/amf"
+	"testing"
+	"utils/pio"
+)
+
+func testPacket(t *testing.T, isVideo bool, ts uint32, data []byte) *av.Packet {
+	p := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, TimeStamp: ts, Data: data}
+	if err := NewDemuxer().DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFileMuxerFinalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewFileMuxer(filepath.Join(dir, "a.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, _ := amf.EncodeDataMessage(amf.OnMetaData, amf.Object{"width": 640.0, "height": 360.0})
+	if err := m.WriteMetaData(meta); err != nil {
+		t.Fatal(err)
+	}
+	//视频: sequence header, 关键帧, 普通帧, 关键帧
+	packets := []*av.Packet{
+		testPacket(t, true, 0, []byte{0x17, 0x00, 0, 0, 0, 1, 2}),
+		testPacket(t, true, 0, []byte{0x17, 0x01, 0, 0, 0, 9, 9, 9}),
+		testPacket(t, false, 20, []byte{0xaf, 0x01, 5, 5}),
+		testPacket(t, true, 40, []byte{0x27, 0x01, 0, 0, 0, 8}),
+		testPacket(t, true, 2000, []byte{0x17, 0x01, 0, 0, 0, 7, 7}),
+	}
+	for _, p := range packets {
+		if err := m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(dir, "b.flv")
+	if err := m.Finalize(dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.flv")); !os.IsNotExist(err) {
+		t.Fatal("source file not removed")
+	}
+
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:3]) != "FLV" || b[13] != av.TAG_SCRIPTDATAAMF0 {
+		t.Fatal("bad flv header")
+	}
+	metaLen := int(pio.U24BE(b[14:17]))
+	name, args, err := amf.DecodeDataMessage(b[24 : 24+metaLen])
+	if err != nil || name != amf.OnMetaData {
+		t.Fatalf("bad metadata %s %v", name, err)
+	}
+	obj := args[0].(amf.Object)
+	if obj["duration"].(float64) != 2 || obj["width"].(float64) != 640 {
+		t.Fatalf("bad metadata %v", obj)
+	}
+	if int(obj["filesize"].(float64)) != len(b) {
+		t.Fatalf("filesize %v, want %d", obj["filesize"], len(b))
+	}
+	keyframes := obj["keyframes"].(amf.Object)
+	positions := keyframes["filepositions"].(amf.Array)
+	if len(positions) != 2 {
+		t.Fatalf("keyframes %v", keyframes)
+	}
+	for _, pos := range positions {
+		off := int(pos.(float64))
+		if b[off] != av.TAG_VIDEO || b[off+11] != 0x17 || b[off+12] != 0x01 {
+			t.Fatalf("keyframe position %d is not a keyframe tag", off)
+		}
+	}
+	if _, ok := obj[metaPadding]; !ok || metaLen != metaReserveLen {
+		t.Fatalf("metadata length %d", metaLen)
+	}
+}
+
+//关键帧太多时onMetaData中的关键帧索引隔几个取一个, 长度不变
+func TestFileMuxerManyKeyframes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "a.flv")
+	m, err := NewFileMuxer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		if err := m.WritePacket(testPacket(t, true, uint32(i*40), []byte{0x17, 0x01, 0, 0, 0, 9})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := m.Size()
+	if err := m.Finalize(name); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(b)) != size || int(pio.U24BE(b[14:17])) != metaReserveLen {
+		t.Fatalf("file size %d, want %d", len(b), size)
+	}
+	_, args, err := amf.DecodeDataMessage(b[24 : 24+metaReserveLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := args[0].(amf.Object)
+	positions := obj["keyframes"].(amf.Object)["filepositions"].(amf.Array)
+	if len(positions) == 0 || len(positions) >= n || int(obj["filesize"].(float64)) != len(b) {
+		t.Fatalf("keyframes %d filesize %v", len(positions), obj["filesize"])
+	}
+	for _, pos := range positions {
+		if off := int(pos.(float64)); b[off] != av.TAG_VIDEO || b[off+11] != 0x17 {
+			t.Fatalf("keyframe position %d is not a keyframe tag", off)
+		}
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "a.flv")
+	m, err := NewFileMuxer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := amf.EncodeDataMessage(amf.OnMetaData, amf.Object{"width": 640.0})
+	if err := m.WriteMetaData(meta); err != nil {
+		t.Fatal(err)
+	}
+	packets := []*av.Packet{
+		testPacket(t, true, 0, []byte{0x17, 0x00, 0, 0, 0, 1, 2}),
+		testPacket(t, false, 20, []byte{0xaf, 0x01, 5, 5}),
+		testPacket(t, true, 0x1000040, []byte{0x27, 0x01, 0, 0, 0, 8}),
+	}
+	for _, p := range packets {
+		if err := m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//不Finalize, 读取正在写入的文件
+	r, err := NewFileReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	p, err := r.ReadPacket()
+	if err != nil || !p.IsMetadata {
+		t.Fatalf("metadata %v %v", p, err)
+	}
+	for i, want := range packets {
+		p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.IsVideo != want.IsVideo || p.TimeStamp != want.TimeStamp || string(p.Data) != string(want.Data) || p.Header == nil {
+			t.Fatalf("packet %d = %+v, want %+v", i, p, want)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("err=%v, want EOF", err)
+	}
+	m.Close()
+}
+
+func TestRecoverFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "a.flv")
+	m, err := NewFileMuxer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []*av.Packet{
+		testPacket(t, true, 0, []byte{0x17, 0x00, 0, 0, 0, 1, 2}),
+		testPacket(t, false, 20, []byte{0xaf, 0x01, 5, 5}),
+		testPacket(t, true, 2000, []byte{0x27, 0x01, 0, 0, 0, 8}),
+	}
+	for _, p := range packets {
+		if err := m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := m.Size()
+	//异常退出时最后一个tag只写了一部分
+	if err := m.WritePacket(testPacket(t, true, 2040, []byte{0x27, 0x01, 0, 0, 0, 9, 9, 9})); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if err := os.Truncate(name, m.Size()-6); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := RecoverFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 2000 {
+		t.Fatalf("last timestamp %d", last)
+	}
+	info, _ := os.Stat(name)
+	if info.Size() != size {
+		t.Fatalf("recovered size %d, want %d", info.Size(), size)
+	}
+
+	r, err := NewFileReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	//文件开头预留的onMetaData
+	if p, err := r.ReadPacket(); err != nil || !p.IsMetadata {
+		t.Fatalf("metadata %v %v", p, err)
+	}
+	for range packets {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+//从网络流中读取, tag可能分在多次写入中
+func TestReader(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n"))); err != ErrInvalidFlv {
+		t.Fatalf("err=%v, want ErrInvalidFlv", err)
+	}
+
+	data := []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}
+	tag := []byte{av.TAG_VIDEO, 0, 0, byte(len(data)), 0, 0, 0x28, 0}
+	tag = append(append(append(tag, 0, 0, 0), data...), 0, 0, 0, byte(len(tag)+3+len(data)))
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0})
+		pw.Write(tag[:5])
+		pw.Write(tag[5:])
+		pw.Close()
+	}()
+
+	r, err := NewReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.ReadPacket()
+	if err != nil || !p.IsVideo || p.TimeStamp != 40 || !bytes.Equal(p.Data, data) || p.Header == nil {
+		t.Fatalf("packet %+v %v", p, err)
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("err=%v, want EOF", err)
+	}
+}
@@ -0,0 +1,112 @@
+package flv
+
+import (
+	"av"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"utils/pio"
+)
+
+var ErrInvalidFlv = errors.New("invalid flv file")
+
+//Reader 顺序读取FLV流中的tag, 用于FLV文件和HTTP-FLV推流
+type Reader struct {
+	r       *bufio.Reader
+	header  []byte
+	demuxer *Demuxer
+}
+
+//NewReader 读取并检查FLV头
+func NewReader(rd io.Reader) (*Reader, error) {
+	r := bufio.NewReader(rd)
+	head := make([]byte, flvBodyOffset)
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:3]) != "FLV" {
+		return nil, ErrInvalidFlv
+	}
+	//跳过header中声明的扩展部分
+	if skip := int(pio.U32BE(head[5:9])) - flvHeaderLen; skip > 0 {
+		if _, err := r.Discard(skip); err != nil {
+			return nil, ErrInvalidFlv
+		}
+	}
+
+	return &Reader{
+		r:       r,
+		header:  make([]byte, headerLen),
+		demuxer: NewDemuxer(),
+	}, nil
+}
+
+//FileReader 顺序读取FLV文件中的tag, 可以读取正在写入的文件
+type FileReader struct {
+	*Reader
+	f *os.File
+}
+
+func NewFileReader(name string) (*FileReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileReader{
+		Reader: r,
+		f:      f,
+	}, nil
+}
+
+//ReadPacket 读取下一个tag, Data为完整的tag数据, 结束时返回io.EOF
+func (fr *Reader) ReadPacket() (*av.Packet, error) {
+	for {
+		if _, err := io.ReadFull(fr.r, fr.header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, err
+		}
+
+		typeID := fr.header[0]
+		dataLen := int(pio.U24BE(fr.header[1:4]))
+		timestamp := pio.U24BE(fr.header[4:7]) | uint32(fr.header[7])<<24
+
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(fr.r, data); err != nil {
+			return nil, io.EOF
+		}
+		if _, err := fr.r.Discard(prevTagLen); err != nil {
+			return nil, io.EOF
+		}
+
+		p := &av.Packet{
+			TimeStamp: timestamp,
+			Data:      data,
+		}
+		switch typeID {
+		case av.TAG_VIDEO:
+			p.IsVideo = true
+		case av.TAG_AUDIO:
+			p.IsAudio = true
+		case av.TAG_SCRIPTDATAAMF0, av.TAG_SCRIPTDATAAMF3:
+			p.IsMetadata = true
+			return p, nil
+		default:
+			continue
+		}
+
+		if err := fr.demuxer.DemuxH(p); err != nil {
+			continue
+		}
+		return p, nil
+	}
+}
+
+func (fr *FileReader) Close() error {
+	return fr.f.Close()
+}
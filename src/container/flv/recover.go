@@ -0,0 +1,64 @@
+package flv
+
+import (
+	"av"
+	"bufio"
+	"io"
+	"os"
+	"utils/pio"
+)
+
+//RecoverFile 恢复异常退出时没有写完的FLV文件
+//截掉最后不完整的tag, 返回最后一个音视频tag的时间戳(毫秒)
+func RecoverFile(name string) (uint32, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head := make([]byte, flvBodyOffset)
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:3]) != "FLV" {
+		return 0, ErrInvalidFlv
+	}
+	valid := int64(pio.U32BE(head[5:9])) + prevTagLen
+	if skip := valid - flvBodyOffset; skip > 0 {
+		if _, err := r.Discard(int(skip)); err != nil {
+			return 0, ErrInvalidFlv
+		}
+	}
+
+	var last uint32
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		typeID := header[0]
+		dataLen := int(pio.U24BE(header[1:4]))
+		timestamp := pio.U24BE(header[4:7]) | uint32(header[7])<<24
+		if typeID != av.TAG_AUDIO && typeID != av.TAG_VIDEO &&
+			typeID != av.TAG_SCRIPTDATAAMF0 && typeID != av.TAG_SCRIPTDATAAMF3 {
+			break
+		}
+		if n, err := r.Discard(dataLen + prevTagLen); err != nil || n != dataLen+prevTagLen {
+			break
+		}
+		valid += int64(headerLen + dataLen + prevTagLen)
+		if typeID != av.TAG_SCRIPTDATAAMF0 && typeID != av.TAG_SCRIPTDATAAMF3 && timestamp > last {
+			last = timestamp
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if valid < info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			return 0, err
+		}
+	}
+	return last, nil
+}
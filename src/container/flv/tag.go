@@ -156,6 +156,22 @@ func (tag *Tag) parseAudioHeader(b []byte) (n int, err error) {
 	case av.SOUND_AAC:
 		tag.mediat.aacPacketType = b[1]
 		n++
+	case av.SOUND_EXHEADER:
+		//Enhanced RTMP: 低4位为AudioPacketType, 后面是FourCC
+		//只有CodedFrames(1)转换为对应的SoundFormat, 其它类型不处理
+		if len(b) < n+4 {
+			err = fmt.Errorf("invalid audiodata len=%d", len(b))
+			return
+		}
+		if flags&0xf == av.AAC_RAW {
+			switch string(b[n : n+4]) {
+			case "ac-3":
+				tag.mediat.soundFormat = av.SOUND_AC3
+			case ".mp3":
+				tag.mediat.soundFormat = av.SOUND_MP3
+			}
+		}
+		n += 4
 	}
 	return
 }
@@ -0,0 +1,75 @@
+package mp4
+
+import (
+	"utils/pio"
+)
+
+//boxWriter 构造box, 先写入占位的size, 结束时回填
+type boxWriter struct {
+	buf   []byte
+	stack []int
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	b := make([]byte, 2)
+	pio.PutU16BE(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) u24(v uint32) {
+	b := make([]byte, 3)
+	pio.PutU24BE(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) u32(v uint32) {
+	b := make([]byte, 4)
+	pio.PutU32BE(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) u64(v uint64) {
+	b := make([]byte, 8)
+	pio.PutU64BE(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	w.buf = append(w.buf, make([]byte, n)...)
+}
+
+//start 开始一个box
+func (w *boxWriter) start(typ string) {
+	w.stack = append(w.stack, len(w.buf))
+	w.u32(0)
+	w.bytes([]byte(typ))
+}
+
+//startFull 开始一个full box
+func (w *boxWriter) startFull(typ string, version uint8, flags uint32) {
+	w.start(typ)
+	w.u8(version)
+	w.u24(flags)
+}
+
+//end 结束最近的box并回填size
+func (w *boxWriter) end() {
+	pos := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	pio.PutU32BE(w.buf[pos:], uint32(len(w.buf)-pos))
+}
+
+//matrix 单位矩阵
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
@@ -0,0 +1,488 @@
+package mp4
+
+import (
+	"av"
+	"io"
+	log "logging"
+	"os"
+	"utils/pio"
+)
+
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+
+	mdatHeaderLen = 16
+
+	//纯音频时分片的最大时长(毫秒)
+	audioFragmentDuration = 1000
+)
+
+//Muxer 写MP4文件, 支持H.264/AAC
+//
+//普通模式: 写入ftyp和mdat, 结束时生成moov并移到mdat之前(faststart)
+//分片模式: 第一个采样到达时写入ftyp和moov, 之后每个GOP写一个moof+mdat, 异常退出时已写入的分片仍可播放
+type Muxer struct {
+	f          *os.File
+	name       string
+	fragmented bool
+	video      *track
+	audio      *track
+	size       int64
+	ftyp       []byte
+	header     bool
+	seq        uint32
+	buf        []byte //没有文件时(Segmenter)写入的分片
+}
+
+func NewMuxer(name string, fragmented bool) (*Muxer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Muxer{
+		f:          f,
+		name:       name,
+		fragmented: fragmented,
+	}, nil
+}
+
+//Name 文件名
+func (m *Muxer) Name() string {
+	return m.name
+}
+
+//Size 已写入文件的大小
+func (m *Muxer) Size() int64 {
+	return m.size
+}
+
+func (m *Muxer) tracks() []*track {
+	var tracks []*track
+	if m.video != nil {
+		tracks = append(tracks, m.video)
+	}
+	if m.audio != nil {
+		tracks = append(tracks, m.audio)
+	}
+	return tracks
+}
+
+//WritePacket 写入音视频包, 不支持的编码和onMetaData直接忽略
+func (m *Muxer) WritePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 || len(p.Data) < 5 {
+			return nil
+		}
+		if vh.IsSeq() {
+			return m.setConfig(true, p.Data[5:])
+		}
+		if m.video == nil {
+			return nil
+		}
+		t := m.video
+		s := sample{
+			dts: t.toDts(p.TimeStamp),
+			cts: vh.CompositionTime() * videoTimeScale / 1000,
+			key: vh.IsKeyFrame(),
+		}
+		//新的GOP开始时写出上一个分片
+		if m.fragmented && s.key && len(t.samples) > 0 {
+			if err := m.flushFragment(s.dts); err != nil {
+				return err
+			}
+		}
+		return m.writeSample(t, s, p.Data[5:])
+	}
+
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	if !ok || ah.SoundFormat() != av.SOUND_AAC || len(p.Data) < 2 {
+		return nil
+	}
+	if ah.AACPacketType() == av.AAC_SEQHDR {
+		return m.setConfig(false, p.Data[2:])
+	}
+	if m.audio == nil {
+		return nil
+	}
+	t := m.audio
+	s := sample{
+		dts: t.toDts(p.TimeStamp),
+		key: true,
+	}
+	if m.fragmented && m.video == nil && len(t.samples) > 0 &&
+		(s.dts-t.samples[0].dts)*1000 >= audioFragmentDuration*int64(t.timescale) {
+		if err := m.flushFragment(-1); err != nil {
+			return err
+		}
+	}
+	return m.writeSample(t, s, p.Data[2:])
+}
+
+//setConfig 收到sequence header时创建track, 分片模式下moov写入后不再变化
+func (m *Muxer) setConfig(video bool, config []byte) error {
+	if m.fragmented && m.header {
+		return nil
+	}
+
+	var t *track
+	var err error
+	if video {
+		t, err = newVideoTrack(videoTrackID, config)
+	} else {
+		t, err = newAudioTrack(audioTrackID, config)
+	}
+	if err != nil {
+		log.Errorf("mp4 %s invalid sequence header: %v", m.name, err)
+		return nil
+	}
+
+	old := m.audio
+	if video {
+		old = m.video
+	}
+	if old != nil {
+		//只更新编码参数, 保留已写入的采样
+		old.config = t.config
+		old.width, old.height = t.width, t.height
+		old.channels = t.channels
+		return nil
+	}
+	if video {
+		m.video = t
+	} else {
+		m.audio = t
+	}
+	return nil
+}
+
+func (m *Muxer) writeSample(t *track, s sample, data []byte) error {
+	if !m.header {
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	s.size = uint32(len(data))
+	if m.fragmented {
+		t.addSample(s)
+		t.pending = append(t.pending, append([]byte(nil), data...))
+		return nil
+	}
+
+	s.offset = m.size
+	if _, err := m.f.Write(data); err != nil {
+		return err
+	}
+	m.size += int64(len(data))
+	t.addSample(s)
+	return nil
+}
+
+func (m *Muxer) writeFtyp() []byte {
+	w := &boxWriter{}
+	w.start("ftyp")
+	w.bytes([]byte("isom"))
+	w.u32(0x200)
+	w.bytes([]byte("isom"))
+	if m.fragmented {
+		w.bytes([]byte("iso6"))
+		if m.f == nil {
+			w.bytes([]byte("cmfc"))
+		}
+	} else {
+		w.bytes([]byte("iso2"))
+	}
+	w.bytes([]byte("avc1"))
+	w.bytes([]byte("mp41"))
+	w.end()
+	return w.buf
+}
+
+//writeHeader 普通模式写入ftyp和mdat头, 分片模式写入ftyp和moov
+func (m *Muxer) writeHeader() error {
+	m.header = true
+	m.ftyp = m.writeFtyp()
+	//内存模式下初始化分片单独获取
+	if m.f == nil {
+		return nil
+	}
+
+	buf := m.ftyp
+	if m.fragmented {
+		buf = append(buf, m.moov(0)...)
+	} else {
+		//mdat使用64位长度, 结束时回填
+		mdat := make([]byte, mdatHeaderLen)
+		pio.PutU32BE(mdat[0:4], 1)
+		copy(mdat[4:8], "mdat")
+		buf = append(buf, mdat...)
+	}
+	if _, err := m.f.Write(buf); err != nil {
+		return err
+	}
+	m.size = int64(len(buf))
+	return nil
+}
+
+//moov 生成moov, shift为采样位置需要增加的偏移
+func (m *Muxer) moov(shift int64) []byte {
+	tracks := m.tracks()
+	var duration int64
+	for _, t := range tracks {
+		if d := t.movieDuration(); d > duration && !m.fragmented {
+			duration = d
+		}
+	}
+
+	w := &boxWriter{}
+	w.start("moov")
+
+	w.startFull("mvhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(movieTimeScale)
+	w.u32(uint32(duration))
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24)
+	w.u32(audioTrackID + 1)
+	w.end()
+
+	for _, t := range tracks {
+		t.writeTrak(w, shift, m.fragmented)
+	}
+
+	if m.fragmented {
+		w.start("mvex")
+		for _, t := range tracks {
+			w.startFull("trex", 0, 0)
+			w.u32(t.id)
+			w.u32(1)
+			w.u32(0)
+			w.u32(0)
+			w.u32(0)
+			w.end()
+		}
+		w.end()
+	}
+
+	w.end()
+	return w.buf
+}
+
+//flushFragment 把未写入的采样写成moof+mdat, nextVideoDts为下一个视频帧的dts
+func (m *Muxer) flushFragment(nextVideoDts int64) error {
+	var tracks []*track
+	for _, t := range m.tracks() {
+		if len(t.samples) > 0 {
+			next := int64(-1)
+			if t.video {
+				next = nextVideoDts
+			}
+			t.calcDurations(0, next)
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	m.seq++
+
+	w := &boxWriter{}
+	w.start("moof")
+	w.startFull("mfhd", 0, 0)
+	w.u32(m.seq)
+	w.end()
+
+	//trun中data_offset的位置, moof完成后回填
+	offsetPos := make([]int, len(tracks))
+	for i, t := range tracks {
+		w.start("traf")
+
+		//default-base-is-moof
+		w.startFull("tfhd", 0, 0x020000)
+		w.u32(t.id)
+		w.end()
+
+		w.startFull("tfdt", 1, 0)
+		w.u64(uint64(t.samples[0].dts))
+		w.end()
+
+		//data-offset, duration, size, flags, composition-time-offset
+		flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400)
+		if t.video {
+			flags |= 0x000800
+		}
+		w.startFull("trun", 1, flags)
+		w.u32(uint32(len(t.samples)))
+		offsetPos[i] = len(w.buf)
+		w.u32(0)
+		for j, s := range t.samples {
+			w.u32(t.durations[j])
+			w.u32(s.size)
+			if s.key {
+				w.u32(sampleFlagKey)
+			} else {
+				w.u32(sampleFlagNonKey)
+			}
+			if t.video {
+				w.u32(uint32(s.cts))
+			}
+		}
+		w.end()
+
+		w.end()
+	}
+	w.end()
+
+	mdatSize := 8
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			mdatSize += int(s.size)
+		}
+	}
+
+	offset := len(w.buf) + 8
+	for i, t := range tracks {
+		pio.PutU32BE(w.buf[offsetPos[i]:], uint32(offset))
+		for _, s := range t.samples {
+			offset += int(s.size)
+		}
+	}
+
+	w.u32(uint32(mdatSize))
+	w.bytes([]byte("mdat"))
+	for _, t := range tracks {
+		for _, data := range t.pending {
+			w.bytes(data)
+		}
+		t.samples = t.samples[:0]
+		t.durations = t.durations[:0]
+		t.pending = t.pending[:0]
+	}
+
+	if err := m.write(w.buf); err != nil {
+		return err
+	}
+	m.size += int64(len(w.buf))
+	return nil
+}
+
+//write 写入文件, 没有文件时写入内存
+func (m *Muxer) write(b []byte) error {
+	if m.f == nil {
+		m.buf = append(m.buf, b...)
+		return nil
+	}
+	_, err := m.f.Write(b)
+	return err
+}
+
+//Close 关闭文件, 分片模式下写出剩余的采样
+func (m *Muxer) Close() error {
+	if m.fragmented && m.header {
+		if err := m.flushFragment(-1); err != nil {
+			log.Errorf("mp4 %s flush fragment error: %v", m.name, err)
+		}
+	}
+	return m.f.Close()
+}
+
+//Finalize 完成文件并保存为dst, 普通模式下把moov移到文件开头
+func (m *Muxer) Finalize(dst string) error {
+	if !m.header {
+		if err := m.writeHeader(); err != nil {
+			m.f.Close()
+			return err
+		}
+	}
+
+	if m.fragmented {
+		if err := m.Close(); err != nil {
+			return err
+		}
+		return m.rename(dst)
+	}
+
+	//回填mdat长度
+	mdatPos := int64(len(m.ftyp))
+	b := make([]byte, 8)
+	pio.PutU64BE(b, uint64(m.size-mdatPos))
+	if _, err := m.f.WriteAt(b, mdatPos+8); err != nil {
+		m.f.Close()
+		return err
+	}
+	if err := m.f.Close(); err != nil {
+		return err
+	}
+
+	for _, t := range m.tracks() {
+		t.calcDurations(0, -1)
+	}
+	//co64定长, moov长度与偏移无关
+	moov := m.moov(0)
+	moov = m.moov(int64(len(moov)))
+
+	src, err := os.Open(m.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		if _, err := out.Write(m.ftyp); err != nil {
+			return err
+		}
+		if _, err := out.Write(moov); err != nil {
+			return err
+		}
+		if _, err := src.Seek(mdatPos, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(out, src)
+		return err
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dst != m.name {
+		os.Remove(m.name)
+	}
+	m.name = dst
+	m.size += int64(len(moov))
+	return nil
+}
+
+func (m *Muxer) rename(dst string) error {
+	if dst == m.name {
+		return nil
+	}
+	if err := os.Rename(m.name, dst); err != nil {
+		return err
+	}
+	m.name = dst
+	return nil
+}
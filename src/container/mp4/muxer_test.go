@@ -0,0 +1,296 @@
+package mp4
+
+import (
+	"av"
+	"bytes"
+	"container/flv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"utils/pio"
+)
+
+//640x360 baseline
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xf4, 0x05, 0x01, 0x7f, 0xca, 0x80}
+
+func testPacket(t *testing.T, isVideo bool, ts uint32, data []byte) *av.Packet {
+	p := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, TimeStamp: ts, Data: data}
+	if err := flv.NewDemuxer().DemuxH(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testPackets(t *testing.T) []*av.Packet {
+	avcc := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, byte(len(testSPS))}
+	avcc = append(avcc, testSPS...)
+	avcc = append(avcc, 0x01, 0x00, 0x02, 0x68, 0xce)
+
+	return []*av.Packet{
+		testPacket(t, true, 0, avcc),
+		//AAC LC 44100 stereo
+		testPacket(t, false, 0, []byte{0xaf, 0x00, 0x12, 0x10}),
+		//关键帧, cts=80ms
+		testPacket(t, true, 0, []byte{0x17, 0x01, 0, 0, 80, 0, 0, 0, 2, 0x65, 0x88}),
+		testPacket(t, false, 0, []byte{0xaf, 0x01, 0x21, 0x00}),
+		testPacket(t, true, 40, []byte{0x27, 0x01, 0, 0, 40, 0, 0, 0, 1, 0x41}),
+		testPacket(t, false, 23, []byte{0xaf, 0x01, 0x21, 0x01}),
+		testPacket(t, true, 80, []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x65}),
+		testPacket(t, true, 120, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x41}),
+	}
+}
+
+type testBox struct {
+	typ  string
+	data []byte
+}
+
+func readBoxes(t *testing.T, b []byte) []testBox {
+	var boxes []testBox
+	for len(b) >= 8 {
+		size := uint64(pio.U32BE(b))
+		typ := string(b[4:8])
+		header := uint64(8)
+		if size == 1 {
+			size = pio.U64BE(b[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			t.Fatalf("box %s size %d invalid", typ, size)
+		}
+		boxes = append(boxes, testBox{typ, b[header:size]})
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d trailing bytes", len(b))
+	}
+	return boxes
+}
+
+//findBox 按路径查找box, full box的version/flags由调用者跳过
+func findBox(t *testing.T, b []byte, path ...string) []byte {
+	for i, name := range path {
+		found := false
+		for _, box := range readBoxes(t, b) {
+			if box.typ == name {
+				b = box.data
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("box %v not found", path[:i+1])
+		}
+	}
+	return b
+}
+
+func boxTypes(t *testing.T, b []byte) []string {
+	var types []string
+	for _, box := range readBoxes(t, b) {
+		types = append(types, box.typ)
+	}
+	return types
+}
+
+func writeTestFile(t *testing.T, fragmented bool) []byte {
+	dir, err := ioutil.TempDir("", "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMuxer(filepath.Join(dir, "a.mp4"), fragmented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range testPackets(t) {
+		if err := m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(dir, "b.mp4")
+	if err := m.Finalize(dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.mp4")); !os.IsNotExist(err) {
+		t.Fatal("source file not removed")
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMuxerFaststart(t *testing.T) {
+	b := writeTestFile(t, false)
+
+	types := boxTypes(t, b)
+	if len(types) != 3 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "mdat" {
+		t.Fatalf("top level boxes %v", types)
+	}
+
+	tkhd := findBox(t, b, "moov", "trak", "tkhd")
+	if w, h := pio.U32BE(tkhd[76:])>>16, pio.U32BE(tkhd[80:])>>16; w != 640 || h != 360 {
+		t.Fatalf("video size %dx%d", w, h)
+	}
+
+	stbl := findBox(t, b, "moov", "trak", "mdia", "minf", "stbl")
+	stsz := findBox(t, stbl, "stsz")
+	if n := pio.U32BE(stsz[8:]); n != 4 {
+		t.Fatalf("video sample count %d", n)
+	}
+	stss := findBox(t, stbl, "stss")
+	if n := pio.U32BE(stss[4:]); n != 2 || pio.U32BE(stss[8:]) != 1 || pio.U32BE(stss[12:]) != 3 {
+		t.Fatalf("stss %x", stss)
+	}
+	ctts := findBox(t, stbl, "ctts")
+	if pio.U32BE(ctts[8:]) != 1 || pio.U32BE(ctts[12:]) != 80*90 {
+		t.Fatalf("ctts %x", ctts)
+	}
+	stts := findBox(t, stbl, "stts")
+	if pio.U32BE(stts[4:]) != 1 || pio.U32BE(stts[8:]) != 4 || pio.U32BE(stts[12:]) != 40*90 {
+		t.Fatalf("stts %x", stts)
+	}
+
+	//第一个采样的位置指向mdat中的关键帧数据
+	co64 := findBox(t, stbl, "co64")
+	offset := pio.U64BE(co64[8:])
+	if !bytes.Equal(b[offset:offset+6], []byte{0, 0, 0, 2, 0x65, 0x88}) {
+		t.Fatalf("chunk offset %d points to %x", offset, b[offset:offset+6])
+	}
+
+	elst := findBox(t, b, "moov", "trak", "edts", "elst")
+	if pio.U32BE(elst[12:]) != 80*90 {
+		t.Fatalf("elst %x", elst)
+	}
+}
+
+func TestMuxerFragmented(t *testing.T) {
+	b := writeTestFile(t, true)
+
+	types := boxTypes(t, b)
+	expect := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}
+	if len(types) != len(expect) {
+		t.Fatalf("top level boxes %v", types)
+	}
+	for i := range expect {
+		if types[i] != expect[i] {
+			t.Fatalf("top level boxes %v", types)
+		}
+	}
+
+	findBox(t, b, "moov", "mvex", "trex")
+
+	boxes := readBoxes(t, b)
+	moof := boxes[2].data
+	trun := findBox(t, moof, "traf", "trun")
+	if n := pio.U32BE(trun[4:]); n != 2 {
+		t.Fatalf("first fragment video samples %d", n)
+	}
+	//data_offset从moof开始, 指向mdat中的第一个采样
+	offset := pio.U32BE(trun[8:])
+	if offset != uint32(len(moof)+8+8) {
+		t.Fatalf("data offset %d", offset)
+	}
+	if d := pio.U32BE(trun[12:]); d != 40*90 {
+		t.Fatalf("first sample duration %d", d)
+	}
+
+	tfdt := findBox(t, boxes[4].data, "traf", "tfdt")
+	if dts := pio.U64BE(tfdt[4:]); dts != 80*90 {
+		t.Fatalf("second fragment dts %d", dts)
+	}
+}
+
+func TestSegmenter(t *testing.T) {
+	s := NewSegmenter()
+	packets := testPackets(t)
+	//第二个关键帧处切片
+	for _, p := range packets[:6] {
+		if err := s.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := s.Segment(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets[6:] {
+		if err := s.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second, err := s.Segment(160)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init := s.Init()
+	types := boxTypes(t, init)
+	if len(types) != 2 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("init segment boxes %v", types)
+	}
+	if !bytes.Contains(findBox(t, init, "ftyp"), []byte("cmfc")) {
+		t.Fatal("init segment without cmfc brand")
+	}
+	findBox(t, init, "moov", "mvex", "trex")
+
+	for i, segment := range [][]byte{first, second} {
+		types := boxTypes(t, segment)
+		if len(types) != 2 || types[0] != "moof" || types[1] != "mdat" {
+			t.Fatalf("segment %d boxes %v", i, types)
+		}
+	}
+	tfdt := findBox(t, readBoxes(t, second)[0].data, "traf", "tfdt")
+	if dts := pio.U64BE(tfdt[4:]); dts != 80*90 {
+		t.Fatalf("second segment dts %d", dts)
+	}
+
+	if codecs := s.Codecs(); codecs != "avc1.42c01e,mp4a.40.2" {
+		t.Fatalf("codecs %s", codecs)
+	}
+	if w, h := s.Resolution(); w != 640 || h != 360 {
+		t.Fatalf("resolution %dx%d", w, h)
+	}
+	if rate := s.SampleRate(); rate != 44100 {
+		t.Fatalf("sample rate %d", rate)
+	}
+}
+
+func TestRecoverFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//异常退出时最后一个分片只写了一部分
+	b := writeTestFile(t, true)
+	name := filepath.Join(dir, "a.mp4")
+	torn := append(append([]byte{}, b...), 0, 0, 0x10, 0, 'm', 'o', 'o', 'f', 0, 0)
+	if err := ioutil.WriteFile(name, torn, 0644); err != nil {
+		t.Fatal(err)
+	}
+	end, err := RecoverFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != 160 {
+		t.Fatalf("end %d", end)
+	}
+	recovered, _ := ioutil.ReadFile(name)
+	if !bytes.Equal(recovered, b) {
+		t.Fatalf("recovered size %d, want %d", len(recovered), len(b))
+	}
+
+	//非分片MP4没有moov不能恢复
+	if err := ioutil.WriteFile(name, []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverFile(name); err != ErrNotRecoverable {
+		t.Fatalf("progressive error %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package mp4
+
+import (
+	"errors"
+	"io"
+	"os"
+	"utils/pio"
+)
+
+//ErrNotRecoverable 非分片MP4的moov在结束时才写入, 异常退出后无法恢复
+var ErrNotRecoverable = errors.New("mp4 without moov is not recoverable")
+
+//RecoverFile 恢复异常退出时没有写完的分片MP4
+//截掉最后不完整的moof/mdat, 返回最后一个采样的结束时间(毫秒)
+func RecoverFile(name string) (uint32, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	timescales := make(map[uint32]uint32)
+	var valid, offset int64
+	var pending map[uint32]uint64 //当前moof中每个轨道的结束时间, mdat完整后生效
+	var end uint64                //毫秒
+	hasMoov := false
+
+	header := make([]byte, 16)
+	for offset+8 <= size {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+		boxSize := int64(pio.U32BE(header[0:4]))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+		if boxSize == 1 {
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				break
+			}
+			boxSize = int64(pio.U64BE(header[8:16]))
+			headerLen = 16
+		}
+		if boxSize < headerLen || offset+boxSize > size {
+			break
+		}
+
+		switch typ {
+		case "moov", "moof":
+			data := make([]byte, boxSize-headerLen)
+			if _, err := f.ReadAt(data, offset+headerLen); err != nil && err != io.EOF {
+				return 0, err
+			}
+			if typ == "moov" {
+				hasMoov = true
+				parseMoov(data, timescales)
+			} else {
+				pending = parseMoof(data)
+			}
+		case "mdat":
+			for id, t := range pending {
+				if scale := timescales[id]; scale > 0 {
+					if ms := t * 1000 / uint64(scale); ms > end {
+						end = ms
+					}
+				}
+			}
+			pending = nil
+			valid = offset + boxSize
+		}
+		if typ != "moof" && typ != "mdat" {
+			valid = offset + boxSize
+		}
+		offset += boxSize
+	}
+
+	if !hasMoov {
+		return 0, ErrNotRecoverable
+	}
+	if valid < size {
+		if err := f.Truncate(valid); err != nil {
+			return 0, err
+		}
+	}
+	return uint32(end), nil
+}
+
+//children 遍历box中的子box
+func children(data []byte, fn func(typ string, payload []byte)) {
+	for len(data) >= 8 {
+		size := int(pio.U32BE(data[0:4]))
+		if size < 8 || size > len(data) {
+			return
+		}
+		fn(string(data[4:8]), data[8:size])
+		data = data[size:]
+	}
+}
+
+//parseMoov 得到每个轨道的timescale
+func parseMoov(data []byte, timescales map[uint32]uint32) {
+	children(data, func(typ string, trak []byte) {
+		if typ != "trak" {
+			return
+		}
+		var id, timescale uint32
+		children(trak, func(typ string, payload []byte) {
+			switch typ {
+			case "tkhd":
+				id = fullBoxField(payload, 12, 20)
+			case "mdia":
+				children(payload, func(typ string, payload []byte) {
+					if typ == "mdhd" {
+						timescale = fullBoxField(payload, 12, 20)
+					}
+				})
+			}
+		})
+		if id > 0 {
+			timescales[id] = timescale
+		}
+	})
+}
+
+//fullBoxField 读取version 0/1中位置不同的32位字段
+func fullBoxField(payload []byte, v0, v1 int) uint32 {
+	if len(payload) < 4 {
+		return 0
+	}
+	pos := v0
+	if payload[0] == 1 {
+		pos = v1
+	}
+	if len(payload) < pos+4 {
+		return 0
+	}
+	return pio.U32BE(payload[pos : pos+4])
+}
+
+//parseMoof 得到moof中每个轨道最后一个采样的结束时间(轨道timescale)
+func parseMoof(data []byte) map[uint32]uint64 {
+	ends := make(map[uint32]uint64)
+	children(data, func(typ string, traf []byte) {
+		if typ != "traf" {
+			return
+		}
+		var id, defaultDuration uint32
+		var base, duration uint64
+		children(traf, func(typ string, payload []byte) {
+			if len(payload) < 8 {
+				return
+			}
+			flags := pio.U24BE(payload[1:4])
+			switch typ {
+			case "tfhd":
+				id = pio.U32BE(payload[4:8])
+				pos := 8
+				if flags&0x01 != 0 {
+					pos += 8
+				}
+				if flags&0x02 != 0 {
+					pos += 4
+				}
+				if flags&0x08 != 0 && len(payload) >= pos+4 {
+					defaultDuration = pio.U32BE(payload[pos : pos+4])
+				}
+			case "tfdt":
+				if payload[0] == 1 && len(payload) >= 12 {
+					base = pio.U64BE(payload[4:12])
+				} else {
+					base = uint64(pio.U32BE(payload[4:8]))
+				}
+			case "trun":
+				count := int(pio.U32BE(payload[4:8]))
+				pos := 8
+				if flags&0x01 != 0 {
+					pos += 4
+				}
+				if flags&0x04 != 0 {
+					pos += 4
+				}
+				sampleLen := 0
+				for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+					if flags&bit != 0 {
+						sampleLen += 4
+					}
+				}
+				for i := 0; i < count; i++ {
+					if flags&0x100 != 0 && len(payload) >= pos+4 {
+						duration += uint64(pio.U32BE(payload[pos : pos+4]))
+					} else {
+						duration += uint64(defaultDuration)
+					}
+					pos += sampleLen
+				}
+			}
+		})
+		if id > 0 {
+			ends[id] = base + duration
+		}
+	})
+	return ends
+}
@@ -0,0 +1,83 @@
+package mp4
+
+import (
+	"av"
+	"fmt"
+	"strings"
+)
+
+//Segmenter 在内存中生成fMP4(CMAF)分片, 用于HLS(EXT-X-MAP)和DASH
+//
+//初始化分片为ftyp+moov, 每个媒体分片由一个或多个moof+mdat组成
+//第一个采样写入后编码参数不再变化
+type Segmenter struct {
+	m *Muxer
+}
+
+func NewSegmenter() *Segmenter {
+	return &Segmenter{
+		m: &Muxer{
+			name:       "segmenter",
+			fragmented: true,
+		},
+	}
+}
+
+//WritePacket 写入音视频包, 不支持的编码直接忽略
+func (s *Segmenter) WritePacket(p *av.Packet) error {
+	return s.m.WritePacket(p)
+}
+
+//Init 初始化分片, 还没有写入采样时返回nil
+func (s *Segmenter) Init() []byte {
+	if !s.m.header {
+		return nil
+	}
+	init := append([]byte(nil), s.m.ftyp...)
+	return append(init, s.m.moov(0)...)
+}
+
+//Segment 在timestamp处结束当前分片, 返回分片数据
+//timestamp为下一个分片第一个视频帧的时间戳, 用于计算最后一帧的时长
+func (s *Segmenter) Segment(timestamp uint32) ([]byte, error) {
+	if s.m.header {
+		next := int64(-1)
+		if s.m.video != nil {
+			next = s.m.video.toDts(timestamp)
+		}
+		if err := s.m.flushFragment(next); err != nil {
+			return nil, err
+		}
+	}
+	data := s.m.buf
+	s.m.buf = nil
+	return data, nil
+}
+
+//Codecs RFC 6381格式的编码, 如avc1.42c01e,mp4a.40.2
+func (s *Segmenter) Codecs() string {
+	var codecs []string
+	if t := s.m.video; t != nil && len(t.config) >= 4 {
+		codecs = append(codecs, fmt.Sprintf("avc1.%02x%02x%02x", t.config[1], t.config[2], t.config[3]))
+	}
+	if t := s.m.audio; t != nil {
+		codecs = append(codecs, fmt.Sprintf("mp4a.40.%d", t.config[0]>>3))
+	}
+	return strings.Join(codecs, ",")
+}
+
+//Resolution 视频宽高, 没有视频时为0
+func (s *Segmenter) Resolution() (int, int) {
+	if s.m.video == nil {
+		return 0, 0
+	}
+	return s.m.video.width, s.m.video.height
+}
+
+//SampleRate 音频采样率, 没有音频时为0
+func (s *Segmenter) SampleRate() int {
+	if s.m.audio == nil {
+		return 0
+	}
+	return int(s.m.audio.timescale)
+}
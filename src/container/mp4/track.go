@@ -0,0 +1,436 @@
+package mp4
+
+import (
+	"errors"
+	"parser/h264"
+)
+
+const (
+	movieTimeScale = 1000
+	videoTimeScale = 90000
+	aacFrameSize   = 1024
+
+	defaultVideoDuration = videoTimeScale / 25
+
+	sampleFlagKey    = 0x02000000 //sample_depends_on=2
+	sampleFlagNonKey = 0x01010000 //sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+var (
+	aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+	configInvalid = errors.New("codec config invalid")
+)
+
+type sample struct {
+	dts    int64 //解码时间, 单位为track的timescale
+	cts    int32 //显示时间偏移
+	size   uint32
+	key    bool
+	offset int64 //在文件中的位置(渐进模式)
+}
+
+//track 一路音频或视频的采样表
+type track struct {
+	id        uint32
+	video     bool
+	timescale uint32
+	config    []byte //avcC或AudioSpecificConfig
+	width     int
+	height    int
+	channels  int
+
+	samples   []sample
+	durations []uint32
+	pending   [][]byte //分片模式下未写入的采样数据
+	lastDts   int64
+	lastDur   uint32
+	started   bool
+	startDts  int64
+}
+
+func newVideoTrack(id uint32, config []byte) (*track, error) {
+	t := &track{
+		id:        id,
+		video:     true,
+		timescale: videoTimeScale,
+		config:    append([]byte(nil), config...),
+	}
+	sps, err := h264.ParseAVCConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	t.width = sps.Width
+	t.height = sps.Height
+	return t, nil
+}
+
+func newAudioTrack(id uint32, config []byte) (*track, error) {
+	if len(config) < 2 {
+		return nil, configInvalid
+	}
+	index := (config[0]&0x07)<<1 | config[1]>>7
+	if int(index) >= len(aacSampleRates) {
+		return nil, configInvalid
+	}
+	return &track{
+		id:        id,
+		timescale: uint32(aacSampleRates[index]),
+		config:    append([]byte(nil), config...),
+		channels:  int(config[1] >> 3 & 0x0f),
+	}, nil
+}
+
+//toDts 毫秒时间戳转换为track的timescale
+func (t *track) toDts(timestamp uint32) int64 {
+	return int64(timestamp) * int64(t.timescale) / 1000
+}
+
+func (t *track) addSample(s sample) {
+	if !t.started {
+		t.started = true
+		t.startDts = s.dts
+	} else if s.dts <= t.lastDts {
+		//时间戳回退时保证dts递增
+		s.dts = t.lastDts + 1
+	}
+	t.lastDts = s.dts
+	t.samples = append(t.samples, s)
+}
+
+//defaultDuration 无法由下一个采样得到时长时使用的默认时长
+func (t *track) defaultDuration() uint32 {
+	if !t.video {
+		return aacFrameSize
+	}
+	if t.lastDur > 0 {
+		return t.lastDur
+	}
+	return defaultVideoDuration
+}
+
+//calcDurations 计算从from开始的采样时长, next为下一个采样的dts, 小于0表示未知
+func (t *track) calcDurations(from int, next int64) {
+	t.durations = t.durations[:from]
+	for i := from; i < len(t.samples); i++ {
+		var d int64
+		if i+1 < len(t.samples) {
+			d = t.samples[i+1].dts - t.samples[i].dts
+		} else if next > t.samples[i].dts {
+			d = next - t.samples[i].dts
+		} else {
+			d = int64(t.defaultDuration())
+		}
+		t.durations = append(t.durations, uint32(d))
+		t.lastDur = uint32(d)
+	}
+}
+
+//duration track的总时长(timescale)
+func (t *track) duration() int64 {
+	var total int64
+	for _, d := range t.durations {
+		total += int64(d)
+	}
+	return total
+}
+
+//movieDuration 从影片起点到track结束的时长(毫秒)
+func (t *track) movieDuration() int64 {
+	if !t.started {
+		return 0
+	}
+	return (t.startDts + t.duration()) * movieTimeScale / int64(t.timescale)
+}
+
+func (t *track) writeTrak(w *boxWriter, shift int64, fragmented bool) {
+	//分片模式下时长由各分片给出
+	movieDuration, mediaDuration := t.movieDuration(), t.duration()
+	if fragmented {
+		movieDuration, mediaDuration = 0, 0
+	}
+
+	w.start("trak")
+
+	w.startFull("tkhd", 0, 0x000003)
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.id)
+	w.u32(0)
+	w.u32(uint32(movieDuration))
+	w.zeros(8)
+	w.u16(0)
+	w.u16(0)
+	if t.video {
+		w.u16(0)
+	} else {
+		w.u16(0x0100)
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.width) << 16)
+	w.u32(uint32(t.height) << 16)
+	w.end()
+
+	if !fragmented {
+		t.writeEdts(w)
+	}
+
+	w.start("mdia")
+
+	w.startFull("mdhd", 1, 0)
+	w.u64(0)
+	w.u64(0)
+	w.u32(t.timescale)
+	w.u64(uint64(mediaDuration))
+	//und
+	w.u16(0x55c4)
+	w.u16(0)
+	w.end()
+
+	w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.video {
+		w.bytes([]byte("vide"))
+	} else {
+		w.bytes([]byte("soun"))
+	}
+	w.zeros(12)
+	if t.video {
+		w.bytes([]byte("VideoHandler\x00"))
+	} else {
+		w.bytes([]byte("SoundHandler\x00"))
+	}
+	w.end()
+
+	w.start("minf")
+	if t.video {
+		w.startFull("vmhd", 0, 0x000001)
+		w.zeros(8)
+		w.end()
+	} else {
+		w.startFull("smhd", 0, 0)
+		w.zeros(4)
+		w.end()
+	}
+
+	w.start("dinf")
+	w.startFull("dref", 0, 0)
+	w.u32(1)
+	w.startFull("url ", 0, 0x000001)
+	w.end()
+	w.end()
+	w.end()
+
+	t.writeStbl(w, shift, fragmented)
+
+	//minf
+	w.end()
+	//mdia
+	w.end()
+	//trak
+	w.end()
+}
+
+//writeEdts 用编辑列表处理track的起始延迟和第一帧的显示偏移
+func (t *track) writeEdts(w *boxWriter) {
+	if len(t.samples) == 0 {
+		return
+	}
+	start := t.startDts * movieTimeScale / int64(t.timescale)
+	firstCts := t.samples[0].cts
+	if start == 0 && firstCts == 0 {
+		return
+	}
+
+	w.start("edts")
+	entries := uint32(1)
+	if start > 0 {
+		entries++
+	}
+	w.startFull("elst", 0, 0)
+	w.u32(entries)
+	if start > 0 {
+		w.u32(uint32(start))
+		w.u32(0xffffffff)
+		w.u16(1)
+		w.u16(0)
+	}
+	w.u32(uint32(t.duration() * movieTimeScale / int64(t.timescale)))
+	w.u32(uint32(firstCts))
+	w.u16(1)
+	w.u16(0)
+	w.end()
+	w.end()
+}
+
+func (t *track) writeStsd(w *boxWriter) {
+	w.startFull("stsd", 0, 0)
+	w.u32(1)
+	if t.video {
+		w.start("avc1")
+		w.zeros(6)
+		w.u16(1)
+		w.zeros(16)
+		w.u16(uint16(t.width))
+		w.u16(uint16(t.height))
+		w.u32(0x00480000)
+		w.u32(0x00480000)
+		w.u32(0)
+		w.u16(1)
+		w.zeros(32)
+		w.u16(0x0018)
+		w.u16(0xffff)
+		w.start("avcC")
+		w.bytes(t.config)
+		w.end()
+		w.end()
+	} else {
+		w.start("mp4a")
+		w.zeros(6)
+		w.u16(1)
+		w.zeros(8)
+		w.u16(uint16(t.channels))
+		w.u16(16)
+		w.u16(0)
+		w.u16(0)
+		w.u32(t.timescale << 16)
+		w.startFull("esds", 0, 0)
+		w.bytes(t.esDescriptor())
+		w.end()
+		w.end()
+	}
+	w.end()
+}
+
+//esDescriptor ES_Descriptor, 包含DecoderConfigDescriptor和AudioSpecificConfig
+func (t *track) esDescriptor() []byte {
+	dsi := descriptor(0x05, t.config)
+
+	dcd := []byte{0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	dcd = append(dcd, dsi...)
+
+	es := []byte{byte(t.id >> 8), byte(t.id), 0}
+	es = append(es, descriptor(0x04, dcd)...)
+	es = append(es, descriptor(0x06, []byte{0x02})...)
+
+	return descriptor(0x03, es)
+}
+
+func descriptor(tag byte, payload []byte) []byte {
+	n := len(payload)
+	b := []byte{tag, 0x80 | byte(n>>21&0x7f), 0x80 | byte(n>>14&0x7f), 0x80 | byte(n>>7&0x7f), byte(n & 0x7f)}
+	return append(b, payload...)
+}
+
+func (t *track) writeStbl(w *boxWriter, shift int64, fragmented bool) {
+	w.start("stbl")
+	t.writeStsd(w)
+
+	samples := t.samples
+	if fragmented {
+		samples = nil
+	}
+
+	//stts
+	w.startFull("stts", 0, 0)
+	type entry struct {
+		count uint32
+		value uint32
+	}
+	var stts []entry
+	for i := range samples {
+		d := t.durations[i]
+		if n := len(stts); n > 0 && stts[n-1].value == d {
+			stts[n-1].count++
+		} else {
+			stts = append(stts, entry{1, d})
+		}
+	}
+	w.u32(uint32(len(stts)))
+	for _, e := range stts {
+		w.u32(e.count)
+		w.u32(e.value)
+	}
+	w.end()
+
+	//ctts
+	hasCts, negative := false, false
+	for _, s := range samples {
+		if s.cts != 0 {
+			hasCts = true
+		}
+		if s.cts < 0 {
+			negative = true
+		}
+	}
+	if hasCts {
+		version := uint8(0)
+		if negative {
+			version = 1
+		}
+		var ctts []entry
+		for _, s := range samples {
+			v := uint32(s.cts)
+			if n := len(ctts); n > 0 && ctts[n-1].value == v {
+				ctts[n-1].count++
+			} else {
+				ctts = append(ctts, entry{1, v})
+			}
+		}
+		w.startFull("ctts", version, 0)
+		w.u32(uint32(len(ctts)))
+		for _, e := range ctts {
+			w.u32(e.count)
+			w.u32(e.value)
+		}
+		w.end()
+	}
+
+	//stss
+	if t.video && !fragmented {
+		var keys []uint32
+		for i, s := range samples {
+			if s.key {
+				keys = append(keys, uint32(i+1))
+			}
+		}
+		w.startFull("stss", 0, 0)
+		w.u32(uint32(len(keys)))
+		for _, k := range keys {
+			w.u32(k)
+		}
+		w.end()
+	}
+
+	//stsc 每个chunk一个采样
+	w.startFull("stsc", 0, 0)
+	if len(samples) > 0 {
+		w.u32(1)
+		w.u32(1)
+		w.u32(1)
+		w.u32(1)
+	} else {
+		w.u32(0)
+	}
+	w.end()
+
+	//stsz
+	w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(uint32(len(samples)))
+	for _, s := range samples {
+		w.u32(s.size)
+	}
+	w.end()
+
+	//co64
+	w.startFull("co64", 0, 0)
+	w.u32(uint32(len(samples)))
+	for _, s := range samples {
+		w.u64(uint64(s.offset + shift))
+	}
+	w.end()
+
+	w.end()
+}
@@ -0,0 +1,349 @@
+package ts
+
+import (
+	"av"
+	"errors"
+)
+
+const (
+	streamTypeAAC  = 0x0f
+	streamTypeH264 = 0x1b
+
+	naluTypeIDR = 5
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeAUD = 9
+
+	aacSamples = 1024
+)
+
+var (
+	ErrInvalidPacket = errors.New("invalid ts packet")
+
+	//ADTS的sampling_frequency_index
+	aacRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+)
+
+//pesBuffer 一个PID上正在组装的PES
+type pesBuffer struct {
+	data   []byte
+	length int //PES_packet_length不为0时PES的总长度
+}
+
+//Demuxer 解析MPEG-TS, 得到FLV格式的音视频包
+//只支持H.264和AAC, H.264由Annex B转为AVCC, AAC去掉ADTS头
+//SPS/PPS和AudioSpecificConfig变化时先输出新的sequence header
+type Demuxer struct {
+	pmtPID   int
+	videoPID int
+	audioPID int
+	video    pesBuffer
+	audio    pesBuffer
+	sps      []byte
+	pps      []byte
+	asc      []byte
+	packets  []*av.Packet
+}
+
+func NewDemuxer() *Demuxer {
+	return &Demuxer{
+		pmtPID:   -1,
+		videoPID: -1,
+		audioPID: -1,
+	}
+}
+
+//Reset 丢弃缓存的PES和解析到的PAT/PMT, 流不连续时调用
+//sequence header仍然保留, 没有变化时不重复输出
+func (d *Demuxer) Reset() {
+	d.pmtPID = -1
+	d.videoPID = -1
+	d.audioPID = -1
+	d.video = pesBuffer{}
+	d.audio = pesBuffer{}
+}
+
+//Demux 解析整数个TS包, 返回其中结束的PES得到的音视频包
+func (d *Demuxer) Demux(data []byte) ([]*av.Packet, error) {
+	d.packets = nil
+	for len(data) >= tsPacketLen {
+		if data[0] != 0x47 {
+			return d.packets, ErrInvalidPacket
+		}
+		d.demuxPacket(data[:tsPacketLen])
+		data = data[tsPacketLen:]
+	}
+	return d.packets, nil
+}
+
+//Flush 输出没有长度的PES(一般是视频), 一个分片结束时调用
+func (d *Demuxer) Flush() []*av.Packet {
+	d.packets = nil
+	d.endPES(&d.video, true)
+	d.endPES(&d.audio, false)
+	return d.packets
+}
+
+func (d *Demuxer) demuxPacket(pkt []byte) {
+	pusi := pkt[1]&0x40 != 0
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	pos := 4
+	if pkt[3]&0x20 != 0 {
+		pos += 1 + int(pkt[4])
+	}
+	if pkt[3]&0x10 == 0 || pos >= tsPacketLen {
+		return
+	}
+	payload := pkt[pos:]
+
+	switch {
+	case pid == 0:
+		d.parsePAT(payload, pusi)
+	case pid == d.pmtPID:
+		d.parsePMT(payload, pusi)
+	case pid == d.videoPID:
+		d.appendPES(&d.video, payload, pusi, true)
+	case pid == d.audioPID:
+		d.appendPES(&d.audio, payload, pusi, false)
+	}
+}
+
+//section 去掉pointer_field, 返回长度为section_length的section数据(不含CRC)
+func section(payload []byte, pusi bool) []byte {
+	if !pusi || len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	b := payload[1+pointer:]
+	length := int(b[1]&0x0f)<<8 | int(b[2])
+	if length < 4 || 3+length > len(b) {
+		return nil
+	}
+	return b[3 : 3+length-4]
+}
+
+func (d *Demuxer) parsePAT(payload []byte, pusi bool) {
+	b := section(payload, pusi)
+	if len(b) < 5 {
+		return
+	}
+	for b = b[5:]; len(b) >= 4; b = b[4:] {
+		program := int(b[0])<<8 | int(b[1])
+		if program != 0 {
+			d.pmtPID = int(b[2]&0x1f)<<8 | int(b[3])
+			return
+		}
+	}
+}
+
+func (d *Demuxer) parsePMT(payload []byte, pusi bool) {
+	b := section(payload, pusi)
+	if len(b) < 9 {
+		return
+	}
+	infoLen := int(b[7]&0x0f)<<8 | int(b[8])
+	if 9+infoLen > len(b) {
+		return
+	}
+	for b = b[9+infoLen:]; len(b) >= 5; {
+		streamType := b[0]
+		pid := int(b[1]&0x1f)<<8 | int(b[2])
+		esLen := int(b[3]&0x0f)<<8 | int(b[4])
+		switch streamType {
+		case streamTypeH264:
+			if d.videoPID < 0 {
+				d.videoPID = pid
+			}
+		case streamTypeAAC:
+			if d.audioPID < 0 {
+				d.audioPID = pid
+			}
+		}
+		if 5+esLen > len(b) {
+			return
+		}
+		b = b[5+esLen:]
+	}
+}
+
+func (d *Demuxer) appendPES(buf *pesBuffer, payload []byte, pusi bool, isVideo bool) {
+	if pusi {
+		d.endPES(buf, isVideo)
+		if len(payload) < 6 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			return
+		}
+		buf.length = 0
+		if length := int(payload[4])<<8 | int(payload[5]); length > 0 {
+			buf.length = 6 + length
+		}
+		buf.data = append([]byte(nil), payload...)
+	} else if len(buf.data) > 0 {
+		buf.data = append(buf.data, payload...)
+	} else {
+		return
+	}
+	if buf.length > 0 && len(buf.data) >= buf.length {
+		buf.data = buf.data[:buf.length]
+		d.endPES(buf, isVideo)
+	}
+}
+
+//pesTimestamp 解析PES头中的33位时间戳
+func pesTimestamp(p []byte) int64 {
+	return int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+}
+
+func (d *Demuxer) endPES(buf *pesBuffer, isVideo bool) {
+	data := buf.data
+	buf.data = nil
+	buf.length = 0
+	if len(data) < 9 || len(data) < 9+int(data[8]) {
+		return
+	}
+	flags := data[7] >> 6
+	if flags&0x2 == 0 || data[8] < 5 {
+		return
+	}
+	pts := pesTimestamp(data[9:14])
+	dts := pts
+	if flags == 0x3 && data[8] >= 10 {
+		dts = pesTimestamp(data[14:19])
+	}
+	es := data[9+int(data[8]):]
+	if isVideo {
+		d.demuxH264(es, pts, dts)
+	} else {
+		d.demuxAAC(es, pts)
+	}
+}
+
+//splitNalus 按起始码拆分Annex B数据
+func splitNalus(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+func (d *Demuxer) demuxH264(es []byte, pts, dts int64) {
+	var sps, pps []byte
+	keyFrame := false
+	body := []byte{0x27, 0x01, 0, 0, 0}
+	frames := 0
+	for _, nalu := range splitNalus(es) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			sps = nalu
+			continue
+		case naluTypePPS:
+			pps = nalu
+			continue
+		case naluTypeAUD:
+			continue
+		case naluTypeIDR:
+			keyFrame = true
+		}
+		n := len(nalu)
+		body = append(body, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		body = append(body, nalu...)
+		frames++
+	}
+
+	timestamp := uint32(dts / h264DefaultHZ)
+	if sps != nil && pps != nil && (string(sps) != string(d.sps) || string(pps) != string(d.pps)) {
+		d.sps = append([]byte(nil), sps...)
+		d.pps = append([]byte(nil), pps...)
+		d.packets = append(d.packets, &av.Packet{
+			IsVideo:   true,
+			TimeStamp: timestamp,
+			Data:      avcSequenceHeader(d.sps, d.pps),
+		})
+	}
+	if frames == 0 || d.sps == nil {
+		return
+	}
+	if keyFrame {
+		body[0] = 0x17
+	}
+	cts := (pts - dts) / h264DefaultHZ
+	body[2], body[3], body[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+	d.packets = append(d.packets, &av.Packet{
+		IsVideo:   true,
+		TimeStamp: timestamp,
+		Data:      body,
+	})
+}
+
+//avcSequenceHeader FLV的AVC sequence header, AVCDecoderConfigurationRecord
+func avcSequenceHeader(sps, pps []byte) []byte {
+	b := []byte{0x17, 0x00, 0, 0, 0}
+	b = append(b, 0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps)>>8), byte(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 0x01, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
+
+func (d *Demuxer) demuxAAC(es []byte, pts int64) {
+	for i := 0; len(es) >= 7; i++ {
+		if es[0] != 0xff || es[1]&0xf0 != 0xf0 {
+			return
+		}
+		headerLen := 7
+		if es[1]&0x01 == 0 {
+			headerLen = 9
+		}
+		frameLen := int(es[3]&0x03)<<11 | int(es[4])<<3 | int(es[5]>>5)
+		if frameLen < headerLen || frameLen > len(es) {
+			return
+		}
+		profile := es[2] >> 6
+		rateIndex := (es[2] >> 2) & 0x0f
+		channels := (es[2]&0x01)<<2 | es[3]>>6
+		if int(rateIndex) >= len(aacRates) {
+			return
+		}
+		timestamp := uint32((pts + int64(i*aacSamples*90000/aacRates[rateIndex])) / h264DefaultHZ)
+
+		//AudioSpecificConfig: audioObjectType(5) samplingFrequencyIndex(4) channelConfiguration(4)
+		asc := []byte{(profile+1)<<3 | rateIndex>>1, rateIndex<<7 | channels<<3}
+		if string(asc) != string(d.asc) {
+			d.asc = asc
+			d.packets = append(d.packets, &av.Packet{
+				IsAudio:   true,
+				TimeStamp: timestamp,
+				Data:      []byte{0xaf, 0x00, asc[0], asc[1]},
+			})
+		}
+		data := make([]byte, 0, 2+frameLen-headerLen)
+		data = append(data, 0xaf, 0x01)
+		data = append(data, es[headerLen:frameLen]...)
+		d.packets = append(d.packets, &av.Packet{
+			IsAudio:   true,
+			TimeStamp: timestamp,
+			Data:      data,
+		})
+		es = es[frameLen:]
+	}
+}
@@ -0,0 +1,91 @@
+package ts
+
+import (
+	"av"
+	"bytes"
+	"testing"
+)
+
+type testVideoHeader struct {
+	keyFrame bool
+	cts      int32
+}
+
+func (h testVideoHeader) IsKeyFrame() bool       { return h.keyFrame }
+func (h testVideoHeader) IsSeq() bool            { return false }
+func (h testVideoHeader) CodecID() uint8         { return av.VIDEO_H264 }
+func (h testVideoHeader) CompositionTime() int32 { return h.cts }
+
+//由Muxer生成的TS解析回FLV格式的包
+func TestDemuxer(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xbf, 0xe5}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	slice := bytes.Repeat([]byte{0x88}, 400)
+
+	var buf bytes.Buffer
+	m := NewMuxer()
+	buf.Write(m.PAT())
+	buf.Write(m.PMT(av.SOUND_AAC, true))
+
+	//关键帧带AUD和SPS/PPS, 长度超过一个TS包
+	key := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1}
+	key = append(key, sps...)
+	key = append(key, 0, 0, 0, 1)
+	key = append(key, pps...)
+	key = append(key, 0, 0, 1, 0x65)
+	key = append(key, slice...)
+	m.Mux(&av.Packet{IsVideo: true, TimeStamp: 1000, Header: testVideoHeader{keyFrame: true, cts: 80}, Data: key}, &buf)
+
+	//ADTS: AAC LC 44100 stereo, 两帧
+	frame := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x3f, 0xfc, 0x21, 0x00, 0x49}
+	frame[4] = byte(len(frame) >> 3)
+	frame[5] = byte(len(frame)<<5) | 0x1f
+	m.Mux(&av.Packet{IsAudio: true, TimeStamp: 1010, Data: append(append([]byte(nil), frame...), frame...)}, &buf)
+
+	m.Mux(&av.Packet{IsVideo: true, TimeStamp: 1040, Header: testVideoHeader{}, Data: []byte{0, 0, 0, 1, 0x41, 0x9a, 0x11}}, &buf)
+
+	d := NewDemuxer()
+	packets, err := d.Demux(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets = append(packets, d.Flush()...)
+	if len(packets) != 6 {
+		t.Fatalf("demux %d packets", len(packets))
+	}
+
+	seq := packets[0]
+	if !seq.IsVideo || seq.TimeStamp != 1000 || !bytes.Equal(seq.Data, avcSequenceHeader(sps, pps)) {
+		t.Fatalf("avc sequence header %d %x", seq.TimeStamp, seq.Data)
+	}
+	idr := packets[1]
+	want := append([]byte{0x17, 0x01, 0, 0, 80, 0, 0, 1, byte(len(slice) + 1), 0x65}, slice...)
+	if !idr.IsVideo || idr.TimeStamp != 1000 || !bytes.Equal(idr.Data, want) {
+		t.Fatalf("key frame %d %x", idr.TimeStamp, idr.Data[:16])
+	}
+
+	if !packets[2].IsAudio || !bytes.Equal(packets[2].Data, []byte{0xaf, 0x00, 0x12, 0x10}) {
+		t.Fatalf("aac sequence header %x", packets[2].Data)
+	}
+	//第二帧的时间戳加上1024个采样
+	for i, ts := range []uint32{1010, 1033} {
+		p := packets[3+i]
+		if !p.IsAudio || p.TimeStamp != ts || !bytes.Equal(p.Data, []byte{0xaf, 0x01, 0x21, 0x00, 0x49}) {
+			t.Fatalf("aac frame %d %d %x", i, p.TimeStamp, p.Data)
+		}
+	}
+
+	//没有PES长度的视频在Flush时输出
+	p := packets[5]
+	if !p.IsVideo || p.TimeStamp != 1040 || !bytes.Equal(p.Data, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 3, 0x41, 0x9a, 0x11}) {
+		t.Fatalf("inter frame %d %x", p.TimeStamp, p.Data)
+	}
+
+	//SPS/PPS没有变化时不重复输出sequence header
+	d.Reset()
+	packets, _ = d.Demux(buf.Bytes())
+	packets = append(packets, d.Flush()...)
+	if len(packets) != 4 || packets[0].Data[1] != 0x01 {
+		t.Fatalf("demux after reset %d packets", len(packets))
+	}
+}
@@ -0,0 +1,40 @@
+package ts
+
+const (
+	id3HeaderLen      = 10
+	id3FrameHeaderLen = 10
+	id3EncodingUTF8   = 0x03
+)
+
+//ID3TXXX 生成只包含一个TXXX帧的ID3v2.4标签,用于HLS的timed metadata
+func ID3TXXX(description, value string) []byte {
+	frameLen := 1 + len(description) + 1 + len(value)
+	tagLen := id3FrameHeaderLen + frameLen
+
+	b := make([]byte, 0, id3HeaderLen+tagLen)
+
+	//ID3v2.4 标签头
+	b = append(b, 'I', 'D', '3', 0x04, 0x00, 0x00)
+	b = appendSyncSafe(b, uint32(tagLen))
+
+	//TXXX 帧头
+	b = append(b, 'T', 'X', 'X', 'X')
+	b = appendSyncSafe(b, uint32(frameLen))
+	b = append(b, 0x00, 0x00)
+
+	//TXXX 帧内容: 编码 + 描述 + 0x00 + 值
+	b = append(b, id3EncodingUTF8)
+	b = append(b, description...)
+	b = append(b, 0x00)
+	b = append(b, value...)
+
+	return b
+}
+
+func appendSyncSafe(b []byte, size uint32) []byte {
+	return append(b,
+		byte(size>>21)&0x7f,
+		byte(size>>14)&0x7f,
+		byte(size>>7)&0x7f,
+		byte(size)&0x7f)
+}
@@ -0,0 +1,55 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestID3TXXX(t *testing.T) {
+	tag := ID3TXXX("onTextData", `{"text":"hi"}`)
+
+	if !bytes.Equal(tag[:6], []byte{'I', 'D', '3', 0x04, 0x00, 0x00}) {
+		t.Fatalf("bad id3 header: % x", tag[:6])
+	}
+	frameLen := 1 + len("onTextData") + 1 + len(`{"text":"hi"}`)
+	if got := len(tag) - id3HeaderLen; got != id3FrameHeaderLen+frameLen {
+		t.Fatalf("tag len %d, want %d", got, id3FrameHeaderLen+frameLen)
+	}
+	if !bytes.Equal(tag[6:10], []byte{0, 0, 0, byte(id3FrameHeaderLen + frameLen)}) {
+		t.Fatalf("bad tag size: % x", tag[6:10])
+	}
+	if string(tag[10:14]) != "TXXX" {
+		t.Fatalf("bad frame id: %s", tag[10:14])
+	}
+}
+
+func TestSyncSafe(t *testing.T) {
+	b := appendSyncSafe(nil, 0x0fffffff)
+	if !bytes.Equal(b, []byte{0x7f, 0x7f, 0x7f, 0x7f}) {
+		t.Fatalf("bad syncsafe: % x", b)
+	}
+	b = appendSyncSafe(nil, 200)
+	if !bytes.Equal(b, []byte{0x00, 0x00, 0x01, 0x48}) {
+		t.Fatalf("bad syncsafe: % x", b)
+	}
+}
+
+func TestPMTTimedMetadata(t *testing.T) {
+	m := NewMuxer()
+	m.EnableTimedMetadata()
+	pmt := m.PMT(10, true)
+
+	sectionLen := int(pmt[6]&0x0f)<<8 | int(pmt[7])
+	end := 8 + sectionLen
+	crc := GenCrc32(pmt[5 : end-4])
+	if got := uint32(pmt[end-4])<<24 | uint32(pmt[end-3])<<16 | uint32(pmt[end-2])<<8 | uint32(pmt[end-1]); got != crc {
+		t.Fatalf("crc mismatch %x != %x", got, crc)
+	}
+	progInfoLen := int(pmt[15]&0x0f)<<8 | int(pmt[16])
+	if progInfoLen != len(metadataPointerDescriptor) {
+		t.Fatalf("program info len %d", progInfoLen)
+	}
+	if !bytes.Contains(pmt[:end], []byte{0x15, 0xe1, 0x02}) {
+		t.Fatal("metadata stream missing in pmt")
+	}
+}
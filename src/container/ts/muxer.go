@@ -10,27 +10,94 @@ const (
 	tsPacketLen      = 188
 	h264DefaultHZ    = 90
 
-	videoPID = 0x100
-	audioPID = 0x101
-	videoSID = 0xe0
-	audioSID = 0xc0
+	videoPID    = 0x100
+	audioPID    = 0x101
+	metadataPID = 0x102
+	videoSID    = 0xe0
+	audioSID    = 0xc0
+	metadataSID = 0xbd
+	ac3SID      = 0xbd //AC-3使用private_stream_1
+)
+
+var (
+	//metadata_pointer_descriptor, 指向ID3 timed metadata
+	metadataPointerDescriptor = []byte{0x25, 0x0f, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x1f, 0x00, 0x01}
+	//metadata_descriptor, 描述ID3 timed metadata流
+	metadataDescriptor = []byte{0x26, 0x0d, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}
 )
 
 type Muxer struct {
-	videoCc  byte
-	audioCc  byte
-	patCc    byte
-	pmtCc    byte
-	pat      [tsPacketLen]byte
-	pmt      [tsPacketLen]byte
-	tsPacket [tsPacketLen]byte
+	videoCc       byte
+	audioCc       byte
+	metadataCc    byte
+	patCc         byte
+	pmtCc         byte
+	timedMetadata bool
+	sampleAES     bool   //SAMPLE-AES加密的流类型
+	audioConfig   []byte //AAC AudioSpecificConfig, SAMPLE-AES的audio_setup_information
+	mpeg2Audio    bool   //MP3为MPEG-2/2.5音频
+	audioSID      byte   //音频PES的stream_id, 由PMT中的音频格式决定
+	pat           [tsPacketLen]byte
+	pmt           [tsPacketLen]byte
+	tsPacket      [tsPacketLen]byte
 }
 
 func NewMuxer() *Muxer {
 	return &Muxer{}
 }
 
+//EnableTimedMetadata PMT中增加ID3 timed metadata流,Mux时IsMetadata的包写入该流
+func (muxer *Muxer) EnableTimedMetadata() {
+	muxer.timedMetadata = true
+}
+
+//EnableSampleAES PMT中使用SAMPLE-AES加密的流类型, audioConfig为AAC的AudioSpecificConfig
+func (muxer *Muxer) EnableSampleAES(audioConfig []byte) {
+	muxer.sampleAES = true
+	muxer.audioConfig = audioConfig
+}
+
+//SetMPEG2Audio MP3为MPEG-2/2.5音频时PMT中使用流类型0x04, 否则为0x03
+func (muxer *Muxer) SetMPEG2Audio(mpeg2 bool) {
+	muxer.mpeg2Audio = mpeg2
+}
+
+//audioProgInfo PMT中的音频流, AAC为0x0f, MP3为0x03/0x04, AC-3为0x81并带registration_descriptor('AC-3')
+func (muxer *Muxer) audioProgInfo(soundFormat byte) []byte {
+	switch soundFormat {
+	case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
+		streamType := byte(0x03)
+		if muxer.mpeg2Audio || soundFormat == av.SOUND_MP3_8KHZ {
+			streamType = 0x04
+		}
+		return []byte{streamType, 0xe1, 0x01, 0xf0, 0x00}
+	case av.SOUND_AC3:
+		return []byte{0x81, 0xe1, 0x01, 0xf0, 0x06, 0x05, 0x04, 'A', 'C', '-', '3'}
+	}
+	return []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
+}
+
+//sampleAESProgInfo SAMPLE-AES加密的H.264(0xdb)和AAC(0xcf), 带private_data_indicator_descriptor
+//AAC另外带registration_descriptor('apad')和audio_setup_information
+func (muxer *Muxer) sampleAESProgInfo(hasVideo bool) []byte {
+	var progInfo []byte
+	if hasVideo {
+		progInfo = append(progInfo, 0xdb, 0xe1, 0x00, 0xf0, 0x06, 0x0f, 0x04, 'z', 'a', 'v', 'c')
+	}
+	setup := []byte{'z', 'a', 'a', 'c', 0x00, 0x00, 0x01, byte(len(muxer.audioConfig))}
+	setup = append(setup, muxer.audioConfig...)
+	desc := []byte{0x0f, 0x04, 'a', 'a', 'c', 'd', 0x05, byte(4 + len(setup)), 'a', 'p', 'a', 'd'}
+	desc = append(desc, setup...)
+	progInfo = append(progInfo, 0xcf, 0xe1, 0x01, 0xf0, byte(len(desc)))
+	return append(progInfo, desc...)
+}
+
 func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
+	return muxer.MuxDts(p, int64(p.TimeStamp)*int64(h264DefaultHZ), w)
+}
+
+//MuxDts dts为90kHz的时间戳, 音频按采样数计算的时间戳不损失精度
+func (muxer *Muxer) MuxDts(p *av.Packet, dts int64, w io.Writer) error {
 	first := true
 	wBytes := 0
 	pesIndex := 0
@@ -38,16 +105,26 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 	dataLen := byte(0)
 
 	var pes pesHeader
-	dts := int64(p.TimeStamp) * int64(h264DefaultHZ)
 	pts := dts
 	pid := audioPID
+	sid := audioSID
+	if muxer.audioSID != 0 {
+		sid = int(muxer.audioSID)
+	}
 	var videoH av.VideoPacketHeader
-	if p.IsVideo {
+	if p.IsMetadata {
+		if !muxer.timedMetadata {
+			return nil
+		}
+		pid = metadataPID
+		sid = metadataSID
+	} else if p.IsVideo {
 		pid = videoPID
+		sid = videoSID
 		videoH, _ = p.Header.(av.VideoPacketHeader)
 		pts = dts + int64(videoH.CompositionTime())*int64(h264DefaultHZ)
 	}
-	err := pes.packet(p, pts, dts)
+	err := pes.packet(p, pts, dts, sid)
 	if err != nil {
 		return err
 	}
@@ -58,7 +135,12 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		if packetBytesLen <= 0 {
 			break
 		}
-		if p.IsVideo {
+		if p.IsMetadata {
+			muxer.metadataCc++
+			if muxer.metadataCc > 0xf {
+				muxer.metadataCc = 0
+			}
+		} else if p.IsVideo {
 			muxer.videoCc++
 			if muxer.videoCc > 0xf {
 				muxer.videoCc = 0
@@ -88,7 +170,9 @@ func (muxer *Muxer) Mux(p *av.Packet, w io.Writer) error {
 		i++
 
 		//scram control, adaptation control, counter
-		if p.IsVideo {
+		if p.IsMetadata {
+			muxer.tsPacket[i] = 0x10 | byte(muxer.metadataCc&0x0f)
+		} else if p.IsVideo {
 			muxer.tsPacket[i] = 0x10 | byte(muxer.videoCc&0x0f)
 		} else {
 			muxer.tsPacket[i] = 0x10 | byte(muxer.audioCc&0x0f)
@@ -199,18 +283,30 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	i := int(0)
 	j := int(0)
 	var progInfo []byte
+	var progDesc []byte
 	remainBytes := int(0)
 	tsHeader := []byte{0x47, 0x50, 0x01, 0x10, 0x00}
 	pmtHeader := []byte{0x02, 0xb0, 0xff, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
 	if !hasVideo {
 		pmtHeader[9] = 0x01
-		progInfo = []byte{0x0f, 0xe1, 0x01, 0xf0, 0x00}
+		progInfo = muxer.audioProgInfo(soundFormat)
 	} else {
-		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00, //h264 or h265*
-			0x0f, 0xe1, 0x01, 0xf0, 0x00, //mp3 or aac
-		}
+		progInfo = []byte{0x1b, 0xe1, 0x00, 0xf0, 0x00} //h264 or h265*
+		progInfo = append(progInfo, muxer.audioProgInfo(soundFormat)...)
 	}
-	pmtHeader[2] = byte(len(progInfo) + 9 + 4)
+	muxer.audioSID = audioSID
+	if soundFormat == av.SOUND_AC3 {
+		muxer.audioSID = ac3SID
+	}
+	if muxer.sampleAES && soundFormat == av.SOUND_AAC {
+		progInfo = muxer.sampleAESProgInfo(hasVideo)
+	}
+	if muxer.timedMetadata {
+		progDesc = metadataPointerDescriptor
+		pmtHeader[10] |= byte(len(progDesc) >> 8)
+		pmtHeader[11] = byte(len(progDesc))
+	}
+	pmtHeader[2] = byte(len(progDesc) + len(progInfo) + 9 + 4)
 
 	if muxer.pmtCc > 0xf {
 		muxer.pmtCc = 0
@@ -218,25 +314,29 @@ func (muxer *Muxer) PMT(soundFormat byte, hasVideo bool) []byte {
 	tsHeader[3] |= muxer.pmtCc & 0x0f
 	muxer.pmtCc++
 
-	if soundFormat == 2 ||
-		soundFormat == 14 {
-		if hasVideo {
-			progInfo[5] = 0x4
-		} else {
-			progInfo[0] = 0x4
-		}
-	}
-
 	copy(muxer.pmt[i:], tsHeader)
 	i += len(tsHeader)
 
 	copy(muxer.pmt[i:], pmtHeader)
 	i += len(pmtHeader)
 
+	copy(muxer.pmt[i:], progDesc)
+	i += len(progDesc)
+
 	copy(muxer.pmt[i:], progInfo[0:])
 	i += len(progInfo)
 
-	crc32Value := GenCrc32(muxer.pmt[5 : 5+len(pmtHeader)+len(progInfo)])
+	if muxer.timedMetadata {
+		//ID3 timed metadata: stream type 0x15, pid 0x102
+		metaInfo := []byte{0x15, 0xe0 | byte(metadataPID>>8), byte(metadataPID & 0xff), 0xf0, byte(len(metadataDescriptor))}
+		copy(muxer.pmt[i:], metaInfo)
+		i += len(metaInfo)
+		copy(muxer.pmt[i:], metadataDescriptor)
+		i += len(metadataDescriptor)
+		muxer.pmt[7] = byte(i - 8 + 4)
+	}
+
+	crc32Value := GenCrc32(muxer.pmt[5:i])
 	muxer.pmt[i] = byte(crc32Value >> 24)
 	i++
 	muxer.pmt[i] = byte(crc32Value >> 16)
@@ -288,7 +388,7 @@ type pesHeader struct {
 }
 
 //pesPacket return pes packet
-func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
+func (header *pesHeader) packet(p *av.Packet, pts, dts int64, sid int) error {
 	//PES header
 	i := 0
 	header.data[i] = 0x00
@@ -298,10 +398,6 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	header.data[i] = 0x01
 	i++
 
-	sid := audioSID
-	if p.IsVideo {
-		sid = videoSID
-	}
 	header.data[i] = byte(sid)
 	i++
 
@@ -323,6 +419,10 @@ func (header *pesHeader) packet(p *av.Packet, pts, dts int64) error {
 	i++
 
 	header.data[i] = 0x80
+	if p.IsMetadata {
+		//data_alignment_indicator
+		header.data[i] |= 0x04
+	}
 	i++
 	header.data[i] = byte(flag)
 	i++
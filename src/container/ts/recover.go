@@ -0,0 +1,86 @@
+package ts
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrInvalidTs = errors.New("invalid ts file")
+
+//RecoverFile 恢复异常退出时没有写完的TS文件
+//截掉最后不完整的TS包, 返回第一个到最后一个音视频PTS的时长(毫秒)
+func RecoverFile(name string) (uint32, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	pkt := make([]byte, tsPacketLen)
+	var valid int64
+	var first, last int64 = -1, -1
+	for {
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			break
+		}
+		if pkt[0] != 0x47 {
+			break
+		}
+		valid += tsPacketLen
+
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if pkt[1]&0x40 == 0 || (pid != videoPID && pid != audioPID) {
+			continue
+		}
+		pos := 4
+		if pkt[3]&0x20 != 0 {
+			pos += 1 + int(pkt[4])
+		}
+		if pos >= tsPacketLen {
+			continue
+		}
+		pts, ok := pesPts(pkt[pos:])
+		if !ok {
+			continue
+		}
+		if first < 0 || pts < first {
+			first = pts
+		}
+		if pts > last {
+			last = pts
+		}
+	}
+	if valid == 0 {
+		return 0, ErrInvalidTs
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if valid < info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			return 0, err
+		}
+	}
+	if first < 0 {
+		return 0, nil
+	}
+	return uint32((last - first) / h264DefaultHZ), nil
+}
+
+//pesPts 读取PES头中的PTS
+func pesPts(data []byte) (int64, bool) {
+	if len(data) < 14 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return 0, false
+	}
+	if data[7]&0x80 == 0 {
+		return 0, false
+	}
+	p := data[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, true
+}
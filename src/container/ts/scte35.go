@@ -0,0 +1,66 @@
+package ts
+
+const (
+	scte35TableID   = 0xfc
+	spliceInsertCmd = 0x05
+)
+
+//SpliceInsert 生成SCTE-35 splice_info_section(splice_insert, splice_immediate)
+//outOfNetwork为true表示广告开始(CUE-OUT),duration为广告时长(90K时钟),0表示不带break_duration
+func SpliceInsert(eventId uint32, outOfNetwork bool, duration uint64, autoReturn bool) []byte {
+	cmd := make([]byte, 0, 16)
+
+	//splice_event_id
+	cmd = append(cmd, byte(eventId>>24), byte(eventId>>16), byte(eventId>>8), byte(eventId))
+	//splice_event_cancel_indicator + reserved
+	cmd = append(cmd, 0x7f)
+
+	//out_of_network_indicator, program_splice_flag, duration_flag, splice_immediate_flag, reserved
+	flags := byte(0x40 | 0x10 | 0x0f)
+	if outOfNetwork {
+		flags |= 0x80
+	}
+	if duration > 0 {
+		flags |= 0x20
+	}
+	cmd = append(cmd, flags)
+
+	//break_duration
+	if duration > 0 {
+		b := byte(0x7e)
+		if autoReturn {
+			b |= 0x80
+		}
+		b |= byte(duration>>32) & 0x01
+		cmd = append(cmd, b, byte(duration>>24), byte(duration>>16), byte(duration>>8), byte(duration))
+	}
+
+	//unique_program_id, avail_num, avails_expected
+	cmd = append(cmd, 0x00, 0x01, 0x00, 0x00)
+
+	//table_id ... splice_command_type 共14字节, descriptor_loop_length 2字节, CRC 4字节
+	total := 14 + len(cmd) + 2 + 4
+	sectionLen := total - 3
+
+	b := make([]byte, 0, total)
+	b = append(b, scte35TableID)
+	//section_syntax_indicator=0, private_indicator=0, sap_type=3
+	b = append(b, 0x30|byte(sectionLen>>8)&0x0f, byte(sectionLen))
+	//protocol_version
+	b = append(b, 0x00)
+	//encrypted_packet, encryption_algorithm, pts_adjustment
+	b = append(b, 0x00, 0x00, 0x00, 0x00, 0x00)
+	//cw_index
+	b = append(b, 0x00)
+	//tier(0xfff), splice_command_length
+	b = append(b, 0xff, 0xf0|byte(len(cmd)>>8)&0x0f, byte(len(cmd)))
+	b = append(b, spliceInsertCmd)
+	b = append(b, cmd...)
+	//descriptor_loop_length
+	b = append(b, 0x00, 0x00)
+
+	crc := GenCrc32(b)
+	b = append(b, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	return b
+}
@@ -0,0 +1,38 @@
+package ts
+
+import (
+	"testing"
+)
+
+func TestSpliceInsert(t *testing.T) {
+	b := SpliceInsert(1234, true, 30*90000, true)
+
+	if b[0] != 0xfc {
+		t.Fatalf("bad table id %x", b[0])
+	}
+	sectionLen := int(b[1]&0x0f)<<8 | int(b[2])
+	if sectionLen != len(b)-3 {
+		t.Fatalf("section len %d, want %d", sectionLen, len(b)-3)
+	}
+	cmdLen := int(b[11]&0x0f)<<8 | int(b[12])
+	if cmdLen != 15 {
+		t.Fatalf("command len %d", cmdLen)
+	}
+	if b[13] != 0x05 {
+		t.Fatalf("bad command type %x", b[13])
+	}
+	if b[19]&0xa0 != 0xa0 {
+		t.Fatalf("out_of_network/duration flag not set: %x", b[19])
+	}
+	if GenCrc32(b) != 0 {
+		t.Fatal("crc check failed")
+	}
+
+	b = SpliceInsert(1234, false, 0, false)
+	if b[19]&0xa0 != 0 {
+		t.Fatalf("unexpected flags %x", b[19])
+	}
+	if int(b[1]&0x0f)<<8|int(b[2]) != len(b)-3 {
+		t.Fatal("bad section len")
+	}
+}
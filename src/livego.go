@@ -226,6 +226,8 @@ func main() {
 
 		log.Info("---->>>> Start Hls")
 		hlsServer, _ = startHls()
+		hlsServer.SetBandwidthFunc(stream.GetBandwidth)
+		stream.SetHlsServer(hlsServer)
 	}
 
 	log.Info("---->>>> Check Flv")
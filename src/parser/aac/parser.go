@@ -102,6 +102,11 @@ func (parser *Parser) SampleRate() int {
 	return rate
 }
 
+//Samples 每个AAC帧1024个采样
+func (parser *Parser) Samples() int {
+	return 1024
+}
+
 func (parser *Parser) Parse(b []byte, packetType uint8, w io.Writer) (err error) {
 	switch packetType {
 	case av.AAC_SEQHDR:
@@ -0,0 +1,117 @@
+package ac3
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	headerLen = 7
+	//每个AC-3帧1536个采样
+	frameSamples = 1536
+	//bsid大于10为E-AC-3
+	maxBsid = 10
+)
+
+// fscod
+// '00' 48 kHz
+// '01' 44.1 kHz
+// '10' 32 kHz
+// '11' reserved
+var ac3Rates = []int{48000, 44100, 32000}
+
+// frmsizecod对应的帧长度(16位字), 分别为48k, 44.1k, 32k
+var frameSizes = [][3]int{
+	{64, 69, 96}, {64, 70, 96},
+	{80, 87, 120}, {80, 88, 120},
+	{96, 104, 144}, {96, 105, 144},
+	{112, 121, 168}, {112, 122, 168},
+	{128, 139, 192}, {128, 140, 192},
+	{160, 174, 240}, {160, 175, 240},
+	{192, 208, 288}, {192, 209, 288},
+	{224, 243, 336}, {224, 244, 336},
+	{256, 278, 384}, {256, 279, 384},
+	{320, 348, 480}, {320, 349, 480},
+	{384, 417, 576}, {384, 418, 576},
+	{448, 487, 672}, {448, 488, 672},
+	{512, 557, 768}, {512, 558, 768},
+	{640, 696, 960}, {640, 697, 960},
+	{768, 835, 1152}, {768, 836, 1152},
+	{896, 975, 1344}, {896, 976, 1344},
+	{1024, 1114, 1536}, {1024, 1115, 1536},
+	{1152, 1253, 1728}, {1152, 1254, 1728},
+	{1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+var (
+	errAc3DataInvalid = errors.New("ac3data invalid")
+	errNoSupportEac3  = errors.New("e-ac3 not supported")
+)
+
+type Parser struct {
+	samplingFrequency int
+	samples           int //最后一个包中的采样数
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//parseHeader 解析同步帧头, 返回采样率和帧长度(字节)
+func parseHeader(b []byte) (int, int, error) {
+	if len(b) < headerLen || b[0] != 0x0b || b[1] != 0x77 {
+		return 0, 0, errAc3DataInvalid
+	}
+	if b[5]>>3 > maxBsid {
+		return 0, 0, errNoSupportEac3
+	}
+	fscod := b[4] >> 6
+	frmsizecod := b[4] & 0x3f
+	if int(fscod) >= len(ac3Rates) || int(frmsizecod) >= len(frameSizes) {
+		return 0, 0, errAc3DataInvalid
+	}
+	return ac3Rates[fscod], frameSizes[frmsizecod][fscod] * 2, nil
+}
+
+//Parse 解析AC-3同步帧, 一个包中可以有多个帧, 数据原样写入w
+func (parser *Parser) Parse(src []byte, w io.Writer) error {
+	rate, _, err := parseHeader(src)
+	if err != nil {
+		return err
+	}
+	parser.samplingFrequency = rate
+
+	frames := 0
+	for b := src; len(b) > 0; frames++ {
+		_, size, err := parseHeader(b)
+		if err != nil || size > len(b) {
+			if frames == 0 {
+				frames = 1
+			}
+			break
+		}
+		b = b[size:]
+	}
+	parser.samples = frames * frameSamples
+
+	if w == nil {
+		return nil
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+func (parser *Parser) SampleRate() int {
+	if parser.samplingFrequency == 0 {
+		parser.samplingFrequency = 48000
+	}
+	return parser.samplingFrequency
+}
+
+//Samples 最后一个包中的采样数
+func (parser *Parser) Samples() int {
+	if parser.samples == 0 {
+		return frameSamples
+	}
+	return parser.samples
+}
@@ -0,0 +1,287 @@
+package h264
+
+import (
+	"errors"
+)
+
+var (
+	spsInvalid = errors.New("sps invalid")
+)
+
+//SPS 序列参数集中用到的信息
+type SPS struct {
+	ProfileIdc byte
+	Constraint byte
+	LevelIdc   byte
+	Width      int
+	Height     int
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.buf)*8 {
+		return 0, spsInvalid
+	}
+	b := (r.buf[r.pos/8] >> uint(7-r.pos%8)) & 0x01
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	v := uint(0)
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+//ue 无符号指数哥伦布编码
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, spsInvalid
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + v, nil
+}
+
+//se 有符号指数哥伦布编码
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v&0x01 == 1 {
+		return int(v+1) / 2, nil
+	}
+	return -int(v / 2), nil
+}
+
+//removeEmulation 去掉防竞争字节 00 00 03
+func removeEmulation(src []byte) []byte {
+	dst := make([]byte, 0, len(src))
+	zeros := 0
+	for _, b := range src {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+//ParseSPS 解析SPS(不带起始码, 包含nalu头), 得到profile, level和宽高
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != nalu_type_sps {
+		return nil, spsInvalid
+	}
+	sps := &SPS{
+		ProfileIdc: nalu[1],
+		Constraint: nalu[2],
+		LevelIdc:   nalu[3],
+	}
+	r := &bitReader{buf: removeEmulation(nalu[4:])}
+
+	//seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+
+	chromaFormatIdc := uint(1)
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormatIdc, err = r.ue(); err != nil {
+			return nil, err
+		}
+		if chromaFormatIdc == 3 {
+			//separate_colour_plane_flag
+			if _, err := r.bit(); err != nil {
+				return nil, err
+			}
+		}
+		//bit_depth_luma, bit_depth_chroma
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+		//qpprime_y_zero_transform_bypass_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		//seq_scaling_matrix_present_flag
+		present, err := r.bit()
+		if err != nil {
+			return nil, err
+		}
+		if present == 1 {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				listPresent, err := r.bit()
+				if err != nil {
+					return nil, err
+				}
+				if listPresent == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	//log2_max_frame_num_minus4
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	picOrderCntType, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	if picOrderCntType == 0 {
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+	} else if picOrderCntType == 1 {
+		//delta_pic_order_always_zero_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		if _, err := r.se(); err != nil {
+			return nil, err
+		}
+		if _, err := r.se(); err != nil {
+			return nil, err
+		}
+		num, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint(0); i < num; i++ {
+			if _, err := r.se(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	//max_num_ref_frames
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	//gaps_in_frame_num_value_allowed_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+
+	widthMbs, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if frameMbsOnly == 0 {
+		//mb_adaptive_frame_field_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+	}
+	//direct_8x8_inference_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	cropping, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if cropping == 1 {
+		for _, v := range []*uint{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+			if *v, err = r.ue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if chromaFormatIdc == 1 {
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	} else if chromaFormatIdc == 2 {
+		cropUnitX, cropUnitY = 2, 2-frameMbsOnly
+	}
+
+	sps.Width = int((widthMbs+1)*16 - (cropLeft+cropRight)*cropUnitX)
+	sps.Height = int((2-frameMbsOnly)*(heightMapUnits+1)*16 - (cropTop+cropBottom)*cropUnitY)
+	return sps, nil
+}
+
+//ParseAVCConfig 从AVCDecoderConfigurationRecord中得到第一个SPS并解析
+func ParseAVCConfig(config []byte) (*SPS, error) {
+	if len(config) < 8 || config[5]&0x1f == 0 {
+		return nil, spsInvalid
+	}
+	spsLen := int(config[6])<<8 | int(config[7])
+	if len(config) < 8+spsLen {
+		return nil, spsInvalid
+	}
+	return ParseSPS(config[8 : 8+spsLen])
+}
@@ -0,0 +1,58 @@
+package h264
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		sps     string
+		want    SPS
+		invalid bool
+	}{
+		{"baseline 480p", "6742c01ed900a03da1000003000100000300320f162e48", SPS{66, 0xc0, 30, 640, 480}, false},
+		{"main 576p", "674d001eab405a126c092828282f800001f4000061a84a", SPS{77, 0x00, 30, 720, 576}, false},
+		{"high 720p", "6764001facd9405005bb0110000003001000000303c0f1831960", SPS{100, 0x00, 31, 1280, 720}, false},
+		//1088行编码, frame_crop_bottom_offset为4, 带防竞争字节
+		{"high 1080p cropped", "67640028acd940780227e5c044000003000400000300f03c60c658", SPS{100, 0x00, 40, 1920, 1080}, false},
+		{"truncated", "67640028acd94078", SPS{}, true},
+		{"header only", "67640028", SPS{}, true},
+		{"too short", "6764", SPS{}, true},
+		{"not sps", "68ebe3cb22c0", SPS{}, true},
+	}
+	for _, tt := range tests {
+		nalu, err := hex.DecodeString(tt.sps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sps, err := ParseSPS(nalu)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: ParseSPS = %+v, want error", tt.name, sps)
+			}
+			continue
+		}
+		if err != nil || *sps != tt.want {
+			t.Errorf("%s: ParseSPS = %+v %v, want %+v", tt.name, sps, err, tt.want)
+		}
+	}
+}
+
+func TestParseAVCConfig(t *testing.T) {
+	config := []byte{
+		0x01, 0x4d, 0x00, 0x1e, 0xff, 0xe1, 0x00, 0x17, 0x67, 0x4d, 0x00,
+		0x1e, 0xab, 0x40, 0x5a, 0x12, 0x6c, 0x09, 0x28, 0x28, 0x28, 0x2f,
+		0x80, 0x00, 0x01, 0xf4, 0x00, 0x00, 0x61, 0xa8, 0x4a, 0x01, 0x00,
+		0x04, 0x68, 0xde, 0x31, 0x12,
+	}
+	sps, err := ParseAVCConfig(config)
+	if err != nil || sps.Width != 720 || sps.Height != 576 {
+		t.Fatalf("ParseAVCConfig = %+v %v", sps, err)
+	}
+	//SPS长度超过数据
+	if _, err := ParseAVCConfig(config[:20]); err == nil {
+		t.Fatal("truncated config parsed")
+	}
+}
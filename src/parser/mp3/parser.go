@@ -1,36 +1,151 @@
 package mp3
 
-import "errors"
+import (
+	"errors"
+	"io"
+)
 
 type Parser struct {
 	samplingFrequency int
+	mpeg1             bool //MPEG-1音频, TS流类型0x03, 否则为0x04
+	samples           int  //最后一个包中的采样数
 }
 
 func NewParser() *Parser {
 	return &Parser{}
 }
 
+const (
+	headerLen = 4
+
+	versionMPEG25 = 0
+	versionMPEG2  = 2
+	versionMPEG1  = 3
+
+	layer3 = 1
+	layer2 = 2
+	layer1 = 3
+)
+
 // sampling_frequency - indicates the sampling frequency, according to the following table.
 // '00' 44.1 kHz
 // '01' 48 kHz
 // '10' 32 kHz
 // '11' reserved
+// MPEG-2为MPEG-1的一半, MPEG-2.5为MPEG-1的四分之一
 var mp3Rates = []int{44100, 48000, 32000}
+
+// bitrate_index对应的码率(kbps), 0为free format
+var (
+	bitratesV1L1 = []int{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}
+	bitratesV1L2 = []int{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384}
+	bitratesV1L3 = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	bitratesV2L1 = []int{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}
+	bitratesV2L2 = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
 var (
 	errMp3DataInvalid = errors.New("mp3data  invalid")
 	errIndexInvalid   = errors.New("invalid rate index")
 )
 
-func (parser *Parser) Parse(src []byte) error {
-	if len(src) < 3 {
-		return errMp3DataInvalid
+//frameHeader MPEG音频帧头
+type frameHeader struct {
+	version    byte
+	layer      byte
+	sampleRate int
+	samples    int //每帧采样数
+	size       int //帧长度, free format时为0
+}
+
+func parseHeader(b []byte) (frameHeader, error) {
+	var h frameHeader
+	if len(b) < headerLen || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, errMp3DataInvalid
+	}
+	h.version = (b[1] >> 3) & 0x3
+	h.layer = (b[1] >> 1) & 0x3
+	if h.version == 1 || h.layer == 0 {
+		return h, errMp3DataInvalid
+	}
+	index := (b[2] >> 2) & 0x3
+	if index > byte(len(mp3Rates)-1) {
+		return h, errIndexInvalid
+	}
+	h.sampleRate = mp3Rates[index]
+	switch h.version {
+	case versionMPEG2:
+		h.sampleRate /= 2
+	case versionMPEG25:
+		h.sampleRate /= 4
+	}
+
+	var bitrates []int
+	switch {
+	case h.layer == layer1:
+		h.samples = 384
+		bitrates = bitratesV1L1
+		if h.version != versionMPEG1 {
+			bitrates = bitratesV2L1
+		}
+	case h.layer == layer2 || h.version == versionMPEG1:
+		h.samples = 1152
+		bitrates = bitratesV1L2
+		if h.version != versionMPEG1 {
+			bitrates = bitratesV2L2
+		} else if h.layer == layer3 {
+			bitrates = bitratesV1L3
+		}
+	default:
+		//MPEG-2/2.5 Layer III
+		h.samples = 576
+		bitrates = bitratesV2L2
+	}
+
+	bitrateIndex := b[2] >> 4
+	if int(bitrateIndex) >= len(bitrates) {
+		return h, errMp3DataInvalid
+	}
+	padding := int(b[2]>>1) & 0x1
+	bitrate := bitrates[bitrateIndex] * 1000
+	if bitrate > 0 {
+		if h.layer == layer1 {
+			h.size = (12*bitrate/h.sampleRate + padding) * 4
+		} else {
+			h.size = h.samples/8*bitrate/h.sampleRate + padding
+		}
+	}
+	return h, nil
+}
+
+//Parse 解析FLV中的MP3数据, 一个包中可以有多个帧, 数据原样写入w
+func (parser *Parser) Parse(src []byte, w io.Writer) error {
+	h, err := parseHeader(src)
+	if err != nil {
+		return err
 	}
-	index := (src[2] >> 2) & 0x3
-	if index <= byte(len(mp3Rates)-1) {
-		parser.samplingFrequency = mp3Rates[index]
+	parser.samplingFrequency = h.sampleRate
+	parser.mpeg1 = h.version == versionMPEG1
+
+	//由帧长度计算包中的帧数
+	frames := 0
+	for b := src; len(b) > 0; frames++ {
+		fh, err := parseHeader(b)
+		if err != nil || fh.size == 0 || fh.size > len(b) {
+			if frames == 0 {
+				frames = 1
+			}
+			break
+		}
+		b = b[fh.size:]
+	}
+	parser.samples = frames * h.samples
+
+	if w == nil {
 		return nil
 	}
-	return errIndexInvalid
+	_, err = w.Write(src)
+	return err
 }
 
 func (parser *Parser) SampleRate() int {
@@ -39,3 +154,16 @@ func (parser *Parser) SampleRate() int {
 	}
 	return parser.samplingFrequency
 }
+
+//Samples 最后一个包中的采样数
+func (parser *Parser) Samples() int {
+	if parser.samples == 0 {
+		return 1152
+	}
+	return parser.samples
+}
+
+//MPEG1 是否为MPEG-1音频
+func (parser *Parser) MPEG1() bool {
+	return parser.mpeg1
+}
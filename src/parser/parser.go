@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"parser/aac"
+	"parser/ac3"
 	"parser/h264"
 	"parser/mp3"
 )
@@ -14,9 +15,11 @@ var (
 )
 
 type CodecParser struct {
-	aac  *aac.Parser
-	mp3  *mp3.Parser
-	h264 *h264.Parser
+	aac         *aac.Parser
+	mp3         *mp3.Parser
+	ac3         *ac3.Parser
+	h264        *h264.Parser
+	soundFormat uint8 //最后一个音频包的格式
 }
 
 func NewCodecParser() *CodecParser {
@@ -24,13 +27,33 @@ func NewCodecParser() *CodecParser {
 }
 
 func (codeParser *CodecParser) SampleRate() (int, error) {
-	if codeParser.aac == nil && codeParser.mp3 == nil {
-		return 0, errNoAudio
-	}
-	if codeParser.aac != nil {
+	switch codeParser.soundFormat {
+	case av.SOUND_AAC:
 		return codeParser.aac.SampleRate(), nil
+	case av.SOUND_MP3:
+		return codeParser.mp3.SampleRate(), nil
+	case av.SOUND_AC3:
+		return codeParser.ac3.SampleRate(), nil
+	}
+	return 0, errNoAudio
+}
+
+//Samples 最后一个音频包中的采样数, 用于计算音频时间戳
+func (codeParser *CodecParser) Samples() (int, error) {
+	switch codeParser.soundFormat {
+	case av.SOUND_AAC:
+		return codeParser.aac.Samples(), nil
+	case av.SOUND_MP3:
+		return codeParser.mp3.Samples(), nil
+	case av.SOUND_AC3:
+		return codeParser.ac3.Samples(), nil
 	}
-	return codeParser.mp3.SampleRate(), nil
+	return 0, errNoAudio
+}
+
+//MPEG1Audio MP3是否为MPEG-1音频, MPEG-2/2.5时返回false
+func (codeParser *CodecParser) MPEG1Audio() bool {
+	return codeParser.mp3 != nil && codeParser.mp3.MPEG1()
 }
 
 func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
@@ -54,12 +77,20 @@ func (codeParser *CodecParser) Parse(p *av.Packet, w io.Writer) (err error) {
 				if codeParser.aac == nil {
 					codeParser.aac = aac.NewParser()
 				}
+				codeParser.soundFormat = av.SOUND_AAC
 				err = codeParser.aac.Parse(p.Data, f.AACPacketType(), w)
-			case av.SOUND_MP3:
+			case av.SOUND_MP3, av.SOUND_MP3_8KHZ:
 				if codeParser.mp3 == nil {
 					codeParser.mp3 = mp3.NewParser()
 				}
-				err = codeParser.mp3.Parse(p.Data)
+				codeParser.soundFormat = av.SOUND_MP3
+				err = codeParser.mp3.Parse(p.Data, w)
+			case av.SOUND_AC3:
+				if codeParser.ac3 == nil {
+					codeParser.ac3 = ac3.NewParser()
+				}
+				codeParser.soundFormat = av.SOUND_AC3
+				err = codeParser.ac3.Parse(p.Data, w)
 			}
 		}
 
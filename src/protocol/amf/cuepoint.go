@@ -0,0 +1,102 @@
+package amf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	CueOut = "CUE-OUT"
+	CueIn  = "CUE-IN"
+)
+
+//CuePoint onCuePoint消息中的广告标记
+//
+//onCuePoint格式: {name, time, type, parameters{cue, duration, id, scte35}}
+//name或parameters.cue 为 CUE-IN/in 表示广告结束, 否则表示广告开始
+type CuePoint struct {
+	Name     string
+	Type     string
+	Time     float64 //秒
+	Out      bool    //广告开始
+	Duration float64 //广告时长(秒), 0表示未知
+	Id       uint32
+	Scte35   []byte //原始splice_info_section
+}
+
+//ParseCuePoint 解析onCuePoint消息参数
+func ParseCuePoint(args []interface{}) (*CuePoint, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("onCuePoint has no object")
+	}
+	obj, ok := args[0].(Object)
+	if !ok {
+		return nil, fmt.Errorf("onCuePoint object error")
+	}
+
+	cue := &CuePoint{Out: true}
+	cue.Name, _ = obj["name"].(string)
+	cue.Type, _ = obj["type"].(string)
+	cue.Time, _ = obj["time"].(float64)
+
+	params, _ := obj["parameters"].(Object)
+	if v, ok := params["cue"].(string); ok {
+		cue.Out = !strings.EqualFold(v, "in")
+	} else if strings.EqualFold(cue.Name, CueIn) {
+		cue.Out = false
+	}
+
+	switch v := params["duration"].(type) {
+	case float64:
+		cue.Duration = v
+	case string:
+		fmt.Sscanf(v, "%g", &cue.Duration)
+	}
+
+	switch v := params["id"].(type) {
+	case float64:
+		cue.Id = uint32(v)
+	case string:
+		fmt.Sscanf(v, "%d", &cue.Id)
+	}
+
+	//scte35 支持hex(0x开头)和base64
+	if v, ok := params["scte35"].(string); ok && v != "" {
+		var err error
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			cue.Scte35, err = hex.DecodeString(v[2:])
+		} else {
+			cue.Scte35, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("onCuePoint scte35 error: %v", err)
+		}
+	}
+
+	return cue, nil
+}
+
+//NewCuePoint 生成onCuePoint消息参数
+func NewCuePoint(out bool, id uint32, time, duration float64) Object {
+	name := CueOut
+	cue := "out"
+	if !out {
+		name = CueIn
+		cue = "in"
+	}
+	params := Object{
+		"cue": cue,
+		"id":  float64(id),
+	}
+	if out && duration > 0 {
+		params["duration"] = duration
+	}
+	return Object{
+		"name":       name,
+		"type":       "event",
+		"time":       time,
+		"parameters": params,
+	}
+}
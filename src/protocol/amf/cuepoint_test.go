@@ -0,0 +1,67 @@
+package amf
+
+import (
+	"testing"
+)
+
+func TestCuePointRoundTrip(t *testing.T) {
+	data, err := EncodeDataMessage(OnCuePoint, NewCuePoint(true, 42, 12.5, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, args, err := DecodeDataMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != OnCuePoint {
+		t.Fatalf("name %s", name)
+	}
+
+	cue, err := ParseCuePoint(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cue.Out || cue.Id != 42 || cue.Duration != 30 || cue.Time != 12.5 || cue.Name != CueOut {
+		t.Fatalf("bad cue point %+v", cue)
+	}
+}
+
+func TestCuePointIn(t *testing.T) {
+	args := []interface{}{Object{
+		"name":       "CUE-IN",
+		"parameters": Object{"scte35": "0xFC30"},
+	}}
+	cue, err := ParseCuePoint(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cue.Out {
+		t.Fatal("expect cue in")
+	}
+	if len(cue.Scte35) != 2 || cue.Scte35[0] != 0xfc {
+		t.Fatalf("bad scte35 % x", cue.Scte35)
+	}
+}
+
+func TestDataMessageSetDataFrame(t *testing.T) {
+	data, err := EncodeDataMessage(OnTextData, map[string]interface{}{"text": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = MetaDataReform(data, ADD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, args, err := DecodeDataMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != OnTextData || len(args) != 1 {
+		t.Fatalf("name %s args %v", name, args)
+	}
+	if obj, ok := args[0].(Object); !ok || obj["text"] != "hi" {
+		t.Fatalf("bad args %v", args)
+	}
+}
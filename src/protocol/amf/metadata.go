@@ -14,6 +14,8 @@ const (
 const (
 	SetDataFrame string = "@setDataFrame"
 	OnMetaData   string = "onMetaData"
+	OnTextData   string = "onTextData"
+	OnCuePoint   string = "onCuePoint"
 )
 
 var setFrameFrame []byte
@@ -68,3 +70,81 @@ func MetaDataReform(p []byte, flag uint8) ([]byte, error) {
 	}
 	return p, nil
 }
+
+//DecodeDataMessage 解析数据消息(script data),返回消息名称和参数,自动跳过@setDataFrame
+func DecodeDataMessage(p []byte) (string, []interface{}, error) {
+	r := bytes.NewReader(p)
+	decoder := &Decoder{}
+
+	v, err := decoder.DecodeAmf0(r)
+	if err != nil {
+		return "", nil, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return "", nil, fmt.Errorf("data message name error")
+	}
+	if name == SetDataFrame {
+		if v, err = decoder.DecodeAmf0(r); err != nil {
+			return "", nil, err
+		}
+		if name, ok = v.(string); !ok {
+			return "", nil, fmt.Errorf("data message name error")
+		}
+	}
+
+	var args []interface{}
+	for r.Len() > 0 {
+		if v, err = decoder.DecodeAmf0(r); err != nil {
+			return "", nil, err
+		}
+		args = append(args, v)
+	}
+	return name, args, nil
+}
+
+//EncodeDataMessage 生成数据消息(script data),参数中的map[string]interface{}会转换为Object
+func EncodeDataMessage(name string, args ...interface{}) ([]byte, error) {
+	b := bytes.NewBuffer(nil)
+	encoder := &Encoder{}
+	if _, err := encoder.EncodeAmf0(b, name); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if _, err := encoder.EncodeAmf0(b, ToAmfValue(arg)); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+//ToAmfValue 将JSON解析出的数据转换为可编码的AMF值
+func ToAmfValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		obj := make(Object, len(val))
+		for k, item := range val {
+			obj[k] = ToAmfValue(item)
+		}
+		return obj
+	case Object:
+		obj := make(Object, len(val))
+		for k, item := range val {
+			obj[k] = ToAmfValue(item)
+		}
+		return obj
+	case []interface{}:
+		arr := make(Array, len(val))
+		for i, item := range val {
+			arr[i] = ToAmfValue(item)
+		}
+		return arr
+	case Array:
+		arr := make(Array, len(val))
+		for i, item := range val {
+			arr[i] = ToAmfValue(item)
+		}
+		return arr
+	}
+	return v
+}
@@ -0,0 +1,487 @@
+package catalog
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	log "logging"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxChecksumQueue = 4096
+
+	//检查文件是否被删除的间隔
+	checkInterval = time.Minute
+
+	DefaultPageSize = 20
+	MaxPageSize     = 1000
+)
+
+//md5计算完成后延迟写索引, 期间完成的md5合并写入一次
+//异常退出时没有写入的md5在下次启动时补算
+var checksumSaveDelay = 5 * time.Second
+
+//Entry 一个录制完成的文件
+type Entry struct {
+	LiveRoomId string  `json:"liveRoomId"` //直播房间ID
+	ProjectId  int     `json:"projectId"`  //项目ID
+	PushId     int     `json:"pushId"`     //推流ID
+	VideoName  string  `json:"videoName"`  //视频名称
+	File       string  `json:"file"`       //本地文件路径
+	Addr       string  `json:"addr"`       //回看地址
+	Format     string  `json:"format"`     //文件格式
+	Start      string  `json:"start"`      //视频起始时间
+	Finish     string  `json:"finish"`     //视频结束时间
+	Size       int64   `json:"size"`       //文件大小
+	Duration   float64 `json:"duration"`   //时长(秒)
+	VideoCodec string  `json:"videoCodec"` //视频编码
+	AudioCodec string  `json:"audioCodec"` //音频编码
+	Md5        string  `json:"md5"`        //文件md5, 后台计算完成前为空
+	Remote     bool    `json:"remote"`     //已上传到对象存储并删除了本地文件
+}
+
+//Query 查询条件, 字符串为空或数值小于0表示不过滤
+//Start/Finish与Entry的时间格式相同, 返回与[Start, Finish]有交集的录制
+type Query struct {
+	LiveRoomId string
+	ProjectId  int
+	PushId     int
+	VideoName  string
+	Start      string
+	Finish     string
+	Offset     int
+	Limit      int
+}
+
+//NewQuery 不过滤任何条件的查询
+func NewQuery() Query {
+	return Query{
+		ProjectId: -1,
+		PushId:    -1,
+		Limit:     DefaultPageSize,
+	}
+}
+
+func (q *Query) match(e *Entry) bool {
+	if q.LiveRoomId != "" && q.LiveRoomId != e.LiveRoomId {
+		return false
+	}
+	if q.ProjectId >= 0 && q.ProjectId != e.ProjectId {
+		return false
+	}
+	if q.PushId >= 0 && q.PushId != e.PushId {
+		return false
+	}
+	if q.VideoName != "" && q.VideoName != e.VideoName {
+		return false
+	}
+	//时间格式按字典序即为时间顺序
+	if q.Start != "" && e.Finish < q.Start {
+		return false
+	}
+	if q.Finish != "" && e.Start > q.Finish {
+		return false
+	}
+	return true
+}
+
+type index struct {
+	Entries []*Entry `json:"entries"`
+}
+
+//Catalog 录制索引, 保存在磁盘上, md5由后台协程计算
+type Catalog struct {
+	mutex     sync.RWMutex
+	file      string
+	entries   map[string]*Entry
+	list      []*Entry //按起始时间排序, 加入和删除时维护
+	checksum  chan string
+	saveLock  sync.Mutex
+	saveTimer *time.Timer //等待写入的md5, 由saveLock保护
+}
+
+//NewCatalog 加载索引文件file, 启动workers个计算md5的协程
+func NewCatalog(file string, workers int) *Catalog {
+	c := &Catalog{
+		file:     file,
+		entries:  make(map[string]*Entry),
+		checksum: make(chan string, maxChecksumQueue),
+	}
+	if err := c.load(); err != nil {
+		log.Errorf("Catalog load %s error: %v", file, err)
+	}
+
+	for i := 0; i < workers; i++ {
+		go c.checksumWorker()
+	}
+
+	//启动时补算没有完成的md5
+	c.mutex.RLock()
+	for _, e := range c.entries {
+		if e.Md5 == "" {
+			c.queueChecksum(e.File)
+		}
+	}
+	c.mutex.RUnlock()
+
+	go c.checkFiles()
+	return c
+}
+
+func (c *Catalog) load() error {
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return err
+	}
+	for _, e := range idx.Entries {
+		c.insert(e)
+	}
+	log.Infof("Catalog load %d records from %s", len(c.entries), c.file)
+	return nil
+}
+
+//save 写入临时文件后改名, 避免写到一半时异常退出破坏索引
+func (c *Catalog) save() error {
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	//这次写入包含了等待写入的修改
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+
+	c.mutex.RLock()
+	idx := index{Entries: c.list}
+	data, err := json.MarshalIndent(idx, "", "\t")
+	c.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+//saveLater 在checksumSaveDelay后写索引, 已经在等待时不重复
+func (c *Catalog) saveLater() {
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	if c.saveTimer != nil {
+		return
+	}
+	c.saveTimer = time.AfterFunc(checksumSaveDelay, func() {
+		if err := c.save(); err != nil {
+			log.Errorf("Catalog save %s error: %v", c.file, err)
+		}
+	})
+}
+
+//search 第一个不在(start, file)之前的位置, 调用者持有锁
+func (c *Catalog) search(start, file string) int {
+	return sort.Search(len(c.list), func(i int) bool {
+		e := c.list[i]
+		if e.Start != start {
+			return e.Start > start
+		}
+		return e.File >= file
+	})
+}
+
+//insert 加入或者替换同一文件的记录, 调用者持有写锁
+func (c *Catalog) insert(e *Entry) {
+	c.remove(e.File)
+	c.entries[e.File] = e
+	i := c.search(e.Start, e.File)
+	c.list = append(c.list, nil)
+	copy(c.list[i+1:], c.list[i:])
+	c.list[i] = e
+}
+
+//remove 删除文件的记录, 调用者持有写锁
+func (c *Catalog) remove(file string) {
+	e, ok := c.entries[file]
+	if !ok {
+		return
+	}
+	delete(c.entries, file)
+	i := c.search(e.Start, e.File)
+	if i < len(c.list) && c.list[i] == e {
+		c.list = append(c.list[:i], c.list[i+1:]...)
+	}
+}
+
+//Add 录制完成时加入索引, 同一文件再次加入时覆盖
+func (c *Catalog) Add(entries ...Entry) {
+	var checksum []string
+	c.mutex.Lock()
+	for i := range entries {
+		e := entries[i]
+		if e.Size == 0 {
+			if info, err := os.Stat(e.File); err == nil {
+				e.Size = info.Size()
+			}
+		}
+		if old, ok := c.entries[e.File]; ok && old.Size == e.Size && e.Md5 == "" {
+			e.Md5 = old.Md5
+		}
+		c.insert(&e)
+		if e.Md5 == "" {
+			checksum = append(checksum, e.File)
+		}
+		log.Infof("Catalog add %s room=%s project=%d push=%d", e.File, e.LiveRoomId, e.ProjectId, e.PushId)
+	}
+	c.mutex.Unlock()
+
+	if err := c.save(); err != nil {
+		log.Errorf("Catalog save %s error: %v", c.file, err)
+	}
+	for _, file := range checksum {
+		c.queueChecksum(file)
+	}
+}
+
+//Remove 删除录制文件并从索引中删除
+func (c *Catalog) Remove(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.remove(file)
+	c.mutex.Unlock()
+
+	log.Infof("Catalog remove %s", file)
+	return c.save()
+}
+
+//SetAddr 上传到对象存储后修改回看地址, remote为true表示本地文件已删除
+func (c *Catalog) SetAddr(file string, addr string, remote bool) error {
+	c.mutex.Lock()
+	e, ok := c.entries[file]
+	if ok {
+		e.Addr = addr
+		e.Remote = remote
+	}
+	c.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%s not in catalog", file)
+	}
+
+	log.Infof("Catalog %s addr=%s remote=%v", file, addr, remote)
+	return c.save()
+}
+
+//Exist 文件是否已经在索引中
+func (c *Catalog) Exist(file string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.entries[file]
+	return ok
+}
+
+//Query 按条件查询, 返回符合条件的总数和当前页
+func (c *Catalog) Query(q Query) (int, []Entry) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		q.Limit = MaxPageSize
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	entries := c.Find(q)
+	total := len(entries)
+	if q.Offset >= total {
+		return total, make([]Entry, 0)
+	}
+	end := q.Offset + q.Limit
+	if end > total {
+		end = total
+	}
+	return total, entries[q.Offset:end]
+}
+
+//Find 返回所有符合条件的记录, 忽略分页
+func (c *Catalog) Find(q Query) []Entry {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	//起始时间晚于q.Finish的记录都在后面
+	list := c.list
+	if q.Finish != "" {
+		list = list[:sort.Search(len(list), func(i int) bool { return list[i].Start > q.Finish })]
+	}
+	result := make([]Entry, 0)
+	for _, e := range list {
+		if q.match(e) {
+			result = append(result, *e)
+		}
+	}
+	return result
+}
+
+func (c *Catalog) queueChecksum(file string) {
+	select {
+	case c.checksum <- file:
+	default:
+		log.Errorf("Catalog checksum queue full, skip %s", file)
+	}
+}
+
+func (c *Catalog) checksumWorker() {
+	for file := range c.checksum {
+		c.mutex.RLock()
+		e, ok := c.entries[file]
+		var size int64
+		if ok {
+			size = e.Size
+			ok = !e.Remote
+		}
+		c.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+
+		sum, err := fileMd5(file)
+		if err != nil {
+			log.Errorf("Catalog md5 %s error: %v", file, err)
+			continue
+		}
+
+		//计算期间文件被替换或删除时放弃结果
+		c.mutex.Lock()
+		e, ok = c.entries[file]
+		if ok && e.Size == size {
+			e.Md5 = sum
+		}
+		c.mutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		log.Infof("Catalog md5 %s %s", file, sum)
+		c.saveLater()
+	}
+}
+
+func fileMd5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+//checkFiles 定期删除本地文件已不存在的记录, 只在有变化时写索引
+//不持有锁检查文件, 检查期间被替换或删除的记录不处理
+func (c *Catalog) checkFiles() {
+	for {
+		time.Sleep(checkInterval)
+
+		c.mutex.RLock()
+		local := make(map[string]*Entry, len(c.entries))
+		for file, e := range c.entries {
+			if !e.Remote {
+				local[file] = e
+			}
+		}
+		c.mutex.RUnlock()
+
+		var missing []string
+		for file := range local {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				missing = append(missing, file)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		var removed []string
+		c.mutex.Lock()
+		for _, file := range missing {
+			if e, ok := c.entries[file]; ok && e == local[file] && !e.Remote {
+				c.remove(file)
+				removed = append(removed, file)
+			}
+		}
+		c.mutex.Unlock()
+
+		if len(removed) == 0 {
+			continue
+		}
+		for _, file := range removed {
+			log.Infof("Catalog remove not found file %s", file)
+		}
+		if err := c.save(); err != nil {
+			log.Errorf("Catalog save %s error: %v", c.file, err)
+		}
+	}
+}
+
+//legacyMd5s 旧版本replay.json的格式
+type legacyMd5s struct {
+	Files []struct {
+		FilePath string `json:"filePath"`
+		Size     int64  `json:"size"`
+		Md5      string `json:"Md5"`
+	} `json:"files"`
+}
+
+//ImportLegacyMd5 把旧版本replay.json中的md5导入到路径和大小都相同的记录, 不用重新计算
+//导入后改名为file+".imported", 只导入一次, 文件不存在时什么都不做
+func ImportLegacyMd5(file string, entries []Entry) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var legacy legacyMd5s
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return 0, err
+	}
+
+	sums := make(map[string]string)
+	for _, f := range legacy.Files {
+		if f.Md5 != "" {
+			sums[fmt.Sprintf("%s:%d", f.FilePath, f.Size)] = f.Md5
+		}
+	}
+	n := 0
+	for i := range entries {
+		e := &entries[i]
+		if sum, ok := sums[fmt.Sprintf("%s:%d", e.File, e.Size)]; ok && e.Md5 == "" {
+			e.Md5 = sum
+			n++
+		}
+	}
+	return n, os.Rename(file, file+".imported")
+}
@@ -0,0 +1,205 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalogQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var entries []Entry
+	for i, v := range []struct {
+		room   string
+		push   int
+		start  string
+		finish string
+	}{
+		{"01", 1, "20200611T100000", "20200611T103000"},
+		{"01", 1, "20200611T103000", "20200611T110000"},
+		{"01", 2, "20200611T100000", "20200611T110000"},
+		{"02", 1, "20200612T100000", "20200612T103000"},
+	} {
+		file := filepath.Join(dir, v.start+"_"+string(rune('a'+i))+".flv")
+		if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{
+			LiveRoomId: v.room,
+			ProjectId:  12,
+			PushId:     v.push,
+			File:       file,
+			Start:      v.start,
+			Finish:     v.finish,
+		})
+	}
+
+	index := filepath.Join(dir, "catalog.json")
+	c := NewCatalog(index, 1)
+	c.Add(entries...)
+
+	q := NewQuery()
+	q.LiveRoomId = "01"
+	q.PushId = 1
+	if total, result := c.Query(q); total != 2 || len(result) != 2 || result[0].Start != "20200611T100000" {
+		t.Fatalf("room query total=%d result=%v", total, result)
+	}
+
+	//时间范围
+	q = NewQuery()
+	q.Start = "20200611T104000"
+	q.Finish = "20200611T120000"
+	if total, _ := c.Query(q); total != 2 {
+		t.Fatalf("time range query total=%d", total)
+	}
+
+	//分页
+	q = NewQuery()
+	q.Offset = 3
+	q.Limit = 2
+	if total, result := c.Query(q); total != 4 || len(result) != 1 || result[0].LiveRoomId != "02" {
+		t.Fatalf("page query total=%d result=%v", total, result)
+	}
+
+	//后台计算md5
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		all := c.Find(NewQuery())
+		done := true
+		for _, e := range all {
+			if e.Md5 == "" {
+				done = false
+			}
+		}
+		if done {
+			if all[0].Md5 != "8d777f385d3dfec8815d20f7496026dc" || all[0].Size != 4 {
+				t.Fatalf("md5=%s size=%d", all[0].Md5, all[0].Size)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("checksum not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//重新加载索引
+	reload := NewCatalog(index, 0)
+	if total, _ := reload.Query(NewQuery()); total != 4 {
+		t.Fatalf("reload total=%d", total)
+	}
+}
+
+//加入, 替换和删除时维护按起始时间排序的索引, md5延迟写入
+func TestCatalogIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	delay := checksumSaveDelay
+	checksumSaveDelay = 50 * time.Millisecond
+	defer func() { checksumSaveDelay = delay }()
+
+	files := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		files[name] = filepath.Join(dir, name+".flv")
+		if err := ioutil.WriteFile(files[name], []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := filepath.Join(dir, "catalog.json")
+	c := NewCatalog(index, 1)
+	c.Add(Entry{File: files["c"], Start: "20200611T120000", Finish: "20200611T130000"},
+		Entry{File: files["a"], Start: "20200611T100000", Finish: "20200611T110000"})
+	c.Add(Entry{File: files["d"], Start: "20200611T100000", Finish: "20200611T103000"},
+		Entry{File: files["b"], Start: "20200611T140000", Finish: "20200611T150000"})
+	//同一文件再次加入时按新的起始时间排序
+	c.Add(Entry{File: files["b"], Start: "20200611T090000", Finish: "20200611T093000"})
+	if err := c.Remove(files["c"]); err != nil {
+		t.Fatal(err)
+	}
+
+	order := func(entries []Entry) string {
+		s := ""
+		for _, e := range entries {
+			s += filepath.Base(e.File)[:1]
+		}
+		return s
+	}
+	if got := order(c.Find(NewQuery())); got != "bad" {
+		t.Fatalf("order %s", got)
+	}
+	q := NewQuery()
+	q.Start = "20200611T100000"
+	q.Finish = "20200611T100000"
+	if got := order(c.Find(q)); got != "ad" {
+		t.Fatalf("time range order %s", got)
+	}
+
+	//md5在延迟之后写入索引文件
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reload := NewCatalog(index, 0)
+		done := true
+		for _, e := range reload.Find(NewQuery()) {
+			if e.Md5 == "" {
+				done = false
+			}
+		}
+		if done {
+			if got := order(reload.Find(NewQuery())); got != "bad" {
+				t.Fatalf("reload order %s", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("checksum not saved")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+//旧版本replay.json中路径和大小都相同的md5导入后不再计算, 只导入一次
+func TestImportLegacyMd5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, "replay.json")
+	data := `{"files":[` +
+		`{"filePath":"/root/data1/01/12/Camera_20200611T095954_20200611T100119.ts","size":5067728,"Md5":"6c2841422a862a2b9ad59e654e4c8c75","start":"20200611T095954","finish":"20200611T100119.ts"},` +
+		`{"filePath":"/root/data1/01/12/Camera_20200611T103300_20200611T103416.ts","size":8974336,"Md5":"5315639a7ed29bdb4de0cd4b0e182ea5","start":"20200611T103300","finish":"20200611T103416"}]}`
+	if err := ioutil.WriteFile(legacy, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []Entry{
+		{File: "/root/data1/01/12/Camera_20200611T095954_20200611T100119.ts", Size: 5067728},
+		//文件大小变化的不导入
+		{File: "/root/data1/01/12/Camera_20200611T103300_20200611T103416.ts", Size: 8995612},
+		{File: "/root/data1/01/12/Camera_20200612T103300_20200612T103416.ts", Size: 100},
+	}
+	n, err := ImportLegacyMd5(legacy, entries)
+	if err != nil || n != 1 {
+		t.Fatalf("import %d %v", n, err)
+	}
+	if entries[0].Md5 != "6c2841422a862a2b9ad59e654e4c8c75" || entries[1].Md5 != "" || entries[2].Md5 != "" {
+		t.Fatalf("entries %+v", entries)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("replay.json not renamed")
+	}
+	if n, err := ImportLegacyMd5(legacy, entries[1:]); err != nil || n != 0 {
+		t.Fatalf("import again %d %v", n, err)
+	}
+}
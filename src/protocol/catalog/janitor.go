@@ -0,0 +1,312 @@
+package catalog
+
+import (
+	"fmt"
+	log "logging"
+	"protocol/record"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	AlertDiskLow       = "disk_low"       //清理后剩余空间仍低于规则
+	AlertDiskCritical  = "disk_critical"  //剩余空间低于临界值
+	AlertRecordRefused = "record_refused" //剩余空间不足, 拒绝录制
+	AlertDiskRecovered = "disk_recovered" //剩余空间恢复
+	AlertRemoveFailed  = "remove_failed"  //删除录制失败
+)
+
+//Rule 推流点的录制保存规则
+type Rule struct {
+	LiveRoomId     string
+	PushId         int
+	Path           string        //保存目录
+	MaxAge         time.Duration //0表示不限制
+	MaxSize        int64         //字节, 0表示不限制
+	MinFreePercent float64       //0表示不限制
+}
+
+//Alert 磁盘告警事件
+type Alert struct {
+	Type        string  `json:"type"`
+	Path        string  `json:"path"`
+	FreePercent float64 `json:"freePercent"`
+	Message     string  `json:"message"`
+	Time        string  `json:"time"`
+}
+
+func NewAlert(alertType, path string, freePercent float64, message string) Alert {
+	return Alert{
+		Type:        alertType,
+		Path:        path,
+		FreePercent: freePercent,
+		Message:     message,
+		Time:        time.Now().Format(record.TimeFormat),
+	}
+}
+
+//Usage 保存目录的使用情况
+type Usage struct {
+	Path        string  `json:"path"`
+	Files       int     `json:"files"`       //索引中的录制数量
+	Bytes       int64   `json:"bytes"`       //索引中的录制大小
+	DiskTotal   uint64  `json:"diskTotal"`   //磁盘总大小
+	DiskFree    uint64  `json:"diskFree"`    //磁盘剩余大小
+	FreePercent float64 `json:"freePercent"` //磁盘剩余百分比
+}
+
+//DiskFree 得到path所在磁盘的总大小和剩余大小
+func DiskFree(path string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	return fs.Blocks * uint64(fs.Bsize), fs.Bavail * uint64(fs.Bsize), nil
+}
+
+//FreePercent 得到path所在磁盘的剩余百分比, 失败时返回100
+func FreePercent(path string) float64 {
+	total, free, err := DiskFree(path)
+	if err != nil || total == 0 {
+		return 100
+	}
+	return float64(free) * 100 / float64(total)
+}
+
+//freePercent 清理时得到剩余百分比, 测试时替换
+var freePercent = FreePercent
+
+//Usage 统计path下的录制和磁盘使用情况
+func (c *Catalog) Usage(path string) Usage {
+	usage := Usage{Path: path}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+
+	c.mutex.RLock()
+	for file, e := range c.entries {
+		if strings.HasPrefix(file, prefix) && !e.Remote {
+			usage.Files++
+			usage.Bytes += e.Size
+		}
+	}
+	c.mutex.RUnlock()
+
+	if total, free, err := DiskFree(path); err == nil && total > 0 {
+		usage.DiskTotal = total
+		usage.DiskFree = free
+		usage.FreePercent = float64(free) * 100 / float64(total)
+	}
+	return usage
+}
+
+//Janitor 按保存规则定期删除最早的录制
+//只删除索引中的文件, 正在录制的分段完成前不会加入索引, 所以不会被删除
+type Janitor struct {
+	catalog  *Catalog
+	interval time.Duration
+	critical float64
+	rules    func() []Rule
+	onAlert  func(Alert)
+
+	mutex   sync.Mutex
+	alerted map[string]string //每个目录最近一次的告警类型, 避免重复告警
+}
+
+//NewJanitor rules在每次检查时调用得到最新的规则, critical为临界剩余百分比
+func NewJanitor(c *Catalog, interval time.Duration, critical float64, rules func() []Rule, onAlert func(Alert)) *Janitor {
+	return &Janitor{
+		catalog:  c,
+		interval: interval,
+		critical: critical,
+		rules:    rules,
+		onAlert:  onAlert,
+		alerted:  make(map[string]string),
+	}
+}
+
+func (j *Janitor) Start() {
+	go func() {
+		for {
+			j.Clean()
+			time.Sleep(j.interval)
+		}
+	}()
+}
+
+//Clean 按所有规则清理一次
+//过期和超过大小的录制按推流点清理, 剩余空间按磁盘清理
+func (j *Janitor) Clean() {
+	rules := j.rules()
+	for _, rule := range rules {
+		j.clean(rule)
+	}
+	for _, group := range diskGroups(rules) {
+		j.cleanFree(group)
+	}
+}
+
+//clean 按推流点的最长保存时间和最大大小删除最早的录制
+func (j *Janitor) clean(rule Rule) {
+	entries, total := j.localEntries(rule)
+
+	now := time.Now()
+	for len(entries) > 0 {
+		e := entries[0]
+
+		reason := ""
+		if rule.MaxAge > 0 && finishTime(e).Before(now.Add(-rule.MaxAge)) {
+			reason = "max age"
+		} else if rule.MaxSize > 0 && total > rule.MaxSize {
+			reason = "max size"
+		} else {
+			break
+		}
+
+		if !j.remove(e, reason, rule.Path) {
+			break
+		}
+		total -= e.Size
+		entries = entries[1:]
+	}
+}
+
+//cleanFree 磁盘剩余空间低于规则时, 在同一磁盘的所有推流点中删除最早的录制
+//每个推流点至少保留一个录制, 只剩最后一个时停止删除并告警
+func (j *Janitor) cleanFree(rules []Rule) {
+	path := rules[0].Path
+	minFree := 0.0
+	left := make(map[slot]int)
+	var entries []Entry
+	for _, rule := range rules {
+		if rule.MinFreePercent > minFree {
+			minFree = rule.MinFreePercent
+		}
+		slotEntries, _ := j.localEntries(rule)
+		left[slot{rule.LiveRoomId, rule.PushId}] = len(slotEntries)
+		entries = append(entries, slotEntries...)
+	}
+	//不同推流点的录制按起始时间排序, 最早的先删除
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].Start < entries[b].Start })
+
+	kept := false
+	for _, e := range entries {
+		if minFree <= 0 || freePercent(path) >= minFree {
+			break
+		}
+		key := slot{e.LiveRoomId, e.PushId}
+		if left[key] <= 1 {
+			kept = true
+			continue
+		}
+		if !j.remove(e, "min free", path) {
+			break
+		}
+		left[key]--
+	}
+
+	j.checkDisk(path, minFree, kept)
+}
+
+//localEntries 推流点在索引中的本地录制, 按起始时间排序
+//只清理本地的录制, 已上传到对象存储的由对象存储的生命周期管理
+func (j *Janitor) localEntries(rule Rule) ([]Entry, int64) {
+	q := NewQuery()
+	q.LiveRoomId = rule.LiveRoomId
+	q.PushId = rule.PushId
+	var entries []Entry
+	var total int64
+	for _, e := range j.catalog.Find(q) {
+		if e.Remote {
+			continue
+		}
+		entries = append(entries, e)
+		total += e.Size
+	}
+	return entries, total
+}
+
+//remove 删除录制, 失败时告警
+func (j *Janitor) remove(e Entry, reason string, path string) bool {
+	log.Infof("Janitor remove %s reason=%s room=%s push=%d", e.File, reason, e.LiveRoomId, e.PushId)
+	if err := j.catalog.Remove(e.File); err != nil {
+		log.Errorf("Janitor remove %s error: %v", e.File, err)
+		j.alert(NewAlert(AlertRemoveFailed, path, freePercent(path), err.Error()))
+		return false
+	}
+	return true
+}
+
+//slot 推流点
+type slot struct {
+	liveRoomId string
+	pushId     int
+}
+
+//diskGroups 按保存目录所在的磁盘分组, 无法得到磁盘时按目录分组
+func diskGroups(rules []Rule) [][]Rule {
+	var groups [][]Rule
+	index := make(map[string]int)
+	for _, rule := range rules {
+		key := "path:" + rule.Path
+		var st syscall.Stat_t
+		if err := syscall.Stat(rule.Path, &st); err == nil {
+			key = fmt.Sprintf("dev:%d", st.Dev)
+		}
+		if i, ok := index[key]; ok {
+			groups[i] = append(groups[i], rule)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []Rule{rule})
+	}
+	return groups
+}
+
+//checkDisk 清理后检查剩余空间, 状态变化时告警
+//kept为true表示为了保留推流点最后一个录制停止了清理
+func (j *Janitor) checkDisk(path string, minFree float64, kept bool) {
+	free := freePercent(path)
+
+	state := ""
+	if j.critical > 0 && free < j.critical {
+		state = AlertDiskCritical
+	} else if minFree > 0 && free < minFree {
+		state = AlertDiskLow
+	}
+
+	j.mutex.Lock()
+	last := j.alerted[path]
+	j.alerted[path] = state
+	j.mutex.Unlock()
+
+	if state == last {
+		return
+	}
+	if state == "" {
+		j.alert(NewAlert(AlertDiskRecovered, path, free, "disk space recovered"))
+		return
+	}
+	message := "disk free space is low"
+	if kept {
+		message = "disk free space is low, stop cleaning to keep the last record of each push"
+	}
+	j.alert(NewAlert(state, path, free, message))
+}
+
+func (j *Janitor) alert(alert Alert) {
+	log.Errorf("Janitor alert %s path=%s free=%.2f%% %s", alert.Type, alert.Path, alert.FreePercent, alert.Message)
+	if j.onAlert != nil {
+		j.onAlert(alert)
+	}
+}
+
+func finishTime(e Entry) time.Time {
+	t, err := time.ParseInLocation(record.TimeFormat, e.Finish, time.Local)
+	if err != nil {
+		//无法解析时视为最新, 不按时间删除
+		return time.Now()
+	}
+	return t
+}
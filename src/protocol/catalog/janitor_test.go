@@ -0,0 +1,125 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJanitorClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-48 * time.Hour).Format("20060102T150405")
+	var entries []Entry
+	for i, start := range []string{old, "20991231T100000", "20991231T110000", "20991231T120000"} {
+		file := filepath.Join(dir, start+"_"+string(rune('a'+i))+".flv")
+		if err := ioutil.WriteFile(file, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{
+			LiveRoomId: "01",
+			PushId:     1,
+			File:       file,
+			Start:      start,
+			Finish:     start,
+		})
+	}
+
+	c := NewCatalog(filepath.Join(dir, "catalog.json"), 0)
+	c.Add(entries...)
+
+	var alerts []Alert
+	rules := func() []Rule {
+		return []Rule{{LiveRoomId: "01", PushId: 1, Path: dir, MaxAge: 24 * time.Hour, MaxSize: 250}}
+	}
+	j := NewJanitor(c, time.Minute, 0, rules, func(a Alert) { alerts = append(alerts, a) })
+	j.Clean()
+
+	//过期的一个按时间删除, 剩下300字节超过250再删除最早的一个
+	left := c.Find(NewQuery())
+	if len(left) != 2 || left[0].File != entries[2].File {
+		t.Fatalf("left=%v", left)
+	}
+	for _, e := range entries[:2] {
+		if _, err := os.Stat(e.File); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed", e.File)
+		}
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("alerts=%v", alerts)
+	}
+
+	usage := c.Usage(dir)
+	if usage.Files != 2 || usage.Bytes != 200 {
+		t.Fatalf("usage=%+v", usage)
+	}
+}
+
+//剩余空间不足时在同一磁盘的所有推流点中删除最早的录制, 每个推流点保留最后一个
+func TestJanitorCleanFree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewCatalog(filepath.Join(dir, "catalog.json"), 0)
+	var entries []Entry
+	for i, start := range []string{"20991231T100000", "20991231T110000", "20991231T120000", "20991231T130000", "20991231T140000"} {
+		pushId := 1
+		if i == 1 {
+			pushId = 2
+		}
+		file := filepath.Join(dir, start+".flv")
+		if err := ioutil.WriteFile(file, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{LiveRoomId: "01", PushId: pushId, File: file, Start: start, Finish: start, Size: 100})
+	}
+	c.Add(entries...)
+
+	//每个录制占1%的磁盘, 剩余空间需要不低于97%
+	defer func(f func(string) float64) { freePercent = f }(freePercent)
+	freePercent = func(string) float64 { return 100 - float64(len(c.Find(NewQuery()))) }
+
+	var alerts []Alert
+	rules := func() []Rule {
+		return []Rule{
+			{LiveRoomId: "01", PushId: 1, Path: dir, MinFreePercent: 97},
+			{LiveRoomId: "01", PushId: 2, Path: dir, MinFreePercent: 97},
+		}
+	}
+	j := NewJanitor(c, time.Minute, 0, rules, func(a Alert) { alerts = append(alerts, a) })
+	j.Clean()
+
+	//推流点1最早的两个被删除, 推流点2只有一个录制, 保留
+	left := c.Find(NewQuery())
+	if len(left) != 3 || left[0].File != entries[1].File || left[1].File != entries[3].File {
+		t.Fatalf("left=%v", left)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("alerts=%v", alerts)
+	}
+
+	//需要的空间只能清空推流点时停止并告警
+	rules = func() []Rule {
+		return []Rule{
+			{LiveRoomId: "01", PushId: 1, Path: dir, MinFreePercent: 99},
+			{LiveRoomId: "01", PushId: 2, Path: dir, MinFreePercent: 99},
+		}
+	}
+	j = NewJanitor(c, time.Minute, 0, rules, func(a Alert) { alerts = append(alerts, a) })
+	j.Clean()
+	if left := c.Find(NewQuery()); len(left) != 2 || left[0].PushId != 2 || left[1].File != entries[4].File {
+		t.Fatalf("left=%v", left)
+	}
+	if len(alerts) != 1 || alerts[0].Type != AlertDiskLow {
+		t.Fatalf("alerts=%v", alerts)
+	}
+}
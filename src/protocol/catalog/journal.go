@@ -0,0 +1,114 @@
+package catalog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	log "logging"
+	"os"
+	"sync"
+)
+
+//Journal 正在录制的文件, 录制开始时写入, 录制完成时删除
+//异常退出后留在日志中的文件没有改名和加入索引, 启动时恢复
+type Journal struct {
+	mutex    sync.Mutex
+	file     string
+	entries  map[string]Entry
+	orphans  []Entry
+	saveLock sync.Mutex
+}
+
+//NewJournal 加载日志文件file, 已有的记录为上次异常退出时没有完成的录制
+func NewJournal(file string) *Journal {
+	j := &Journal{
+		file:    file,
+		entries: make(map[string]Entry),
+	}
+	if err := j.load(); err != nil {
+		log.Errorf("Journal load %s error: %v", file, err)
+	}
+	return j
+}
+
+func (j *Journal) load() error {
+	data, err := ioutil.ReadFile(j.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		j.entries[e.File] = e
+	}
+	j.orphans = entries
+	log.Infof("Journal load %d unfinished records from %s", len(entries), j.file)
+	return nil
+}
+
+//save 写入临时文件后改名
+func (j *Journal) save() {
+	j.saveLock.Lock()
+	defer j.saveLock.Unlock()
+
+	j.mutex.Lock()
+	entries := make([]Entry, 0, len(j.entries))
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.MarshalIndent(entries, "", "\t")
+	j.mutex.Unlock()
+	if err != nil {
+		log.Errorf("Journal save error: %v", err)
+		return
+	}
+
+	tmp := j.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Journal save %s error: %v", j.file, err)
+		return
+	}
+	if err := os.Rename(tmp, j.file); err != nil {
+		log.Errorf("Journal save %s error: %v", j.file, err)
+	}
+}
+
+//Begin 开始录制e.File, 在创建文件之前调用
+func (j *Journal) Begin(e Entry) {
+	j.mutex.Lock()
+	j.entries[e.File] = e
+	j.mutex.Unlock()
+	j.save()
+}
+
+//End 录制完成或恢复完成
+func (j *Journal) End(file string) {
+	j.mutex.Lock()
+	_, ok := j.entries[file]
+	delete(j.entries, file)
+	j.mutex.Unlock()
+	if ok {
+		j.save()
+	}
+}
+
+//Active 文件是否在日志中, 正在录制或等待恢复
+func (j *Journal) Active(file string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	_, ok := j.entries[file]
+	return ok
+}
+
+//Orphans 加载时已有的记录, 即上次异常退出时没有完成的录制
+func (j *Journal) Orphans() []Entry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	orphans := make([]Entry, len(j.orphans))
+	copy(orphans, j.orphans)
+	return orphans
+}
@@ -0,0 +1,39 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "journal.json")
+	j := NewJournal(file)
+	if len(j.Orphans()) != 0 {
+		t.Fatal("new journal has orphans")
+	}
+	j.Begin(Entry{File: "a/Camera_20200611T100000.flv", Format: "flv", Start: "20200611T100000"})
+	j.Begin(Entry{File: "a/Camera_20200611T110000.ts", Format: "ts", Start: "20200611T110000"})
+	j.End("a/Camera_20200611T100000.flv")
+	if j.Active("a/Camera_20200611T100000.flv") || !j.Active("a/Camera_20200611T110000.ts") {
+		t.Fatal("active mismatch")
+	}
+
+	//异常退出后重新加载, 没有结束的录制为orphan
+	j = NewJournal(file)
+	orphans := j.Orphans()
+	if len(orphans) != 1 || orphans[0].File != "a/Camera_20200611T110000.ts" || orphans[0].Format != "ts" {
+		t.Fatalf("orphans %+v", orphans)
+	}
+	j.End(orphans[0].File)
+	if j.Active(orphans[0].File) || len(NewJournal(file).Orphans()) != 0 {
+		t.Fatal("orphan not ended")
+	}
+}
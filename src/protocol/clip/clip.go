@@ -0,0 +1,151 @@
+package clip
+
+import (
+	"av"
+	"bytes"
+	"errors"
+	"protocol/amf"
+	"protocol/record"
+	"time"
+)
+
+var errFinished = errors.New("clip finished")
+
+type gopPacket struct {
+	t time.Time
+	p *av.Packet
+}
+
+//cutter 从起始时间前最近的关键帧开始复制音视频包, 时间戳从0开始
+type cutter struct {
+	start  time.Time
+	finish time.Time
+	writer record.Writer
+
+	metadata *av.Packet
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+	hasVideo bool
+	gop      []gopPacket
+
+	started  bool
+	done     bool //已超过结束时间
+	base     time.Time
+	last     time.Time //已写入的最后一个包的时间
+	floor    time.Time //切换数据源时丢弃不晚于此时间的包
+	duration uint32
+}
+
+func newCutter(start, finish time.Time, writer record.Writer) *cutter {
+	return &cutter{
+		start:  start,
+		finish: finish,
+		writer: writer,
+	}
+}
+
+//nextSource 切换到下一个数据源, 避免录制和直播缓存重叠的部分重复写入
+func (c *cutter) nextSource() {
+	c.floor = c.last
+}
+
+func (c *cutter) write(t time.Time, p *av.Packet) error {
+	if p.IsMetadata {
+		if c.metadata == nil {
+			if name, _, err := amf.DecodeDataMessage(p.Data); err == nil && name == amf.OnMetaData {
+				c.metadata = p
+			}
+		}
+		return nil
+	}
+
+	key := false
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil
+		}
+		if vh.IsSeq() {
+			c.hasVideo = true
+			return c.writeHeader(&c.videoSeq, p)
+		}
+		key = vh.IsKeyFrame()
+	} else if isSeq(p) {
+		return c.writeHeader(&c.audioSeq, p)
+	}
+
+	if !c.floor.IsZero() && !t.After(c.floor) {
+		return nil
+	}
+	if t.After(c.finish) {
+		c.done = true
+		return errFinished
+	}
+
+	if c.started {
+		return c.writePacket(t, p)
+	}
+
+	//没有视频时每个音频包都可以作为起点
+	if key || (!c.hasVideo && p.IsAudio) {
+		c.gop = c.gop[:0]
+		c.gop = append(c.gop, gopPacket{t: t, p: p})
+	} else if len(c.gop) > 0 {
+		c.gop = append(c.gop, gopPacket{t: t, p: p})
+	}
+	if t.Before(c.start) || len(c.gop) == 0 {
+		return nil
+	}
+
+	c.started = true
+	c.base = c.gop[0].t
+	for _, h := range []*av.Packet{c.metadata, c.videoSeq, c.audioSeq} {
+		if h == nil {
+			continue
+		}
+		np := *h
+		np.TimeStamp = 0
+		if err := c.writer.WritePacket(&np); err != nil {
+			return err
+		}
+	}
+	for _, g := range c.gop {
+		if err := c.writePacket(g.t, g.p); err != nil {
+			return err
+		}
+	}
+	c.gop = nil
+	return nil
+}
+
+//writeHeader 保存sequence header, 开始写入后变化时写入新的
+//每个录制文件开头都有相同的sequence header, 不重复写入
+func (c *cutter) writeHeader(header **av.Packet, p *av.Packet) error {
+	changed := *header == nil || !bytes.Equal((*header).Data, p.Data)
+	*header = p
+	if !c.started || !changed {
+		return nil
+	}
+	np := *p
+	np.TimeStamp = c.timestamp(c.last)
+	return c.writer.WritePacket(&np)
+}
+
+func (c *cutter) writePacket(t time.Time, p *av.Packet) error {
+	np := *p
+	np.TimeStamp = c.timestamp(t)
+	if np.TimeStamp > c.duration {
+		c.duration = np.TimeStamp
+	}
+	if t.After(c.last) {
+		c.last = t
+	}
+	return c.writer.WritePacket(&np)
+}
+
+func (c *cutter) timestamp(t time.Time) uint32 {
+	if t.Before(c.base) {
+		return 0
+	}
+	return uint32(t.Sub(c.base) / time.Millisecond)
+}
@@ -0,0 +1,158 @@
+package clip
+
+import (
+	"av"
+	"container/flv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testAVCConfig 640x360 baseline的AVCDecoderConfigurationRecord
+var testAVCConfig = []byte{
+	0x17, 0x00, 0, 0, 0,
+	0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1,
+	0x00, 0x0a, 0x67, 0x42, 0xc0, 0x1e, 0xf4, 0x05, 0x01, 0x7f, 0xca, 0x80,
+	0x01, 0x00, 0x04, 0x68, 0xce, 0x3c, 0x80,
+}
+
+//testPackets 10秒25fps视频和音频, 每秒一个关键帧
+func testPackets(t *testing.T) []*av.Packet {
+	demuxer := flv.NewDemuxer()
+	packets := []*av.Packet{
+		{IsVideo: true, Data: testAVCConfig},
+		{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+	}
+	for i := 0; i < 250; i++ {
+		data := []byte{0x27, 0x01, 0, 0, 0, byte(i)}
+		if i%25 == 0 {
+			data[0] = 0x17
+		}
+		packets = append(packets,
+			&av.Packet{IsVideo: true, TimeStamp: uint32(i * 40), Data: data},
+			&av.Packet{IsAudio: true, TimeStamp: uint32(i*40 + 20), Data: []byte{0xaf, 0x01, byte(i)}})
+	}
+	for _, p := range packets {
+		if err := demuxer.DemuxH(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return packets
+}
+
+func waitJob(t *testing.T, m *Manager, id string) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == StatusDone || job.Status == StatusFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("clip job not finished")
+	return Job{}
+}
+
+func TestClipFromRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "record.flv")
+	w, err := flv.NewFileMuxer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range testPackets(t) {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	start := time.Date(2020, 6, 11, 10, 0, 0, 0, time.Local)
+	m := NewManager(filepath.Join(dir, "clips"))
+	job, err := m.Submit(Job{Format: "flv"}, start.Add(2500*time.Millisecond), start.Add(4500*time.Millisecond),
+		[]Source{NewFileSource([]File{{File: file, Start: start}})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, m, job.Id)
+	if job.Status != StatusDone {
+		t.Fatalf("job=%+v", job)
+	}
+
+	r, err := flv.NewFileReader(job.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	//sequence header之后从2秒的关键帧开始, 到4.5秒结束
+	var media []*av.Packet
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsMetadata && !isSeq(p) {
+			media = append(media, p)
+		}
+	}
+	first := media[0]
+	if !first.IsVideo || first.TimeStamp != 0 || first.Data[0] != 0x17 || first.Data[5] != 50 {
+		t.Fatalf("first packet %+v", first)
+	}
+	last := media[len(media)-1]
+	if last.TimeStamp > 2500 || last.TimeStamp < 2400 {
+		t.Fatalf("last timestamp %d", last.TimeStamp)
+	}
+	if job.Duration != float64(last.TimeStamp)/1000 {
+		t.Fatalf("duration %v", job.Duration)
+	}
+}
+
+func TestClipFromBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewBuffer(5 * time.Second)
+	now := time.Now()
+	for _, p := range testPackets(t) {
+		b.Write(*p)
+	}
+	//只保留最后5秒
+	if oldest := b.Oldest(); oldest.Sub(now) < 4*time.Second {
+		t.Fatalf("oldest %v", oldest.Sub(now))
+	}
+
+	m := NewManager(filepath.Join(dir, "clips"))
+	job, err := m.Submit(Job{Format: "mp4"}, now.Add(7*time.Second), now.Add(8*time.Second), []Source{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, m, job.Id)
+	if job.Status != StatusDone || job.Size == 0 || job.Duration < 0.9 || job.Duration > 2 {
+		t.Fatalf("job=%+v", job)
+	}
+
+	//超出缓存范围
+	job, _ = m.Submit(Job{Format: "mp4"}, now.Add(time.Minute), now.Add(2*time.Minute), []Source{b})
+	if job = waitJob(t, m, job.Id); job.Status != StatusFailed || job.Message != ErrNoData.Error() {
+		t.Fatalf("job=%+v", job)
+	}
+}
@@ -0,0 +1,208 @@
+package clip
+
+import (
+	"errors"
+	"fmt"
+	log "logging"
+	"os"
+	"path/filepath"
+	"protocol/record"
+	"sync"
+	"time"
+	"utils/uid"
+)
+
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+
+	MaxDuration = time.Hour //单个剪辑的最大时长
+
+	jobExpire     = 24 * time.Hour //完成的剪辑保留时间
+	checkInterval = time.Minute
+)
+
+var (
+	ErrFormat   = errors.New("clip format must be mp4 or flv")
+	ErrRange    = errors.New("clip time range error")
+	ErrNotFound = errors.New("clip job not found")
+	ErrNoData   = errors.New("no data in clip time range")
+)
+
+//Job 一个剪辑任务
+type Job struct {
+	Id         string  `json:"id"`
+	Key        string  `json:"key"`
+	LiveRoomId string  `json:"liveRoomId"`
+	PushId     int     `json:"pushId"`
+	Start      string  `json:"start"`
+	Finish     string  `json:"finish"`
+	Format     string  `json:"format"`
+	Status     string  `json:"status"`
+	Message    string  `json:"message"`
+	Size       int64   `json:"size"`
+	Duration   float64 `json:"duration"` //秒
+	Url        string  `json:"url"`      //下载地址, 完成后有效
+	File       string  `json:"-"`
+
+	start   time.Time
+	finish  time.Time
+	created time.Time
+}
+
+//Manager 异步执行剪辑任务, 剪辑文件保存在dir下
+type Manager struct {
+	mutex sync.RWMutex
+	dir   string
+	jobs  map[string]*Job
+}
+
+func NewManager(dir string) *Manager {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Errorf("Clip Manager MkdirAll %s error: %v", dir, err)
+	}
+	m := &Manager{
+		dir:  dir,
+		jobs: make(map[string]*Job),
+	}
+	go m.checkExpire()
+	return m
+}
+
+//Submit 提交剪辑任务, 按顺序从sources中读取[start, finish]内的音视频包
+func (m *Manager) Submit(job Job, start, finish time.Time, sources []Source) (Job, error) {
+	if job.Format != record.FormatMp4 && job.Format != record.FormatFlv {
+		return job, ErrFormat
+	}
+	if !finish.After(start) || finish.Sub(start) > MaxDuration {
+		return job, ErrRange
+	}
+
+	job.Id = uid.NewId()
+	job.Start = start.Format(record.TimeFormat)
+	job.Finish = finish.Format(record.TimeFormat)
+	job.Status = StatusPending
+	job.File = filepath.Join(m.dir, job.Id+"."+job.Format)
+	job.start = start
+	job.finish = finish
+	job.created = time.Now()
+
+	m.mutex.Lock()
+	m.jobs[job.Id] = &job
+	m.mutex.Unlock()
+
+	log.Infof("Clip Submit id=%s key=%s room=%s push=%d %s-%s %s", job.Id, job.Key, job.LiveRoomId, job.PushId, job.Start, job.Finish, job.Format)
+	go m.run(job.Id, sources)
+	return job, nil
+}
+
+//Get 得到剪辑任务的状态
+func (m *Manager) Get(id string) (Job, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return *job, nil
+}
+
+func (m *Manager) update(id string, fn func(job *Job)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if job, ok := m.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+func (m *Manager) run(id string, sources []Source) {
+	job, err := m.Get(id)
+	if err != nil {
+		return
+	}
+	m.update(id, func(job *Job) {
+		job.Status = StatusRunning
+	})
+
+	duration, err := m.cut(job, sources)
+	if err != nil {
+		log.Errorf("Clip id=%s error: %v", id, err)
+		m.update(id, func(job *Job) {
+			job.Status = StatusFailed
+			job.Message = err.Error()
+		})
+		return
+	}
+
+	var size int64
+	if info, err := os.Stat(job.File); err == nil {
+		size = info.Size()
+	}
+	log.Infof("Clip id=%s done file=%s size=%d duration=%d", id, job.File, size, duration)
+	m.update(id, func(job *Job) {
+		job.Status = StatusDone
+		job.Message = "success"
+		job.Size = size
+		job.Duration = float64(duration) / 1000
+	})
+}
+
+func (m *Manager) cut(job Job, sources []Source) (uint32, error) {
+	tmp := job.File + ".part"
+	writer, err := record.NewWriter(job.Format, tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	c := newCutter(job.start, job.finish, writer)
+	for _, source := range sources {
+		c.nextSource()
+		if err := source.Read(c.write); err != nil && err != errFinished {
+			writer.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+		if c.done {
+			break
+		}
+	}
+
+	if !c.started {
+		writer.Close()
+		os.Remove(tmp)
+		return 0, ErrNoData
+	}
+	if err := writer.Finalize(job.File); err != nil {
+		writer.Close()
+		os.Remove(tmp)
+		return 0, fmt.Errorf("finalize clip error: %v", err)
+	}
+	return c.duration, nil
+}
+
+//checkExpire 定期删除过期的剪辑任务和文件
+func (m *Manager) checkExpire() {
+	for {
+		time.Sleep(checkInterval)
+
+		var files []string
+		m.mutex.Lock()
+		for id, job := range m.jobs {
+			if time.Since(job.created) < jobExpire || job.Status == StatusPending || job.Status == StatusRunning {
+				continue
+			}
+			delete(m.jobs, id)
+			files = append(files, job.File)
+		}
+		m.mutex.Unlock()
+
+		for _, file := range files {
+			log.Infof("Clip remove expired %s", file)
+			os.Remove(file)
+		}
+	}
+}
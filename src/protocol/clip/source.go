@@ -0,0 +1,184 @@
+package clip
+
+import (
+	"av"
+	"container/flv"
+	"io"
+	"protocol/amf"
+	"sync"
+	"time"
+)
+
+//Source 按时间顺序提供音视频包, t为包对应的绝对时间
+type Source interface {
+	Read(fn func(t time.Time, p *av.Packet) error) error
+}
+
+//File 一个FLV录制文件
+type File struct {
+	File  string
+	Start time.Time //文件起始时间, 文件中的时间戳从0开始
+}
+
+type fileSource struct {
+	files []File
+}
+
+//NewFileSource 按顺序读取多个FLV录制文件
+func NewFileSource(files []File) Source {
+	return &fileSource{files: files}
+}
+
+func (s *fileSource) Read(fn func(t time.Time, p *av.Packet) error) error {
+	for _, file := range s.files {
+		if err := s.readFile(file, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSource) readFile(file File, fn func(t time.Time, p *av.Packet) error) error {
+	r, err := flv.NewFileReader(file.File)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		p, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t := file.Start.Add(time.Duration(p.TimeStamp) * time.Millisecond)
+		if err := fn(t, p); err != nil {
+			return err
+		}
+	}
+}
+
+type bufferPacket struct {
+	t time.Time
+	p av.Packet
+}
+
+//Buffer 直播最近一段时间的音视频包, 用于直播中剪辑
+type Buffer struct {
+	mutex    sync.RWMutex
+	duration time.Duration
+	packets  []bufferPacket
+	metadata *av.Packet
+	videoSeq *av.Packet
+	audioSeq *av.Packet
+
+	started  bool
+	baseTime time.Time
+	baseTs   uint32
+	lastTs   uint32
+}
+
+//NewBuffer 保存最近duration的音视频包
+func NewBuffer(duration time.Duration) *Buffer {
+	return &Buffer{
+		duration: duration,
+	}
+}
+
+//Write 加入一个音视频包, 绝对时间由第一个包的到达时间加时间戳得到
+func (b *Buffer) Write(p av.Packet) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if p.IsMetadata {
+		if name, _, err := amf.DecodeDataMessage(p.Data); err == nil && name == amf.OnMetaData {
+			b.metadata = &p
+		}
+		return
+	}
+	if isSeq(&p) {
+		if p.IsVideo {
+			b.videoSeq = &p
+		} else {
+			b.audioSeq = &p
+		}
+		return
+	}
+
+	//重新推流时时间戳从头开始
+	if !b.started || p.TimeStamp+1000 < b.lastTs {
+		b.started = true
+		b.baseTime = time.Now()
+		b.baseTs = p.TimeStamp
+		b.lastTs = p.TimeStamp
+	}
+	if p.TimeStamp > b.lastTs {
+		b.lastTs = p.TimeStamp
+	}
+	var t time.Time
+	if p.TimeStamp >= b.baseTs {
+		t = b.baseTime.Add(time.Duration(p.TimeStamp-b.baseTs) * time.Millisecond)
+	} else {
+		t = b.baseTime
+	}
+	b.packets = append(b.packets, bufferPacket{t: t, p: p})
+
+	expire := t.Add(-b.duration)
+	n := 0
+	for n < len(b.packets) && b.packets[n].t.Before(expire) {
+		n++
+	}
+	if n > 0 {
+		b.packets = b.packets[n:]
+	}
+}
+
+//Oldest 缓存中最早的包的时间
+func (b *Buffer) Oldest() time.Time {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if len(b.packets) == 0 {
+		return time.Time{}
+	}
+	return b.packets[0].t
+}
+
+//Read 读取缓存的快照, 先返回metadata和sequence header
+func (b *Buffer) Read(fn func(t time.Time, p *av.Packet) error) error {
+	b.mutex.RLock()
+	packets := b.packets
+	headers := []*av.Packet{b.metadata, b.videoSeq, b.audioSeq}
+	b.mutex.RUnlock()
+
+	if len(packets) == 0 {
+		return nil
+	}
+	for _, p := range headers {
+		if p == nil {
+			continue
+		}
+		np := *p
+		if err := fn(packets[0].t, &np); err != nil {
+			return err
+		}
+	}
+	for i := range packets {
+		np := packets[i].p
+		if err := fn(packets[i].t, &np); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSeq(p *av.Packet) bool {
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	}
+	ah, ok := p.Header.(av.AudioPacketHeader)
+	return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+}
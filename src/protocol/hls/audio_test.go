@@ -0,0 +1,102 @@
+package hls
+
+import (
+	"av"
+	"testing"
+	"time"
+)
+
+//tsAudioInfo 由TS分片得到PMT中的音频流类型, 音频PES的stream_id和PTS
+func tsAudioInfo(t *testing.T, data []byte) (byte, byte, []uint64) {
+	var streamType, sid byte
+	var pts []uint64
+	for i := 0; i+188 <= len(data); i += 188 {
+		pkt := data[i : i+188]
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		if pkt[1]&0x40 == 0 {
+			continue
+		}
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		switch pid {
+		case 0x1001:
+			//PMT, 找到PID 0x101的流
+			section := payload[1+int(payload[0]):]
+			infoLen := int(section[10]&0x0f)<<8 | int(section[11])
+			sectionLen := int(section[1]&0x0f)<<8 | int(section[2])
+			es := section[12+infoLen : 3+sectionLen-4]
+			for len(es) >= 5 {
+				esPid := int(es[1]&0x1f)<<8 | int(es[2])
+				if esPid == 0x101 {
+					streamType = es[0]
+				}
+				es = es[5+(int(es[3]&0x0f)<<8|int(es[4])):]
+			}
+		case 0x101:
+			sid = payload[3]
+			p := payload[9:14]
+			pts = append(pts, uint64(p[0]>>1&0x07)<<30|uint64(p[1])<<22|uint64(p[2]>>1)<<15|uint64(p[3])<<7|uint64(p[4]>>1))
+		}
+	}
+	if streamType == 0 {
+		t.Fatal("no audio stream in PMT")
+	}
+	return streamType, sid, pts
+}
+
+//feedAudio 写入seconds秒纯音频, frameMs为每帧时长
+func feedAudio(s *Source, seconds int, header []byte, frame []byte, frameMs float64) {
+	for i := 0; float64(i)*frameMs < float64(seconds*1000); i++ {
+		data := append(append([]byte{}, header...), frame...)
+		s.Write(&av.Packet{IsAudio: true, TimeStamp: uint32(float64(i) * frameMs), Data: data})
+	}
+}
+
+func checkAudioSegment(t *testing.T, cfg Config, header []byte, frame []byte, frameMs float64, streamType, sid byte, inc uint64) {
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	defer source.Close(nil)
+
+	feedAudio(source, 4, header, frame, frameMs)
+	for i := 0; i < 100 && len(source.GetCacheInc().Items()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	items := source.GetCacheInc().Items()
+	if len(items) < 2 {
+		t.Fatalf("segments %d", len(items))
+	}
+	typ, id, pts := tsAudioInfo(t, items[1].Data)
+	if typ != streamType || id != sid {
+		t.Fatalf("stream type 0x%x sid 0x%x", typ, id)
+	}
+	if len(pts) < 2 {
+		t.Fatalf("audio pes %d", len(pts))
+	}
+	//每个PES有cache_max_frames帧, PTS由采样数和采样率计算
+	for i := 1; i < len(pts)-1; i++ {
+		if pts[i]-pts[i-1] != inc*uint64(cache_max_frames) {
+			t.Fatalf("pts %v, want increment %d", pts, inc*uint64(cache_max_frames))
+		}
+	}
+}
+
+//MP3和AC-3纯音频流
+func TestMP3AndAC3(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3}
+
+	//MPEG-1 Layer III 128kbps 44.1kHz, 每帧417字节, 1152个采样
+	mp3 := make([]byte, 417)
+	copy(mp3, []byte{0xff, 0xfb, 0x90, 0x00})
+	checkAudioSegment(t, cfg, []byte{0x2f}, mp3, 1152.0*1000/44100, 0x03, 0xc0, 90000*1152/44100)
+
+	//MPEG-2 Layer III 64kbps 22.05kHz, 每帧576个采样
+	mp3 = make([]byte, 208)
+	copy(mp3, []byte{0xff, 0xf3, 0x80, 0x00})
+	checkAudioSegment(t, cfg, []byte{0x2f}, mp3, 576.0*1000/22050, 0x04, 0xc0, 90000*576/22050)
+
+	//AC-3 48kHz, frmsizecod 8为256字节, 每帧1536个采样, Enhanced RTMP FourCC ac-3
+	ac3 := make([]byte, 256)
+	copy(ac3, []byte{0x0b, 0x77, 0x00, 0x00, 0x08, 0x40, 0xe0})
+	checkAudioSegment(t, cfg, []byte{0x91, 'a', 'c', '-', '3'}, ac3, 32, 0x81, 0xbd, 2880)
+}
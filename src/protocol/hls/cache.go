@@ -5,11 +5,14 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
+	log "logging"
 	"sync"
 )
 
 const (
 	maxTSCacheNum = 3
+
+	dateRangeFormat = "2006-01-02T15:04:05.000Z"
 )
 
 var (
@@ -17,69 +20,301 @@ var (
 )
 
 type TSCacheItem struct {
-	id   string
-	num  int
-	lock sync.RWMutex
-	ll   *list.List
-	lm   map[string]TSItem
+	id    string
+	num   int
+	lock  sync.RWMutex
+	ll    *list.List
+	lm    map[string]TSItem
+	store *diskStore //为nil时分片保存在内存中
+	cfg   Config
+
+	mapName string //fMP4初始化分片, EXT-X-MAP
+	discSeq int    //已经离开播放列表的EXT-X-DISCONTINUITY个数
+
+	//LL-HLS
+	parts    []TSPart          //正在生成的分片中已完成的部分分片
+	partSeq  int               //正在生成的分片序号
+	partData map[string][]byte //最近的部分分片数据
+	hint     string            //下一个部分分片, EXT-X-PRELOAD-HINT
+	partKey  TSKey             //正在生成的分片的密钥
+	update   chan struct{}     //播放列表更新时关闭, 用于阻塞请求
 }
 
 func NewTSCacheItem(id string) *TSCacheItem {
 	return &TSCacheItem{
-		id:  id,
-		ll:  list.New(),
-		num: maxTSCacheNum,
-		lm:  make(map[string]TSItem),
+		id:       id,
+		ll:       list.New(),
+		num:      maxTSCacheNum,
+		lm:       make(map[string]TSItem),
+		partData: make(map[string][]byte),
+		update:   make(chan struct{}),
+	}
+}
+
+//NewTSCacheItemWithConfig 按应用配置的播放列表长度和保存目录创建
+func NewTSCacheItemWithConfig(id string, cfg Config) *TSCacheItem {
+	c := NewTSCacheItem(id)
+	c.cfg = cfg
+	if cfg.PlaylistLength > 0 {
+		c.num = cfg.PlaylistLength
+	}
+	if cfg.Dir != "" {
+		c.store = newDiskStore(cfg.Dir, cfg.Retain)
 	}
+	return c
 }
 
 func (tcCacheItem *TSCacheItem) ID() string {
 	return tcCacheItem.id
 }
 
-// TODO: found data race, fix it
 func (tcCacheItem *TSCacheItem) GenM3U8PlayList() ([]byte, error) {
-	var seq int
-	var getSeq bool
-	var maxDuration int
-	m3u8body := bytes.NewBuffer(nil)
+	return tcCacheItem.GenPlayList(false, "")
+}
+
+//GenDeltaM3U8PlayList LL-HLS的delta播放列表(_HLS_skip=YES), 跳过较早的分片
+func (tcCacheItem *TSCacheItem) GenDeltaM3U8PlayList() ([]byte, error) {
+	return tcCacheItem.GenPlayList(true, "")
+}
+
+//GenPlayList 生成播放列表, keyQuery加在密钥地址后面(如播放token)
+func (tcCacheItem *TSCacheItem) GenPlayList(delta bool, keyQuery string) ([]byte, error) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	var items []TSItem
+	maxDuration := int(tcCacheItem.cfg.SegmentDuration)
 	for e := tcCacheItem.ll.Front(); e != nil; e = e.Next() {
-		key := e.Value.(string)
-		v, ok := tcCacheItem.lm[key]
-		if ok {
+		if v, ok := tcCacheItem.lm[e.Value.(string)]; ok {
+			items = append(items, v)
 			if v.Duration > maxDuration {
 				maxDuration = v.Duration
 			}
-			if !getSeq {
-				getSeq = true
-				seq = v.SeqNum
-			}
-			fmt.Fprintf(m3u8body, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
 		}
 	}
+	targetDuration := (maxDuration + 999) / 1000
+
+	var seq, skipped int
+	if len(items) > 0 {
+		seq = items[0].SeqNum
+	}
+	lowLatency := tcCacheItem.lowLatency()
+	if lowLatency && delta {
+		skipped = skipCount(items, targetDuration*canSkipTargets)
+	}
+
 	w := bytes.NewBuffer(nil)
-	fmt.Fprintf(w,
-		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n\n",
-		maxDuration/1000+1, seq)
-	w.Write(m3u8body.Bytes())
+	if lowLatency {
+		version := 6
+		if skipped > 0 {
+			version = 9
+		}
+		partTarget := float64(tcCacheItem.cfg.PartDuration) / 1000
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", version, targetDuration)
+		fmt.Fprintf(w, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%d,PART-HOLD-BACK=%.3f\n",
+			targetDuration*canSkipTargets, partTarget*partHoldBackTargets)
+		fmt.Fprintf(w, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+		fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:%d\n%s\n", seq, tcCacheItem.discontinuitySequence())
+		if skipped > 0 {
+			fmt.Fprintf(w, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped)
+		}
+	} else if tcCacheItem.mapName != "" {
+		fmt.Fprintf(w,
+			"#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n%s#EXT-X-MAP:URI=\"%s\"\n\n",
+			targetDuration, seq, tcCacheItem.discontinuitySequence(), tcCacheItem.mapName)
+	} else {
+		//SAMPLE-AES需要版本5
+		version := 3
+		if tcCacheItem.partKey.Method == methodSampleAES {
+			version = 5
+		}
+		fmt.Fprintf(w,
+			"#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n%s\n",
+			version, targetDuration, seq, tcCacheItem.discontinuitySequence())
+	}
+
+	//密钥变化时输出EXT-X-KEY
+	var key TSKey
+	for _, v := range items[skipped:] {
+		if v.Key != key {
+			key = v.Key
+			writeKey(w, key, keyQuery)
+		}
+		if v.Discontinuity {
+			fmt.Fprintf(w, "#EXT-X-DISCONTINUITY\n")
+		}
+		if !v.StartDate.IsZero() {
+			fmt.Fprintf(w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", v.StartDate.UTC().Format(dateRangeFormat))
+		}
+		writeCueTags(w, v)
+		writeParts(w, v.Parts)
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%s\n", float64(v.Duration)/float64(1000), v.Name)
+	}
+	if lowLatency {
+		if len(tcCacheItem.parts) > 0 && tcCacheItem.partKey != key {
+			writeKey(w, tcCacheItem.partKey, keyQuery)
+		}
+		writeParts(w, tcCacheItem.parts)
+		if tcCacheItem.hint != "" {
+			fmt.Fprintf(w, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", tcCacheItem.hint)
+		}
+	}
 	return w.Bytes(), nil
 }
 
+//discontinuitySequence 有分片的EXT-X-DISCONTINUITY离开播放列表后输出EXT-X-DISCONTINUITY-SEQUENCE, 调用者持有锁
+func (tcCacheItem *TSCacheItem) discontinuitySequence() string {
+	if tcCacheItem.discSeq == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", tcCacheItem.discSeq)
+}
+
+//SetKey 设置正在生成的分片的密钥
+func (tcCacheItem *TSCacheItem) SetKey(key TSKey) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.partKey = key
+}
+
+//writeKey 输出EXT-X-KEY, 没有IV属性时IV为分片序号
+func writeKey(w *bytes.Buffer, key TSKey, query string) {
+	if key.Method == "" {
+		fmt.Fprintf(w, "#EXT-X-KEY:METHOD=NONE\n")
+		return
+	}
+	fmt.Fprintf(w, "#EXT-X-KEY:METHOD=%s,URI=\"%s%s\"", key.Method, key.URI, queryString(query))
+	if key.Method == methodSampleAES {
+		fmt.Fprintf(w, ",KEYFORMAT=\"identity\",KEYFORMATVERSIONS=\"1\"")
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+//MediaSequence 播放列表中第一个分片的序号
+func (tcCacheItem *TSCacheItem) MediaSequence() int {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	for e := tcCacheItem.ll.Front(); e != nil; e = e.Next() {
+		if v, ok := tcCacheItem.lm[e.Value.(string)]; ok {
+			return v.SeqNum
+		}
+	}
+	return 0
+}
+
+//Items 播放列表中的分片
+func (tcCacheItem *TSCacheItem) Items() []TSItem {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	items := make([]TSItem, 0, tcCacheItem.ll.Len())
+	for e := tcCacheItem.ll.Front(); e != nil; e = e.Next() {
+		if v, ok := tcCacheItem.lm[e.Value.(string)]; ok {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+//writeCueTags 输出分片的广告标记
+func writeCueTags(w *bytes.Buffer, v TSItem) {
+	cue := v.Cue
+	switch cue.Tag {
+	case cueOutTag:
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"%d\",START-DATE=\"%s\"", cue.Id, cue.StartDate.UTC().Format(dateRangeFormat))
+		if cue.Duration > 0 {
+			fmt.Fprintf(w, ",PLANNED-DURATION=%.3f", cue.Duration)
+		}
+		fmt.Fprintf(w, ",SCTE35-OUT=0x%X\n", cue.Scte35)
+		if cue.Duration > 0 {
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT:DURATION=%.3f\n", cue.Duration)
+		} else {
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT\n")
+		}
+	case cueContTag:
+		if cue.Duration > 0 {
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f,Duration=%.3f\n", cue.Elapsed, cue.Duration)
+		} else {
+			fmt.Fprintf(w, "#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f\n", cue.Elapsed)
+		}
+	case cueInTag:
+		fmt.Fprintf(w, "#EXT-X-DATERANGE:ID=\"%d\",START-DATE=\"%s\",END-DATE=\"%s\",DURATION=%.3f,SCTE35-IN=0x%X\n",
+			cue.Id, cue.StartDate.UTC().Format(dateRangeFormat), cue.EndDate.UTC().Format(dateRangeFormat), cue.Elapsed, cue.Scte35)
+		fmt.Fprintf(w, "#EXT-X-CUE-IN\n")
+	}
+}
+
 func (tcCacheItem *TSCacheItem) SetItem(key string, item TSItem) {
-	if tcCacheItem.ll.Len() == tcCacheItem.num {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	//保存在磁盘上时内存中不保留分片数据
+	if tcCacheItem.store != nil {
+		if err := tcCacheItem.store.write(key, item.Data); err != nil {
+			log.Errorf("hls write segment %s error: %v", key, err)
+			return
+		}
+		item.Data = nil
+	}
+	if tcCacheItem.ll.Len() >= tcCacheItem.num {
 		e := tcCacheItem.ll.Front()
 		tcCacheItem.ll.Remove(e)
 		k := e.Value.(string)
+		tcCacheItem.removeParts(tcCacheItem.lm[k].Parts)
+		if tcCacheItem.lm[k].Discontinuity {
+			tcCacheItem.discSeq++
+		}
 		delete(tcCacheItem.lm, k)
+		if tcCacheItem.store != nil {
+			tcCacheItem.store.evict(k)
+		}
+	}
+	if tcCacheItem.lowLatency() {
+		tcCacheItem.finishParts(&item)
 	}
 	tcCacheItem.lm[key] = item
 	tcCacheItem.ll.PushBack(key)
+	tcCacheItem.notify()
 }
 
+//GetItem 得到分片, 保存在磁盘上时离开播放列表但还没有删除的分片也可以读取
 func (tcCacheItem *TSCacheItem) GetItem(key string) (TSItem, error) {
+	tcCacheItem.lock.RLock()
+	defer tcCacheItem.lock.RUnlock()
+
+	if data, ok := tcCacheItem.partData[key]; ok {
+		return TSItem{Name: key, Data: data}, nil
+	}
 	item, ok := tcCacheItem.lm[key]
-	if !ok {
+	if tcCacheItem.store == nil {
+		if !ok {
+			return item, ErrNoKey
+		}
+		return item, nil
+	}
+
+	data, err := tcCacheItem.store.read(key)
+	if err != nil {
 		return item, ErrNoKey
 	}
+	item.Name = key
+	item.Data = data
 	return item, nil
 }
+
+//Clear 流结束时删除磁盘上的分片
+func (tcCacheItem *TSCacheItem) Clear() {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	if tcCacheItem.store == nil {
+		return
+	}
+	names := make([]string, 0, len(tcCacheItem.lm))
+	for name := range tcCacheItem.lm {
+		names = append(names, name)
+	}
+	tcCacheItem.store.clear(names)
+}
@@ -0,0 +1,76 @@
+package hls
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePlaylist(t *testing.T) {
+	cache := NewTSCacheItemWithConfig("live/test", Config{PlaylistLength: 2})
+	session := time.Date(2020, 6, 11, 10, 0, 0, 0, time.UTC)
+	for seq := 1; seq <= 3; seq++ {
+		name := segmentName("live/test", session, seq)
+		item := NewTSItem(name, 2500, seq, []byte{byte(seq)})
+		item.StartDate = session.Add(time.Duration(seq) * 2500 * time.Millisecond)
+		cache.SetItem(name, item)
+	}
+
+	body, err := cache.GenM3U8PlayList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:2\n\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2020-06-11T10:00:05.000Z\n#EXTINF:2.500,\n/live/test/20200611100000-2.ts\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2020-06-11T10:00:07.500Z\n#EXTINF:2.500,\n/live/test/20200611100000-3.ts\n"
+	if string(body) != want {
+		t.Fatalf("playlist:\n%s", body)
+	}
+	if _, err := cache.GetItem("/live/test/20200611100000-1.ts"); err != ErrNoKey {
+		t.Fatal("evicted segment still in memory")
+	}
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewTSCacheItemWithConfig("live/test", Config{PlaylistLength: 2, Dir: dir, Retain: 1})
+	session := time.Now()
+	var names []string
+	for seq := 1; seq <= 4; seq++ {
+		name := segmentName("live/test", session, seq)
+		names = append(names, name)
+		cache.SetItem(name, NewTSItem(name, 3000, seq, []byte{byte(seq)}))
+	}
+
+	//播放列表中2个, 离开播放列表后保留1个
+	for i, name := range names {
+		item, err := cache.GetItem(name)
+		if i == 0 {
+			if err == nil {
+				t.Fatalf("segment %s not removed", name)
+			}
+			continue
+		}
+		if err != nil || len(item.Data) != 1 || item.Data[0] != byte(i+1) {
+			t.Fatalf("segment %s data %v err %v", name, item.Data, err)
+		}
+	}
+	body, _ := cache.GenM3U8PlayList()
+	if strings.Contains(string(body), names[1]) || !strings.Contains(string(body), names[3]) {
+		t.Fatalf("playlist:\n%s", body)
+	}
+
+	cache.Clear()
+	for _, name := range names {
+		if _, err := os.Stat(cache.store.file(name)); !os.IsNotExist(err) {
+			t.Fatalf("segment %s not cleared", name)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+//suggestedPresentationDelay为3倍目标时长
+const mpdDelayTargets = 3
+
+//CMAFCache fMP4(CMAF)分片, HLS播放列表(EXT-X-MAP)和DASH MPD使用相同的分片
+type CMAFCache struct {
+	*TSCacheItem
+	init       []byte    //初始化分片ftyp+moov
+	initName   string    //初始化分片名称
+	media      string    //媒体分片名称模板, 序号为$Number$
+	codecs     string    //RFC 6381编码
+	width      int       //视频宽
+	height     int       //视频高
+	sampleRate int       //音频采样率
+	start      time.Time //时间戳0对应的时间, MPD的availabilityStartTime
+}
+
+//NewCMAFCache 部分分片只用于TS, fMP4分片不开启LL-HLS
+func NewCMAFCache(id string, session time.Time, cfg Config) *CMAFCache {
+	cfg.PartDuration = 0
+	return &CMAFCache{
+		TSCacheItem: NewTSCacheItemWithConfig(id, cfg),
+		initName:    fmp4InitName(id, session),
+		media:       fmp4MediaTemplate(id, session),
+	}
+}
+
+//SetInit 设置初始化分片, 第一个媒体分片完成时调用
+//start为时间戳0对应的时间
+func (c *CMAFCache) SetInit(data []byte, codecs string, width, height, sampleRate int, start time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.init = data
+	c.mapName = c.initName
+	c.codecs = codecs
+	c.width, c.height = width, height
+	c.sampleRate = sampleRate
+	c.start = start
+}
+
+//HasInit 是否已经生成初始化分片
+func (c *CMAFCache) HasInit() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.init != nil
+}
+
+//GetItem 得到初始化分片或媒体分片
+func (c *CMAFCache) GetItem(key string) (TSItem, error) {
+	c.lock.RLock()
+	if c.init != nil && key == c.initName {
+		item := TSItem{Name: key, Data: c.init}
+		c.lock.RUnlock()
+		return item, nil
+	}
+	c.lock.RUnlock()
+	return c.TSCacheItem.GetItem(key)
+}
+
+//GenMPD 生成动态MPEG-DASH MPD, 使用SegmentTemplate和SegmentTimeline
+//音视频在同一个Representation中
+func (c *CMAFCache) GenMPD() ([]byte, error) {
+	items := c.Items()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.init == nil || len(items) == 0 {
+		return nil, ErrNoKey
+	}
+
+	var duration, size int
+	maxDuration := int(c.cfg.SegmentDuration)
+	for _, v := range items {
+		duration += v.Duration
+		size += v.Size
+		if v.Duration > maxDuration {
+			maxDuration = v.Duration
+		}
+	}
+	target := float64((maxDuration+999)/1000*1000) / 1000
+	bandwidth := 0
+	if duration > 0 {
+		bandwidth = size * 8 * 1000 / duration
+	}
+
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+	fmt.Fprintf(w, " availabilityStartTime=\"%s\" publishTime=\"%s\"", c.start.UTC().Format(dateRangeFormat), time.Now().UTC().Format(dateRangeFormat))
+	fmt.Fprintf(w, " minimumUpdatePeriod=\"PT%.3fS\" minBufferTime=\"PT%.3fS\"", target, target)
+	fmt.Fprintf(w, " timeShiftBufferDepth=\"PT%.3fS\" suggestedPresentationDelay=\"PT%.3fS\">\n",
+		float64(duration)/1000, target*mpdDelayTargets)
+	fmt.Fprintf(w, "\t<Period id=\"0\" start=\"PT0S\">\n")
+
+	mimeType := "video/mp4"
+	if c.width == 0 {
+		mimeType = "audio/mp4"
+	}
+	fmt.Fprintf(w, "\t\t<AdaptationSet mimeType=\"%s\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", mimeType)
+	fmt.Fprintf(w, "\t\t\t<Representation id=\"0\" codecs=\"%s\" bandwidth=\"%d\"", c.codecs, bandwidth)
+	if c.width > 0 {
+		fmt.Fprintf(w, " width=\"%d\" height=\"%d\"", c.width, c.height)
+	}
+	if c.sampleRate > 0 {
+		fmt.Fprintf(w, " audioSamplingRate=\"%d\"", c.sampleRate)
+	}
+	fmt.Fprintf(w, ">\n")
+	fmt.Fprintf(w, "\t\t\t\t<SegmentTemplate timescale=\"1000\" initialization=\"%s\" media=\"%s\" startNumber=\"%d\">\n",
+		c.initName, c.media, items[0].SeqNum)
+	fmt.Fprintf(w, "\t\t\t\t\t<SegmentTimeline>\n")
+	for _, v := range items {
+		fmt.Fprintf(w, "\t\t\t\t\t\t<S t=\"%d\" d=\"%d\"/>\n", v.Timestamp, v.Duration)
+	}
+	fmt.Fprintf(w, "\t\t\t\t\t</SegmentTimeline>\n")
+	fmt.Fprintf(w, "\t\t\t\t</SegmentTemplate>\n")
+	fmt.Fprintf(w, "\t\t\t</Representation>\n")
+	fmt.Fprintf(w, "\t\t</AdaptationSet>\n")
+	fmt.Fprintf(w, "\t</Period>\n")
+	fmt.Fprintf(w, "</MPD>\n")
+	return w.Bytes(), nil
+}
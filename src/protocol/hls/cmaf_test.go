@@ -0,0 +1,122 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMPD struct {
+	Type           string `xml:"type,attr"`
+	Representation struct {
+		Codecs          string `xml:"codecs,attr"`
+		Width           int    `xml:"width,attr"`
+		SegmentTemplate struct {
+			Initialization string `xml:"initialization,attr"`
+			Media          string `xml:"media,attr"`
+			StartNumber    int    `xml:"startNumber,attr"`
+			S              []struct {
+				T int `xml:"t,attr"`
+				D int `xml:"d,attr"`
+			} `xml:"SegmentTimeline>S"`
+		}
+	} `xml:"Period>AdaptationSet>Representation"`
+}
+
+var mapRegexp = regexp.MustCompile(`#EXT-X-MAP:URI="([^"]+)"`)
+var m4sRegexp = regexp.MustCompile(`(/live/test/[0-9]+-[0-9]+\.m4s)\n`)
+
+//fMP4分片同时提供HLS和DASH
+func TestCMAF(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, Fmp4: true}
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	defer source.Close(nil)
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set("live/test", source)
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	feedSource(source, 5, 0)
+	//等待发送协程处理完
+	for i := 0; i < 100 && len(source.GetCMAFCache().Items()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, body := get(t, ts.URL+"/live/test.cmaf.m3u8")
+	if code != http.StatusOK {
+		t.Fatalf("cmaf playlist status %d %s", code, body)
+	}
+	if !strings.Contains(body, "#EXT-X-VERSION:7") {
+		t.Fatalf("cmaf playlist version:\n%s", body)
+	}
+	m := mapRegexp.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("cmaf playlist without EXT-X-MAP:\n%s", body)
+	}
+	code, init := get(t, ts.URL+m[1])
+	if code != http.StatusOK || init[4:8] != "ftyp" || !strings.Contains(init, "moov") {
+		t.Fatalf("init segment %s status %d", m[1], code)
+	}
+	segments := m4sRegexp.FindAllStringSubmatch(body, -1)
+	if len(segments) == 0 {
+		t.Fatalf("cmaf playlist without segments:\n%s", body)
+	}
+	for _, segment := range segments {
+		code, data := get(t, ts.URL+segment[1])
+		if code != http.StatusOK || data[4:8] != "moof" {
+			t.Fatalf("segment %s status %d", segment[1], code)
+		}
+	}
+
+	//DASH使用相同的分片
+	code, body = get(t, ts.URL+"/live/test.mpd")
+	if code != http.StatusOK {
+		t.Fatalf("mpd status %d %s", code, body)
+	}
+	var mpd testMPD
+	if err := xml.Unmarshal([]byte(body), &mpd); err != nil {
+		t.Fatal(err)
+	}
+	rep := mpd.Representation
+	if mpd.Type != "dynamic" || rep.Codecs != "avc1.42c01e" || rep.Width != 640 {
+		t.Fatalf("mpd:\n%s", body)
+	}
+	tmpl := rep.SegmentTemplate
+	if tmpl.Initialization != m[1] || len(tmpl.S) != len(segments) {
+		t.Fatalf("mpd segment template:\n%s", body)
+	}
+	first := strings.Replace(tmpl.Media, "$Number$", "1", 1)
+	if tmpl.StartNumber != 1 || first != segments[0][1] {
+		t.Fatalf("mpd media %s start %d, playlist %s", tmpl.Media, tmpl.StartNumber, segments[0][1])
+	}
+	for i := 1; i < len(tmpl.S); i++ {
+		if tmpl.S[i].T != tmpl.S[i-1].T+tmpl.S[i-1].D {
+			t.Fatalf("mpd timeline not continuous:\n%s", body)
+		}
+	}
+
+	//CORS
+	resp, err := http.Get(ts.URL + "/live/test.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal("mpd without CORS header")
+	}
+	if code, _ := get(t, ts.URL+"/crossdomain.xml"); code != http.StatusOK {
+		t.Fatalf("crossdomain.xml status %d", code)
+	}
+
+	//没有开启fMP4
+	if code, _ := get(t, ts.URL+"/live/other.mpd"); code != http.StatusForbidden {
+		t.Fatalf("unknown stream mpd status %d", code)
+	}
+}
@@ -0,0 +1,131 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//waitSeq 等待播放列表中最后一个分片的序号达到seq
+func waitSeq(t *testing.T, s *Source, seq int) []TSItem {
+	for i := 0; i < 200; i++ {
+		items := s.GetCacheInc().Items()
+		if len(items) > 0 && items[len(items)-1].SeqNum >= seq {
+			return items
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("wait segment %d timeout", seq)
+	return nil
+}
+
+//重新推流时分片序号连续, 不连续的分片前插入EXT-X-DISCONTINUITY
+func TestRepublishContinuity(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, RepublishGrace: time.Minute}
+	first := NewSource(av.Info{Key: "live/test"}, cfg)
+	feedSource(first, 5, 0)
+	waitSeq(t, first, 2)
+	first.Close(nil)
+	if first.expired(time.Now()) || first.GetCacheInc() == nil {
+		t.Fatal("playlist dropped within republish grace")
+	}
+
+	source := newSource(av.Info{Key: "live/test"}, cfg, first)
+	defer source.Close(nil)
+	feedSource(source, 5, 0)
+	items := waitSeq(t, source, 4)
+	if len(items) != 3 || items[0].SeqNum != 2 {
+		t.Fatalf("playlist after republish starts at %d", items[0].SeqNum)
+	}
+	for _, item := range items {
+		if item.Discontinuity != (item.SeqNum == 3) {
+			t.Fatalf("segment %d discontinuity %v", item.SeqNum, item.Discontinuity)
+		}
+	}
+	body, _ := source.GetCacheInc().GenM3U8PlayList()
+	playlist := string(body)
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:2\n") || strings.Count(playlist, "#EXT-X-DISCONTINUITY\n") != 1 ||
+		strings.Contains(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE") {
+		t.Fatalf("playlist after republish:\n%s", playlist)
+	}
+
+	//分辨率变化: 新的sequence header之后的关键帧立即切片
+	sps := append([]byte(nil), testSPS...)
+	sps[len(sps)-1] = 0x40
+	avcc := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, byte(len(sps))}
+	avcc = append(avcc, sps...)
+	avcc = append(avcc, 0x01, 0x00, 0x02, 0x68, 0xce)
+	source.Write(&av.Packet{IsVideo: true, TimeStamp: 5000, Data: avcc})
+	for i := 0; i < 75; i++ {
+		data := []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}
+		if i%25 == 0 {
+			data = []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}
+		}
+		source.Write(&av.Packet{IsVideo: true, TimeStamp: uint32(5000 + i*40), Data: data})
+	}
+	items = waitSeq(t, source, 6)
+	if items[1].SeqNum != 5 || items[1].Duration >= 1000 || items[1].Discontinuity || !items[2].Discontinuity {
+		t.Fatalf("segment %d duration %d after sequence header change", items[1].SeqNum, items[1].Duration)
+	}
+
+	//不连续的分片离开播放列表后输出EXT-X-DISCONTINUITY-SEQUENCE
+	body, _ = source.GetCacheInc().GenM3U8PlayList()
+	playlist = string(body)
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:4\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n") {
+		t.Fatalf("playlist without discontinuity sequence:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME") {
+		t.Fatalf("playlist without discontinuity:\n%s", playlist)
+	}
+}
+
+//之前的Source没有发送结束时, 重新推流不阻塞发布者, 超时后使用新的播放列表
+//同时推流时只创建一个Source
+func TestRepublishHandover(t *testing.T) {
+	defer func(d time.Duration) { handoverTimeout = d }(handoverTimeout)
+	handoverTimeout = 100 * time.Millisecond
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	info := av.Info{Key: "live/test"}
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3}
+	prev := &Source{info: info, cfg: cfg, closed: true, done: make(chan struct{})}
+	prev.tsCache, prev.audioTsCache = newTsCaches(info, cfg)
+	server.conns.Set(streamKey(info.Key), prev)
+
+	var wg sync.WaitGroup
+	writers := make(chan *Source, 10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writers <- server.GetWriter(info).(*Source)
+		}()
+	}
+	wg.Wait()
+	close(writers)
+	if time.Since(start) >= handoverTimeout {
+		t.Fatal("GetWriter blocked by previous source")
+	}
+	source := server.getConn(info.Key)
+	for s := range writers {
+		if s != source {
+			t.Fatal("more than one source created")
+		}
+	}
+	defer source.Close(nil)
+
+	//接管之前显示之前的播放列表
+	if source.GetCacheInc() != prev.tsCache {
+		t.Fatal("previous playlist not kept before handover")
+	}
+	//应用的配置: 3秒一个分片
+	feedSource(source, 10, 0)
+	items := waitSeq(t, source, 2)
+	if source.GetCacheInc() == prev.tsCache || items[0].SeqNum != 1 || prev.isReleased() {
+		t.Fatalf("new playlist starts at %d", items[0].SeqNum)
+	}
+}
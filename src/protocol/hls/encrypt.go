@@ -0,0 +1,167 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+)
+
+const (
+	//SAMPLE-AES: NAL单元前32字节不加密, 之后每10个16字节块加密1个
+	nalClearLeader  = 32
+	nalMinLen       = 48
+	nalCryptBlocks  = 1
+	nalSkipBlocks   = 9
+	aacClearLeader  = 16
+	adtsHeaderLen   = 7
+	naluTypeSlice   = 1
+	naluTypeIDR     = 5
+	aesBlockSize    = aes.BlockSize
+	adtsProtectFlag = 0x01
+)
+
+//TSKey 分片的EXT-X-KEY
+type TSKey struct {
+	Method string //AES-128或SAMPLE-AES, 为空表示不加密
+	URI    string
+}
+
+//segmentIV 没有IV属性时, IV为分片序号
+func segmentIV(seq int) []byte {
+	iv := make([]byte, aesBlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+//encryptSegment AES-128加密整个分片, PKCS7填充
+func encryptSegment(key []byte, seq int, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aesBlockSize - len(data)%aesBlockSize
+	out := make([]byte, len(data)+padding)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, segmentIV(seq)).CryptBlocks(out, out)
+	return out, nil
+}
+
+//sampleEncryptH264 SAMPLE-AES加密Annex B格式的H.264帧
+//只加密长度超过48字节的slice NAL单元, 加密后重新加入防竞争字节
+func sampleEncryptH264(block cipher.Block, iv []byte, data []byte) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+64))
+	for len(data) > 0 {
+		start, next := nextNalu(data)
+		out.Write(data[:start])
+		nalu := data[start:next]
+		data = data[next:]
+
+		if len(nalu) == 0 {
+			continue
+		}
+		typ := nalu[0] & 0x1f
+		if typ != naluTypeSlice && typ != naluTypeIDR {
+			out.Write(nalu)
+			continue
+		}
+		raw := unescapeNalu(nalu)
+		if len(raw) <= nalMinLen {
+			out.Write(nalu)
+			continue
+		}
+		mode := cipher.NewCBCEncrypter(block, iv)
+		for pos := nalClearLeader; pos+aesBlockSize <= len(raw); pos += aesBlockSize * (nalCryptBlocks + nalSkipBlocks) {
+			b := raw[pos : pos+aesBlockSize]
+			mode.CryptBlocks(b, b)
+		}
+		out.Write(escapeNalu(raw))
+	}
+	return out.Bytes()
+}
+
+//nextNalu 得到第一个NAL单元在data中的起始位置和结束位置(下一个起始码的位置)
+func nextNalu(data []byte) (int, int) {
+	start := 0
+	if n := startCodeLen(data); n > 0 {
+		start = n
+	} else {
+		//没有起始码时整个数据作为一个单元
+		return 0, len(data)
+	}
+	for i := start; i+3 <= len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && (data[i+2] == 1 || (data[i+2] == 0 && i+3 < len(data) && data[i+3] == 1)) {
+			return start, i
+		}
+	}
+	return start, len(data)
+}
+
+func startCodeLen(data []byte) int {
+	if len(data) >= 3 && data[0] == 0 && data[1] == 0 && data[2] == 1 {
+		return 3
+	}
+	if len(data) >= 4 && data[0] == 0 && data[1] == 0 && data[2] == 0 && data[3] == 1 {
+		return 4
+	}
+	return 0
+}
+
+//unescapeNalu 去掉防竞争字节 00 00 03
+func unescapeNalu(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+//escapeNalu 加入防竞争字节, 00 00后面是00-03时插入03
+func escapeNalu(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+	for _, b := range raw {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+//sampleEncryptAAC SAMPLE-AES加密一个ADTS帧
+//ADTS头和之后的16字节不加密, 最后不足16字节的部分不加密
+func sampleEncryptAAC(block cipher.Block, iv []byte, frame []byte) []byte {
+	header := adtsHeaderLen
+	if len(frame) > 1 && frame[1]&adtsProtectFlag == 0 {
+		header += 2
+	}
+	out := make([]byte, len(frame))
+	copy(out, frame)
+	start := header + aacClearLeader
+	if len(out) < start+aesBlockSize {
+		return out
+	}
+	end := start + (len(out)-start)/aesBlockSize*aesBlockSize
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[start:end], out[start:end])
+	return out
+}
@@ -0,0 +1,224 @@
+package hls
+
+import (
+	"av"
+	"bytes"
+	cmap "concurrent-map"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var keyRegexp = regexp.MustCompile(`#EXT-X-KEY:METHOD=([A-Z0-9-]+),URI="([^"]+)"`)
+var encryptedTsRegexp = regexp.MustCompile(`(/live/test/[0-9]+-([0-9]+)\.ts)\n`)
+
+func newEncryptServer(t *testing.T, cfg Config) (*Source, *httptest.Server) {
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set("live/test", source)
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+
+	feedSource(source, 6, 0)
+	for i := 0; i < 100 && len(source.GetCacheInc().Items()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return source, ts
+}
+
+//AES-128加密分片, 密钥地址需要播放token
+func TestEncryptAES128(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlskeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, EncryptMethod: methodAES128, KeyDir: dir, TokenSecret: "secret"}
+	source, ts := newEncryptServer(t, cfg)
+	defer source.Close(nil)
+	defer ts.Close()
+
+	if code, _ := get(t, ts.URL+"/live/test.m3u8"); code != http.StatusForbidden {
+		t.Fatalf("playlist without token status %d", code)
+	}
+	expired := PlayToken("secret", "live/test", time.Now().Add(-time.Minute))
+	if code, _ := get(t, ts.URL+"/live/test.m3u8?token="+expired); code != http.StatusForbidden {
+		t.Fatalf("playlist with expired token status %d", code)
+	}
+	token := PlayToken("secret", "live/test", time.Now().Add(time.Minute))
+	code, body := get(t, ts.URL+"/live/test.m3u8?token="+token)
+	if code != http.StatusOK {
+		t.Fatalf("playlist status %d %s", code, body)
+	}
+	m := keyRegexp.FindStringSubmatch(body)
+	if m == nil || m[1] != methodAES128 {
+		t.Fatalf("playlist without EXT-X-KEY:\n%s", body)
+	}
+	keyURL := ts.URL + m[2]
+	if code, _ := get(t, keyURL[:len(keyURL)-len(token)]+"x"); code != http.StatusForbidden {
+		t.Fatalf("key with invalid token status %d", code)
+	}
+	code, key := get(t, keyURL)
+	if code != http.StatusOK || len(key) != keyLen {
+		t.Fatalf("key %s status %d len %d", m[2], code, len(key))
+	}
+
+	segment := encryptedTsRegexp.FindStringSubmatch(body)
+	if segment == nil {
+		t.Fatalf("playlist without segments:\n%s", body)
+	}
+	code, data := get(t, ts.URL+segment[1])
+	if code != http.StatusOK || len(data)%aes.BlockSize != 0 {
+		t.Fatalf("segment %s status %d len %d", segment[1], code, len(data))
+	}
+	if data[0] == 0x47 && data[188] == 0x47 {
+		t.Fatalf("segment %s not encrypted", segment[1])
+	}
+	seq, _ := strconv.Atoi(segment[2])
+	block, _ := aes.NewCipher([]byte(key))
+	plain := []byte(data)
+	cipher.NewCBCDecrypter(block, segmentIV(seq)).CryptBlocks(plain, plain)
+	padding := int(plain[len(plain)-1])
+	plain = plain[:len(plain)-padding]
+	if len(plain)%188 != 0 || plain[0] != 0x47 || plain[188] != 0x47 {
+		t.Fatalf("decrypted segment %s len %d", segment[1], len(plain))
+	}
+
+	//其它推流的密钥
+	if code, _ := get(t, ts.URL+"/live/test/20000101000000-key-0.key?token="+token); code != http.StatusNotFound {
+		t.Fatalf("other session key status %d", code)
+	}
+}
+
+//流名称带大写字母时, 播放列表中的密钥地址使用发布者的流名称, 可以得到密钥
+func TestEncryptMixedCaseKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlskeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const publisher = "live/01/12/Camera_1"
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, EncryptMethod: methodSampleAES, KeyDir: dir, TokenSecret: "secret"}
+	source := NewSource(av.Info{Key: publisher}, cfg)
+	defer source.Close(nil)
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set(streamKey(publisher), source)
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+	feedSource(source, 4, 0)
+	for i := 0; i < 100 && len(source.GetCacheInc().Items()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	token := PlayToken("secret", publisher, time.Now().Add(time.Minute))
+	code, body := get(t, ts.URL+"/"+publisher+".m3u8?token="+token)
+	m := keyRegexp.FindStringSubmatch(body)
+	if code != http.StatusOK || m == nil || m[1] != methodSampleAES {
+		t.Fatalf("playlist status %d:\n%s", code, body)
+	}
+	if !strings.HasPrefix(m[2], "/"+publisher+"/") {
+		t.Fatalf("key uri %s", m[2])
+	}
+	code, key := get(t, ts.URL+m[2])
+	name := strings.TrimSuffix(path.Base(strings.SplitN(m[2], "?", 2)[0]), ".key")
+	want, _ := NewFileKeyProvider(dir).Key(publisher, name)
+	if code != http.StatusOK || !bytes.Equal([]byte(key), want) {
+		t.Fatalf("key %s status %d", m[2], code)
+	}
+}
+
+//每个分片更换密钥, 使用HTTP密钥服务
+func TestEncryptKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlskeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	provider := NewFileKeyProvider(dir)
+	service := httptest.NewServer(KeyServiceHandler(provider))
+	defer service.Close()
+
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, EncryptMethod: methodAES128, KeyRotate: 1, KeyService: service.URL}
+	source, ts := newEncryptServer(t, cfg)
+	defer source.Close(nil)
+	defer ts.Close()
+
+	_, body := get(t, ts.URL+"/live/test.m3u8")
+	keys := keyRegexp.FindAllStringSubmatch(body, -1)
+	segments := encryptedTsRegexp.FindAllStringSubmatch(body, -1)
+	if len(segments) < 2 || len(keys) != len(segments) {
+		t.Fatalf("playlist keys %d segments %d:\n%s", len(keys), len(segments), body)
+	}
+	for i, m := range keys {
+		code, key := get(t, ts.URL+m[2])
+		if code != http.StatusOK || len(key) != keyLen {
+			t.Fatalf("key %s status %d", m[2], code)
+		}
+		if i > 0 && m[2] == keys[i-1][2] {
+			t.Fatalf("key not rotated:\n%s", body)
+		}
+		//与密钥服务的密钥相同
+		name := m[2][len("/live/test/") : len(m[2])-len(".key")]
+		want, _ := provider.Key("live/test", name)
+		if !bytes.Equal([]byte(key), want) {
+			t.Fatalf("key %s differs from key service", m[2])
+		}
+	}
+}
+
+//SAMPLE-AES: 只加密slice数据和AAC帧的部分块
+func TestSampleEncrypt(t *testing.T) {
+	key := make([]byte, keyLen)
+	block, _ := aes.NewCipher(key)
+	iv := segmentIV(3)
+
+	nalu := []byte{0x65}
+	for i := 0; len(nalu) < 400; i++ {
+		nalu = append(nalu, byte(i%200+1))
+	}
+	sps := []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x00, 0x1e}
+	frame := append(append(append([]byte{}, sps...), 0x00, 0x00, 0x00, 0x01), nalu...)
+	out := sampleEncryptH264(block, iv, frame)
+	if !bytes.Equal(out[:len(sps)+4+nalClearLeader], frame[:len(sps)+4+nalClearLeader]) {
+		t.Fatal("sps or slice leader encrypted")
+	}
+	start, next := nextNalu(out[len(sps):])
+	raw := unescapeNalu(out[len(sps)+start : len(sps)+next])
+	if len(raw) != len(nalu) || bytes.Equal(raw, nalu) {
+		t.Fatalf("slice not encrypted, len %d", len(raw))
+	}
+	mode := cipher.NewCBCDecrypter(block, iv)
+	for pos := nalClearLeader; pos+aes.BlockSize <= len(raw); pos += aes.BlockSize * (nalCryptBlocks + nalSkipBlocks) {
+		b := raw[pos : pos+aes.BlockSize]
+		mode.CryptBlocks(b, b)
+	}
+	if !bytes.Equal(raw, nalu) {
+		t.Fatal("slice decrypt error")
+	}
+
+	//ADTS没有CRC
+	adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x00, 0x1f, 0xfc}
+	for i := 0; i < 60; i++ {
+		adts = append(adts, byte(i))
+	}
+	out = sampleEncryptAAC(block, iv, adts)
+	clear := adtsHeaderLen + aacClearLeader
+	end := clear + (len(adts)-clear)/aes.BlockSize*aes.BlockSize
+	if !bytes.Equal(out[:clear], adts[:clear]) || !bytes.Equal(out[end:], adts[end:]) || bytes.Equal(out[clear:end], adts[clear:end]) {
+		t.Fatal("aac encrypt range error")
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out[clear:end], out[clear:end])
+	if !bytes.Equal(out, adts) {
+		t.Fatal("aac decrypt error")
+	}
+}
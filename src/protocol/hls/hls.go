@@ -3,42 +3,55 @@ package hls
 import (
 	"av"
 	cmap "concurrent-map"
+	"configure"
 	"errors"
 	"fmt"
 	log "logging"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	duration = 3000
-)
-
 var (
 	ErrNoPublisher         = errors.New("No publisher")
 	ErrInvalidReq          = errors.New("invalid req url path")
 	ErrNoSupportVideoCodec = errors.New("no support video codec")
 	ErrNoSupportAudioCodec = errors.New("no support audio codec")
+	ErrKicked              = errors.New("hls session kicked")
+	ErrNotReady            = errors.New("hls segment not ready")
 )
 
+//fMP4播放列表的后缀, key.cmaf.m3u8
+const cmafSuffix = ".cmaf"
+
 var crossdomainxml = []byte(`<?xml version="1.0" ?>
 <cross-domain-policy>
 	<allow-access-from domain="*" />
 	<allow-http-request-headers-from domain="*" headers="*"/>
 </cross-domain-policy>`)
 
+//ActivateFunc 按需切片时向流的发布者添加HLS写入, 没有发布者时返回false
+type ActivateFunc func(key string) bool
+
 type Server struct {
-	listener net.Listener
-	conns    cmap.ConcurrentMap
+	listener     net.Listener
+	conns        cmap.ConcurrentMap
+	bandwidth    BandwidthFunc //主播放列表中的码率
+	sessions     *sessions     //观看会话
+	activate     ActivateFunc  //请求的流没有切片时开始切片
+	activateLock sync.Mutex
+	writerLock   sync.Mutex //创建Source, 在activateLock之后获取
 }
 
 func NewServer() *Server {
 	ret := &Server{
-		conns: cmap.New(),
+		conns:    cmap.New(),
+		sessions: newSessions(),
 	}
 	go ret.checkStop()
 	return ret
@@ -58,41 +71,113 @@ func (server *Server) GetListener() net.Listener {
 	return server.listener
 }
 
+//SetBandwidthFunc 设置得到发布者码率的方法
+func (server *Server) SetBandwidthFunc(fn BandwidthFunc) {
+	server.bandwidth = fn
+}
+
+//SetActivateFunc 设置按需开始切片的方法
+func (server *Server) SetActivateFunc(fn ActivateFunc) {
+	server.activate = fn
+}
+
+//GetOnDemandWriter 按需切片的写入, 超过IdleTimeout没有请求时停止
+func (server *Server) GetOnDemandWriter(info av.Info) av.WriteCloser {
+	s := server.GetWriter(info).(*Source)
+	s.setOnDemand()
+	return s
+}
+
 func (server *Server) GetWriter(info av.Info) av.WriteCloser {
-	var s *Source
-	ok := server.conns.Has(info.Key)
-	if !ok {
-		log.Info("new hls source")
-		s = NewSource(info)
-		server.conns.Set(info.Key, s)
-	} else {
-		v, _ := server.conns.Get(info.Key)
-		s = v.(*Source)
+	//同时推流时只创建一个Source, 接管之前的播放列表在Source的发送协程中进行, 这里不会阻塞
+	server.writerLock.Lock()
+	defer server.writerLock.Unlock()
+
+	prev := server.getConn(info.Key)
+	if prev != nil && !prev.isClosed() {
+		return prev
 	}
+	log.Info("new hls source")
+	//推流断开后在RepublishGrace之内重新推流, 继续之前的播放列表
+	s := newSource(info, NewConfig(configure.GetHlsInfo(appName(info.Key))), prev)
+	server.conns.Set(streamKey(info.Key), s)
 	return s
 }
 
+//appName 流名称中的应用名称 live/01/12/Camera_1 -> live
+func appName(key string) string {
+	if index := strings.Index(key, "/"); index > 0 {
+		return key[:index]
+	}
+	return key
+}
+
+//streamKey HLS服务中流的名称, 发布者的流名称和请求地址都转换为小写后查找
+//live/01/12/Camera_1 -> live/01/12/camera_1
+func streamKey(key string) string {
+	return strings.ToLower(strings.Trim(key, "/"))
+}
+
 func (server *Server) getConn(key string) *Source {
-	v, ok := server.conns.Get(key)
+	v, ok := server.conns.Get(streamKey(key))
 	if !ok {
 		return nil
 	}
 	return v.(*Source)
 }
 
+//activateConn 请求的流没有切片时向发布者添加HLS写入, 没有发布者时返回nil
+func (server *Server) activateConn(key string) *Source {
+	if server.activate == nil {
+		return nil
+	}
+	server.activateLock.Lock()
+	defer server.activateLock.Unlock()
+
+	if conn := server.getConn(key); conn != nil {
+		return conn
+	}
+	if !server.activate(key) {
+		return nil
+	}
+	log.Info("hls activate: ", key)
+	return server.getConn(key)
+}
+
 func (server *Server) checkStop() {
 	for {
 		<-time.After(5 * time.Second)
+		now := time.Now()
 		for item := range server.conns.IterBuffered() {
 			v := item.Val.(*Source)
-			if !v.Alive() {
+			if v.idle(now) {
+				v.stop()
+				if server.getConn(item.Key) == v {
+					server.conns.Remove(item.Key)
+				}
+				continue
+			}
+			if v.expired(now) {
 				log.Info("check stop and remove: ", v.Info())
-				server.conns.Remove(item.Key)
+				if server.getConn(item.Key) == v {
+					server.conns.Remove(item.Key)
+				}
 			}
 		}
+		server.sessions.expire(time.Now())
 	}
 }
 
+//Sessions 正在观看的HLS会话
+func (server *Server) Sessions() []SessionStat {
+	return server.sessions.stats()
+}
+
+//KickSessions 踢出流的观看会话, id为空时踢出流的所有会话, 过期之前的请求返回403
+func (server *Server) KickSessions(key string, id string) int {
+	return server.sessions.kick(key, id)
+}
+
 func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 	if path.Base(r.URL.Path) == "crossdomain.xml" {
 		w.Header().Set("Content-Type", "application/xml")
@@ -102,19 +187,98 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 	switch path.Ext(r.URL.Path) {
 	case ".m3u8":
 		key, _ := server.parseM3u8(r.URL.Path)
+		//key.cmaf.m3u8为fMP4分片的播放列表, key.av.m3u8和key.audio.m3u8为主播放列表中的播放列表
+		variant := ""
+		for _, suffix := range []string{cmafSuffix, avSuffix, audioSuffix} {
+			if strings.HasSuffix(key, suffix) {
+				variant = suffix
+				key = strings.TrimSuffix(key, suffix)
+				break
+			}
+		}
+		//播放列表和密钥使用相同的播放token, 检查通过后才开始切片
+		token := r.URL.Query().Get("token")
+		if err := CheckPlayToken(server.tokenSecret(key), key, token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		conn := server.getConn(key)
+		if conn == nil {
+			conn = server.activateConn(key)
+		}
 		if conn == nil {
 			//log.Error("m3u8 url", r.URL.Path, "key", key, "connection do not exist.")
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		conn.touch()
+		keyQuery := ""
+		if token != "" {
+			keyQuery = "token=" + url.QueryEscape(token)
+		}
+		//第一次请求时分配会话ID, 重定向到带session参数的地址
+		if conn.cfg.IssueSession {
+			if id := server.sessions.issue(r, key, conn.cfg.SessionTimeout); id != "" {
+				u := *r.URL
+				query := u.Query()
+				query.Set(sessionQuery, id)
+				u.RawQuery = query.Encode()
+				http.Redirect(w, r, u.String(), http.StatusFound)
+				return
+			}
+		}
+		if conn.cfg.TokenSecret != "" {
+			server.sessions.authorize(r, key, conn.cfg.SessionTimeout)
+		}
+		//推流刚开始或者按需开始切片时等待第一个分片
+		if tsCache := conn.GetCacheInc(); tsCache != nil {
+			if err := tsCache.WaitFor(1, -1); err != nil {
+				http.Error(w, ErrNotReady.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
 		tsCache := conn.GetCacheInc()
+		switch variant {
+		case cmafSuffix:
+			tsCache = nil
+			if cmafCache := conn.GetCMAFCache(); cmafCache != nil && cmafCache.HasInit() {
+				tsCache = cmafCache.TSCacheItem
+			}
+		case audioSuffix:
+			tsCache = conn.GetAudioCache()
+		case "":
+			if conn.MasterPlayList() {
+				if !server.sessions.playlist(r, key, 0, conn.cfg.SessionTimeout) {
+					http.Error(w, ErrKicked.Error(), http.StatusForbidden)
+					return
+				}
+				server.writeMaster(w, conn, keyQuery)
+				return
+			}
+		}
 		if tsCache == nil {
 			//log.Error("url", r.URL.Path, "key", key, "has no tsCache")
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
-		body, err := tsCache.GenM3U8PlayList()
+		if !server.sessions.playlist(r, key, tsCache.MediaSequence(), conn.cfg.SessionTimeout) {
+			http.Error(w, ErrKicked.Error(), http.StatusForbidden)
+			return
+		}
+		//LL-HLS阻塞请求和delta播放列表
+		if tsCache.LowLatency() {
+			if err := server.blockReload(r, tsCache); err != nil {
+				status := http.StatusBadRequest
+				if err == ErrBlockTimeout {
+					status = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+		var body []byte
+		var err error
+		body, err = tsCache.GenPlayList(tsCache.LowLatency() && r.URL.Query().Get("_HLS_skip") == "YES", keyQuery)
 		if err != nil {
 			log.Error("GenM3U8PlayList error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -134,22 +298,184 @@ func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
 			return
 		}
+		if err := server.checkSegment(r, key, conn); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		conn.touch()
 		tsCache := conn.GetCacheInc()
+		if tsCache == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		if tsCache.LowLatency() {
+			tsCache.WaitPart(r.URL.Path)
+		}
 		item, err := tsCache.GetItem(r.URL.Path)
+		if audioCache := conn.GetAudioCache(); err != nil && audioCache != nil {
+			item, err = audioCache.GetItem(r.URL.Path)
+		}
 		if err != nil {
 			log.Error("GetItem error: ", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if !server.sessions.segment(r, key, item.SeqNum, len(item.Data), conn.cfg.SessionTimeout) {
+			http.Error(w, ErrKicked.Error(), http.StatusForbidden)
+			return
+		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "video/mp2ts")
 		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
 		w.Write(item.Data)
+	case ".mpd":
+		key, _ := server.parseMpd(r.URL.Path)
+		conn := server.getConn(key)
+		if conn == nil || conn.GetCMAFCache() == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		//DASH的分片地址不带token, 与HLS播放列表相同由会话授权
+		if err := CheckPlayToken(conn.cfg.TokenSecret, key, r.URL.Query().Get("token")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		conn.touch()
+		if conn.cfg.TokenSecret != "" {
+			server.sessions.authorize(r, key, conn.cfg.SessionTimeout)
+		}
+		cmafCache := conn.GetCMAFCache()
+		if !server.sessions.playlist(r, key, cmafCache.MediaSequence(), conn.cfg.SessionTimeout) {
+			http.Error(w, ErrKicked.Error(), http.StatusForbidden)
+			return
+		}
+		body, err := cmafCache.GenMPD()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	case ".m4s", ".mp4":
+		key := streamKey(path.Dir(r.URL.Path))
+		conn := server.getConn(key)
+		if conn == nil || conn.GetCMAFCache() == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		if err := server.checkSegment(r, key, conn); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		conn.touch()
+		item, err := conn.GetCMAFCache().GetItem(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contentType := "video/iso.segment"
+		if path.Ext(r.URL.Path) == ".mp4" {
+			contentType = "video/mp4"
+		} else if !server.sessions.segment(r, key, item.SeqNum, len(item.Data), conn.cfg.SessionTimeout) {
+			http.Error(w, ErrKicked.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(item.Data)))
+		w.Write(item.Data)
+	case ".key":
+		key := streamKey(path.Dir(r.URL.Path))
+		conn := server.getConn(key)
+		if conn == nil {
+			http.Error(w, ErrNoPublisher.Error(), http.StatusForbidden)
+			return
+		}
+		if err := CheckPlayToken(conn.cfg.TokenSecret, key, r.URL.Query().Get("token")); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		data, err := conn.GetKey(strings.TrimSuffix(path.Base(r.URL.Path), ".key"))
+		if err != nil {
+			log.Error("GetKey error: ", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
+
+//tokenSecret 流的播放token密钥, 还没有开始切片时使用应用的配置
+func (server *Server) tokenSecret(key string) string {
+	if conn := server.getConn(key); conn != nil {
+		return conn.cfg.TokenSecret
+	}
+	return configure.GetHlsInfo(appName(key)).Encrypt.TokenSecret
+}
+
+//checkSegment 分片地址不带token, 请求需要带有效的token, 或者会话请求过带有效token的播放列表
+func (server *Server) checkSegment(r *http.Request, key string, conn *Source) error {
+	if conn.cfg.TokenSecret == "" {
+		return nil
+	}
+	if CheckPlayToken(conn.cfg.TokenSecret, key, r.URL.Query().Get("token")) == nil {
+		return nil
+	}
+	if server.sessions.authorized(r, key) {
+		return nil
+	}
+	return ErrInvalidToken
+}
+
+//writeMaster 输出主播放列表
+func (server *Server) writeMaster(w http.ResponseWriter, conn *Source, query string) {
+	var video, audio uint64
+	if server.bandwidth != nil {
+		video, audio = server.bandwidth(conn.Info().Key)
+	}
+	body, err := conn.GenMasterPlayList(video, audio, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+//blockReload 等待请求中_HLS_msn/_HLS_part指定的分片
+func (server *Server) blockReload(r *http.Request, tsCache *TSCacheItem) error {
+	query := r.URL.Query()
+	if query.Get("_HLS_msn") == "" {
+		if query.Get("_HLS_part") != "" {
+			return ErrInvalidReq
+		}
+		return nil
+	}
+	msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+	if err != nil || msn < 0 {
+		return ErrInvalidReq
+	}
+	part := -1
+	if value := query.Get("_HLS_part"); value != "" {
+		part, err = strconv.Atoi(value)
+		if err != nil || part < 0 {
+			return ErrInvalidReq
+		}
+	}
+	return tsCache.WaitFor(msn, part)
 }
 
 func (server *Server) parseM3u8(pathstr string) (key string, err error) {
-	pathstr = strings.ToLower(pathstr)
 	pathstr = strings.TrimLeft(pathstr, "/")
 
 	index := strings.LastIndex(pathstr, ".m3u8")
@@ -157,13 +483,25 @@ func (server *Server) parseM3u8(pathstr string) (key string, err error) {
 		errString := fmt.Sprintf("path(%s) has no .m3u8", pathstr)
 		return "", errors.New(errString)
 	}
-	key = pathstr[0:index]
+	key = streamKey(pathstr[0:index])
+
+	return
+}
+
+func (server *Server) parseMpd(pathstr string) (key string, err error) {
+	pathstr = strings.TrimLeft(pathstr, "/")
+
+	index := strings.LastIndex(pathstr, ".mpd")
+	if index < 0 {
+		errString := fmt.Sprintf("path(%s) has no .mpd", pathstr)
+		return "", errors.New(errString)
+	}
+	key = streamKey(pathstr[0:index])
 
 	return
 }
 
 func (server *Server) parseTs(pathstr string) (key string, err error) {
-	pathstr = strings.ToLower(pathstr)
 	pathstr = strings.TrimLeft(pathstr, "/")
 
 	index := strings.LastIndex(pathstr, ".ts")
@@ -179,6 +517,6 @@ func (server *Server) parseTs(pathstr string) (key string, err error) {
 		return "", errors.New(errString)
 	}
 
-	key = pathstr[0:index]
+	key = streamKey(pathstr[0:index])
 	return
 }
@@ -1,10 +1,46 @@
 package hls
 
+import "time"
+
+const (
+	cueNone = iota
+	cueOutTag
+	cueContTag
+	cueInTag
+)
+
+//TSCue 分片上的广告标记
+type TSCue struct {
+	Tag       int
+	Id        uint32
+	StartDate time.Time //广告开始时间
+	EndDate   time.Time //广告结束时间(CUE-IN)
+	Duration  float64   //广告计划时长(秒)
+	Elapsed   float64   //本分片之前已播放的广告时长(秒)
+	Scte35    []byte
+}
+
+//TSPart LL-HLS的部分分片
+type TSPart struct {
+	Name        string
+	Duration    int  //毫秒
+	Independent bool //以关键帧开始
+	Data        []byte
+}
+
 type TSItem struct {
-	Name     string
-	SeqNum   int
-	Duration int
-	Data     []byte
+	Name      string
+	SeqNum    int
+	Duration  int
+	Data      []byte
+	Size      int //分片大小, 保存在磁盘上时Data为空
+	StartDate time.Time
+	Timestamp uint32 //分片开始的时间戳(毫秒), DASH时间线使用
+	Cue       TSCue
+	Key       TSKey    //加密密钥
+	Parts     []TSPart //最近的分片保留部分分片, Data为空
+
+	Discontinuity bool //分片前插入EXT-X-DISCONTINUITY, 重新推流或编码参数变化
 }
 
 func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
@@ -13,6 +49,7 @@ func NewTSItem(name string, duration, seqNum int, b []byte) TSItem {
 	item.SeqNum = seqNum
 	item.Duration = duration
 	item.Data = make([]byte, len(b))
+	item.Size = len(b)
 	copy(item.Data, b)
 	return item
 }
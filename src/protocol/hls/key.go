@@ -0,0 +1,195 @@
+package hls
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyLen = 16
+
+	methodAES128    = "AES-128"
+	methodSampleAES = "SAMPLE-AES"
+)
+
+var (
+	ErrInvalidKey   = errors.New("invalid hls key")
+	ErrInvalidToken = errors.New("invalid play token")
+)
+
+//KeyProvider 提供分片加密密钥, stream为流名称, name为密钥名称
+//同一个stream和name每次返回相同的密钥, 不存在时生成
+type KeyProvider interface {
+	Key(stream string, name string) ([]byte, error)
+}
+
+//NewKeyProvider 配置了密钥服务时使用HTTP密钥服务, 否则使用本地目录
+func NewKeyProvider(cfg Config) KeyProvider {
+	if cfg.KeyService != "" {
+		return NewHttpKeyProvider(cfg.KeyService)
+	}
+	return NewFileKeyProvider(cfg.KeyDir)
+}
+
+//fileKeyProvider 密钥保存在本地目录, dir/stream/name.key
+type fileKeyProvider struct {
+	lock sync.Mutex
+	dir  string
+}
+
+func NewFileKeyProvider(dir string) KeyProvider {
+	return &fileKeyProvider{dir: dir}
+}
+
+func (f *fileKeyProvider) Key(stream string, name string) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file := filepath.Join(f.dir, filepath.FromSlash(path.Clean("/"+stream+"/"+name+".key")))
+	key, err := ioutil.ReadFile(file)
+	if err == nil {
+		if len(key) != keyLen {
+			return nil, ErrInvalidKey
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, key, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//httpKeyProvider 从HTTP密钥服务得到密钥, GET service?stream=&name=, 返回16字节密钥
+//得到的密钥缓存在内存中
+type httpKeyProvider struct {
+	lock    sync.Mutex
+	service string
+	client  *http.Client
+	keys    map[string][]byte
+}
+
+func NewHttpKeyProvider(service string) KeyProvider {
+	return &httpKeyProvider{
+		service: service,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		keys:    make(map[string][]byte),
+	}
+}
+
+func (h *httpKeyProvider) Key(stream string, name string) ([]byte, error) {
+	id := stream + "/" + name
+	h.lock.Lock()
+	key, ok := h.keys[id]
+	h.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	query := url.Values{}
+	query.Set("stream", stream)
+	query.Set("name", name)
+	sep := "?"
+	if strings.Contains(h.service, "?") {
+		sep = "&"
+	}
+	resp, err := h.client.Get(h.service + sep + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	key, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key service status %d", resp.StatusCode)
+	}
+	if len(key) != keyLen {
+		return nil, ErrInvalidKey
+	}
+
+	h.lock.Lock()
+	h.keys[id] = key
+	h.lock.Unlock()
+	return key, nil
+}
+
+//KeyServiceHandler 按HTTP密钥服务的接口提供provider中的密钥, 用于本地测试
+func KeyServiceHandler(provider KeyProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream, name := r.URL.Query().Get("stream"), r.URL.Query().Get("name")
+		if stream == "" || name == "" {
+			http.Error(w, ErrInvalidReq.Error(), http.StatusBadRequest)
+			return
+		}
+		key, err := provider.Key(stream, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(key)
+	})
+}
+
+//PlayToken 生成流的播放token, expires之前有效
+//token为 过期时间(unix秒)-HMAC-SHA256(secret, stream:过期时间)
+func PlayToken(secret string, stream string, expires time.Time) string {
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return e + "-" + tokenSign(secret, stream, e)
+}
+
+//CheckPlayToken 检查播放token, secret为空时不检查
+func CheckPlayToken(secret string, stream string, token string) error {
+	if secret == "" {
+		return nil
+	}
+	index := strings.Index(token, "-")
+	if index < 0 {
+		return ErrInvalidToken
+	}
+	e := token[:index]
+	expires, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(token[index+1:]), []byte(tokenSign(secret, stream, e))) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func tokenSign(secret string, stream string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToLower(stream) + ":" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
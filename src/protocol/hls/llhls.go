@@ -0,0 +1,204 @@
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	canSkipTargets      = 6 //CAN-SKIP-UNTIL为6倍目标时长
+	partHoldBackTargets = 3 //PART-HOLD-BACK为3倍部分分片时长
+	blockTargets        = 3 //阻塞请求最多等待3倍目标时长
+	partSegments        = 3 //最近几个分片在播放列表中保留部分分片
+)
+
+var (
+	ErrBlockTooFar  = errors.New("_HLS_msn too far in the future")
+	ErrBlockTimeout = errors.New("blocking request timeout")
+)
+
+//partName 部分分片名称, 分片名称后加部分分片序号
+func partName(key string, session time.Time, seq int, index int) string {
+	return fmt.Sprintf("/%s/%s-%d.%d.ts", key, session.Format("20060102150405"), seq, index)
+}
+
+//lowLatency 是否开启LL-HLS, 调用者持有锁
+func (tcCacheItem *TSCacheItem) lowLatency() bool {
+	return tcCacheItem.cfg.PartDuration > 0
+}
+
+//LowLatency 是否开启LL-HLS
+func (tcCacheItem *TSCacheItem) LowLatency() bool {
+	return tcCacheItem.lowLatency()
+}
+
+//AddPart 加入正在生成的分片seq的部分分片
+func (tcCacheItem *TSCacheItem) AddPart(seq int, part TSPart) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	if seq != tcCacheItem.partSeq {
+		tcCacheItem.removeParts(tcCacheItem.parts)
+		tcCacheItem.parts = nil
+		tcCacheItem.partSeq = seq
+	}
+	tcCacheItem.partData[part.Name] = part.Data
+	part.Data = nil
+	tcCacheItem.parts = append(tcCacheItem.parts, part)
+	tcCacheItem.notify()
+}
+
+//DropParts 丢弃正在生成的分片的部分分片, 重新推流时调用
+func (tcCacheItem *TSCacheItem) DropParts() {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.removeParts(tcCacheItem.parts)
+	tcCacheItem.parts = nil
+	tcCacheItem.hint = ""
+	tcCacheItem.notify()
+}
+
+//SetPreloadHint 设置下一个部分分片
+func (tcCacheItem *TSCacheItem) SetPreloadHint(name string) {
+	tcCacheItem.lock.Lock()
+	defer tcCacheItem.lock.Unlock()
+
+	tcCacheItem.hint = name
+}
+
+//finishParts 分片完成, 部分分片移到分片上, 较早分片的部分分片删除, 调用者持有锁
+func (tcCacheItem *TSCacheItem) finishParts(item *TSItem) {
+	if tcCacheItem.partSeq == item.SeqNum {
+		item.Parts = tcCacheItem.parts
+	} else {
+		tcCacheItem.removeParts(tcCacheItem.parts)
+	}
+	tcCacheItem.parts = nil
+	tcCacheItem.partSeq = item.SeqNum + 1
+
+	n := 0
+	for e := tcCacheItem.ll.Back(); e != nil; e = e.Prev() {
+		n++
+		if n < partSegments {
+			continue
+		}
+		k := e.Value.(string)
+		v := tcCacheItem.lm[k]
+		if v.Parts == nil {
+			break
+		}
+		tcCacheItem.removeParts(v.Parts)
+		v.Parts = nil
+		tcCacheItem.lm[k] = v
+	}
+}
+
+//removeParts 删除部分分片数据, 调用者持有锁
+func (tcCacheItem *TSCacheItem) removeParts(parts []TSPart) {
+	for _, part := range parts {
+		delete(tcCacheItem.partData, part.Name)
+	}
+}
+
+//notify 唤醒等待播放列表更新的请求, 调用者持有锁
+func (tcCacheItem *TSCacheItem) notify() {
+	close(tcCacheItem.update)
+	tcCacheItem.update = make(chan struct{})
+}
+
+//has 分片msn的第part个部分分片(part小于0表示整个分片)是否已经在播放列表中, 调用者持有锁
+func (tcCacheItem *TSCacheItem) has(msn int, part int) bool {
+	if back := tcCacheItem.ll.Back(); back != nil && msn <= tcCacheItem.lm[back.Value.(string)].SeqNum {
+		return true
+	}
+	return part >= 0 && msn == tcCacheItem.partSeq && part < len(tcCacheItem.parts)
+}
+
+//blockTimeout 阻塞请求的最长等待时间
+func (tcCacheItem *TSCacheItem) blockTimeout() time.Duration {
+	return time.Duration(tcCacheItem.cfg.SegmentDuration*blockTargets) * time.Millisecond
+}
+
+//WaitFor 阻塞播放列表请求(_HLS_msn/_HLS_part), 直到分片msn的第part个部分分片出现
+func (tcCacheItem *TSCacheItem) WaitFor(msn int, part int) error {
+	timer := time.NewTimer(tcCacheItem.blockTimeout())
+	defer timer.Stop()
+
+	for {
+		tcCacheItem.lock.RLock()
+		if tcCacheItem.has(msn, part) {
+			tcCacheItem.lock.RUnlock()
+			return nil
+		}
+		//只能等待最后一个分片之后的两个分片, 分片序号从1开始
+		last := 0
+		if back := tcCacheItem.ll.Back(); back != nil {
+			last = tcCacheItem.lm[back.Value.(string)].SeqNum
+		}
+		update := tcCacheItem.update
+		tcCacheItem.lock.RUnlock()
+
+		if msn > last+2 {
+			return ErrBlockTooFar
+		}
+		select {
+		case <-update:
+		case <-timer.C:
+			return ErrBlockTimeout
+		}
+	}
+}
+
+//WaitPart 请求EXT-X-PRELOAD-HINT中的部分分片时, 等待部分分片完成
+func (tcCacheItem *TSCacheItem) WaitPart(name string) {
+	timer := time.NewTimer(tcCacheItem.blockTimeout())
+	defer timer.Stop()
+
+	for {
+		tcCacheItem.lock.RLock()
+		_, ok := tcCacheItem.partData[name]
+		wait := !ok && name == tcCacheItem.hint
+		update := tcCacheItem.update
+		tcCacheItem.lock.RUnlock()
+
+		if !wait {
+			return
+		}
+		select {
+		case <-update:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+//skipCount delta播放列表可以跳过的分片数, 起始时间距离结尾超过skipUntil秒的分片可以跳过
+//带广告标记的分片不跳过
+func skipCount(items []TSItem, skipUntil int) int {
+	remain := 0
+	for _, v := range items {
+		remain += v.Duration
+	}
+	n := 0
+	for _, v := range items {
+		if remain <= skipUntil*1000 || v.Cue.Tag != cueNone {
+			break
+		}
+		remain -= v.Duration
+		n++
+	}
+	return n
+}
+
+func writeParts(w *bytes.Buffer, parts []TSPart) {
+	for _, part := range parts {
+		fmt.Fprintf(w, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", float64(part.Duration)/1000, part.Name)
+		if part.Independent {
+			fmt.Fprintf(w, ",INDEPENDENT=YES")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
@@ -0,0 +1,123 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//640x360 baseline
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xf4, 0x05, 0x01, 0x7f, 0xca, 0x80}
+
+//feedSource 写入seconds秒25fps视频, 每秒一个关键帧, 按interval间隔写入
+func feedSource(s *Source, seconds int, interval time.Duration) {
+	avcc := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, byte(len(testSPS))}
+	avcc = append(avcc, testSPS...)
+	avcc = append(avcc, 0x01, 0x00, 0x02, 0x68, 0xce)
+	s.Write(&av.Packet{IsVideo: true, Data: avcc})
+
+	for i := 0; i < seconds*25; i++ {
+		data := []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}
+		if i%25 == 0 {
+			data = []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}
+		}
+		s.Write(&av.Packet{IsVideo: true, TimeStamp: uint32(i * 40), Data: data})
+		time.Sleep(interval)
+	}
+}
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+var partRegexp = regexp.MustCompile(`#EXT-X-PART:DURATION=([0-9.]+),URI="([^"]+)"(,INDEPENDENT=YES)?`)
+var segmentRegexp = regexp.MustCompile(`-([0-9]+)\.ts\n`)
+var hintRegexp = regexp.MustCompile(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="([^"]+)"`)
+
+//LL-HLS测试客户端: 阻塞请求, 预加载提示和部分分片
+func TestLowLatency(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 4, PartDuration: 200}
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	defer source.Close(nil)
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set("live/test", source)
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		feedSource(source, 6, 10*time.Millisecond)
+		close(done)
+	}()
+
+	//等待第2个分片的第1个部分分片
+	code, body := get(t, ts.URL+"/live/test.m3u8?_HLS_msn=2&_HLS_part=1")
+	if code != http.StatusOK {
+		t.Fatalf("blocking reload status %d %s", code, body)
+	}
+	for _, tag := range []string{"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES", "#EXT-X-PART-INF:PART-TARGET=0.200", "#EXT-X-PRELOAD-HINT"} {
+		if !strings.Contains(body, tag) {
+			t.Fatalf("playlist without %s:\n%s", tag, body)
+		}
+	}
+	if !strings.Contains(body, "-2.1.ts") && !strings.Contains(body, "-2.ts\n") {
+		t.Fatalf("playlist without msn 2 part 1:\n%s", body)
+	}
+
+	//请求预加载提示中的部分分片, 完成后返回
+	hint := hintRegexp.FindStringSubmatch(body)
+	code, data := get(t, ts.URL+hint[1])
+	if code != http.StatusOK || len(data) == 0 || data[0] != 0x47 {
+		t.Fatalf("preload hint %s status %d len %d", hint[1], code, len(data))
+	}
+
+	if code, _ := get(t, ts.URL+"/live/test.m3u8?_HLS_msn=100"); code != http.StatusBadRequest {
+		t.Fatalf("too far msn status %d", code)
+	}
+
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	_, body = get(t, ts.URL+"/live/test.m3u8")
+	parts := partRegexp.FindAllStringSubmatch(body, -1)
+	if len(parts) == 0 {
+		t.Fatalf("no parts:\n%s", body)
+	}
+	for _, part := range parts {
+		duration, _ := strconv.ParseFloat(part[1], 64)
+		if duration > 0.2 {
+			t.Fatalf("part %s duration %s exceeds part target", part[2], part[1])
+		}
+		//每个分片的第一个部分分片以关键帧开始
+		if strings.HasSuffix(part[2], ".0.ts") && part[3] == "" {
+			t.Fatalf("first part %s not independent", part[2])
+		}
+		if code, data := get(t, ts.URL+part[2]); code != http.StatusOK || data[0] != 0x47 {
+			t.Fatalf("part %s status %d", part[2], code)
+		}
+	}
+
+	//没有新数据时阻塞请求超时
+	segments := segmentRegexp.FindAllStringSubmatch(body, -1)
+	last, _ := strconv.Atoi(segments[len(segments)-1][1])
+	start := time.Now()
+	if code, _ := get(t, ts.URL+"/live/test.m3u8?_HLS_msn="+strconv.Itoa(last+2)); code != http.StatusServiceUnavailable {
+		t.Fatalf("timeout status %d", code)
+	}
+	if time.Since(start) < 2*time.Second {
+		t.Fatal("blocking request returned too early")
+	}
+}
@@ -0,0 +1,142 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"parser/h264"
+	"strings"
+	"sync"
+)
+
+const (
+	avSuffix    = ".av"    //音视频播放列表, key.av.m3u8
+	audioSuffix = ".audio" //纯音频播放列表, key.audio.m3u8
+)
+
+//BandwidthFunc 得到发布者的视频和音频码率(kbps), 由RTMP发布者的StaticsBW统计
+type BandwidthFunc func(key string) (video uint64, audio uint64)
+
+//mediaInfo 由sequence header得到的编码信息, 主播放列表使用
+type mediaInfo struct {
+	lock       sync.RWMutex
+	videoCodec string //avc1.PPCCLL
+	audioCodec string //mp4a.40.N
+	width      int
+	height     int
+}
+
+//setVideo 解析AVCDecoderConfigurationRecord
+func (m *mediaInfo) setVideo(config []byte) {
+	if len(config) < 4 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.videoCodec = fmt.Sprintf("avc1.%02x%02x%02x", config[1], config[2], config[3])
+	if sps, err := h264.ParseAVCConfig(config); err == nil {
+		m.width, m.height = sps.Width, sps.Height
+	}
+}
+
+//setAudio 解析AudioSpecificConfig
+func (m *mediaInfo) setAudio(config []byte) {
+	if len(config) < 1 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.audioCodec = fmt.Sprintf("mp4a.40.%d", config[0]>>3)
+}
+
+//setAudioCodec 没有AudioSpecificConfig的音频, 如MP3和AC-3
+func (m *mediaInfo) setAudioCodec(codec string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.audioCodec = codec
+}
+
+//segmentBandwidth 由播放列表中的分片大小计算码率(bps), StaticsBW没有统计时使用
+func segmentBandwidth(items []TSItem) uint64 {
+	var size, duration int
+	for _, v := range items {
+		size += v.Size
+		duration += v.Duration
+	}
+	if duration <= 0 {
+		return 0
+	}
+	return uint64(size) * 8 * 1000 / uint64(duration)
+}
+
+//GenMasterPlayList 主播放列表, 音视频和纯音频两个码率
+//video/audio为发布者的码率(kbps), 为0时由分片大小计算, query加在播放列表地址后
+func (source *Source) GenMasterPlayList(video, audio uint64, query string) ([]byte, error) {
+	tsCache, audioCache := source.GetCacheInc(), source.GetAudioCache()
+	if tsCache == nil {
+		return nil, ErrNoPublisher
+	}
+
+	source.media.lock.RLock()
+	defer source.media.lock.RUnlock()
+	media := &source.media
+
+	var codecs []string
+	if media.videoCodec != "" {
+		codecs = append(codecs, media.videoCodec)
+	}
+	if media.audioCodec != "" {
+		codecs = append(codecs, media.audioCodec)
+	}
+
+	bandwidth := (video + audio) * 1000
+	if bandwidth == 0 {
+		bandwidth = segmentBandwidth(tsCache.Items())
+	}
+
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+	if len(codecs) > 0 {
+		fmt.Fprintf(w, ",CODECS=\"%s\"", strings.Join(codecs, ","))
+	}
+	if media.width > 0 {
+		fmt.Fprintf(w, ",RESOLUTION=%dx%d", media.width, media.height)
+	}
+	fmt.Fprintf(w, "\n/%s%s.m3u8%s\n", source.info.Key, avSuffix, queryString(query))
+
+	//有音频和视频时才提供纯音频
+	if audioCache != nil && media.videoCodec != "" && media.audioCodec != "" {
+		bandwidth = audio * 1000
+		if bandwidth == 0 {
+			bandwidth = segmentBandwidth(audioCache.Items())
+		}
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n", bandwidth, media.audioCodec)
+		fmt.Fprintf(w, "/%s%s.m3u8%s\n", source.info.Key, audioSuffix, queryString(query))
+	}
+	return w.Bytes(), nil
+}
+
+func queryString(query string) string {
+	if query == "" {
+		return ""
+	}
+	return "?" + query
+}
+
+//MasterPlayList 是否提供主播放列表
+func (source *Source) MasterPlayList() bool {
+	return source.cfg.AudioOnly
+}
+
+//GetAudioCache 纯音频分片, 没有开启时为nil
+func (source *Source) GetAudioCache() *TSCacheItem {
+	source.closeLock.RLock()
+	defer source.closeLock.RUnlock()
+	if source.released {
+		return nil
+	}
+	return source.audioTsCache
+}
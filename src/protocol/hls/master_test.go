@@ -0,0 +1,106 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+//feedAudioVideo 写入seconds秒25fps视频和AAC音频, 每秒一个关键帧
+func feedAudioVideo(s *Source, seconds int) {
+	avcc := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0x00, byte(len(testSPS))}
+	avcc = append(avcc, testSPS...)
+	avcc = append(avcc, 0x01, 0x00, 0x02, 0x68, 0xce)
+	s.Write(&av.Packet{IsVideo: true, Data: avcc})
+	//AAC LC 44100 stereo
+	s.Write(&av.Packet{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}})
+
+	audio := 0
+	for i := 0; i < seconds*25; i++ {
+		for ; audio*23 <= i*40; audio++ {
+			s.Write(&av.Packet{IsAudio: true, TimeStamp: uint32(audio * 23), Data: []byte{0xaf, 0x01, 0x21, 0x00, 0x49, 0x90}})
+		}
+		data := []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}
+		if i%25 == 0 {
+			data = []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}
+		}
+		s.Write(&av.Packet{IsVideo: true, TimeStamp: uint32(i * 40), Data: data})
+	}
+}
+
+var variantRegexp = regexp.MustCompile(`#EXT-X-STREAM-INF:([^\n]+)\n([^\n]+)\n`)
+var audioTsRegexp = regexp.MustCompile(`(/live/test/[0-9]+-audio-[0-9]+\.ts)\n`)
+
+//主播放列表: 音视频和纯音频
+func TestMasterPlayList(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, AudioOnly: true}
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	defer source.Close(nil)
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set("live/test", source)
+	server.SetBandwidthFunc(func(key string) (uint64, uint64) {
+		return 500, 64
+	})
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	feedAudioVideo(source, 5)
+	for i := 0; i < 100 && len(source.GetAudioCache().Items()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, body := get(t, ts.URL+"/live/test.m3u8")
+	if code != http.StatusOK {
+		t.Fatalf("master playlist status %d %s", code, body)
+	}
+	variants := variantRegexp.FindAllStringSubmatch(body, -1)
+	if len(variants) != 2 {
+		t.Fatalf("master playlist variants:\n%s", body)
+	}
+	if variants[0][1] != `BANDWIDTH=564000,CODECS="avc1.42c01e,mp4a.40.2",RESOLUTION=640x360` || variants[0][2] != "/live/test.av.m3u8" {
+		t.Fatalf("audio video variant:\n%s", body)
+	}
+	if variants[1][1] != `BANDWIDTH=64000,CODECS="mp4a.40.2"` || variants[1][2] != "/live/test.audio.m3u8" {
+		t.Fatalf("audio only variant:\n%s", body)
+	}
+
+	code, body = get(t, ts.URL+variants[0][2])
+	if code != http.StatusOK || !strings.Contains(body, "#EXTINF") {
+		t.Fatalf("audio video playlist status %d:\n%s", code, body)
+	}
+
+	code, body = get(t, ts.URL+variants[1][2])
+	if code != http.StatusOK {
+		t.Fatalf("audio only playlist status %d", code)
+	}
+	segments := audioTsRegexp.FindAllStringSubmatch(body, -1)
+	if len(segments) == 0 {
+		t.Fatalf("audio only playlist without segments:\n%s", body)
+	}
+	for _, segment := range segments {
+		code, data := get(t, ts.URL+segment[1])
+		if code != http.StatusOK || len(data) == 0 || len(data)%188 != 0 {
+			t.Fatalf("audio segment %s status %d len %d", segment[1], code, len(data))
+		}
+		//只有音频PID
+		for i := 0; i < len(data); i += 188 {
+			pid := int(data[i+1]&0x1f)<<8 | int(data[i+2])
+			if pid == 0x100 {
+				t.Fatalf("audio segment %s with video", segment[1])
+			}
+		}
+	}
+
+	//StaticsBW没有统计时由分片大小计算
+	server.SetBandwidthFunc(nil)
+	_, body = get(t, ts.URL+"/live/test.m3u8")
+	if strings.Contains(body, "BANDWIDTH=0") {
+		t.Fatalf("master playlist without measured bandwidth:\n%s", body)
+	}
+}
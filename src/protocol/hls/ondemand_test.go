@@ -0,0 +1,126 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"configure"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//按需切片: 第一次请求播放列表时由发布者开始切片, 请求等待第一个分片, 没有请求后停止
+//发布者的流名称带大写字母, 请求地址的大小写不影响查找
+func TestOnDemand(t *testing.T) {
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	const publisher = "live/01/12/Camera_1"
+	var source *Source
+	server.SetActivateFunc(func(key string) bool {
+		//与rtmp.activateHls相同, 忽略大小写查找发布者
+		if !strings.EqualFold(key, publisher) {
+			return false
+		}
+		source = server.GetOnDemandWriter(av.Info{Key: publisher}).(*Source)
+		go feedSource(source, 7, 5*time.Millisecond)
+		return true
+	})
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	if code, _ := get(t, ts.URL+"/live/none.m3u8"); code != http.StatusForbidden {
+		t.Fatalf("playlist without publisher status %d", code)
+	}
+
+	code, body := get(t, ts.URL+"/"+publisher+".m3u8")
+	if code != http.StatusOK || !strings.Contains(body, "#EXTINF") {
+		t.Fatalf("first playlist status %d:\n%s", code, body)
+	}
+	if source == nil || server.getConn(publisher) != source || server.getConn("LIVE/01/12/camera_1") != source {
+		t.Fatal("source not activated")
+	}
+
+	//分片地址使用发布者的流名称
+	var segment string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasSuffix(line, ".ts") {
+			segment = line
+		}
+	}
+	if code, _ := get(t, ts.URL+"/"+strings.TrimLeft(segment, "/")); segment == "" || code != http.StatusOK {
+		t.Fatalf("segment %q status %d", segment, code)
+	}
+	if code, _ := get(t, ts.URL+"/live/01/12/camera_1.m3u8"); code != http.StatusOK {
+		t.Fatalf("lower case playlist status %d", code)
+	}
+
+	if source.idle(time.Now()) || !source.idle(time.Now().Add(10*time.Minute)) {
+		t.Fatal("idle timeout not applied")
+	}
+	source.stop()
+	if !source.isClosed() || source.GetCacheInc() != nil || source.idle(time.Now().Add(10*time.Minute)) {
+		t.Fatal("source not stopped")
+	}
+}
+
+//配置了播放token时, 没有有效token的请求不能开始切片, 分片需要会话请求过带token的播放列表
+func TestOnDemandToken(t *testing.T) {
+	servers := configure.RtmpServercfg.Servers
+	configure.RtmpServercfg.Servers = []configure.ServerInfo{{Servername: "live", Hls: configure.HlsInfo{Encrypt: configure.HlsEncryptInfo{TokenSecret: "secret"}}}}
+	defer func() { configure.RtmpServercfg.Servers = servers }()
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	activated := 0
+	server.SetActivateFunc(func(key string) bool {
+		activated++
+		source := server.GetOnDemandWriter(av.Info{Key: "live/test"}).(*Source)
+		go feedSource(source, 7, 5*time.Millisecond)
+		return true
+	})
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	expired := PlayToken("secret", "live/test", time.Now().Add(-time.Minute))
+	for _, query := range []string{"", "?token=" + expired} {
+		if code, _ := get(t, ts.URL+"/live/test.m3u8"+query); code != http.StatusForbidden || activated != 0 {
+			t.Fatalf("playlist %q status %d activated %d", query, code, activated)
+		}
+	}
+
+	token := PlayToken("secret", "live/test", time.Now().Add(time.Minute))
+	code, body := get(t, ts.URL+"/live/test.m3u8?token="+token)
+	if code != http.StatusOK || activated != 1 {
+		t.Fatalf("playlist status %d activated %d", code, activated)
+	}
+	var segment string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasSuffix(line, ".ts") {
+			segment = ts.URL + line
+		}
+	}
+
+	//其它客户端没有会话, 需要token
+	fetch := func(url string, agent string) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("User-Agent", agent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+	if code := fetch(segment, "other"); segment == "" || code != http.StatusForbidden {
+		t.Fatalf("segment %q without session status %d", segment, code)
+	}
+	if code := fetch(segment+"?token="+token, "other"); code != http.StatusOK {
+		t.Fatalf("segment with token status %d", code)
+	}
+	if code, _ := get(t, segment); code != http.StatusOK {
+		t.Fatalf("segment with session status %d", code)
+	}
+	server.getConn("live/test").stop()
+}
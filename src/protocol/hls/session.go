@@ -0,0 +1,250 @@
+package hls
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionQuery          = "session"
+	defaultSessionTimeout = 30 * time.Second
+)
+
+//SessionStat HLS观看会话的统计
+type SessionStat struct {
+	Id        string    `json:"id"`
+	Key       string    `json:"key"`
+	PeerIP    string    `json:"peerIP"`
+	UserAgent string    `json:"userAgent"`
+	First     time.Time `json:"first"`         //第一次请求时间
+	Last      time.Time `json:"last"`          //最后一次请求时间
+	Segments  int64     `json:"segments"`      //下载的分片数
+	Bytes     int64     `json:"bytes"`         //下载的字节数
+	MediaSeq  int       `json:"mediaSequence"` //当前的分片序号
+}
+
+type session struct {
+	SessionStat
+	timeout time.Duration
+	client  string
+	kicked  bool //被踢出, 过期之前的请求返回403
+	allowed bool //请求过带有效播放token的播放列表, 可以请求分片
+}
+
+//sessions HLS没有连接, 由会话ID统计观看者
+//会话ID为请求中的session参数, 没有时由IP和User-Agent得到
+//流名称都使用streamKey转换后的名称, 与HLS服务中查找流相同
+type sessions struct {
+	lock    sync.Mutex
+	m       map[string]*session
+	clients map[string]string //IP和User-Agent得到的ID对应分配的会话ID
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		m:       make(map[string]*session),
+		clients: make(map[string]string),
+	}
+}
+
+//peerIP 客户端IP, 经过代理时使用X-Forwarded-For中的第一个地址
+func peerIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//clientID 由IP, User-Agent和流名称得到的会话ID
+func clientID(r *http.Request, key string) string {
+	sum := sha1.Sum([]byte(peerIP(r) + "|" + r.UserAgent() + "|" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//id 请求的会话ID
+func (s *sessions) id(r *http.Request, key string) (string, string) {
+	client := clientID(r, key)
+	if id := r.URL.Query().Get(sessionQuery); id != "" {
+		return id, client
+	}
+	if id, ok := s.clients[client]; ok {
+		return id, client
+	}
+	return client, client
+}
+
+//issue 请求中没有会话ID且没有分配过时分配新的会话ID, 返回空表示不需要分配
+func (s *sessions) issue(r *http.Request, key string, timeout time.Duration) string {
+	if r.URL.Query().Get(sessionQuery) != "" {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = streamKey(key)
+	client := clientID(r, key)
+	if _, ok := s.clients[client]; ok {
+		return ""
+	}
+	id := newSessionID()
+	s.clients[client] = id
+	s.add(r, id, client, key, timeout)
+	return id
+}
+
+func (s *sessions) add(r *http.Request, id string, client string, key string, timeout time.Duration) *session {
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	sess := &session{
+		SessionStat: SessionStat{
+			Id:        id,
+			Key:       key,
+			PeerIP:    peerIP(r),
+			UserAgent: r.UserAgent(),
+			First:     time.Now(),
+		},
+		timeout: timeout,
+		client:  client,
+	}
+	s.m[id] = sess
+	return sess
+}
+
+//touch 得到请求的会话, 没有时新建, 会话被踢出时返回nil
+func (s *sessions) touch(r *http.Request, key string, timeout time.Duration) *session {
+	key = streamKey(key)
+	id, client := s.id(r, key)
+	sess, ok := s.m[id]
+	if !ok || sess.Key != key {
+		sess = s.add(r, id, client, key, timeout)
+	}
+	if sess.kicked {
+		return nil
+	}
+	sess.Last = time.Now()
+	return sess
+}
+
+//playlist 请求播放列表, seq为播放列表的媒体序号, 会话被踢出时返回false
+func (s *sessions) playlist(r *http.Request, key string, seq int, timeout time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess := s.touch(r, key, timeout)
+	if sess == nil {
+		return false
+	}
+	if seq > sess.MediaSeq {
+		sess.MediaSeq = seq
+	}
+	return true
+}
+
+//authorize 播放列表的token检查通过, 会话过期之前可以请求分片
+func (s *sessions) authorize(r *http.Request, key string, timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sess := s.touch(r, key, timeout); sess != nil {
+		sess.allowed = true
+	}
+}
+
+//authorized 请求的会话是否可以请求分片, 不新建会话
+func (s *sessions) authorized(r *http.Request, key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key = streamKey(key)
+	id, _ := s.id(r, key)
+	sess, ok := s.m[id]
+	return ok && sess.Key == key && sess.allowed && !sess.kicked
+}
+
+//segment 请求分片, 会话被踢出时返回false
+func (s *sessions) segment(r *http.Request, key string, seq int, size int, timeout time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sess := s.touch(r, key, timeout)
+	if sess == nil {
+		return false
+	}
+	sess.Segments++
+	sess.Bytes += int64(size)
+	if seq > 0 {
+		sess.MediaSeq = seq
+	}
+	return true
+}
+
+//expire 删除超过timeout没有请求的会话
+func (s *sessions) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, sess := range s.m {
+		last := sess.Last
+		if last.IsZero() {
+			last = sess.First
+		}
+		if now.Sub(last) > sess.timeout {
+			delete(s.m, id)
+			if s.clients[sess.client] == id {
+				delete(s.clients, sess.client)
+			}
+		}
+	}
+}
+
+//kick 踢出流的观看会话, id为空时踢出流的所有会话, 返回踢出的个数
+func (s *sessions) kick(key string, id string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	key = streamKey(key)
+	for _, sess := range s.m {
+		if sess.kicked || (key != "" && sess.Key != key) || (id != "" && sess.Id != id) {
+			continue
+		}
+		sess.kicked = true
+		n++
+	}
+	return n
+}
+
+//stats 没有被踢出的会话, 按开始时间排序
+func (s *sessions) stats() []SessionStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := make([]SessionStat, 0, len(s.m))
+	for _, sess := range s.m {
+		if !sess.kicked {
+			stats = append(stats, sess.SessionStat)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].First.Before(stats[j].First)
+	})
+	return stats
+}
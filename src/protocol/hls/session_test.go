@@ -0,0 +1,127 @@
+package hls
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getWithAgent(t *testing.T, client *http.Client, url string, agent string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("User-Agent", agent)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+//HLS观看会话: IP+User-Agent得到的会话, 分配的会话ID, 踢出和过期
+func TestSessions(t *testing.T) {
+	cfg := Config{SegmentDuration: 1000, PlaylistLength: 3, SessionTimeout: 10 * time.Second}
+	source := NewSource(av.Info{Key: "live/test"}, cfg)
+	defer source.Close(nil)
+
+	server := &Server{conns: cmap.New(), sessions: newSessions()}
+	server.conns.Set("live/test", source)
+	ts := httptest.NewServer(http.HandlerFunc(server.handle))
+	defer ts.Close()
+
+	feedSource(source, 5, 0)
+	for i := 0; i < 100 && len(source.GetCacheInc().Items()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := &http.Client{}
+	_, body := getWithAgent(t, client, ts.URL+"/live/test.m3u8", "player-a")
+	segments := encryptedTsRegexp.FindAllStringSubmatch(body, -1)
+	if len(segments) == 0 {
+		t.Fatalf("playlist without segments:\n%s", body)
+	}
+	_, data := getWithAgent(t, client, ts.URL+segments[0][1], "player-a")
+	getWithAgent(t, client, ts.URL+"/live/test.m3u8", "player-b")
+
+	stats := server.Sessions()
+	if len(stats) != 2 {
+		t.Fatalf("sessions %+v", stats)
+	}
+	a := stats[0]
+	if a.UserAgent != "player-a" || a.Key != "live/test" || a.PeerIP != "127.0.0.1" {
+		t.Fatalf("session %+v", a)
+	}
+	if a.Segments != 1 || a.Bytes != int64(len(data)) || segments[0][2] != strconv.Itoa(a.MediaSeq) {
+		t.Fatalf("session counters %+v, segment %s", a, segments[0][1])
+	}
+
+	//踢出后请求返回403, 不再统计
+	if n := server.KickSessions("live/test", a.Id); n != 1 {
+		t.Fatalf("kick %d sessions", n)
+	}
+	if resp, _ := getWithAgent(t, client, ts.URL+"/live/test.m3u8", "player-a"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("kicked session playlist status %d", resp.StatusCode)
+	}
+	if stats := server.Sessions(); len(stats) != 1 || stats[0].UserAgent != "player-b" {
+		t.Fatalf("sessions after kick %+v", stats)
+	}
+
+	//没有请求后过期
+	server.sessions.expire(time.Now().Add(cfg.SessionTimeout + time.Second))
+	if stats := server.Sessions(); len(stats) != 0 {
+		t.Fatalf("sessions after expire %+v", stats)
+	}
+
+	//第一次请求播放列表时分配会话ID
+	source.cfg.IssueSession = true
+	noRedirect := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, _ := getWithAgent(t, noRedirect, ts.URL+"/live/test.m3u8", "player-c")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("issue session status %d", resp.StatusCode)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	id := location.Query().Get(sessionQuery)
+	if id == "" {
+		t.Fatalf("redirect location %s", resp.Header.Get("Location"))
+	}
+	if resp, _ := getWithAgent(t, noRedirect, ts.URL+location.String(), "player-c"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("playlist with session status %d", resp.StatusCode)
+	}
+	//分片请求没有session参数时由IP和User-Agent对应到分配的会话
+	getWithAgent(t, noRedirect, ts.URL+segments[len(segments)-1][1], "player-c")
+	stats = server.Sessions()
+	if len(stats) != 1 || stats[0].Id != id || stats[0].Segments != 1 {
+		t.Fatalf("issued session %+v", stats)
+	}
+}
+
+//会话记录HLS服务中的流名称, 使用发布者的流名称踢出
+func TestSessionKey(t *testing.T) {
+	s := newSessions()
+	r := httptest.NewRequest("GET", "/live/01/12/Camera_1.m3u8", nil)
+	r.Header.Set("User-Agent", "player-a")
+	if !s.playlist(r, "live/01/12/Camera_1", 1, time.Minute) || !s.segment(r, "/live/01/12/camera_1", 2, 100, time.Minute) {
+		t.Fatal("session rejected")
+	}
+	stats := s.stats()
+	if len(stats) != 1 || stats[0].Key != "live/01/12/camera_1" || stats[0].Segments != 1 {
+		t.Fatalf("sessions %+v", stats)
+	}
+	if n := s.kick("live/01/12/Camera_2", ""); n != 0 {
+		t.Fatalf("kick other stream %d", n)
+	}
+	if n := s.kick("live/01/12/Camera_1", ""); n != 1 {
+		t.Fatalf("kick %d sessions", n)
+	}
+	if s.playlist(r, "live/01/12/camera_1", 3, time.Minute) {
+		t.Fatal("kicked session accepted")
+	}
+}
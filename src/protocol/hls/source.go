@@ -4,11 +4,18 @@ import (
 	"av"
 	"bytes"
 	"container/flv"
+	"container/mp4"
 	"container/ts"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "logging"
 	"parser"
+	"protocol/amf"
+	"strings"
+	"sync"
 
 	//"runtime"
 	"time"
@@ -36,39 +43,193 @@ type Source struct {
 	cache       *audioCache
 	tsCache     *TSCacheItem
 	tsparser    *parser.CodecParser
-	closed      bool
+	closed      bool //推流结束, 包队列已经关闭, 由closeLock保护
+	released    bool //分片缓存已经删除或者交给重新推流的Source, 由closeLock保护
+	closeLock   sync.RWMutex
+	done        chan struct{} //SendPacket结束时关闭, 之后才能删除分片缓存
 	packetQueue chan *av.Packet
+
+	cfg      Config
+	session  time.Time //流开始时间, 用于分片命名
+	hasVideo bool      //收到过视频sequence header, 没有视频时按音频切片
+
+	//LL-HLS部分分片
+	partIndex       int    //当前部分分片在分片中的序号
+	partOffset      int    //当前部分分片在btswriter中的起始位置
+	partStart       uint32 //当前部分分片的起始时间戳
+	partIndependent bool   //当前部分分片以关键帧开始
+	lastTs          uint32 //上一个音视频包的时间戳
+
+	//纯音频分片, 与TS在相同的位置切片
+	audioMuxer   *ts.Muxer
+	audioWriter  *bytes.Buffer
+	audioTsCache *TSCacheItem
+	hasAudio     bool      //收到过音频sequence header
+	soundFormat  byte      //音频格式, AAC/MP3/AC-3
+	media        mediaInfo //主播放列表中的编码信息
+
+	//分片加密, keys为nil时不加密
+	keys     KeyProvider
+	key      TSKey        //当前分片的密钥
+	keyData  []byte       //当前分片的密钥, 得到密钥失败时为nil, 分片丢弃
+	keyBlock cipher.Block //SAMPLE-AES
+	keyIV    []byte       //当前分片的IV, 为分片序号
+
+	//fMP4(CMAF)分片, 与TS在相同的位置切片
+	segmenter *mp4.Segmenter
+	cmafCache *CMAFCache
+	segTs     uint32 //当前分片开始的时间戳
+
+	segStart   time.Time     //当前分片开始时间
+	segCue     TSCue         //当前分片的广告标记
+	pendingCue *amf.CuePoint //等待在下一个关键帧切片的广告标记
+	breakCue   *TSCue        //当前广告, nil表示不在广告中
+
+	//不连续: 重新推流或sequence header变化时立即切片, 新分片前插入EXT-X-DISCONTINUITY
+	discontinuity    bool      //下一个分片不连续
+	segDiscontinuity bool      //当前分片不连续
+	videoSeq         []byte    //当前的AVC sequence header
+	audioSeq         []byte    //当前的AAC sequence header
+	closeTime        time.Time //推流结束时间, RepublishGrace之内重新推流时继续使用播放列表
+
+	//按需切片: 第一次请求播放列表时开始, 超过IdleTimeout没有请求时停止
+	onDemand    bool
+	lastRequest time.Time
+	reqLock     sync.Mutex
+}
+
+//handoverTimeout 重新推流时等待之前的Source发送结束的最长时间, 超时后使用新的播放列表
+var handoverTimeout = 5 * time.Second
+
+func NewSource(info av.Info, cfg Config) *Source {
+	return newSource(info, cfg, nil)
 }
 
-func NewSource(info av.Info) *Source {
+//newSource prev不为nil时是推流断开后重新推流, 由发送协程接管prev的播放列表, 不阻塞发布者
+func newSource(info av.Info, cfg Config, prev *Source) *Source {
 	info.Inter = true
 	s := &Source{
 		info:        info,
+		cfg:         cfg,
+		session:     time.Now(),
 		align:       &align{},
 		stat:        newStatus(),
 		RWBaser:     av.NewRWBaser(time.Second * 10),
 		cache:       newAudioCache(),
 		demuxer:     flv.NewDemuxer(),
 		muxer:       ts.NewMuxer(),
-		tsCache:     NewTSCacheItem(info.Key),
 		tsparser:    parser.NewCodecParser(),
 		bwriter:     bytes.NewBuffer(make([]byte, 100*1024)),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
+		done:        make(chan struct{}),
+		soundFormat: av.SOUND_AAC,
+	}
+	s.muxer.EnableTimedMetadata()
+	s.tsCache, s.audioTsCache = newTsCaches(info, cfg)
+	if cfg.AudioOnly {
+		s.audioMuxer = ts.NewMuxer()
+		s.audioWriter = bytes.NewBuffer(nil)
+	}
+	//接管完成之前显示之前的播放列表
+	if prev != nil {
+		s.tsCache = prev.tsCache
+		if s.audioTsCache != nil && prev.audioTsCache != nil {
+			s.audioTsCache = prev.audioTsCache
+		}
+	}
+	if cfg.EncryptMethod != "" {
+		s.keys = NewKeyProvider(cfg)
+		if cfg.EncryptMethod == methodSampleAES {
+			s.muxer.EnableSampleAES(nil)
+			if s.audioMuxer != nil {
+				s.audioMuxer.EnableSampleAES(nil)
+			}
+		}
+	}
+	//加密时不生成fMP4分片
+	if cfg.Fmp4 && s.keys == nil {
+		s.segmenter = mp4.NewSegmenter()
+		s.cmafCache = NewCMAFCache(info.Key, s.session, cfg)
+	} else if cfg.Fmp4 {
+		log.Infof("[%v] hls fmp4 disabled with %s encryption", info, cfg.EncryptMethod)
 	}
 	go func() {
+		defer close(s.done)
+		if prev != nil {
+			s.continueFrom(prev)
+		}
 		err := s.SendPacket()
 		if err != nil {
 			log.Error("send packet error: ", err)
-			s.closed = true
+			s.markClosed()
 		}
 	}()
 	return s
 }
 
+//newTsCaches TS分片和纯音频分片的缓存, 没有开启纯音频时为nil
+func newTsCaches(info av.Info, cfg Config) (*TSCacheItem, *TSCacheItem) {
+	var audioTsCache *TSCacheItem
+	if cfg.AudioOnly {
+		audioCfg := cfg
+		audioCfg.PartDuration = 0
+		audioTsCache = NewTSCacheItemWithConfig(info.Key, audioCfg)
+	}
+	return NewTSCacheItemWithConfig(info.Key, cfg), audioTsCache
+}
+
+//continueFrom 推流断开后重新推流, 继续使用之前的播放列表和分片序号
+//在发送协程中等待之前的Source发送结束后接管分片缓存, 之前的Source不再删除这些缓存
+//等待超时或者分片缓存已经删除时使用新的播放列表
+func (source *Source) continueFrom(prev *Source) {
+	select {
+	case <-prev.done:
+	case <-time.After(handoverTimeout):
+		log.Errorf("[%v] hls previous source not stopped, start new playlist", source.info)
+		source.resetCaches()
+		return
+	}
+	prev.closeLock.Lock()
+	released := prev.released
+	prev.released = true
+	prev.closeLock.Unlock()
+	if released {
+		source.resetCaches()
+		return
+	}
+	log.Infof("[%v] hls continue playlist from sequence %d", source.info, prev.seq)
+	source.seq = prev.seq
+	source.session = prev.session
+	source.tsCache.DropParts()
+	source.discontinuity = true
+}
+
+//resetCaches 不能接管之前的播放列表时换成新的分片缓存
+func (source *Source) resetCaches() {
+	tsCache, audioTsCache := newTsCaches(source.info, source.cfg)
+	source.closeLock.Lock()
+	source.tsCache, source.audioTsCache = tsCache, audioTsCache
+	source.closeLock.Unlock()
+}
+
+//GetCacheInc TS分片, 分片缓存删除后为nil
 func (source *Source) GetCacheInc() *TSCacheItem {
+	source.closeLock.RLock()
+	defer source.closeLock.RUnlock()
+	if source.released {
+		return nil
+	}
 	return source.tsCache
 }
 
+//GetCMAFCache fMP4分片, 没有开启时为nil
+func (source *Source) GetCMAFCache() *CMAFCache {
+	if source.isReleased() {
+		return nil
+	}
+	return source.cmafCache
+}
+
 func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
 	log.Infof("[%v] packet queue max!!!", info)
 	for i := 0; i < maxQueueNum-84; i++ {
@@ -99,6 +260,9 @@ func (source *Source) DropPacket(pktQue chan *av.Packet, info av.Info) {
 
 func (source *Source) Write(p *av.Packet) (err error) {
 	err = nil
+	//持有读锁时包队列不会被关闭
+	source.closeLock.RLock()
+	defer source.closeLock.RUnlock()
 	if source.closed {
 		err = errors.New("hls source closed")
 		return
@@ -113,9 +277,7 @@ func (source *Source) Write(p *av.Packet) (err error) {
 	if len(source.packetQueue) >= maxQueueNum-24 {
 		source.DropPacket(source.packetQueue, source.info)
 	} else {
-		if !source.closed {
-			source.packetQueue <- p
-		}
+		source.packetQueue <- p
 	}
 	return
 }
@@ -124,22 +286,23 @@ func (source *Source) SendPacket() error {
 	defer func() {
 		log.Infof("[%v] hls sender stop", source.info)
 		if r := recover(); r != nil {
-			log.Errorf("hls SendPacket panic: ", r)
+			log.Errorf("hls SendPacket panic: %v", r)
 		}
 	}()
 
 	log.Infof("[%v] hls sender start", source.info)
 	for {
-		if source.closed {
-			return errors.New("closed")
-		}
-
 		p, ok := <-source.packetQueue
 		if ok {
 			if p.IsMetadata {
+				if err := source.metadataMux(p); err != nil {
+					log.Error(err)
+				}
 				continue
 			}
 
+			//fMP4使用完整的FLV tag
+			data := p.Data
 			err := source.demuxer.Demux(p)
 			if err == flv.ErrAvcEndSEQ {
 				log.Error(err)
@@ -154,10 +317,14 @@ func (source *Source) SendPacket() error {
 			if err != nil {
 				log.Error(err)
 			}
+			if err == nil {
+				source.fmp4Mux(p, data, isSeq)
+			}
 			if err != nil || isSeq {
 				continue
 			}
 			if source.btswriter != nil {
+				source.checkPart(p)
 				source.stat.update(p.IsVideo, p.TimeStamp)
 				source.calcPtsDts(p.IsVideo, p.TimeStamp, uint32(compositionTime))
 				source.tsMux(p)
@@ -172,33 +339,134 @@ func (source *Source) Info() (ret av.Info) {
 	return source.info
 }
 
-func (source *Source) cleanup() {
+//markClosed 标记推流结束并关闭包队列, SendPacket发送完队列中的包后结束, 已经关闭时返回false
+func (source *Source) markClosed() bool {
+	source.closeLock.Lock()
+	defer source.closeLock.Unlock()
+
+	if source.closed {
+		return false
+	}
+	source.closed = true
+	source.closeTime = time.Now()
 	close(source.packetQueue)
-	source.bwriter = nil
-	source.btswriter = nil
-	source.cache = nil
-	source.tsCache = nil
+	return true
+}
+
+func (source *Source) isClosed() bool {
+	source.closeLock.RLock()
+	defer source.closeLock.RUnlock()
+
+	return source.closed
+}
+
+func (source *Source) isReleased() bool {
+	source.closeLock.RLock()
+	defer source.closeLock.RUnlock()
+
+	return source.released
+}
+
+//release 等待SendPacket结束后删除分片缓存, 切片的状态只在SendPacket中使用, 不需要删除
+func (source *Source) release() {
+	<-source.done
+	source.closeLock.Lock()
+	defer source.closeLock.Unlock()
+
+	if source.released {
+		return
+	}
+	source.released = true
+	source.tsCache.Clear()
+	if source.cmafCache != nil {
+		source.cmafCache.Clear()
+	}
+	if source.audioTsCache != nil {
+		source.audioTsCache.Clear()
+	}
 }
 
 func (source *Source) Close(err error) {
 	log.Info("hls source closed: ", source.info)
-	if !source.closed {
-		source.cleanup()
+	//RepublishGrace大于0时保留播放列表, 超过RepublishGrace没有重新推流时由服务删除
+	if source.markClosed() && source.cfg.RepublishGrace <= 0 {
+		source.release()
 	}
-	source.closed = true
 }
 
-func (source *Source) cut() {
+//expired 推流结束超过RepublishGrace, 或者超时没有数据, 可以从服务中删除
+func (source *Source) expired(now time.Time) bool {
+	if !source.isClosed() {
+		if source.Alive() {
+			return false
+		}
+		source.Close(errors.New("hls source timeout"))
+	}
+	source.closeLock.RLock()
+	closeTime := source.closeTime
+	source.closeLock.RUnlock()
+	if source.cfg.RepublishGrace > 0 && now.Sub(closeTime) < source.cfg.RepublishGrace {
+		return false
+	}
+	source.release()
+	return true
+}
+
+//setOnDemand 按需开始切片, 超过IdleTimeout没有请求时停止
+func (source *Source) setOnDemand() {
+	source.reqLock.Lock()
+	source.onDemand = true
+	source.lastRequest = time.Now()
+	source.reqLock.Unlock()
+}
+
+//touch 记录播放列表和分片请求的时间
+func (source *Source) touch() {
+	source.reqLock.Lock()
+	source.lastRequest = time.Now()
+	source.reqLock.Unlock()
+}
+
+//idle 按需切片的流超过IdleTimeout没有请求
+func (source *Source) idle(now time.Time) bool {
+	source.reqLock.Lock()
+	defer source.reqLock.Unlock()
+
+	return source.onDemand && !source.isClosed() && source.cfg.IdleTimeout > 0 && now.Sub(source.lastRequest) >= source.cfg.IdleTimeout
+}
+
+//stop 没有观看者时停止按需切片, 不保留播放列表, 推流写入时返回错误后从流中删除
+func (source *Source) stop() {
+	log.Info("hls source idle stop: ", source.info)
+	if source.markClosed() {
+		source.release()
+	}
+}
+
+func (source *Source) cut(timestamp uint32) {
 	newf := true
 	if source.btswriter == nil {
 		source.btswriter = bytes.NewBuffer(nil)
-	} else if source.btswriter != nil && source.stat.durationMs() >= duration {
+	} else if source.btswriter != nil && (source.stat.durationMs() >= source.cfg.SegmentDuration || source.needSplice() || source.discontinuity) {
 		source.flushAudio()
+		source.closePart(timestamp)
 
 		source.seq++
-		filename := fmt.Sprintf("/%s/%d.ts", source.info.Key, time.Now().Unix())
+		filename := segmentName(source.info.Key, source.session, source.seq)
 		item := NewTSItem(filename, int(source.stat.durationMs()), source.seq, source.btswriter.Bytes())
-		source.tsCache.SetItem(filename, item)
+		item.StartDate = source.segStart
+		item.Timestamp = source.segTs
+		item.Cue = source.segCue
+		item.Key = source.key
+		item.Discontinuity = source.segDiscontinuity
+		if source.encrypt(&item) {
+			source.tsCache.SetItem(filename, item)
+			source.cutAudio(item)
+		}
+		source.cutFmp4(timestamp, item)
+		if source.breakCue != nil {
+			source.breakCue.Elapsed += float64(item.Duration) / 1000
+		}
 
 		source.btswriter.Reset()
 		source.stat.resetAndNew()
@@ -206,9 +474,219 @@ func (source *Source) cut() {
 		newf = false
 	}
 	if newf {
+		source.segDiscontinuity = source.discontinuity
+		source.discontinuity = false
+		source.segStart = time.Now()
+		source.segTs = timestamp
+		source.segCue = source.nextCue()
 		source.btswriter.Write(source.muxer.PAT())
-		source.btswriter.Write(source.muxer.PMT(av.SOUND_AAC, true))
+		source.btswriter.Write(source.muxer.PMT(source.soundFormat, true))
+		if source.audioWriter != nil {
+			source.audioWriter.Reset()
+			source.audioWriter.Write(source.audioMuxer.PAT())
+			source.audioWriter.Write(source.audioMuxer.PMT(source.soundFormat, false))
+		}
+		source.startKey()
+		source.startPart(timestamp, 0)
+	}
+}
+
+//cutAudio 与TS分片同时结束纯音频分片
+func (source *Source) cutAudio(ts TSItem) {
+	if source.audioWriter == nil || !source.hasAudio || !source.hasVideo {
+		return
+	}
+	filename := audioSegmentName(source.info.Key, source.session, ts.SeqNum)
+	item := NewTSItem(filename, ts.Duration, ts.SeqNum, source.audioWriter.Bytes())
+	item.StartDate = ts.StartDate
+	item.Timestamp = ts.Timestamp
+	item.Cue = ts.Cue
+	item.Key = ts.Key
+	item.Discontinuity = ts.Discontinuity
+	if source.encrypt(&item) {
+		source.audioTsCache.SetItem(filename, item)
+	}
+}
+
+//fmp4Mux 写入fMP4分片, data为转换成TS之前的FLV tag
+func (source *Source) fmp4Mux(p *av.Packet, data []byte, isSeq bool) {
+	if source.segmenter == nil || (!isSeq && source.btswriter == nil) {
+		return
+	}
+	fp := *p
+	fp.Data = data
+	if err := source.segmenter.WritePacket(&fp); err != nil {
+		log.Error("hls fmp4 write packet error: ", err)
+	}
+}
+
+//cutFmp4 与TS分片同时结束fMP4分片, 第一个分片完成时生成初始化分片
+func (source *Source) cutFmp4(timestamp uint32, ts TSItem) {
+	if source.segmenter == nil {
+		return
+	}
+	data, err := source.segmenter.Segment(timestamp)
+	if err != nil {
+		log.Error("hls fmp4 segment error: ", err)
+		return
+	}
+	if !source.cmafCache.HasInit() {
+		init := source.segmenter.Init()
+		if init == nil {
+			return
+		}
+		width, height := source.segmenter.Resolution()
+		start := ts.StartDate.Add(-time.Duration(ts.Timestamp) * time.Millisecond)
+		source.cmafCache.SetInit(init, source.segmenter.Codecs(), width, height, source.segmenter.SampleRate(), start)
+	}
+	//时长到下一个分片开始, DASH时间线连续
+	duration := ts.Duration
+	if timestamp > ts.Timestamp {
+		duration = int(timestamp - ts.Timestamp)
 	}
+	filename := fmp4SegmentName(source.info.Key, source.session, ts.SeqNum)
+	item := NewTSItem(filename, duration, ts.SeqNum, data)
+	item.StartDate = ts.StartDate
+	item.Timestamp = ts.Timestamp
+	item.Cue = ts.Cue
+	source.cmafCache.SetItem(filename, item)
+}
+
+//startPart 开始新的部分分片, 分片开始时都在关键帧上
+func (source *Source) startPart(timestamp uint32, offset int) {
+	if source.cfg.PartDuration <= 0 {
+		return
+	}
+	if offset == 0 {
+		source.partIndex = 0
+		source.partIndependent = true
+	}
+	source.partOffset = offset
+	source.partStart = timestamp
+	source.tsCache.SetPreloadHint(partName(source.info.Key, source.session, source.seq+1, source.partIndex))
+}
+
+//checkPart 加入下一个包会超过部分分片时长时, 结束当前部分分片
+func (source *Source) checkPart(p *av.Packet) {
+	if source.cfg.PartDuration <= 0 {
+		return
+	}
+	var gap int64
+	if p.TimeStamp > source.lastTs {
+		gap = int64(p.TimeStamp - source.lastTs)
+	}
+	source.lastTs = p.TimeStamp
+
+	elapsed := int64(p.TimeStamp) - int64(source.partStart)
+	if source.btswriter.Len() > source.partOffset && elapsed+gap > source.cfg.PartDuration {
+		source.flushAudio()
+		source.closePart(p.TimeStamp)
+		source.partIndependent = !source.hasVideo
+		if p.IsVideo {
+			if vh, ok := p.Header.(av.VideoPacketHeader); ok && vh.IsKeyFrame() {
+				source.partIndependent = true
+			}
+		}
+		source.startPart(p.TimeStamp, source.btswriter.Len())
+	}
+}
+
+//closePart 结束当前部分分片, 数据为当前分片中还没有加入部分分片的部分
+func (source *Source) closePart(timestamp uint32) {
+	if source.cfg.PartDuration <= 0 || source.btswriter.Len() <= source.partOffset {
+		return
+	}
+	duration := int64(timestamp) - int64(source.partStart)
+	if duration < 0 {
+		duration = 0
+	}
+	data := source.btswriter.Bytes()[source.partOffset:]
+	part := TSPart{
+		Name:        partName(source.info.Key, source.session, source.seq+1, source.partIndex),
+		Duration:    int(duration),
+		Independent: source.partIndependent,
+		Data:        make([]byte, len(data)),
+	}
+	copy(part.Data, data)
+	if source.keys != nil {
+		if source.keyData == nil {
+			return
+		}
+		if source.key.Method == methodAES128 {
+			var err error
+			if part.Data, err = encryptSegment(source.keyData, source.seq+1, part.Data); err != nil {
+				log.Error("hls encrypt part error: ", err)
+				return
+			}
+		}
+	}
+	source.tsCache.AddPart(source.seq+1, part)
+	source.partIndex++
+	source.partOffset = source.btswriter.Len()
+}
+
+//needSplice 是否需要在广告开始/结束处切片
+func (source *Source) needSplice() bool {
+	if source.pendingCue != nil {
+		return true
+	}
+	if source.breakCue != nil && source.breakCue.Duration > 0 {
+		elapsed := source.breakCue.Elapsed + float64(source.stat.durationMs())/1000
+		return elapsed >= source.breakCue.Duration
+	}
+	return false
+}
+
+//nextCue 计算新分片的广告标记
+func (source *Source) nextCue() TSCue {
+	if cue := source.pendingCue; cue != nil {
+		source.pendingCue = nil
+		if cue.Out {
+			id := cue.Id
+			if id == 0 {
+				id = uint32(source.segStart.Unix())
+			}
+			scte35 := cue.Scte35
+			if scte35 == nil {
+				scte35 = ts.SpliceInsert(id, true, uint64(cue.Duration*videoHZ), cue.Duration > 0)
+			}
+			source.breakCue = &TSCue{
+				Tag:       cueOutTag,
+				Id:        id,
+				StartDate: source.segStart,
+				Duration:  cue.Duration,
+				Scte35:    scte35,
+			}
+			return *source.breakCue
+		}
+		if source.breakCue != nil {
+			return source.endBreak(cue.Scte35)
+		}
+		return TSCue{}
+	}
+
+	if source.breakCue != nil {
+		if source.breakCue.Duration > 0 && source.breakCue.Elapsed >= source.breakCue.Duration {
+			return source.endBreak(nil)
+		}
+		cue := *source.breakCue
+		cue.Tag = cueContTag
+		return cue
+	}
+	return TSCue{}
+}
+
+//endBreak 结束当前广告
+func (source *Source) endBreak(scte35 []byte) TSCue {
+	cue := *source.breakCue
+	cue.Tag = cueInTag
+	cue.EndDate = source.segStart
+	if scte35 == nil {
+		scte35 = ts.SpliceInsert(cue.Id, false, 0, false)
+	}
+	cue.Scte35 = scte35
+	source.breakCue = nil
+	return cue
 }
 
 func (source *Source) parse(p *av.Packet) (int32, bool, error) {
@@ -222,14 +700,31 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 		}
 		compositionTime = vh.CompositionTime()
 		if vh.IsKeyFrame() && vh.IsSeq() {
+			source.checkSequenceHeader(&source.videoSeq, p.Data)
+			source.hasVideo = true
+			source.media.setVideo(p.Data)
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	} else {
 		ah = p.Header.(av.AudioPacketHeader)
-		if ah.SoundFormat() != av.SOUND_AAC {
+		switch ah.SoundFormat() {
+		case av.SOUND_AAC:
+		case av.SOUND_MP3, av.SOUND_MP3_8KHZ, av.SOUND_AC3:
+		default:
 			return compositionTime, false, ErrNoSupportAudioCodec
 		}
-		if ah.AACPacketType() == av.AAC_SEQHDR {
+		if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+			source.checkSequenceHeader(&source.audioSeq, p.Data)
+			source.hasAudio = true
+			source.soundFormat = av.SOUND_AAC
+			source.media.setAudio(p.Data)
+			if source.cfg.EncryptMethod == methodSampleAES {
+				config := append([]byte(nil), p.Data...)
+				source.muxer.EnableSampleAES(config)
+				if source.audioMuxer != nil {
+					source.audioMuxer.EnableSampleAES(config)
+				}
+			}
 			return compositionTime, true, source.tsparser.Parse(p, source.bwriter)
 		}
 	}
@@ -238,20 +733,45 @@ func (source *Source) parse(p *av.Packet) (int32, bool, error) {
 		return compositionTime, false, err
 	}
 	p.Data = source.bwriter.Bytes()
+	if p.IsAudio && ah.SoundFormat() != av.SOUND_AAC {
+		source.setSoundFormat(ah.SoundFormat())
+	}
 
-	if p.IsVideo && vh.IsKeyFrame() {
-		source.cut()
+	//在关键帧处切片, 纯音频流在音频帧处切片
+	if (p.IsVideo && vh.IsKeyFrame()) || (p.IsAudio && !source.hasVideo) {
+		//时间戳回退(推流端重启)时不连续
+		if source.btswriter != nil && p.TimeStamp < source.segTs {
+			source.discontinuity = true
+		}
+		source.cut(p.TimeStamp)
 	}
 	return compositionTime, false, nil
 }
 
+//checkSequenceHeader sequence header变化时(分辨率或音频参数变化)在下一个关键帧切片
+//新分片以新的PAT/PMT开始, 关键帧前带新的SPS/PPS
+func (source *Source) checkSequenceHeader(current *[]byte, data []byte) {
+	if *current != nil && !bytes.Equal(*current, data) && source.btswriter != nil {
+		log.Infof("[%v] hls sequence header changed", source.info)
+		source.discontinuity = true
+	}
+	*current = append((*current)[:0], data...)
+}
+
 func (source *Source) calcPtsDts(isVideo bool, ts, compositionTs uint32) {
 	source.dts = uint64(ts) * h264_default_hz
 	if isVideo {
 		source.pts = source.dts + uint64(compositionTs)*h264_default_hz
 	} else {
+		//MP3和AC-3每帧的采样数不同, 由实际的帧计算
+		samples, err := source.tsparser.Samples()
+		if err != nil {
+			samples = aacSampleLen
+		}
 		sampleRate, _ := source.tsparser.SampleRate()
-		source.align.align(&source.dts, uint32(videoHZ*aacSampleLen/sampleRate))
+		if sampleRate > 0 {
+			source.align.align(&source.dts, uint32(videoHZ*samples/sampleRate))
+		}
 		source.pts = source.dts
 	}
 }
@@ -267,14 +787,150 @@ func (source *Source) muxAudio(limit byte) error {
 	_, pts, buf := source.cache.GetFrame()
 	p.Data = buf
 	p.TimeStamp = uint32(pts / h264_default_hz)
-	return source.muxer.Mux(&p, source.btswriter)
+	if source.audioWriter != nil {
+		if err := source.audioMuxer.MuxDts(&p, int64(pts), source.audioWriter); err != nil {
+			return err
+		}
+	}
+	return source.muxer.MuxDts(&p, int64(pts), source.btswriter)
+}
+
+//metadataMux 将自定义数据消息转换为ID3写入TS, onMetaData不写入
+//onCuePoint在下一个关键帧处切片并标记广告
+func (source *Source) metadataMux(p *av.Packet) error {
+	name, args, err := amf.DecodeDataMessage(p.Data)
+	if err != nil {
+		return err
+	}
+	if name == amf.OnCuePoint {
+		cue, err := amf.ParseCuePoint(args)
+		if err != nil {
+			return err
+		}
+		source.pendingCue = cue
+	}
+	if name == amf.OnMetaData || source.btswriter == nil {
+		return nil
+	}
+	var value []byte
+	if len(args) == 1 {
+		value, err = json.Marshal(args[0])
+	} else {
+		value, err = json.Marshal(args)
+	}
+	if err != nil {
+		return err
+	}
+
+	var mp av.Packet
+	mp.IsMetadata = true
+	mp.TimeStamp = p.TimeStamp
+	mp.Data = ts.ID3TXXX(name, string(value))
+	return source.muxer.Mux(&mp, source.btswriter)
 }
 
 func (source *Source) tsMux(p *av.Packet) error {
 	if p.IsVideo {
+		if source.keyBlock != nil {
+			p.Data = sampleEncryptH264(source.keyBlock, source.keyIV, p.Data)
+		}
 		return source.muxer.Mux(p, source.btswriter)
 	} else {
-		source.cache.Cache(p.Data, source.pts)
+		data := p.Data
+		if source.keyBlock != nil && source.soundFormat == av.SOUND_AAC {
+			data = sampleEncryptAAC(source.keyBlock, source.keyIV, data)
+		}
+		source.cache.Cache(data, source.pts)
 		return source.muxAudio(cache_max_frames)
 	}
 }
+
+//setSoundFormat MP3和AC-3没有sequence header, 由音频帧得到格式, 下一个分片的PMT中使用
+func (source *Source) setSoundFormat(format uint8) {
+	if format == av.SOUND_MP3_8KHZ {
+		format = av.SOUND_MP3
+	}
+	mpeg2 := format == av.SOUND_MP3 && !source.tsparser.MPEG1Audio()
+	source.muxer.SetMPEG2Audio(mpeg2)
+	if source.audioMuxer != nil {
+		source.audioMuxer.SetMPEG2Audio(mpeg2)
+	}
+	if source.hasAudio && source.soundFormat == format {
+		return
+	}
+	source.hasAudio = true
+	source.soundFormat = format
+	switch format {
+	case av.SOUND_MP3:
+		source.media.setAudioCodec("mp4a.40.34")
+	case av.SOUND_AC3:
+		source.media.setAudioCodec("ac-3")
+	}
+}
+
+//startKey 新分片开始时得到密钥, 每KeyRotate个分片更换密钥
+func (source *Source) startKey() {
+	if source.keys == nil {
+		return
+	}
+	seq := source.seq + 1
+	index := 0
+	if source.cfg.KeyRotate > 0 {
+		index = (seq - 1) / source.cfg.KeyRotate
+	}
+	name := keyName(source.session, index)
+	uri := keyURI(source.info.Key, name)
+	if uri != source.key.URI || source.keyData == nil {
+		source.key = TSKey{Method: source.cfg.EncryptMethod, URI: uri}
+		source.keyData, source.keyBlock = nil, nil
+		data, err := source.keys.Key(source.info.Key, name)
+		if err != nil {
+			log.Errorf("[%v] hls get key %s error: %v", source.info, name, err)
+			return
+		}
+		block, err := aes.NewCipher(data)
+		if err != nil {
+			log.Errorf("[%v] hls key %s error: %v", source.info, name, err)
+			return
+		}
+		source.keyData = data
+		if source.key.Method == methodSampleAES {
+			source.keyBlock = block
+		}
+	}
+	source.keyIV = segmentIV(seq)
+	source.tsCache.SetKey(source.key)
+	if source.audioTsCache != nil {
+		source.audioTsCache.SetKey(source.key)
+	}
+}
+
+//encrypt AES-128加密分片, 没有得到密钥时分片丢弃
+func (source *Source) encrypt(item *TSItem) bool {
+	if source.keys == nil {
+		return true
+	}
+	if source.keyData == nil {
+		log.Errorf("[%v] hls drop segment %s without key", source.info, item.Name)
+		return false
+	}
+	if source.key.Method != methodAES128 {
+		return true
+	}
+	data, err := encryptSegment(source.keyData, item.SeqNum, item.Data)
+	if err != nil {
+		log.Errorf("[%v] hls encrypt segment %s error: %v", source.info, item.Name, err)
+		return false
+	}
+	item.Data = data
+	item.Size = len(data)
+	return true
+}
+
+//GetKey 得到密钥, 只提供本次推流的密钥
+func (source *Source) GetKey(name string) ([]byte, error) {
+	if source.keys == nil || !strings.HasPrefix(name, source.session.Format("20060102150405")+"-key-") {
+		return nil, ErrInvalidKey
+	}
+	return source.keys.Key(source.info.Key, name)
+}
@@ -0,0 +1,149 @@
+package hls
+
+import (
+	"configure"
+	"fmt"
+	"io/ioutil"
+	log "logging"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//Config 应用的HLS配置
+type Config struct {
+	SegmentDuration int64         //分片目标时长(毫秒)
+	PlaylistLength  int           //播放列表中的分片数
+	Dir             string        //分片保存目录, 为空时保存在内存中
+	Retain          int           //分片离开播放列表后在磁盘上保留的个数
+	PartDuration    int64         //LL-HLS部分分片时长(毫秒), 0表示不开启
+	Fmp4            bool          //同时生成fMP4(CMAF)分片
+	AudioOnly       bool          //同时生成纯音频TS分片和主播放列表
+	EncryptMethod   string        //AES-128或SAMPLE-AES, 为空时不加密
+	KeyRotate       int           //每N个分片更换密钥, 0表示不更换
+	KeyDir          string        //本地密钥目录
+	KeyService      string        //HTTP密钥服务地址
+	TokenSecret     string        //播放token签名密钥, 为空时不检查token
+	SessionTimeout  time.Duration //观看会话过期时间
+	IssueSession    bool          //第一次请求播放列表时分配会话ID
+	RepublishGrace  time.Duration //推流断开后保留播放列表的时间, 期间重新推流时继续分片序号
+	IdleTimeout     time.Duration //按需切片时没有请求后停止切片的时间
+}
+
+func NewConfig(info configure.HlsInfo) Config {
+	return Config{
+		SegmentDuration: int64(info.SegmentDuration) * 1000,
+		PlaylistLength:  info.PlaylistLength,
+		Dir:             info.Dir,
+		Retain:          info.Retain,
+		PartDuration:    int64(info.PartDuration),
+		Fmp4:            info.Fmp4,
+		AudioOnly:       info.AudioOnly,
+		EncryptMethod:   strings.ToUpper(info.Encrypt.Method),
+		KeyRotate:       info.Encrypt.Rotate,
+		KeyDir:          info.Encrypt.KeyDir,
+		KeyService:      info.Encrypt.KeyService,
+		TokenSecret:     info.Encrypt.TokenSecret,
+		SessionTimeout:  time.Duration(info.SessionTimeout) * time.Second,
+		IssueSession:    info.IssueSession,
+		RepublishGrace:  time.Duration(info.RepublishGrace) * time.Second,
+		IdleTimeout:     time.Duration(info.IdleTimeout) * time.Minute,
+	}
+}
+
+//diskStore 分片保存在磁盘上, 内存中只保留播放列表
+//分片离开播放列表后再保留retain个, 避免播放器还没有下载完
+type diskStore struct {
+	dir    string
+	retain int
+	old    []string //离开播放列表但仍保留在磁盘上的分片
+}
+
+func newDiskStore(dir string, retain int) *diskStore {
+	return &diskStore{
+		dir:    dir,
+		retain: retain,
+	}
+}
+
+//file 分片名称对应的文件, 名称中的..不能跳出保存目录
+func (d *diskStore) file(name string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+//write 写入临时文件后改名, 播放器不会读到写了一半的分片
+func (d *diskStore) write(name string, data []byte) error {
+	file := d.file(name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (d *diskStore) read(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.file(name))
+}
+
+//evict 分片离开播放列表, 删除超过保留个数的分片
+func (d *diskStore) evict(name string) {
+	d.old = append(d.old, name)
+	for len(d.old) > d.retain {
+		d.remove(d.old[0])
+		d.old = d.old[1:]
+	}
+}
+
+//clear 流结束时删除所有分片
+func (d *diskStore) clear(names []string) {
+	for _, name := range append(d.old, names...) {
+		d.remove(name)
+	}
+	d.old = nil
+}
+
+func (d *diskStore) remove(name string) {
+	if err := os.Remove(d.file(name)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("hls remove segment %s error: %v", name, err)
+	}
+}
+
+//segmentName 按序号命名分片, 加上流开始时间避免重新推流后与之前的分片重名
+func segmentName(key string, session time.Time, seq int) string {
+	return fmt.Sprintf("/%s/%s-%d.ts", key, session.Format("20060102150405"), seq)
+}
+
+//audioSegmentName 纯音频分片名称
+func audioSegmentName(key string, session time.Time, seq int) string {
+	return fmt.Sprintf("/%s/%s-audio-%d.ts", key, session.Format("20060102150405"), seq)
+}
+
+//keyName 第index个密钥的名称
+func keyName(session time.Time, index int) string {
+	return fmt.Sprintf("%s-key-%d", session.Format("20060102150405"), index)
+}
+
+//keyURI 密钥地址
+func keyURI(key string, name string) string {
+	return fmt.Sprintf("/%s/%s.key", key, name)
+}
+
+//fmp4SegmentName fMP4分片名称
+func fmp4SegmentName(key string, session time.Time, seq int) string {
+	return fmt.Sprintf("/%s/%s-%d.m4s", key, session.Format("20060102150405"), seq)
+}
+
+//fmp4MediaTemplate DASH SegmentTemplate中的fMP4分片名称
+func fmp4MediaTemplate(key string, session time.Time) string {
+	return fmt.Sprintf("/%s/%s-$Number$.m4s", key, session.Format("20060102150405"))
+}
+
+//fmp4InitName fMP4初始化分片名称
+func fmp4InitName(key string, session time.Time) string {
+	return fmt.Sprintf("/%s/%s-init.mp4", key, session.Format("20060102150405"))
+}
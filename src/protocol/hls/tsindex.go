@@ -0,0 +1,248 @@
+package hls
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	ptsHZ        = 90000
+)
+
+var ErrInvalidTs = errors.New("invalid ts file")
+
+//VodSegment 录制文件中的一个分片, 通过字节范围访问, 不需要重新封装
+type VodSegment struct {
+	Offset   int64   //分片在文件中的起始位置
+	Length   int64   //分片字节数
+	Time     float64 //相对文件开始的时间(秒)
+	Duration float64 //分片时长(秒)
+}
+
+//tsScanner 按188字节扫描TS文件, 在关键帧处切分
+type tsScanner struct {
+	target   int64 //分片目标时长(90kHz)
+	pmtPid   int
+	videoPid int
+	audioPid int
+
+	patOffset   int64 //最近一个PAT的位置
+	mediaOffset int64 //最近一个音视频包的位置
+	firstPts    int64
+	lastPts     int64
+	segStarts   []int64
+	segPts      []int64
+}
+
+//ScanTs 扫描TS文件, 返回在关键帧对齐的分片, 每个分片不短于target秒
+//纯音频文件按音频PES切分
+func ScanTs(file string, target float64) ([]VodSegment, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tsScanner{
+		target:      int64(target * ptsHZ),
+		pmtPid:      -1,
+		videoPid:    -1,
+		audioPid:    -1,
+		patOffset:   -1,
+		mediaOffset: -1,
+		firstPts:    -1,
+		lastPts:     -1,
+	}
+
+	r := bufio.NewReaderSize(f, tsPacketSize*512)
+	packet := make([]byte, tsPacketSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(r, packet); err != nil {
+			//最后不完整的包忽略
+			break
+		}
+		if packet[0] != tsSyncByte {
+			return nil, ErrInvalidTs
+		}
+		s.packet(packet, offset)
+		offset += tsPacketSize
+	}
+
+	if len(s.segStarts) == 0 {
+		return nil, ErrInvalidTs
+	}
+	return s.segments(offset, info.Size()), nil
+}
+
+func (s *tsScanner) packet(packet []byte, offset int64) {
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	unitStart := packet[1]&0x40 != 0
+	adaptation := packet[3] & 0x30
+
+	payload := 4
+	randomAccess := false
+	if adaptation&0x20 != 0 {
+		length := int(packet[4])
+		if length > 0 && packet[5]&0x40 != 0 {
+			randomAccess = true
+		}
+		payload += 1 + length
+	}
+	if adaptation&0x10 == 0 || payload >= tsPacketSize {
+		return
+	}
+	data := packet[payload:]
+
+	switch pid {
+	case 0:
+		s.patOffset = offset
+		if unitStart {
+			s.parsePat(data)
+		}
+		return
+	case s.pmtPid:
+		if unitStart {
+			s.parsePmt(data)
+		}
+		return
+	case s.videoPid, s.audioPid:
+	default:
+		return
+	}
+
+	if !unitStart {
+		s.mediaOffset = offset
+		return
+	}
+
+	pts, ok := pesPts(data)
+	if !ok {
+		s.mediaOffset = offset
+		return
+	}
+	if s.firstPts < 0 {
+		s.firstPts = pts
+		s.segStarts = append(s.segStarts, 0)
+		s.segPts = append(s.segPts, pts)
+	}
+	if pts > s.lastPts {
+		s.lastPts = pts
+	}
+
+	cut := false
+	if s.videoPid >= 0 {
+		cut = pid == s.videoPid && randomAccess
+	} else {
+		cut = pid == s.audioPid
+	}
+	if cut && pts-s.segPts[len(s.segPts)-1] >= s.target {
+		//关键帧前紧挨着的PAT/PMT一起放到新分片中
+		start := offset
+		if s.patOffset > s.mediaOffset {
+			start = s.patOffset
+		}
+		s.segStarts = append(s.segStarts, start)
+		s.segPts = append(s.segPts, pts)
+	}
+	s.mediaOffset = offset
+}
+
+func (s *tsScanner) segments(end, size int64) []VodSegment {
+	segments := make([]VodSegment, 0, len(s.segStarts))
+	for i, start := range s.segStarts {
+		next := end
+		nextPts := s.lastPts
+		if i+1 < len(s.segStarts) {
+			next = s.segStarts[i+1]
+			nextPts = s.segPts[i+1]
+		} else if end < size {
+			next = size
+		}
+		segments = append(segments, VodSegment{
+			Offset:   start,
+			Length:   next - start,
+			Time:     float64(s.segPts[i]-s.firstPts) / ptsHZ,
+			Duration: float64(nextPts-s.segPts[i]) / ptsHZ,
+		})
+	}
+	return segments
+}
+
+//section 跳过pointer_field, 返回section数据
+func section(data []byte) []byte {
+	if len(data) < 1 || int(data[0])+1 >= len(data) {
+		return nil
+	}
+	return data[1+int(data[0]):]
+}
+
+func (s *tsScanner) parsePat(data []byte) {
+	sec := section(data)
+	if len(sec) < 8 {
+		return
+	}
+	length := int(sec[1]&0x0f)<<8 | int(sec[2])
+	end := 3 + length - 4
+	if end > len(sec) {
+		end = len(sec)
+	}
+	for i := 8; i+4 <= end; i += 4 {
+		program := int(sec[i])<<8 | int(sec[i+1])
+		if program != 0 {
+			s.pmtPid = int(sec[i+2]&0x1f)<<8 | int(sec[i+3])
+			return
+		}
+	}
+}
+
+func (s *tsScanner) parsePmt(data []byte) {
+	sec := section(data)
+	if len(sec) < 12 {
+		return
+	}
+	length := int(sec[1]&0x0f)<<8 | int(sec[2])
+	end := 3 + length - 4
+	if end > len(sec) {
+		end = len(sec)
+	}
+	infoLen := int(sec[10]&0x0f)<<8 | int(sec[11])
+	for i := 12 + infoLen; i+5 <= end; {
+		streamType := sec[i]
+		pid := int(sec[i+1]&0x1f)<<8 | int(sec[i+2])
+		esLen := int(sec[i+3]&0x0f)<<8 | int(sec[i+4])
+		switch streamType {
+		case 0x1b, 0x24:
+			if s.videoPid < 0 {
+				s.videoPid = pid
+			}
+		case 0x0f, 0x03, 0x04, 0x81:
+			if s.audioPid < 0 {
+				s.audioPid = pid
+			}
+		}
+		i += 5 + esLen
+	}
+}
+
+//pesPts 从PES头中取出PTS
+func pesPts(data []byte) (int64, bool) {
+	if len(data) < 14 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return 0, false
+	}
+	if data[7]&0x80 == 0 {
+		return 0, false
+	}
+	p := data[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, true
+}
@@ -0,0 +1,136 @@
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "logging"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxVodCache = 4096
+)
+
+var ErrNoRecord = errors.New("no record")
+
+//VodFile 一个录制完成的TS文件
+type VodFile struct {
+	File  string    //本地文件路径, 用于扫描分片
+	Uri   string    //播放列表中的分片地址
+	Start time.Time //文件起始时间
+}
+
+type vodIndex struct {
+	size     int64
+	modTime  time.Time
+	segments []VodSegment
+}
+
+//VodIndexer 生成点播播放列表, 缓存每个文件的分片, 文件变化时重新扫描
+type VodIndexer struct {
+	mutex    sync.Mutex
+	duration float64
+	cache    map[string]*vodIndex
+}
+
+//NewVodIndexer duration为分片目标时长(秒)
+func NewVodIndexer(duration float64) *VodIndexer {
+	return &VodIndexer{
+		duration: duration,
+		cache:    make(map[string]*vodIndex),
+	}
+}
+
+//Segments 得到文件的分片
+func (v *VodIndexer) Segments(file string) ([]VodSegment, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mutex.Lock()
+	idx, ok := v.cache[file]
+	v.mutex.Unlock()
+	if ok && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+		return idx.segments, nil
+	}
+
+	segments, err := ScanTs(file, v.duration)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mutex.Lock()
+	if len(v.cache) >= maxVodCache {
+		v.cache = make(map[string]*vodIndex)
+	}
+	v.cache[file] = &vodIndex{
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		segments: segments,
+	}
+	v.mutex.Unlock()
+	return segments, nil
+}
+
+//Playlist 把多个连续的录制生成一个点播播放列表, 文件之间加EXT-X-DISCONTINUITY
+//start/finish不为零时只保留与[start, finish]有交集的分片
+func (v *VodIndexer) Playlist(files []VodFile, start, finish time.Time) ([]byte, error) {
+	body := bytes.NewBuffer(nil)
+	maxDuration := 0.0
+	count := 0
+
+	for _, file := range files {
+		segments, err := v.Segments(file.File)
+		if err != nil {
+			log.Errorf("VodIndexer scan %s error: %v", file.File, err)
+			continue
+		}
+
+		first := true
+		for _, seg := range segments {
+			segStart := file.Start.Add(time.Duration(seg.Time * float64(time.Second)))
+			segFinish := segStart.Add(time.Duration(seg.Duration * float64(time.Second)))
+			if !start.IsZero() && segFinish.Before(start) {
+				continue
+			}
+			if !finish.IsZero() && segStart.After(finish) {
+				break
+			}
+
+			if first {
+				if count > 0 {
+					fmt.Fprintf(body, "#EXT-X-DISCONTINUITY\n")
+				}
+				fmt.Fprintf(body, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segStart.Format("2006-01-02T15:04:05.000Z07:00"))
+				first = false
+			}
+			fmt.Fprintf(body, "#EXTINF:%.3f,\n", seg.Duration)
+			fmt.Fprintf(body, "#EXT-X-BYTERANGE:%d@%d\n", seg.Length, seg.Offset)
+			fmt.Fprintf(body, "%s\n", file.Uri)
+
+			if seg.Duration > maxDuration {
+				maxDuration = seg.Duration
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil, ErrNoRecord
+	}
+
+	w := bytes.NewBuffer(nil)
+	fmt.Fprintf(w, "#EXTM3U\n")
+	fmt.Fprintf(w, "#EXT-X-VERSION:4\n")
+	fmt.Fprintf(w, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(maxDuration)))
+	fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:0\n")
+	w.Write(body.Bytes())
+	fmt.Fprintf(w, "#EXT-X-ENDLIST\n")
+	return w.Bytes(), nil
+}
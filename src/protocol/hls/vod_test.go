@@ -0,0 +1,141 @@
+package hls
+
+import (
+	"av"
+	"bytes"
+	"container/flv"
+	"container/ts"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeTestTs 写入seconds秒的TS文件, 25fps视频每2秒一个关键帧, 关键帧前写PAT/PMT
+func writeTestTs(t *testing.T, file string, seconds int) {
+	muxer := ts.NewMuxer()
+	demuxer := flv.NewDemuxer()
+	w := bytes.NewBuffer(nil)
+
+	for i := 0; i < seconds*25; i++ {
+		ms := uint32(i * 40)
+		key := i%50 == 0
+		data := []byte{0x27, 0x01, 0, 0, 0}
+		if key {
+			data[0] = 0x17
+			w.Write(muxer.PAT())
+			w.Write(muxer.PMT(av.SOUND_AAC, true))
+		}
+		video := &av.Packet{IsVideo: true, TimeStamp: ms, Data: append(data, make([]byte, 500)...)}
+		if err := demuxer.DemuxH(video); err != nil {
+			t.Fatal(err)
+		}
+		video.Data = video.Data[5:]
+		if err := muxer.Mux(video, w); err != nil {
+			t.Fatal(err)
+		}
+
+		audio := &av.Packet{IsAudio: true, TimeStamp: ms, Data: append([]byte{0xaf, 0x01}, make([]byte, 100)...)}
+		if err := demuxer.DemuxH(audio); err != nil {
+			t.Fatal(err)
+		}
+		audio.Data = audio.Data[2:]
+		if err := muxer.Mux(audio, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, w.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ts")
+	writeTestTs(t, file, 10)
+
+	segments, err := ScanTs(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//关键帧在0,2,4,6,8秒, 不短于3秒时在4,8秒切分
+	if len(segments) != 3 {
+		t.Fatalf("segments=%+v", segments)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	var total int64
+	for i, seg := range segments {
+		if seg.Offset != total {
+			t.Fatalf("segment %d offset=%d want %d", i, seg.Offset, total)
+		}
+		total += seg.Length
+		//每个分片从PAT开始
+		if seg.Offset%188 != 0 || data[seg.Offset+1]&0x1f != 0 || data[seg.Offset+2] != 0 {
+			t.Fatalf("segment %d does not start with PAT", i)
+		}
+	}
+	if total != int64(len(data)) {
+		t.Fatalf("total=%d size=%d", total, len(data))
+	}
+	if segments[1].Time != 4 || segments[1].Duration != 4 || segments[2].Time != 8 {
+		t.Fatalf("segments=%+v", segments)
+	}
+}
+
+func TestVodPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 6, 11, 10, 0, 0, 0, time.Local)
+	var files []VodFile
+	for i, name := range []string{"a.ts", "b.ts"} {
+		file := filepath.Join(dir, name)
+		writeTestTs(t, file, 10)
+		files = append(files, VodFile{
+			File:  file,
+			Uri:   "http://127.0.0.1/" + name,
+			Start: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	v := NewVodIndexer(3)
+	body, err := v.Playlist(files, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := string(body)
+	for _, tag := range []string{"#EXT-X-PLAYLIST-TYPE:VOD", "#EXT-X-TARGETDURATION:4", "#EXT-X-BYTERANGE:", "#EXT-X-ENDLIST"} {
+		if !strings.Contains(playlist, tag) {
+			t.Fatalf("missing %s in\n%s", tag, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXTINF") != 6 || strings.Count(playlist, "#EXT-X-DISCONTINUITY\n") != 1 {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+
+	//只保留第二个文件的第二个分片之后
+	body, err = v.Playlist(files, start.Add(time.Minute+5*time.Second), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist = string(body)
+	if strings.Count(playlist, "#EXTINF") != 2 || strings.Contains(playlist, "a.ts") || strings.Contains(playlist, "#EXT-X-DISCONTINUITY") {
+		t.Fatalf("range playlist:\n%s", playlist)
+	}
+
+	if _, err := v.Playlist(files, start.Add(time.Hour), time.Time{}); err != ErrNoRecord {
+		t.Fatalf("err=%v", err)
+	}
+}
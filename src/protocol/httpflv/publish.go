@@ -0,0 +1,118 @@
+package httpflv
+
+import (
+	"av"
+	"container/flv"
+	"errors"
+	log "logging"
+	"net"
+	"net/http"
+	"protocol/rtmp"
+	"protocol/rtmp/core"
+	"sync"
+	"time"
+)
+
+var ErrPublishOnly = errors.New("http flv publisher is read only")
+
+//flvPublisher HTTP-FLV推流的连接, 请求体中的FLV tag转换为ChunkStream
+//由rtmp.VirReader读取, 与RTMP推流相同的流管理, 统计和关闭
+type flvPublisher struct {
+	app, name, url string
+	peer           string
+	reader         *flv.Reader
+	ctl            *http.ResponseController
+	closed         bool
+	lock           sync.Mutex
+	done           chan struct{}
+}
+
+func (p *flvPublisher) GetInfo() (string, string, string, *core.Conn) {
+	return p.app, p.name, p.url, nil
+}
+
+func (p *flvPublisher) PeerAddr() string {
+	return p.peer
+}
+
+func (p *flvPublisher) Write(core.ChunkStream) error {
+	return ErrPublishOnly
+}
+
+func (p *flvPublisher) Read(cs *core.ChunkStream) error {
+	pkt, err := p.reader.ReadPacket()
+	if err != nil {
+		p.Close(err)
+		return err
+	}
+	switch {
+	case pkt.IsVideo:
+		cs.TypeID = av.TAG_VIDEO
+	case pkt.IsAudio:
+		cs.TypeID = av.TAG_AUDIO
+	default:
+		cs.TypeID = av.TAG_SCRIPTDATAAMF0
+	}
+	cs.StreamID = 1
+	cs.Timestamp = pkt.TimeStamp
+	cs.Data = pkt.Data
+	cs.Length = uint32(len(pkt.Data))
+	return nil
+}
+
+//Close 结束推流, 设置读取超时使正在读取请求体的Read返回
+func (p *flvPublisher) Close(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.ctl.SetReadDeadline(time.Now())
+		close(p.done)
+	}
+}
+
+//handlePublish HTTP-FLV推流: POST/PUT /app/stream.flv, 请求体为FLV(一般为chunked)
+//推流点的授权与RTMP推流相同, 请求在推流结束后返回
+func (server *Server) handlePublish(w http.ResponseWriter, r *http.Request, app, title, key string) {
+	rtmpStream, ok := server.handler.(*rtmp.RtmpStream)
+	if !ok {
+		http.Error(w, "Get rtmp Stream information error", http.StatusInternalServerError)
+		return
+	}
+
+	err, pushUrl := rtmpStream.FindPushUrlByKey(key)
+	if err != nil {
+		log.Error("Not Found PushStream key=", key)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err, _, _ := rtmpStream.GetProjectPushIdFromUrl(pushUrl); err != nil {
+		log.Error("Not Found projectId and pushId url=", pushUrl)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	reader, err := flv.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	publisher := &flvPublisher{
+		app:    app,
+		name:   title,
+		url:    pushUrl,
+		peer:   peer,
+		reader: reader,
+		ctl:    http.NewResponseController(w),
+		done:   make(chan struct{}),
+	}
+	log.Infof("http flv publish key=%s url=%s peer=%s", key, pushUrl, peer)
+	rtmpStream.Publish(rtmp.NewVirReader(publisher))
+	<-publisher.done
+	w.WriteHeader(http.StatusOK)
+}
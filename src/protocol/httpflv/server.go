@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"protocol/rtmp"
+	"protocol/websocket"
 	"strings"
 )
 
@@ -73,6 +74,10 @@ func (server *Server) getStream(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	//HLS观看会话
+	for _, v := range rtmpStream.GetHlsSessions() {
+		msgs.Players = append(msgs.Players, stream{v.Key, v.Id})
+	}
 	resp, _ := json.Marshal(msgs)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
@@ -101,6 +106,18 @@ func (server *Server) handleConn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//HTTP-FLV推流
+	if r.Method == "POST" || r.Method == "PUT" {
+		server.handlePublish(w, r, paths[0], paths[1], path)
+		return
+	}
+
+	//ws://host:flvPort/app/stream.flv
+	if websocket.IsWebSocket(r) {
+		server.handleWebSocket(w, r, paths[0], paths[1], url)
+		return
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	writer := NewFLVWriter(paths[0], paths[1], url, w)
 
@@ -0,0 +1,57 @@
+package httpflv
+
+import (
+	log "logging"
+	"net/http"
+	"protocol/websocket"
+	"time"
+)
+
+const (
+	wsPingInterval = 10 * time.Second   //发送Ping的间隔
+	wsReadTimeout  = 3 * wsPingInterval //超过这个时间没有收到客户端的帧时断开
+)
+
+//handleWebSocket WebSocket-FLV观看, 与HTTP-FLV相同的FLV tag, 每个tag作为一个二进制消息
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, app, title, url string) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Error("websocket upgrade error: ", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetWriteTimeout(writeTimeout)
+
+	writer := NewFLVWriter(app, title, url, conn)
+	server.handler.HandleWriter(writer)
+	go wsKeepAlive(conn, writer)
+	writer.Wait()
+}
+
+//wsKeepAlive 定时发送Ping, 客户端关闭或者超时没有收到Pong时关闭观看者
+func wsKeepAlive(conn *websocket.Conn, writer *FLVWriter) {
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-writer.closedChan:
+				return
+			case <-ticker.C:
+				if err := conn.WriteMessage(websocket.OpPing, nil); err != nil {
+					writer.Close(err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			log.Info("websocket flv read: ", err)
+			writer.Close(err)
+			return
+		}
+	}
+}
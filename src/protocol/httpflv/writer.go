@@ -4,17 +4,19 @@ import (
 	"av"
 	"errors"
 	"fmt"
+	"io"
 	log "logging"
-	"net/http"
 	"protocol/amf"
+	"sync"
 	"time"
 	"utils/pio"
 	"utils/uid"
 )
 
 const (
-	headerLen   = 11
-	maxQueueNum = 1024
+	headerLen    = 11
+	maxQueueNum  = 1024
+	writeTimeout = 10 * time.Second //超过这个时间没有写出数据时观看者超时
 )
 
 type FLVWriter struct {
@@ -24,31 +26,31 @@ type FLVWriter struct {
 	buf             []byte
 	closed          bool
 	closedChan      chan struct{}
-	ctx             http.ResponseWriter
+	closeLock       sync.Mutex
+	ctx             io.Writer //HTTP响应或WebSocket连接, 每次写入一个完整的FLV tag
 	packetQueue     chan *av.Packet
 }
 
-func NewFLVWriter(app, title, url string, ctx http.ResponseWriter) *FLVWriter {
+func NewFLVWriter(app, title, url string, ctx io.Writer) *FLVWriter {
 	ret := &FLVWriter{
 		Uid:         uid.NewId(),
 		app:         app,
 		title:       title,
 		url:         url,
 		ctx:         ctx,
-		RWBaser:     av.NewRWBaser(time.Second * 10),
+		RWBaser:     av.NewRWBaser(writeTimeout),
 		closedChan:  make(chan struct{}),
 		buf:         make([]byte, headerLen),
 		packetQueue: make(chan *av.Packet, maxQueueNum),
 	}
 
-	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09})
-	pio.PutI32BE(ret.buf[:4], 0)
-	ret.ctx.Write(ret.buf[:4])
+	//FLV头和PreviousTagSize0
+	ret.ctx.Write([]byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00})
 	go func() {
 		err := ret.SendPacket()
 		if err != nil {
 			log.Error("SendPacket error:", err)
-			ret.closed = true
+			ret.Close(err)
 		}
 	}()
 	return ret
@@ -135,16 +137,12 @@ func (flvWriter *FLVWriter) SendPacket() error {
 			pio.PutI24BE(h[4:7], int32(timestampbase))
 			pio.PutU8(h[7:8], uint8(timestampExt))
 
-			if _, err := flvWriter.ctx.Write(h); err != nil {
-				return err
-			}
-
-			if _, err := flvWriter.ctx.Write(p.Data); err != nil {
-				return err
-			}
-
-			pio.PutI32BE(h[:4], int32(preDataLen))
-			if _, err := flvWriter.ctx.Write(h[:4]); err != nil {
+			//tag头, 数据和PreviousTagSize一次写入, WebSocket时为一个消息
+			tag := make([]byte, 0, preDataLen+4)
+			tag = append(tag, h...)
+			tag = append(tag, p.Data...)
+			tag = append(tag, byte(preDataLen>>24), byte(preDataLen>>16), byte(preDataLen>>8), byte(preDataLen))
+			if _, err := flvWriter.ctx.Write(tag); err != nil {
 				return err
 			}
 		} else {
@@ -165,6 +163,9 @@ func (flvWriter *FLVWriter) Wait() {
 
 func (flvWriter *FLVWriter) Close(error) {
 	log.Info("http flv closed")
+	flvWriter.closeLock.Lock()
+	defer flvWriter.closeLock.Unlock()
+
 	if !flvWriter.closed {
 		close(flvWriter.packetQueue)
 		close(flvWriter.closedChan)
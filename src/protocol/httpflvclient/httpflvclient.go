@@ -1,13 +1,21 @@
 package httpflvclient
 
 import (
+	"bufio"
+	"common/utils"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	log "logging"
 	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,71 +23,63 @@ const (
 	RTMP_ERROR
 )
 
-type HttpFlvClient struct {
-	Url         string
-	HostUrl     string
-	HostPort    int
-	PathUrl     string
-	rcvHandle   FlvRcvCallback
-	IsStartFlag bool
-}
+const (
+	flvHeaderLen = 9
+	tagHeaderLen = 11
+	prevTagLen   = 4
+
+	defaultConnectTimeout = 5 * time.Second  //连接和等待响应头的超时
+	defaultReadTimeout    = 10 * time.Second //超过这个时间没有收到数据时重连
+	defaultMaxRetry       = 5                //连续重连失败的次数, 超过后报告FLV_ERROR
+	minBackoff            = time.Second
+	maxBackoff            = 30 * time.Second
+	maxRedirects          = 5
+)
+
+var (
+	ErrInvalidUrl    = errors.New("invalid http flv url")
+	ErrInvalidHeader = errors.New("invalid flv header")
+	ErrInvalidTag    = errors.New("invalid flv tag")
+	ErrReadTimeout   = errors.New("http flv read timeout")
+	ErrStopped       = errors.New("http flv client stopped")
+)
 
 type FlvRcvCallback interface {
 	HandleFlvData(data []byte, srcUrl string) error
 	StatusReport(stat int)
 }
 
-//http://pull2.a8.com/live/1499323853715657.flv
-func NewHttpFlvClient(url string) *HttpFlvClient {
+//HttpFlvClient 拉取HTTP(S)-FLV流, 每个tag(11字节tag头和数据)交给FlvRcvCallback
+//支持chunked响应, 重定向, cookie和代理, 断开后按指数退避重连
+type HttpFlvClient struct {
+	Url                string
+	Header             http.Header   //请求中附加的头, 例如Referer, User-Agent, Cookie
+	ConnectTimeout     time.Duration //连接和等待响应头的超时, 0表示默认5秒
+	ReadTimeout        time.Duration //没有收到数据的超时, 0表示默认10秒
+	MaxRetry           int           //连续重连失败的次数, 超过后报告FLV_ERROR, 0表示默认5次, 小于0表示不重连
+	InsecureSkipVerify bool          //HTTPS不校验证书
+	IsStartFlag        bool
+
+	rcvHandle FlvRcvCallback
+	client    *http.Client
+	stopChan  chan struct{}
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+}
 
-	log.Infof("Http flv client %s", url)
-	if len(url) <= 6 {
-		log.Errorf("url(%s) length(%d) is error", url, len(url))
-		return nil
-	}
+//http://pull2.a8.com/live/1499323853715657.flv
+func NewHttpFlvClient(flvUrl string) *HttpFlvClient {
 
-	if url[:7] != "http://" {
-		log.Errorf("url(%s) header(%s) is error", url, url[:7])
+	log.Infof("Http flv client %s", flvUrl)
+	u, err := url.Parse(flvUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Errorf("url(%s) is error: %v", flvUrl, ErrInvalidUrl)
 		return nil
 	}
-	tempString := url[7:]
-
-	pathArray := strings.Split(tempString, "/")
-
-	hostUrl := pathArray[0]
-
-	hostInfoArray := strings.Split(hostUrl, ":")
-	log.Infof("host info array=%v", hostInfoArray)
-
-	var hostPort int
-	if len(hostInfoArray) == 1 {
-		hostPort = 80
-	} else {
-		hostUrl = hostInfoArray[0]
-		hostportString := hostInfoArray[1]
-		var err error
-		hostPort, err = strconv.Atoi(hostportString)
-		if err != nil {
-			log.Errorf("host port(%s) error=%v", hostportString, err)
-			return nil
-		}
-	}
-	log.Infof("host url=%s, hostport=%d", hostUrl, hostPort)
-
-	var pathString string
-	for _, pachUrl := range pathArray[1:] {
-		pathString = pathString + "/" + pachUrl
-	}
-
-	//pathString = pathString[0:(len(pathString) - 1)]
-
-	log.Infof("pathurl=%s", pathString)
 
 	return &HttpFlvClient{
-		Url:      url,
-		HostUrl:  hostUrl,
-		HostPort: hostPort,
-		PathUrl:  pathString,
+		Url:    flvUrl,
+		Header: make(http.Header),
 	}
 }
 
@@ -133,6 +133,59 @@ func (self *HttpFlvClient) IsStart() bool {
 	return self.IsStartFlag
 }
 
+func (self *HttpFlvClient) connectTimeout() time.Duration {
+	if self.ConnectTimeout > 0 {
+		return self.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+func (self *HttpFlvClient) readTimeout() time.Duration {
+	if self.ReadTimeout > 0 {
+		return self.ReadTimeout
+	}
+	return defaultReadTimeout
+}
+
+func (self *HttpFlvClient) maxRetry() int {
+	if self.MaxRetry == 0 {
+		return defaultMaxRetry
+	}
+	return self.MaxRetry
+}
+
+//newClient 代理使用http_proxy配置, 没有时使用HTTP_PROXY/HTTPS_PROXY/NO_PROXY环境变量
+//cookie在重连和重定向时带上
+func (self *HttpFlvClient) newClient() *http.Client {
+	proxy := utils.GetHttpProxy()
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   self.connectTimeout(),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: self.InsecureSkipVerify},
+			TLSHandshakeTimeout:   self.connectTimeout(),
+			ResponseHeaderTimeout: self.connectTimeout(),
+			DisableCompression:    true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			log.Infof("HttpFlvClient(%s) redirect to %s", self.Url, req.URL)
+			return nil
+		},
+	}
+}
+
+//Start 连接并检查FLV头, 成功后在后台接收, 断开时重连
 func (self *HttpFlvClient) Start(rcvHandle FlvRcvCallback) error {
 	if self.IsStartFlag {
 		errString := fmt.Sprintf("HttpFlvClient has already started, url=%s", self.Url)
@@ -140,169 +193,177 @@ func (self *HttpFlvClient) Start(rcvHandle FlvRcvCallback) error {
 		return errors.New(errString)
 	}
 
-	hostString := fmt.Sprintf("%s:%d", self.HostUrl, self.HostPort)
+	self.lock.Lock()
+	self.client = self.newClient()
+	self.stopChan = make(chan struct{})
+	self.lock.Unlock()
 
-	conn, err := net.Dial("tcp", hostString)
+	body, err := self.connect(self.stopChan)
 	if err != nil {
-		log.Errorf("HttpFlvClient.Start(%s) Dail error=%v", hostString, err)
+		log.Errorf("HttpFlvClient.Start(%s) error=%v", self.Url, err)
 		return err
 	}
 
-	content := fmt.Sprintf("GET %s HTTP/1.1\r\n", self.PathUrl)
-	content = content + fmt.Sprintf("Accept:*/*\r\n")
-	content = content + fmt.Sprintf("Accept-Encoding:gzip\r\n")
-	content = content + fmt.Sprintf("Accept-Language:zh_CN\r\n")
-	content = content + fmt.Sprintf("Connection:Keep-Alive\r\n")
-	content = content + fmt.Sprintf("Host:%s\r\n", self.HostUrl)
-	content = content + fmt.Sprintf("Referer:http://www.abc.com/vplayer.swf\r\n\r\n")
-
-	log.Infof("send content:\r\n%s", content)
-	conn.Write([]byte(content))
+	self.rcvHandle = rcvHandle
+	self.IsStartFlag = true
+	go self.OnRcv(body, self.stopChan)
 
-	var rcvBuff []byte
+	return nil
+}
 
-	for {
-		temp := make([]byte, 1)
-		retLen, err := conn.Read(temp)
-		if err != nil || retLen <= 0 {
-			log.Errorf("connect read len=%d, error=%v", retLen, err)
-			return errors.New("connect read error")
-		}
-		rcvBuff = append(rcvBuff, temp[0])
+//connect 发送请求, 检查响应和FLV头, 返回位于第一个tag的响应体
+func (self *HttpFlvClient) connect(stop chan struct{}) (*timeoutReader, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	self.lock.Lock()
+	select {
+	case <-stop:
+		self.lock.Unlock()
+		cancel()
+		return nil, ErrStopped
+	default:
+	}
+	self.cancel = cancel
+	self.lock.Unlock()
 
-		if len(rcvBuff) >= 4 {
-			lastIndex := len(rcvBuff) - 1
-			if rcvBuff[lastIndex-3] == 0x0d && rcvBuff[lastIndex-2] == 0x0a && rcvBuff[lastIndex-1] == 0x0d && rcvBuff[lastIndex] == 0x0a {
-				break
-			}
-		}
+	req, err := http.NewRequest("GET", self.Url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "*/*")
+	for k, v := range self.Header {
+		req.Header[k] = v
 	}
-	httpHdrString := string(rcvBuff)
-	log.Infof("rcv http header:\r\n%s", httpHdrString)
 
-	index := strings.Index(httpHdrString, "200")
-	if index < 0 {
-		errString := fmt.Sprintf("http read error:%s", httpHdrString)
-		log.Error(errString)
-		return errors.New(errString)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("http flv response %s", resp.Status)
 	}
+	log.Infof("HttpFlvClient(%s) connected %s", self.Url, resp.Request.URL)
 
-	self.rcvHandle = rcvHandle
-	self.IsStartFlag = true
-	go self.OnRcv(conn)
+	body := newTimeoutReader(resp.Body, self.readTimeout(), cancel)
+	if err := readFlvHeader(body.r); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
 
+//readFlvHeader 检查FLV头并跳过PreviousTagSize0
+func readFlvHeader(r *bufio.Reader) error {
+	header := make([]byte, flvHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:3]) != "FLV" || header[3] != 0x01 || header[4]&0xfa != 0 {
+		return ErrInvalidHeader
+	}
+	dataOffset := int(header[5])<<24 | int(header[6])<<16 | int(header[7])<<8 | int(header[8])
+	if dataOffset < flvHeaderLen || dataOffset > 1024 {
+		return ErrInvalidHeader
+	}
+	if _, err := r.Discard(dataOffset - flvHeaderLen + prevTagLen); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (self *HttpFlvClient) OnRcv(conn net.Conn) {
-	const FLV_HEADER_LENGTH = 9
-	const RTMP_MESSAGE_HEADER_LENGTH = 15
-	const WAIT_FLV_HEADER_STATE = "waiting_for_flvheader"
-	const READ_RTMP_HEADER_STATE = "read_rtmpheader"
-	const READ_RTMP_BODY_START = "read_rtmpbody"
-	currentState := WAIT_FLV_HEADER_STATE
+//readTag 读取一个tag, 返回11字节tag头和数据, 检查tag类型和PreviousTagSize
+func readTag(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, tagHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	tagType := header[0] & 0x1f
+	if header[0]&0xc0 != 0 || (tagType != 0x08 && tagType != 0x09 && tagType != 0x12) {
+		return nil, ErrInvalidTag
+	}
+	dataLen := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	packet := make([]byte, tagHeaderLen+dataLen+prevTagLen)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[tagHeaderLen:]); err != nil {
+		return nil, err
+	}
+	prev := packet[tagHeaderLen+dataLen:]
+	prevSize := int(prev[0])<<24 | int(prev[1])<<16 | int(prev[2])<<8 | int(prev[3])
+	//有的服务器PreviousTagSize为0, 只检查不为0时的值
+	if prevSize != 0 && prevSize != tagHeaderLen+dataLen {
+		return nil, ErrInvalidTag
+	}
+	return packet[:tagHeaderLen+dataLen], nil
+}
 
-	needLen := FLV_HEADER_LENGTH
-	isBreak := false
+//OnRcv 接收tag, 断开后按指数退避重连, 连续失败超过MaxRetry次时报告FLV_ERROR
+func (self *HttpFlvClient) OnRcv(body *timeoutReader, stop chan struct{}) {
 	log.Infof("rcv data from %s:", self.Url)
+	retry := 0
+	backoff := minBackoff
 	for {
-		if !self.IsStartFlag {
-			break
-		}
-		if currentState == WAIT_FLV_HEADER_STATE {
-			flvHeaderBuffer := make([]byte, needLen)
-
-			for {
-				startPos := FLV_HEADER_LENGTH - needLen
-				rcvData := flvHeaderBuffer[startPos:]
-				retLen, err := conn.Read(rcvData)
-				if err != nil || retLen <= 0 {
-					log.Errorf("connect read flv header len=%d, error=%v", retLen, err)
-					isBreak = true
-					break
-				}
-				log.Infof("state=WAIT_FLV_HEADER_STATE flv read data:%v", flvHeaderBuffer)
-				needLen -= retLen
-				if needLen <= 0 {
-					currentState = READ_RTMP_HEADER_STATE
-					needLen = RTMP_MESSAGE_HEADER_LENGTH
-
-					log.Infof("flv header: %v", flvHeaderBuffer)
-					break
-				}
+		received := false
+		for {
+			packet, err := readTag(body.r)
+			if err != nil {
+				log.Errorf("HttpFlvClient(%s) read error=%v", self.Url, body.err(err))
+				break
+			}
+			received = true
+			if handle := self.handle(stop); handle != nil {
+				handle.HandleFlvData(packet, self.Url)
 			}
-
 		}
+		body.Close()
 
-		if isBreak {
-			break
+		//收到过数据后重新计算重连次数
+		if received {
+			retry = 0
+			backoff = minBackoff
 		}
-		var rtmpHeader []byte
-		if currentState == READ_RTMP_HEADER_STATE {
-			rtmpHeader = make([]byte, needLen)
-			for {
-				startPos := RTMP_MESSAGE_HEADER_LENGTH - needLen
-				rcvData := rtmpHeader[startPos:]
-				retLen, err := conn.Read(rcvData)
-				if err != nil || retLen <= 0 {
-					log.Errorf("connect read rtmp message header len=%d, error=%v", retLen, err)
-					isBreak = true
-					break
-				}
-				//log.Infof("state=READ_RTMP_HEADER_STATE flv read data:%v", rtmpHeader)
-				needLen -= retLen
-				if needLen <= 0 {
-					bodyLenByte := rtmpHeader[5:8]
-					bodyLen := int(bodyLenByte[0])<<16 + int(bodyLenByte[1])<<8 + int(bodyLenByte[2])
-					needLen = bodyLen
-					currentState = READ_RTMP_BODY_START
-					//log.Printf("rtmp header, bodylen=%d", bodyLen)
-					break
+		for body = nil; body == nil; {
+			if self.maxRetry() < 0 || retry >= self.maxRetry() {
+				if handle := self.handle(stop); handle != nil {
+					handle.StatusReport(FLV_ERROR)
 				}
+				return
 			}
-		}
-		if isBreak {
-			break
-		}
-		var bodyData []byte
-		if currentState == READ_RTMP_BODY_START {
-			bodyData = make([]byte, needLen)
-			bodyLen := needLen
-			for {
-				startPos := bodyLen - needLen
-				rcvData := bodyData[startPos:]
-				retLen, err := conn.Read(rcvData)
-				if err != nil || retLen <= 0 {
-					isBreak = true
-					log.Errorf("connect read rtmp body len=%d, error=%v", retLen, err)
-					break
-				}
-				//log.Infof("state=READ_RTMP_BODY_START flv read data:%v", rtmpHeader)
-				needLen -= retLen
-				if needLen <= 0 {
-					//log.Printf("rtmp body(%d)", bodyLen)
-					currentState = READ_RTMP_HEADER_STATE
-					needLen = RTMP_MESSAGE_HEADER_LENGTH
-					break
-				}
+			retry++
+			log.Warningf("HttpFlvClient(%s) reconnect %d/%d after %v", self.Url, retry, self.maxRetry(), backoff)
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
 			}
-		}
-		if isBreak {
-			break
-		}
-		var rtmppacket []byte
-		if len(rtmpHeader) > 0 && len(bodyData) > 0 {
-			rtmppacket = append(rtmppacket, rtmpHeader[4:]...)
-			rtmppacket = append(rtmppacket, bodyData[:]...)
-			if self.IsStartFlag && self.rcvHandle != nil {
-				self.rcvHandle.HandleFlvData(rtmppacket, self.Url)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			var err error
+			if body, err = self.connect(stop); err != nil {
+				log.Errorf("HttpFlvClient(%s) reconnect error=%v", self.Url, err)
+				if err == ErrStopped {
+					return
+				}
 			}
 		}
 	}
+}
 
-	conn.Close()
-	if self.IsStartFlag && self.rcvHandle != nil {
-		self.rcvHandle.StatusReport(FLV_ERROR)
+//handle 没有停止时返回回调
+func (self *HttpFlvClient) handle(stop chan struct{}) FlvRcvCallback {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	select {
+	case <-stop:
+		return nil
+	default:
+		return self.rcvHandle
 	}
 }
 
@@ -312,7 +373,66 @@ func (self *HttpFlvClient) Stop() {
 		return
 	}
 
-	self.IsStartFlag = false
+	self.lock.Lock()
+	close(self.stopChan)
+	if self.cancel != nil {
+		self.cancel()
+	}
 	self.rcvHandle = nil
+	self.lock.Unlock()
+
+	self.IsStartFlag = false
 	log.Infof("HttpFlvClient has stoped, url=%s", self.Url)
 }
+
+//timeoutReader 超过timeout没有读到数据时取消请求, 阻塞的Read返回
+type timeoutReader struct {
+	body     io.ReadCloser
+	r        *bufio.Reader
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	timedOut bool
+}
+
+func newTimeoutReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *timeoutReader {
+	t := &timeoutReader{
+		body:    body,
+		timeout: timeout,
+		cancel:  cancel,
+	}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.lock.Lock()
+		t.timedOut = true
+		t.lock.Unlock()
+		cancel()
+	})
+	t.r = bufio.NewReader(t)
+	return t
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 {
+		t.timer.Reset(t.timeout)
+	}
+	return n, err
+}
+
+//err 超时取消的请求返回ErrReadTimeout
+func (t *timeoutReader) err(err error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.timedOut {
+		return ErrReadTimeout
+	}
+	return err
+}
+
+func (t *timeoutReader) Close() error {
+	t.timer.Stop()
+	t.cancel()
+	return t.body.Close()
+}
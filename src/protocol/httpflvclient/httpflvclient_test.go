@@ -0,0 +1,153 @@
+package httpflvclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var flvHeader = []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+
+//flvTag tag头, 数据和PreviousTagSize
+func flvTag(tagType byte, timestamp int, data []byte) []byte {
+	n := len(data)
+	tag := []byte{tagType, byte(n >> 16), byte(n >> 8), byte(n),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	tag = append(tag, data...)
+	size := n + tagHeaderLen
+	return append(tag, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+}
+
+type testHandle struct {
+	lock    sync.Mutex
+	packets [][]byte
+	status  chan int
+}
+
+func (h *testHandle) HandleFlvData(data []byte, srcUrl string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.packets = append(h.packets, data)
+	return nil
+}
+
+func (h *testHandle) StatusReport(stat int) {
+	h.status <- stat
+}
+
+func (h *testHandle) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.packets)
+}
+
+//重定向, cookie, 自定义头和chunked响应, 断开后重连, 重连失败后报告FLV_ERROR
+func TestHttpFlvClient(t *testing.T) {
+	var lock sync.Mutex
+	connects := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live/test.flv" {
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/edge/test.flv", http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/live/bad.flv" {
+			w.Write([]byte("<html></html>"))
+			return
+		}
+		lock.Lock()
+		connects++
+		n := connects
+		lock.Unlock()
+		if c, err := r.Cookie("token"); err != nil || c.Value != "abc" || r.Header.Get("Referer") != "http://test/" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		//第一次连接发送两个tag后断开, 之后的连接失败
+		if n > 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		flusher := w.(http.Flusher)
+		w.Write(flvHeader)
+		flusher.Flush()
+		w.Write(flvTag(0x08, 0, []byte{0xaf, 0x00, 0x12, 0x10}))
+		flusher.Flush()
+		w.Write(flvTag(0x09, 0x01000020, []byte{0x17, 0x01, 0x00, 0x00, 0x00}))
+	}))
+	defer ts.Close()
+
+	if NewHttpFlvClient("rtmp://127.0.0.1/live/test") != nil || NewHttpFlvClient("http:///live/test.flv") != nil {
+		t.Fatal("invalid url accepted")
+	}
+
+	bad := NewHttpFlvClient(ts.URL + "/live/bad.flv")
+	if err := bad.Start(&testHandle{}); err != ErrInvalidHeader || bad.IsStart() {
+		t.Fatalf("invalid flv header error %v", err)
+	}
+
+	client := NewHttpFlvClient(ts.URL + "/live/test.flv")
+	client.Header.Set("Referer", "http://test/")
+	client.MaxRetry = 1
+	handle := &testHandle{status: make(chan int, 1)}
+	if err := client.Start(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case stat := <-handle.status:
+		if stat != FLV_ERROR {
+			t.Fatalf("status %d", stat)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no FLV_ERROR after retries")
+	}
+	lock.Lock()
+	if connects != 2 {
+		t.Fatalf("connects %d", connects)
+	}
+	lock.Unlock()
+
+	if handle.count() != 2 {
+		t.Fatalf("packets %d", handle.count())
+	}
+	video := handle.packets[1]
+	if video[0] != 0x09 || len(video) != tagHeaderLen+5 || video[7] != 0x01 || video[11] != 0x17 {
+		t.Fatalf("video tag %x", video)
+	}
+
+	client.Stop()
+	if client.IsStart() {
+		t.Fatal("client not stopped")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(flvHeader)
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	client := NewHttpFlvClient(ts.URL + "/live/test.flv")
+	client.ReadTimeout = 100 * time.Millisecond
+	client.MaxRetry = -1
+	handle := &testHandle{status: make(chan int, 1)}
+	if err := client.Start(handle); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handle.status:
+	case <-time.After(3 * time.Second):
+		t.Fatal("read timeout not applied")
+	}
+	client.Stop()
+}
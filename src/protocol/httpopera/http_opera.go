@@ -10,11 +10,17 @@ import (
 	_ "io/ioutil"
 	log "logging"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
+	"protocol/catalog"
+	"protocol/clip"
+	"protocol/hls"
+	"protocol/record"
 	"protocol/rtmp"
 	"protocol/rtmp/rtmprelay"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -208,9 +214,23 @@ func (s *Server) startWeb(operaListen string) {
 	//路由
 	s.webGin.GET("getPush", s.handleGetPush)
 	s.webGin.GET("getReplay", s.handleGetReplay)
+	s.webGin.GET("getRecords", s.handleGetRecords)
+	s.webGin.GET("getStats", s.handleGetStats)
+	s.webGin.GET("startRecord", s.handleStartRecord)
+	s.webGin.GET("stopRecord", s.handleStopRecord)
+	s.webGin.GET("getRecordState", s.handleGetRecordState)
+	s.webGin.GET("getVod", s.handleGetVod)
+	s.webGin.GET("getDayReplay", s.handleGetDayReplay)
+	s.webGin.GET("exportClip", s.handleExportClip)
+	s.webGin.GET("getClip", s.handleGetClip)
+	s.webGin.GET("downloadClip", s.handleDownloadClip)
 	s.webGin.GET("stopProject", s.handleStopProject)
 	s.webGin.GET("getCurrentList", s.handleGetCurrentList)
 	s.webGin.GET("setPushIdAudio", s.handleSetAudioFromPushId)
+	s.webGin.POST("injectData", s.handleInjectData)
+	s.webGin.GET("cueOut", s.handleCueOut)
+	s.webGin.GET("cueIn", s.handleCueIn)
+	s.webGin.GET("kickPlayer", s.handleKickPlayer)
 	s.webGin.Run(operaListen)
 }
 
@@ -228,8 +248,10 @@ type Stream struct {
 type Streams struct {
 	PublisherNumber int64
 	PlayerNumber    int64
-	Publishers      []Stream `json:"publishers"`
-	Players         []Stream `json:"players"`
+	Publishers      []Stream          `json:"publishers"`
+	Players         []Stream          `json:"players"`
+	HlsPlayers      []hls.SessionStat `json:"hlsPlayers"` //HLS观看会话, 同时计入Players
+	Storages        []catalog.Usage   `json:"storages"`   //录制目录使用情况
 }
 
 /*
@@ -657,6 +679,11 @@ func (s *Server) closeWriteConn(c *gin.Context, url string) {
 			}
 		}
 	}
+
+	//HLS观看会话, rtmp://10.10.60.62:1935/live/01/12/Camera_1 -> live/01/12/Camera_1
+	if u, err := neturl.Parse(url); err == nil && strings.Trim(u.Path, "/") != "" {
+		rtmpStream.KickHlsSessions(strings.Trim(u.Path, "/"), "")
+	}
 }
 
 /*
@@ -870,50 +897,154 @@ func (s *Server) handleGetReplay(c *gin.Context) {
 }
 
 /*
-声音控制
+分页查询录制索引
 
 格式：
-http://127.0.0.1:8090/setPushIdAudio?&projectId=12&pushId=1&audio=0
+http://127.0.0.1:8090/getRecords?&liveRoomId=01&projectId=12&pushId=1&videoName=Camera&start=20200611T000000&finish=20200612T000000&page=1&pageSize=20
+
+参数：
+liveRoomId: 直播房间ID, 可选
+projectId: 项目ID, 可选
+pushId: 推流ID, 可选
+videoName: 视频名称, 可选
+start: 起始时间(20060102T150405), 可选
+finish: 结束时间(20060102T150405), 可选, 返回与[start, finish]有交集的录制
+page: 页码, 从1开始, 默认1
+pageSize: 每页数量, 默认20, 最大1000
 
 地址举例：
-http://127.0.0.1:8090/setPushIdAudio?&projectId=12&pushId=1&audio=0
+http://127.0.0.1:8090/getRecords?&projectId=12&start=20200611T000000&page=1
 */
-func (s *Server) handleSetAudioFromPushId(c *gin.Context) {
+func (s *Server) handleGetRecords(c *gin.Context) {
 
 	//获得参数信息
-	tmpProjectId := c.Query("projectId")
-	projectId, errInt := strconv.Atoi(tmpProjectId)
-	if errInt != nil {
+	query := catalog.NewQuery()
+	query.LiveRoomId = c.Query("liveRoomId")
+	query.VideoName = c.Query("videoName")
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"projectId", &query.ProjectId},
+		{"pushId", &query.PushId},
+	} {
+		if tmp := c.Query(param.name); tmp != "" {
+			value, errInt := strconv.Atoi(tmp)
+			if errInt != nil || value < 0 {
+
+				c.JSON(601, gin.H{
+					"result":  601,
+					"message": param.name + " Param error, please check them",
+				})
+				return
+			}
+			*param.value = value
+		}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{
+		{"start", &query.Start},
+		{"finish", &query.Finish},
+	} {
+		if tmp := c.Query(param.name); tmp != "" {
+			if _, errTime := time.Parse(record.TimeFormat, tmp); errTime != nil {
+
+				c.JSON(601, gin.H{
+					"result":  601,
+					"message": param.name + " Param error, please check them",
+				})
+				return
+			}
+			*param.value = tmp
+		}
+	}
+
+	page, errPage := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, errPageSize := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(catalog.DefaultPageSize)))
+	if errPage != nil || errPageSize != nil || page < 1 || pageSize < 1 || pageSize > catalog.MaxPageSize {
 
 		c.JSON(601, gin.H{
 			"result":  601,
-			"message": "projectId Param error, please check them",
+			"message": "page or pageSize Param error, please check them",
 		})
 		return
 	}
+	query.Offset = (page - 1) * pageSize
+	query.Limit = pageSize
+	log.Infof("Server handleGetRecords query=%+v", query)
 
-	tmpPushId := c.Query("pushId")
-	pushId, errPushId := strconv.Atoi(tmpPushId)
-	if errPushId != nil {
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
 
 		c.JSON(601, gin.H{
 			"result":  601,
-			"message": "pushId Param error, please check them",
+			"message": "Get rtmp Stream information error",
 		})
 		return
 	}
 
-	tmpAudio := c.Query("audio")
-	audio, errAudio := strconv.Atoi(tmpAudio)
-	if errAudio != nil {
+	total, records := rtmpStream.QueryRecords(query)
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":   http.StatusOK,
+		"message":  "success",
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+		"records":  records,
+	})
+}
+
+/*
+得到一个推流点的点播播放列表(HLS VOD), 可以跨越多个连续的录制, 分片按字节范围访问TS录制文件
+
+格式：
+http://127.0.0.1:8090/getVod?&liveRoomId=01&pushId=1&start=20200611T100000&finish=20200611T120000
+
+参数：
+liveRoomId: 直播房间ID
+pushId: 推流ID
+start: 起始时间(20060102T150405), 可选
+finish: 结束时间(20060102T150405), 可选
+
+地址举例：
+http://127.0.0.1:8090/getVod?&liveRoomId=01&pushId=1&start=20200611T100000&finish=20200611T120000
+*/
+func (s *Server) handleGetVod(c *gin.Context) {
+
+	//获得参数信息
+	liveRoomId := c.Query("liveRoomId")
+	pushId, errInt := strconv.Atoi(c.Query("pushId"))
+	if liveRoomId == "" || errInt != nil {
 
 		c.JSON(601, gin.H{
 			"result":  601,
-			"message": "audio Param error, please check them",
+			"message": "liveRoomId or pushId Param error, please check them",
 		})
 		return
 	}
-	log.Infof("Server handleSetAudioFromPushId projectId=%d pushId=%d audio=%d", projectId, pushId, audio)
+
+	start := c.Query("start")
+	finish := c.Query("finish")
+	for _, value := range []string{start, finish} {
+		if value == "" {
+			continue
+		}
+		if _, errTime := time.Parse(record.TimeFormat, value); errTime != nil {
+
+			c.JSON(601, gin.H{
+				"result":  601,
+				"message": "start or finish Param error, please check them",
+			})
+			return
+		}
+	}
+	log.Infof("Server handleGetVod liveRoomId=%s pushId=%d start=%s finish=%s", liveRoomId, pushId, start, finish)
 
 	//得到Rtmp流的管理对象
 	rtmpStream := s.handler.(*rtmp.RtmpStream)
@@ -926,120 +1057,874 @@ func (s *Server) handleSetAudioFromPushId(c *gin.Context) {
 		return
 	}
 
-	//设置声音控制
-	rtmpStream.SetLimitAudioFromPushId(projectId, pushId, audio)
+	err, body := rtmpStream.VodPlaylist(liveRoomId, pushId, start, finish)
+	s.writePlaylist(c, err, body)
+}
 
-	writeString := fmt.Sprintf("set Audio Success ProjectId:%d pushId=%d Audio=%d", projectId, pushId, audio)
+/*
+得到一个项目中一个推流点全天的回看播放列表(HLS VOD), 录制之间加EXT-X-DISCONTINUITY
 
-	c.JSON(http.StatusOK, gin.H{
-		"result":  http.StatusOK,
-		"message": writeString,
-	})
+格式：
+http://127.0.0.1:8090/getDayReplay?&projectId=12&liveRoomId=01&pushId=1&date=20200611
 
-	log.Infof("Server handleGetCurrentList %s", writeString)
-}
+参数：
+projectId: 项目ID
+liveRoomId: 直播房间ID
+pushId: 推流ID
+date: 日期(20060102)
 
-func (s *Server) requestUrl(Url string, requestType configure.RequestTypeEunm) bool {
+地址举例：
+http://127.0.0.1:8090/getDayReplay?&projectId=12&liveRoomId=01&pushId=1&date=20200611
+*/
+func (s *Server) handleGetDayReplay(c *gin.Context) {
 
-	var requestString string
-	switch requestType {
+	//获得参数信息
+	liveRoomId := c.Query("liveRoomId")
+	projectId, errProject := strconv.Atoi(c.Query("projectId"))
+	pushId, errPush := strconv.Atoi(c.Query("pushId"))
+	if liveRoomId == "" || errProject != nil || errPush != nil {
 
-	case configure.ProjectStart:
-		requestString = Url + "&status=1"
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "projectId, liveRoomId or pushId Param error, please check them",
+		})
+		return
+	}
 
-	case configure.ProjectStop:
-		requestString = Url + "&status=1"
+	date := c.Query("date")
+	if _, errTime := time.Parse("20060102", date); errTime != nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "date Param error, please check them",
+		})
+		return
 	}
+	log.Infof("Server handleGetDayReplay projectId=%d liveRoomId=%s pushId=%d date=%s", projectId, liveRoomId, pushId, date)
 
-	resp, err := http.Get(requestString)
-	if err != nil {
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
 
-		log.Error("requestUrl Failed %s", requestString)
-		return false
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
 	}
 
-	defer resp.Body.Close()
-	//	_, errResp := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode == 200 {
+	err, body := rtmpStream.DayPlaylist(projectId, liveRoomId, pushId, date)
+	s.writePlaylist(c, err, body)
+}
 
-		log.Infof("requestUrl Success %s", requestString)
-		return true
+//返回m3u8播放列表
+func (s *Server) writePlaylist(c *gin.Context, err error, body []byte) {
+
+	if err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
 	}
-	return false
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/x-mpegURL", body)
 }
 
-func NewReportStat(serverlist []string, localserver *Server) *ReportStat {
-	return &ReportStat{
-		serverList:  serverlist,
-		isStart:     false,
-		localServer: localserver,
+/*
+剪辑一段直播或录制, 从起始时间前最近的关键帧开始复制, 时间戳从0开始, 异步执行
+
+格式：
+http://127.0.0.1:8090/exportClip?&key=live/01/12/Camera_1&start=20200611T100000&finish=20200611T100030&format=mp4
+http://127.0.0.1:8090/exportClip?&liveRoomId=01&pushId=1&start=20200611T100000&finish=20200611T100030&format=flv
+
+参数：
+key: 流名称, 与liveRoomId/pushId二选一
+liveRoomId: 直播房间ID
+pushId: 推流ID
+start: 起始时间(20060102T150405)
+finish: 结束时间(20060102T150405), 最长1小时
+format: mp4或flv, 默认mp4
+
+只能从FLV录制或直播缓存中剪辑, 返回的id用于getClip查询状态
+
+地址举例：
+http://127.0.0.1:8090/exportClip?&liveRoomId=01&pushId=1&start=20200611T100000&finish=20200611T100030
+*/
+func (s *Server) handleExportClip(c *gin.Context) {
+
+	//获得参数信息
+	key := c.Query("key")
+	liveRoomId := c.Query("liveRoomId")
+	pushId := -1
+	if key == "" {
+
+		value, errInt := strconv.Atoi(c.Query("pushId"))
+		if liveRoomId == "" || errInt != nil {
+
+			c.JSON(601, gin.H{
+				"result":  601,
+				"message": "key or liveRoomId/pushId Param error, please check them",
+			})
+			return
+		}
+		pushId = value
+	}
+
+	start, errStart := time.ParseInLocation(record.TimeFormat, c.Query("start"), time.Local)
+	finish, errFinish := time.ParseInLocation(record.TimeFormat, c.Query("finish"), time.Local)
+	if errStart != nil || errFinish != nil || !finish.After(start) || finish.Sub(start) > clip.MaxDuration {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "start or finish Param error, please check them",
+		})
+		return
+	}
+
+	format := c.DefaultQuery("format", record.FormatMp4)
+	if format != record.FormatMp4 && format != record.FormatFlv {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "format Param error, please check them",
+		})
+		return
+	}
+	log.Infof("Server handleExportClip key=%s liveRoomId=%s pushId=%d start=%v finish=%v format=%s", key, liveRoomId, pushId, start, finish, format)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	err, job := rtmpStream.ExportClip(key, liveRoomId, pushId, start, finish, format)
+	if err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
 	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "success",
+		"job":     job,
+	})
 }
 
-func (self *ReportStat) httpsend(data []byte) error {
+/*
+查询剪辑任务状态, 完成后url为下载地址
 
-	return nil
+格式：
+http://127.0.0.1:8090/getClip?&id=xxxx
+
+参数：
+id: exportClip返回的任务ID
+
+地址举例：
+http://127.0.0.1:8090/getClip?&id=xxxx
+*/
+func (s *Server) handleGetClip(c *gin.Context) {
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	err, job := rtmpStream.GetClip(c.Query("id"))
+	if err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if job.Status == clip.StatusDone {
+		job.Url = fmt.Sprintf("http://%s/downloadClip?id=%s", c.Request.Host, job.Id)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "success",
+		"job":     job,
+	})
 }
 
-func (self *ReportStat) onWork() {
-	rtmpStream := self.localServer.handler.(*rtmp.RtmpStream)
+/*
+下载剪辑文件
+
+格式：
+http://127.0.0.1:8090/downloadClip?&id=xxxx
+
+参数：
+id: exportClip返回的任务ID
+
+地址举例：
+http://127.0.0.1:8090/downloadClip?&id=xxxx
+*/
+func (s *Server) handleDownloadClip(c *gin.Context) {
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
 	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
 		return
 	}
-	for {
-		if !self.isStart {
-			break
-		}
 
-		if self.serverList == nil || len(self.serverList) == 0 {
-			log.Warning("Report statics server list is null.")
-			break
-		}
+	err, job := rtmpStream.GetClip(c.Query("id"))
+	if err == nil && job.Status != clip.StatusDone {
+		err = errors.New("clip is " + job.Status)
+	}
+	if err != nil {
 
-		msgs := new(Streams)
-		msgs.PublisherNumber = 0
-		msgs.PlayerNumber = 0
-
-		for item := range rtmpStream.GetStreams().IterBuffered() {
-			if s, ok := item.Val.(*rtmp.Stream); ok {
-				if s.GetReader() != nil {
-					switch s.GetReader().(type) {
-					case *rtmp.VirReader:
-						v := s.GetReader().(*rtmp.VirReader)
-						msg := Stream{item.Key, v.Info().URL, v.ReadBWInfo.PeerIP, v.ReadBWInfo.StreamId, v.ReadBWInfo.VideoDatainBytes, v.ReadBWInfo.VideoSpeedInBytesperMS,
-							v.ReadBWInfo.AudioDatainBytes, v.ReadBWInfo.AudioSpeedInBytesperMS}
-						msgs.Publishers = append(msgs.Publishers, msg)
-						msgs.PublisherNumber++
-					}
-				}
-			}
-		}
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
 
-		for item := range rtmpStream.GetStreams().IterBuffered() {
-			ws := item.Val.(*rtmp.Stream).GetWs()
-			for s := range ws.IterBuffered() {
-				if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
-					if pw.GetWriter() != nil {
-						switch pw.GetWriter().(type) {
-						case *rtmp.VirWriter:
-							v := pw.GetWriter().(*rtmp.VirWriter)
-							msg := Stream{item.Key, v.Info().URL, v.WriteBWInfo.PeerIP, v.WriteBWInfo.StreamId, v.WriteBWInfo.VideoDatainBytes, v.WriteBWInfo.VideoSpeedInBytesperMS,
-								v.WriteBWInfo.AudioDatainBytes, v.WriteBWInfo.AudioSpeedInBytesperMS}
-							msgs.Players = append(msgs.Players, msg)
-							msgs.PlayerNumber++
-						}
-					}
-				}
-			}
-		}
-		resp, _ := json.Marshal(msgs)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(job.File)))
+	c.File(job.File)
+}
 
-		//log.Info("report statics server list:", self.serverList)
-		//log.Info("resp:", string(resp))
+/*
+得到统计信息(发布者, 观看者, 录制目录使用情况)
 
-		self.httpsend(resp)
-		time.Sleep(time.Second * 5)
+格式：
+http://127.0.0.1:8090/getStats
+
+地址举例：
+http://127.0.0.1:8090/getStats
+*/
+func (s *Server) handleGetStats(c *gin.Context) {
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newStreams(rtmpStream))
+}
+
+/*
+启动录制, 已经在录制时结束当前文件重新开始
+
+格式：
+http://127.0.0.1:8090/startRecord?&key=live/01/12/Camera_1&duration=600
+
+参数：
+key: 流名称, 与liveRoomId/pushId二选一
+liveRoomId: 直播房间ID
+pushId: 推流ID, 不填表示房间内所有推流点
+duration: 录制时长(秒), 可选, 到时后自动停止
+
+地址举例：
+http://127.0.0.1:8090/startRecord?&liveRoomId=01&pushId=1&duration=600
+*/
+func (s *Server) handleStartRecord(c *gin.Context) {
+
+	//获得参数信息
+	err, key, liveRoomId, pushId := s.recordParams(c)
+	if err != nil {
+		return
+	}
+
+	duration := 0
+	if tmpDuration := c.Query("duration"); tmpDuration != "" {
+		var errInt error
+		duration, errInt = strconv.Atoi(tmpDuration)
+		if errInt != nil || duration < 0 {
+
+			c.JSON(601, gin.H{
+				"result":  601,
+				"message": "duration Param error, please check them",
+			})
+			return
+		}
+	}
+	log.Infof("Server handleStartRecord key=%s liveRoomId=%s pushId=%d duration=%d", key, liveRoomId, pushId, duration)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	err, states := rtmpStream.StartRecording(key, liveRoomId, pushId, duration)
+	if err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "start record success",
+		"records": states,
+	})
+}
+
+/*
+停止录制, 当前文件写完后加入录制索引
+
+格式：
+http://127.0.0.1:8090/stopRecord?&key=live/01/12/Camera_1
+
+参数：
+key: 流名称, 与liveRoomId/pushId二选一
+liveRoomId: 直播房间ID
+pushId: 推流ID, 不填表示房间内所有推流点
+
+地址举例：
+http://127.0.0.1:8090/stopRecord?&liveRoomId=01&pushId=1
+*/
+func (s *Server) handleStopRecord(c *gin.Context) {
+
+	//获得参数信息
+	err, key, liveRoomId, pushId := s.recordParams(c)
+	if err != nil {
+		return
+	}
+	log.Infof("Server handleStopRecord key=%s liveRoomId=%s pushId=%d", key, liveRoomId, pushId)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	err, states := rtmpStream.StopRecording(key, liveRoomId, pushId)
+	if err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "stop record success",
+		"records": states,
+	})
+}
+
+//得到录制接口的推流点参数, 参数错误时已经返回601
+func (s *Server) recordParams(c *gin.Context) (error, string, string, int) {
+
+	key := c.Query("key")
+	liveRoomId := c.Query("liveRoomId")
+	pushId := -1
+	if key == "" && liveRoomId == "" {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "key or liveRoomId Param error, please check them",
+		})
+		return errors.New("Param error"), "", "", 0
+	}
+	if tmpPushId := c.Query("pushId"); key == "" && tmpPushId != "" {
+
+		value, errInt := strconv.Atoi(tmpPushId)
+		if errInt != nil {
+
+			c.JSON(601, gin.H{
+				"result":  601,
+				"message": "pushId Param error, please check them",
+			})
+			return errors.New("Param error"), "", "", 0
+		}
+		pushId = value
+	}
+	return nil, key, liveRoomId, pushId
+}
+
+/*
+得到所有发布者的录制状态和正在录制的文件
+
+格式：
+http://127.0.0.1:8090/getRecordState
+
+地址举例：
+http://127.0.0.1:8090/getRecordState
+*/
+func (s *Server) handleGetRecordState(c *gin.Context) {
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "success",
+		"records": rtmpStream.RecordStates(),
+	})
+}
+
+/*
+声音控制
+
+格式：
+http://127.0.0.1:8090/setPushIdAudio?&projectId=12&pushId=1&audio=0
+
+地址举例：
+http://127.0.0.1:8090/setPushIdAudio?&projectId=12&pushId=1&audio=0
+*/
+func (s *Server) handleSetAudioFromPushId(c *gin.Context) {
+
+	//获得参数信息
+	tmpProjectId := c.Query("projectId")
+	projectId, errInt := strconv.Atoi(tmpProjectId)
+	if errInt != nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "projectId Param error, please check them",
+		})
+		return
+	}
+
+	tmpPushId := c.Query("pushId")
+	pushId, errPushId := strconv.Atoi(tmpPushId)
+	if errPushId != nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "pushId Param error, please check them",
+		})
+		return
+	}
+
+	tmpAudio := c.Query("audio")
+	audio, errAudio := strconv.Atoi(tmpAudio)
+	if errAudio != nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "audio Param error, please check them",
+		})
+		return
+	}
+	log.Infof("Server handleSetAudioFromPushId projectId=%d pushId=%d audio=%d", projectId, pushId, audio)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	//设置声音控制
+	rtmpStream.SetLimitAudioFromPushId(projectId, pushId, audio)
+
+	writeString := fmt.Sprintf("set Audio Success ProjectId:%d pushId=%d Audio=%d", projectId, pushId, audio)
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": writeString,
+	})
+
+	log.Infof("Server handleGetCurrentList %s", writeString)
+}
+
+type InjectDataRequest struct {
+	Key     string      `json:"key"`
+	Handler string      `json:"handler"`
+	Data    interface{} `json:"data"`
+}
+
+/*
+向直播流注入数据消息(timed metadata)
+
+格式：
+http://127.0.0.1:8090/injectData
+
+参数(POST JSON)：
+key: 流名称
+handler: 消息名称, 默认onTextData
+data: 消息内容
+
+地址举例：
+curl -X POST http://127.0.0.1:8090/injectData -d '{"key":"live/01/12/Camera_1","handler":"onTextData","data":{"text":"hello"}}'
+*/
+func (s *Server) handleInjectData(c *gin.Context) {
+
+	//获得参数信息
+	var req InjectDataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Body Param error, please check them",
+		})
+		return
+	}
+	if req.Key == "" || req.Data == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "key or data Param error, please check them",
+		})
+		return
+	}
+	log.Infof("Server handleInjectData key=%s handler=%s", req.Key, req.Handler)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	if err := rtmpStream.InjectData(req.Key, req.Handler, req.Data); err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "inject data success",
+	})
+}
+
+/*
+手动插入广告开始标记(onCuePoint / SCTE-35 CUE-OUT)
+
+格式：
+http://127.0.0.1:8090/cueOut?&key=live/01/12/Camera_1&duration=30
+
+参数：
+key: 流名称
+duration: 广告时长(秒), 可选, 不填需要调用cueIn结束广告
+
+地址举例：
+http://127.0.0.1:8090/cueOut?&key=live/01/12/Camera_1&duration=30
+*/
+func (s *Server) handleCueOut(c *gin.Context) {
+
+	//获得参数信息
+	key := c.Query("key")
+	if key == "" {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "key Param error, please check them",
+		})
+		return
+	}
+
+	var duration float64
+	if tmpDuration := c.Query("duration"); tmpDuration != "" {
+		var errFloat error
+		duration, errFloat = strconv.ParseFloat(tmpDuration, 64)
+		if errFloat != nil || duration < 0 {
+
+			c.JSON(601, gin.H{
+				"result":  601,
+				"message": "duration Param error, please check them",
+			})
+			return
+		}
+	}
+	log.Infof("Server handleCueOut key=%s duration=%f", key, duration)
+
+	s.sendCuePoint(c, key, true, duration)
+}
+
+/*
+手动插入广告结束标记(onCuePoint / SCTE-35 CUE-IN)
+
+格式：
+http://127.0.0.1:8090/cueIn?&key=live/01/12/Camera_1
+
+参数：
+key: 流名称
+
+地址举例：
+http://127.0.0.1:8090/cueIn?&key=live/01/12/Camera_1
+*/
+func (s *Server) handleCueIn(c *gin.Context) {
+
+	//获得参数信息
+	key := c.Query("key")
+	if key == "" {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "key Param error, please check them",
+		})
+		return
+	}
+	log.Infof("Server handleCueIn key=%s", key)
+
+	s.sendCuePoint(c, key, false, 0)
+}
+
+func (s *Server) sendCuePoint(c *gin.Context, key string, out bool, duration float64) {
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	if err := rtmpStream.SendCuePoint(key, out, duration); err != nil {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "send cue point success",
+	})
+}
+
+/*
+踢出观看者, 包括RTMP, HTTP-FLV观看者和HLS会话
+
+格式：
+http://127.0.0.1:8090/kickPlayer?&key=live/01/12/Camera_1&id=xxx
+
+参数：
+key: 流名称
+id: 观看者ID或HLS会话ID, 可选, 不填踢出流的所有观看者
+
+地址举例：
+http://127.0.0.1:8090/kickPlayer?&key=live/01/12/Camera_1
+*/
+func (s *Server) handleKickPlayer(c *gin.Context) {
+
+	//获得参数信息
+	key := c.Query("key")
+	if key == "" {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "key Param error, please check them",
+		})
+		return
+	}
+	id := c.Query("id")
+	log.Infof("Server handleKickPlayer key=%s id=%s", key, id)
+
+	//得到Rtmp流的管理对象
+	rtmpStream := s.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+
+		c.JSON(601, gin.H{
+			"result":  601,
+			"message": "Get rtmp Stream information error",
+		})
+		return
+	}
+
+	n := rtmpStream.KickPlayers(key, id)
+	if n == 0 {
+
+		c.JSON(602, gin.H{
+			"result":  602,
+			"message": "player not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result":  http.StatusOK,
+		"message": "kick player success",
+		"kicked":  n,
+	})
+}
+
+func (s *Server) requestUrl(Url string, requestType configure.RequestTypeEunm) bool {
+
+	var requestString string
+	switch requestType {
+
+	case configure.ProjectStart:
+		requestString = Url + "&status=1"
+
+	case configure.ProjectStop:
+		requestString = Url + "&status=1"
+	}
+
+	resp, err := http.Get(requestString)
+	if err != nil {
+
+		log.Error("requestUrl Failed %s", requestString)
+		return false
+	}
+
+	defer resp.Body.Close()
+	//	_, errResp := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == 200 {
+
+		log.Infof("requestUrl Success %s", requestString)
+		return true
+	}
+	return false
+}
+
+func NewReportStat(serverlist []string, localserver *Server) *ReportStat {
+	return &ReportStat{
+		serverList:  serverlist,
+		isStart:     false,
+		localServer: localserver,
+	}
+}
+
+func (self *ReportStat) httpsend(data []byte) error {
+
+	return nil
+}
+
+func (self *ReportStat) onWork() {
+	rtmpStream := self.localServer.handler.(*rtmp.RtmpStream)
+	if rtmpStream == nil {
+		return
+	}
+	for {
+		if !self.isStart {
+			break
+		}
+
+		if self.serverList == nil || len(self.serverList) == 0 {
+			log.Warning("Report statics server list is null.")
+			break
+		}
+
+		msgs := newStreams(rtmpStream)
+		resp, _ := json.Marshal(msgs)
+
+		//log.Info("report statics server list:", self.serverList)
+		//log.Info("resp:", string(resp))
+
+		self.httpsend(resp)
+		time.Sleep(time.Second * 5)
+	}
+}
+
+//统计发布者, 观看者和录制目录使用情况
+func newStreams(rtmpStream *rtmp.RtmpStream) *Streams {
+	msgs := new(Streams)
+	msgs.PublisherNumber = 0
+	msgs.PlayerNumber = 0
+
+	for item := range rtmpStream.GetStreams().IterBuffered() {
+		if s, ok := item.Val.(*rtmp.Stream); ok {
+			if s.GetReader() != nil {
+				switch s.GetReader().(type) {
+				case *rtmp.VirReader:
+					v := s.GetReader().(*rtmp.VirReader)
+					stats := v.ReadStatics()
+					msg := Stream{item.Key, v.Info().URL, stats.PeerIP, stats.StreamId, stats.VideoDatainBytes, stats.VideoSpeedInBytesperMS,
+						stats.AudioDatainBytes, stats.AudioSpeedInBytesperMS}
+					msgs.Publishers = append(msgs.Publishers, msg)
+					msgs.PublisherNumber++
+				}
+			}
+		}
+	}
+
+	for item := range rtmpStream.GetStreams().IterBuffered() {
+		ws := item.Val.(*rtmp.Stream).GetWs()
+		for s := range ws.IterBuffered() {
+			if pw, ok := s.Val.(*rtmp.PackWriterCloser); ok {
+				if pw.GetWriter() != nil {
+					switch pw.GetWriter().(type) {
+					case *rtmp.VirWriter:
+						v := pw.GetWriter().(*rtmp.VirWriter)
+						stats := v.WriteStatics()
+						msg := Stream{item.Key, v.Info().URL, stats.PeerIP, stats.StreamId, stats.VideoDatainBytes, stats.VideoSpeedInBytesperMS,
+							stats.AudioDatainBytes, stats.AudioSpeedInBytesperMS}
+						msgs.Players = append(msgs.Players, msg)
+						msgs.PlayerNumber++
+					}
+				}
+			}
+		}
+	}
+	//HLS没有连接, 由观看会话统计
+	msgs.HlsPlayers = rtmpStream.GetHlsSessions()
+	for _, v := range msgs.HlsPlayers {
+		msg := Stream{Key: v.Key, Url: "/" + v.Key + ".m3u8?session=" + v.Id, PeerIP: v.PeerIP}
+		msgs.Players = append(msgs.Players, msg)
+		msgs.PlayerNumber++
 	}
+	msgs.Storages = rtmpStream.StorageUsage()
+	return msgs
 }
 
 func (self *ReportStat) Start() error {
@@ -0,0 +1,126 @@
+package httpopera
+
+import (
+	"configure"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"protocol/httpflv"
+	"protocol/rtmp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//flvTag tag头, 数据和PreviousTagSize
+func flvTag(tagType byte, timestamp int, data []byte) []byte {
+	n := len(data)
+	tag := []byte{tagType, byte(n >> 16), byte(n >> 8), byte(n),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0}
+	tag = append(tag, data...)
+	size := n + 11
+	return append(tag, byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+}
+
+func getJSON(t *testing.T, h http.Handler, url string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: %v %s", url, err, w.Body.String())
+	}
+	return w.Code
+}
+
+//HTTP-FLV推流的发布者没有RTMP连接, 统计和停止项目的接口使用请求的对端地址
+func TestHttpFlvPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configure.RtmpServercfg.Record.Catalog = dir + "/catalog.json"
+	configure.RtmpServercfg.Record.Journal = dir + "/journal.json"
+	configure.RtmpServercfg.Clip.Dir = dir + "/clips"
+	configure.LiveRtmpcfg.Lives = []configure.Live{{
+		LiveId: "room1",
+		Urls:   []configure.Url{{PushId: 1, VideoType: configure.PCCamera, SavePath: dir, VideoName: "camera"}},
+	}}
+
+	rtmpStream := rtmp.NewRtmpStream()
+	const pushUrl = "rtmp://127.0.0.1:1935/live/room1/1"
+	if err := rtmpStream.SetStartState(1, "room1", 1, pushUrl, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go httpflv.NewServer(rtmpStream).Serve(l)
+
+	body, pw := io.Pipe()
+	defer pw.Close()
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+l.Addr().String()+"/live/room1/1.flv", "video/x-flv", body)
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	go func() {
+		pw.Write([]byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00})
+		pw.Write(flvTag(0x08, 0, []byte{0xaf, 0x00, 0x12, 0x10}))
+		for i := 0; ; i++ {
+			if _, err := pw.Write(flvTag(0x09, i*40, []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65})); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	gin.SetMode(gin.ReleaseMode)
+	server := &Server{handler: rtmpStream, webGin: gin.New()}
+	server.webGin.GET("getStats", server.handleGetStats)
+	server.webGin.GET("stopProject", server.handleStopProject)
+
+	var stats Streams
+	for i := 0; ; i++ {
+		if code := getJSON(t, server.webGin, "/getStats", &stats); code != http.StatusOK {
+			t.Fatalf("getStats status %d", code)
+		}
+		if len(stats.Publishers) == 1 && stats.Publishers[0].VideoTotalBytes > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("publisher not found %+v", stats)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if publisher := stats.Publishers[0]; publisher.Key != "live/room1/1" || publisher.Url != pushUrl || publisher.PeerIP != "127.0.0.1" {
+		t.Fatalf("publisher %+v", publisher)
+	}
+
+	var resp struct {
+		Result int `json:"result"`
+	}
+	if code := getJSON(t, server.webGin, "/stopProject?projectId=1", &resp); code != http.StatusOK || resp.Result != 0 {
+		t.Fatalf("stopProject status %d result %d", code, resp.Result)
+	}
+	select {
+	case code := <-result:
+		if code != http.StatusOK {
+			t.Fatalf("publish status %d", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("publisher not closed")
+	}
+}
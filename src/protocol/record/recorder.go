@@ -0,0 +1,376 @@
+package record
+
+import (
+	"av"
+	"errors"
+	"fmt"
+	log "logging"
+	"os"
+	"protocol/amf"
+	"sync"
+	"time"
+	"utils/uid"
+)
+
+const (
+	maxQueueNum = 1024
+
+	//文件名中的时间格式: 名称_起始时间_结束时间.后缀
+	TimeFormat = "20060102T150405"
+)
+
+//Recorder 录制器, 作为观看者挂在Stream上, 按时长或大小分段写文件
+type Recorder struct {
+	av.RWBaser
+	uid         string
+	info        av.Info
+	dir         string
+	name        string
+	format      string
+	segDuration uint32 //毫秒
+	segSize     int64
+	packetQueue chan *av.Packet
+	closed      bool //由closeLock保护, 关闭后不再写入包队列
+	closeLock   sync.RWMutex
+	onClose     func() //写入出错自己关闭时调用, 由closeLock保护
+	done        chan struct{}
+
+	seg       *segment
+	lastStart time.Time
+	metadata  *av.Packet
+	videoSeq  *av.Packet
+	audioSeq  *av.Packet
+	onStart   func(SegmentInfo)
+	onDone    func(SegmentInfo)
+}
+
+type segment struct {
+	writer Writer
+	file   string
+	start  time.Time
+	baseTs uint32
+	lastTs uint32
+
+	videoCodec string
+	audioCodec string
+}
+
+//SegmentInfo 录制完成的分段
+type SegmentInfo struct {
+	File       string
+	Temp       string //录制中的文件名: 名称_起始时间
+	Format     string
+	Start      time.Time
+	Finish     time.Time
+	Size       int64
+	Duration   uint32 //毫秒
+	VideoCodec string
+	AudioCodec string
+}
+
+//NewRecorder 创建录制器, 文件保存在dir下, 以name为文件名前缀
+//segDuration为分段时长(秒), segSize为分段大小(字节), 为0表示不分段
+//每个分段创建文件前调用onStart(只有File, Format, Start), 完成后调用onDone, 可以为nil
+func NewRecorder(info av.Info, dir, name, format string, segDuration int, segSize int64, onStart, onDone func(SegmentInfo)) *Recorder {
+	r := &Recorder{
+		uid:         uid.NewId(),
+		dir:         dir,
+		name:        name,
+		format:      format,
+		segDuration: uint32(segDuration) * 1000,
+		segSize:     segSize,
+		RWBaser:     av.NewRWBaser(time.Second * 10),
+		packetQueue: make(chan *av.Packet, maxQueueNum),
+		done:        make(chan struct{}),
+		onStart:     onStart,
+		onDone:      onDone,
+	}
+	//录制器由Stream启动和停止, 不随发布者断开自动关闭
+	r.info = av.Info{
+		Key:   info.Key,
+		URL:   info.URL,
+		UID:   r.uid,
+		Inter: false,
+	}
+
+	go r.SendPacket()
+	return r
+}
+
+func (r *Recorder) Info() av.Info {
+	return r.info
+}
+
+//File 当前正在录制的文件
+func (r *Recorder) File() string {
+	if seg := r.seg; seg != nil {
+		return seg.file
+	}
+	return ""
+}
+
+func (r *Recorder) Write(p *av.Packet) (err error) {
+	err = nil
+	//持有读锁时包队列不会被关闭
+	r.closeLock.RLock()
+	defer r.closeLock.RUnlock()
+	if r.closed {
+		err = errors.New("recorder closed")
+		return
+	}
+	r.SetPreTime()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("recorder has already been closed:%v", e)
+		}
+	}()
+
+	if len(r.packetQueue) >= maxQueueNum-1 {
+		log.Errorf("Recorder [%v] packet queue full, drop packet", r.info)
+		return
+	}
+	r.packetQueue <- p
+	return
+}
+
+func (r *Recorder) SendPacket() {
+	defer close(r.done)
+
+	log.Infof("Recorder [%v] start dir=%s", r.info, r.dir)
+	for p := range r.packetQueue {
+		if err := r.writePacket(p); err != nil {
+			log.Errorf("Recorder [%v] write error: %v", r.info, err)
+			r.closeLock.Lock()
+			r.closed = true
+			onClose := r.onClose
+			r.closeLock.Unlock()
+			r.finishSegment()
+			if onClose != nil {
+				onClose()
+			}
+			return
+		}
+	}
+	r.finishSegment()
+	log.Infof("Recorder [%v] stop", r.info)
+}
+
+func (r *Recorder) Close(err error) {
+	log.Infof("Recorder [%v] close: %v", r.info, err)
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.packetQueue)
+	}
+}
+
+//OnClose 写入出错, 录制器自己关闭时调用fn, 调用Close关闭时不调用
+func (r *Recorder) OnClose(fn func()) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+
+	r.onClose = fn
+}
+
+//Wait 等待最后一个分段写完
+func (r *Recorder) Wait() {
+	<-r.done
+}
+
+func (r *Recorder) writePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		name, _, err := amf.DecodeDataMessage(p.Data)
+		if err != nil {
+			return nil
+		}
+		if name == amf.OnMetaData {
+			r.metadata = p
+			return nil
+		}
+		//自定义数据消息直接写入当前分段
+		if r.seg != nil {
+			return r.writeSegment(p)
+		}
+		return nil
+	}
+
+	isKey := false
+	if p.IsVideo {
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil
+		}
+		if vh.IsSeq() {
+			r.videoSeq = p
+			if r.seg != nil {
+				return r.writeSegment(p)
+			}
+			return nil
+		}
+		isKey = vh.IsKeyFrame()
+	} else {
+		ah, ok := p.Header.(av.AudioPacketHeader)
+		if !ok {
+			return nil
+		}
+		if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+			r.audioSeq = p
+			if r.seg != nil {
+				return r.writeSegment(p)
+			}
+			return nil
+		}
+	}
+
+	//有视频时从关键帧开始切分
+	canCut := isKey || (!p.IsVideo && r.videoSeq == nil)
+	if r.seg == nil {
+		if !canCut {
+			return nil
+		}
+		if err := r.newSegment(p.TimeStamp); err != nil {
+			return err
+		}
+	} else if canCut && r.needCut(p.TimeStamp) {
+		r.finishSegment()
+		if err := r.newSegment(p.TimeStamp); err != nil {
+			return err
+		}
+	}
+
+	return r.writeSegment(p)
+}
+
+func (r *Recorder) needCut(timestamp uint32) bool {
+	if r.segDuration > 0 && timestamp >= r.seg.baseTs && timestamp-r.seg.baseTs >= r.segDuration {
+		return true
+	}
+	if r.segSize > 0 && r.seg.writer.Size() >= r.segSize {
+		return true
+	}
+	return false
+}
+
+func (r *Recorder) writeSegment(p *av.Packet) error {
+	np := *p
+	if np.TimeStamp >= r.seg.baseTs {
+		np.TimeStamp -= r.seg.baseTs
+	} else {
+		np.TimeStamp = 0
+	}
+	if !np.IsMetadata && np.TimeStamp > r.seg.lastTs {
+		r.seg.lastTs = np.TimeStamp
+	}
+	if np.IsVideo && r.seg.videoCodec == "" {
+		r.seg.videoCodec = codecName(p)
+	} else if np.IsAudio && r.seg.audioCodec == "" {
+		r.seg.audioCodec = codecName(p)
+	}
+	return r.seg.writer.WritePacket(&np)
+}
+
+func (r *Recorder) newSegment(baseTs uint32) error {
+	start := time.Now()
+	//同一秒内分段时保证文件名不重复
+	if start.Unix() <= r.lastStart.Unix() {
+		start = r.lastStart.Add(time.Second)
+	}
+	r.lastStart = start
+
+	file := fmt.Sprintf("%s/%s_%s.%s", r.dir, r.name, start.Format(TimeFormat), FormatExt(r.format))
+	//先记录再创建文件, 异常退出时可以找到没有完成的文件
+	if r.onStart != nil {
+		r.onStart(SegmentInfo{File: file, Format: r.format, Start: start})
+	}
+	writer, err := NewWriter(r.format, file)
+	if err != nil {
+		return err
+	}
+	r.seg = &segment{
+		writer: writer,
+		file:   file,
+		start:  start,
+		baseTs: baseTs,
+	}
+	log.Infof("Recorder [%v] new segment %s", r.info, file)
+
+	//每个分段都以metadata和sequence header开始
+	for _, p := range []*av.Packet{r.metadata, r.videoSeq, r.audioSeq} {
+		if p == nil {
+			continue
+		}
+		np := *p
+		np.TimeStamp = 0
+		if err := writer.WritePacket(&np); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Recorder) finishSegment() {
+	seg := r.seg
+	if seg == nil {
+		return
+	}
+	r.seg = nil
+
+	finish := time.Now()
+	if finish.Before(seg.start) {
+		finish = seg.start
+	}
+	dst := fmt.Sprintf("%s/%s_%s_%s.%s", r.dir, r.name, seg.start.Format(TimeFormat), finish.Format(TimeFormat), FormatExt(r.format))
+
+	if err := seg.writer.Finalize(dst); err != nil {
+		log.Errorf("Recorder [%v] finalize %s error: %v", r.info, seg.file, err)
+		seg.writer.Close()
+		if err := os.Rename(seg.file, dst); err != nil {
+			log.Errorf("Recorder [%v] rename %s error: %v", r.info, seg.file, err)
+			return
+		}
+	}
+	log.Infof("Recorder [%v] finish segment %s", r.info, dst)
+
+	if r.onDone == nil {
+		return
+	}
+	done := SegmentInfo{
+		File:       dst,
+		Temp:       seg.file,
+		Format:     r.format,
+		Start:      seg.start,
+		Finish:     finish,
+		Duration:   seg.lastTs,
+		VideoCodec: seg.videoCodec,
+		AudioCodec: seg.audioCodec,
+	}
+	if info, err := os.Stat(dst); err == nil {
+		done.Size = info.Size()
+	}
+	r.onDone(done)
+}
+
+//codecName 由音视频包头得到编码名称
+func codecName(p *av.Packet) string {
+	if p == nil {
+		return ""
+	}
+	if vh, ok := p.Header.(av.VideoPacketHeader); ok {
+		if vh.CodecID() == av.VIDEO_H264 {
+			return "h264"
+		}
+		return fmt.Sprintf("video_%d", vh.CodecID())
+	}
+	if ah, ok := p.Header.(av.AudioPacketHeader); ok {
+		switch ah.SoundFormat() {
+		case av.SOUND_AAC:
+			return "aac"
+		case av.SOUND_MP3:
+			return "mp3"
+		}
+		return fmt.Sprintf("audio_%d", ah.SoundFormat())
+	}
+	return ""
+}
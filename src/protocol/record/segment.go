@@ -0,0 +1,80 @@
+package record
+
+import (
+	"av"
+	"container/flv"
+	"container/mp4"
+	"container/ts"
+	"fmt"
+)
+
+const (
+	FormatTs   = "ts"
+	FormatFlv  = "flv"
+	FormatMp4  = "mp4"  //结束时moov前置(faststart)
+	FormatFmp4 = "fmp4" //分片MP4, 异常退出时已写入的分片可以播放
+)
+
+//Writer 录制文件的写入接口, 时间戳由调用者重置为从0开始
+type Writer interface {
+	WritePacket(p *av.Packet) error
+	Size() int64
+	//Finalize 完成写入(写入索引等)并保存为dst
+	Finalize(dst string) error
+	Close() error
+}
+
+//ValidFormat 是否支持的录制格式
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatTs, FormatFlv, FormatMp4, FormatFmp4:
+		return true
+	}
+	return false
+}
+
+//FormatExt 录制格式对应的文件后缀
+func FormatExt(format string) string {
+	if format == FormatFmp4 {
+		return FormatMp4
+	}
+	return format
+}
+
+//NewWriter 按录制格式创建文件写入
+func NewWriter(format string, file string) (Writer, error) {
+	switch format {
+	case FormatFlv:
+		w, err := flv.NewFileMuxer(file)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	case FormatTs:
+		w, err := newTsWriter(file)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	case FormatMp4, FormatFmp4:
+		w, err := mp4.NewMuxer(file, format == FormatFmp4)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("unsupported record format %s", format)
+}
+
+//Recover 恢复异常退出时没有写完的录制文件, 截掉不完整的结尾, 返回录制时长(毫秒)
+func Recover(format string, file string) (uint32, error) {
+	switch format {
+	case FormatFlv:
+		return flv.RecoverFile(file)
+	case FormatTs:
+		return ts.RecoverFile(file)
+	case FormatMp4, FormatFmp4:
+		return mp4.RecoverFile(file)
+	}
+	return 0, fmt.Errorf("unsupported record format %s", format)
+}
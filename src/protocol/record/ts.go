@@ -0,0 +1,113 @@
+package record
+
+import (
+	"av"
+	"bytes"
+	"container/flv"
+	"container/ts"
+	"os"
+	"parser"
+)
+
+//tsWriter 录制TS文件, 只支持H.264/AAC
+type tsWriter struct {
+	f        *os.File
+	name     string
+	size     int64
+	demuxer  *flv.Demuxer
+	parser   *parser.CodecParser
+	muxer    *ts.Muxer
+	buf      *bytes.Buffer
+	hasVideo bool
+	header   bool
+}
+
+func newTsWriter(name string) (*tsWriter, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tsWriter{
+		f:       f,
+		name:    name,
+		demuxer: flv.NewDemuxer(),
+		parser:  parser.NewCodecParser(),
+		muxer:   ts.NewMuxer(),
+		buf:     bytes.NewBuffer(nil),
+	}, nil
+}
+
+func (w *tsWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *tsWriter) WritePacket(p *av.Packet) error {
+	if p.IsMetadata {
+		return nil
+	}
+
+	np := *p
+	if err := w.demuxer.Demux(&np); err != nil {
+		return nil
+	}
+
+	isKey := false
+	if np.IsVideo {
+		vh, ok := np.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 {
+			return nil
+		}
+		if vh.IsSeq() {
+			w.hasVideo = true
+			return w.parser.Parse(&np, w.buf)
+		}
+		isKey = vh.IsKeyFrame()
+	} else {
+		ah, ok := np.Header.(av.AudioPacketHeader)
+		if !ok || ah.SoundFormat() != av.SOUND_AAC {
+			return nil
+		}
+		if ah.AACPacketType() == av.AAC_SEQHDR {
+			return w.parser.Parse(&np, w.buf)
+		}
+	}
+
+	w.buf.Reset()
+	if err := w.parser.Parse(&np, w.buf); err != nil {
+		return err
+	}
+	np.Data = w.buf.Bytes()
+
+	//文件开头和每个关键帧前写入PAT/PMT, 方便从中间开始播放
+	if !w.header || isKey {
+		w.header = true
+		if _, err := w.Write(w.muxer.PAT()); err != nil {
+			return err
+		}
+		if _, err := w.Write(w.muxer.PMT(av.SOUND_AAC, w.hasVideo)); err != nil {
+			return err
+		}
+	}
+	return w.muxer.Mux(&np, w)
+}
+
+func (w *tsWriter) Size() int64 {
+	return w.size
+}
+
+func (w *tsWriter) Close() error {
+	return w.f.Close()
+}
+
+//Finalize TS不需要索引, 关闭后改名
+func (w *tsWriter) Finalize(dst string) error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if dst == w.name {
+		return nil
+	}
+	return os.Rename(w.name, dst)
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"av"
 	"flag"
+	"protocol/amf"
 )
 
 var (
@@ -27,7 +28,10 @@ func NewCache() *Cache {
 
 func (cache *Cache) Write(p av.Packet) {
 	if p.IsMetadata {
-		cache.metadata.Write(&p)
+		//只缓存onMetaData,自定义数据消息(onTextData/onCuePoint等)只做实时转发
+		if name, _, err := amf.DecodeDataMessage(p.Data); err == nil && name == amf.OnMetaData {
+			cache.metadata.Write(&p)
+		}
 		return
 	} else {
 		if !p.IsVideo {
@@ -60,19 +64,28 @@ func (cache *Cache) Write(p av.Packet) {
 }
 
 func (cache *Cache) Send(w av.WriteCloser) error {
-	if err := cache.metadata.Send(w); err != nil {
+	if err := cache.SendSeq(w); err != nil {
 		return err
 	}
 
-	if err := cache.videoSeq.Send(w); err != nil {
+	if err := cache.gop.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.audioSeq.Send(w); err != nil {
+	return nil
+}
+
+//SendSeq 只发送metadata和音视频序列头, 不发送缓存的GOP
+func (cache *Cache) SendSeq(w av.WriteCloser) error {
+	if err := cache.metadata.Send(w); err != nil {
 		return err
 	}
 
-	if err := cache.gop.Send(w); err != nil {
+	if err := cache.videoSeq.Send(w); err != nil {
+		return err
+	}
+
+	if err := cache.audioSeq.Send(w); err != nil {
 		return err
 	}
 
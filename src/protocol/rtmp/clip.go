@@ -0,0 +1,99 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"protocol/catalog"
+	"protocol/clip"
+	"protocol/record"
+	"time"
+)
+
+//ExportClip 提交剪辑任务, 按流名称key或直播房间和推流ID指定推流点
+//优先使用直播缓存, 缓存不包含起始时间时从FLV录制中复制, 录制之后的部分再从直播缓存中复制
+func (rs *RtmpStream) ExportClip(key string, liveRoomId string, pushId int, start, finish time.Time, format string) (error, clip.Job) {
+
+	job := clip.Job{
+		Key:        key,
+		LiveRoomId: liveRoomId,
+		PushId:     pushId,
+		Format:     format,
+	}
+
+	stream := rs.findClipStream(key, liveRoomId, pushId)
+	if stream != nil {
+		job.Key = stream.info.Key
+		job.LiveRoomId = stream.liveRoomId
+		job.PushId = stream.pushId
+	} else if key != "" {
+		return errors.New("stream not found"), job
+	}
+
+	var sources []clip.Source
+	var buffer *clip.Buffer
+	if stream != nil {
+		buffer = stream.clipBuffer
+	}
+	if buffer == nil || buffer.Oldest().IsZero() || buffer.Oldest().After(start) {
+
+		var files []clip.File
+		query := catalog.NewQuery()
+		query.LiveRoomId = job.LiveRoomId
+		query.PushId = job.PushId
+		query.Start = start.Format(record.TimeFormat)
+		query.Finish = finish.Format(record.TimeFormat)
+		for _, e := range rs.catalog.Find(query) {
+
+			if e.Format != record.FormatFlv {
+				return fmt.Errorf("clip from %s record is not supported", e.Format), job
+			}
+			if e.Remote {
+				return fmt.Errorf("record %s has been moved to object storage", e.File), job
+			}
+			fileStart, err := time.ParseInLocation(record.TimeFormat, e.Start, time.Local)
+			if err != nil {
+				continue
+			}
+			files = append(files, clip.File{File: e.File, Start: fileStart})
+		}
+		if len(files) > 0 {
+			sources = append(sources, clip.NewFileSource(files))
+		}
+	}
+	if buffer != nil {
+		sources = append(sources, buffer)
+	}
+	if len(sources) == 0 {
+		return errors.New("no record or live buffer in time range"), job
+	}
+
+	job, err := rs.clips.Submit(job, start, finish, sources)
+	return err, job
+}
+
+//GetClip 得到剪辑任务的状态
+func (rs *RtmpStream) GetClip(id string) (error, clip.Job) {
+
+	job, err := rs.clips.Get(id)
+	return err, job
+}
+
+//按流名称或直播房间和推流ID查找正在直播的流
+func (rs *RtmpStream) findClipStream(key string, liveRoomId string, pushId int) *Stream {
+
+	if key != "" {
+		if i, ok := rs.streams.Get(key); ok {
+			if s, ok := i.(*Stream); ok {
+				return s
+			}
+		}
+		return nil
+	}
+
+	for item := range rs.streams.IterBuffered() {
+		if s, ok := item.Val.(*Stream); ok && s.liveRoomId == liveRoomId && s.pushId == pushId {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package rtmp
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+//同时请求广告开始时只有一个成功, 不等发布者转发广告标记
+func TestSendCuePoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rs, s := newRecordStream(dir)
+	s.isStart = true
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- rs.SendCuePoint(s.info.Key, true, 30)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	n := 0
+	for err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	if n != 1 || !s.IsCueOut() {
+		t.Fatalf("cue out succeeded %d times, cue out %v", n, s.IsCueOut())
+	}
+
+	//发布者转发广告标记时更新状态
+	s.checkCuePoint(<-s.injectQueue)
+	if !s.IsCueOut() {
+		t.Fatal("cue out cleared")
+	}
+	if err := rs.SendCuePoint(s.info.Key, false, 0); err != nil || s.IsCueOut() {
+		t.Fatalf("cue in: %v", err)
+	}
+	if err := rs.SendCuePoint(s.info.Key, false, 0); err == nil {
+		t.Fatal("cue in without cue out")
+	}
+}
@@ -0,0 +1,66 @@
+package rtmp
+
+import (
+	"av"
+	"configure"
+	log "logging"
+	"strings"
+)
+
+//得到流的HLS切片模式, 房间配置优先, 其次是应用配置
+func (rs *RtmpStream) hlsMode(info av.Info) string {
+
+	if err, liveRoomId, _ := rs.GetPushIdFromUrl(info.URL); err == nil {
+		for _, v := range configure.LiveRtmpcfg.Lives {
+
+			if v.LiveId == liveRoomId && v.HlsMode != "" {
+				if v.HlsMode == configure.HlsModeOnDemand {
+					return configure.HlsModeOnDemand
+				}
+				return configure.HlsModeAlways
+			}
+		}
+	}
+
+	app := info.Key
+	if index := strings.Index(app, "/"); index > 0 {
+		app = app[:index]
+	}
+	return configure.GetHlsInfo(app).Mode
+}
+
+//推流时是否开始HLS切片, ondemand模式在第一次请求播放列表时开始
+func hlsOnPublish(h av.Handler, info av.Info) bool {
+
+	rs, ok := h.(*RtmpStream)
+	return !ok || rs.hlsMode(info) == configure.HlsModeAlways
+}
+
+//HLS请求的流没有切片时向发布者添加HLS写入, 没有发布者时返回false
+//HLS服务的流名称为小写, 没有找到时忽略大小写查找
+func (rs *RtmpStream) activateHls(key string) bool {
+
+	var s *Stream
+	if item, ok := rs.streams.Get(key); ok {
+		s, _ = item.(*Stream)
+	} else {
+		for item := range rs.streams.IterBuffered() {
+			if strings.EqualFold(item.Key, key) {
+				s, _ = item.Val.(*Stream)
+				break
+			}
+		}
+	}
+	if s == nil || s.GetReader() == nil {
+		return false
+	}
+
+	info := s.GetReader().Info()
+	log.Infof("RtmpStream activateHls %s", info.String())
+	if rs.hlsMode(info) == configure.HlsModeOnDemand {
+		s.AddWriter(rs.hlsServer.GetOnDemandWriter(info))
+	} else {
+		s.AddWriter(rs.hlsServer.GetWriter(info))
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package rtmp
+
+import (
+	"av"
+	"configure"
+	"errors"
+	log "logging"
+	"net/url"
+	"strings"
+)
+
+//根据流名称查找已经分配的推流点地址, HTTP-FLV推流时使用, 与RTMP推流相同只允许已经开启的推流点
+//live/01/12/Camera_1 -> rtmp://10.10.50.159:1935/live/01/12/Camera_1
+func (rs *RtmpStream) FindPushUrlByKey(key string) (error, string) {
+
+	log.Infof("RtmpStream FindPushUrlByKey key=%s", key)
+
+	for _, v := range rs.liveRooms.Rooms {
+
+		for _, value := range v.Urls {
+
+			if 1 != value.State {
+				continue
+			}
+			u, err := url.Parse(value.PushUrl)
+			if err == nil && strings.TrimLeft(u.Path, "/") == key {
+				return nil, value.PushUrl
+			}
+		}
+	}
+	return errors.New("Not Found PushUrl"), ""
+}
+
+//HTTP-FLV推流, 与RTMP推流相同: 加入流管理, always模式开始HLS切片, 执行推流钩子
+func (rs *RtmpStream) Publish(reader av.ReadCloser) {
+
+	info := reader.Info()
+	rs.HandleReader(reader)
+	log.Infof("RtmpStream Publish New Publisher: %s", info.String())
+
+	if rs.hlsServer != nil && rs.hlsMode(info) == configure.HlsModeAlways {
+		rs.HandleWriter(rs.hlsServer.GetWriter(info))
+	}
+	execPush(info.Key)
+}
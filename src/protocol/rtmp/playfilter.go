@@ -0,0 +1,158 @@
+package rtmp
+
+import (
+	"av"
+	log "logging"
+	"net/url"
+	"protocol/amf"
+	"strconv"
+)
+
+//onMetaData中只属于视频或者音频的字段
+var (
+	videoMetaFields = []string{"videocodecid", "videodatarate", "width", "height", "framerate", "videoframerate", "videosize", "videoid"}
+	audioMetaFields = []string{"audiocodecid", "audiodatarate", "audiosamplerate", "audiosamplesize", "audiochannels", "stereo", "audiosize", "audioid"}
+)
+
+//PlayOptions 观看参数, HTTP-FLV为URL的查询参数, RTMP为play流名称的查询参数
+//例如 http://127.0.0.1:8011/live/stream.flv?only_audio=1, rtmp://127.0.0.1:1935/live/stream?gop=0
+type PlayOptions struct {
+	OnlyAudio         bool //only_audio=1, 只发送音频
+	OnlyVideo         bool //only_video=1, 只发送视频
+	NoGop             bool //gop=0, 不发送缓存的GOP, 从下一个关键帧开始
+	StartFromKeyframe bool //start_from_keyframe=1, 丢弃第一个视频关键帧之前的音视频
+}
+
+//ParsePlayOptions 从观看地址中解析观看参数, 只有参数名没有值时表示开启
+func ParsePlayOptions(rawurl string) PlayOptions {
+
+	var opts PlayOptions
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return opts
+	}
+	query := u.Query()
+	flag := func(name string) bool {
+		if _, ok := query[name]; !ok {
+			return false
+		}
+		value := query.Get(name)
+		if value == "" {
+			return true
+		}
+		b, _ := strconv.ParseBool(value)
+		return b
+	}
+
+	opts.OnlyAudio = flag("only_audio")
+	opts.OnlyVideo = flag("only_video")
+	opts.NoGop = query.Get("gop") == "0"
+	opts.StartFromKeyframe = flag("start_from_keyframe")
+	//同时指定时都不过滤
+	if opts.OnlyAudio && opts.OnlyVideo {
+		log.Warningf("ParsePlayOptions %s: only_audio and only_video both set, ignored", rawurl)
+		opts.OnlyAudio, opts.OnlyVideo = false, false
+	}
+	return opts
+}
+
+//IsZero 没有设置任何观看参数
+func (opts PlayOptions) IsZero() bool {
+	return opts == PlayOptions{}
+}
+
+//playFilter 按观看参数过滤发送给一个观看者的数据包, 数据包在观看者之间共享, 修改时复制
+type playFilter struct {
+	av.WriteCloser
+	opts     PlayOptions
+	hasVideo bool //收到过视频序列头, 等待关键帧时才丢弃音频
+	started  bool //已经收到第一个视频关键帧
+}
+
+func newPlayFilter(w av.WriteCloser, opts PlayOptions) *playFilter {
+	return &playFilter{
+		WriteCloser: w,
+		opts:        opts,
+		started:     !(opts.NoGop || opts.StartFromKeyframe) || opts.OnlyAudio,
+	}
+}
+
+func (f *playFilter) Write(p *av.Packet) error {
+
+	if p.IsMetadata {
+		if f.opts.OnlyAudio || f.opts.OnlyVideo {
+			p = f.reformMetadata(p)
+		}
+		return f.WriteCloser.Write(p)
+	}
+
+	if p.IsVideo {
+		if f.opts.OnlyAudio {
+			return nil
+		}
+		vh, ok := p.Header.(av.VideoPacketHeader)
+		if ok && vh.IsSeq() {
+			f.hasVideo = true
+			return f.WriteCloser.Write(p)
+		}
+		if !f.started {
+			if !ok || !vh.IsKeyFrame() {
+				return nil
+			}
+			f.started = true
+		}
+		return f.WriteCloser.Write(p)
+	}
+
+	if f.opts.OnlyVideo {
+		return nil
+	}
+	//序列头总是发送, 有视频时在第一个关键帧之前丢弃音频
+	if ah, ok := p.Header.(av.AudioPacketHeader); ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
+		return f.WriteCloser.Write(p)
+	}
+	if !f.started && f.hasVideo {
+		return nil
+	}
+	return f.WriteCloser.Write(p)
+}
+
+//reformMetadata 删除onMetaData中被过滤掉的音频或者视频字段, 其他数据消息原样发送
+func (f *playFilter) reformMetadata(p *av.Packet) *av.Packet {
+
+	name, args, err := amf.DecodeDataMessage(p.Data)
+	if err != nil || name != amf.OnMetaData || len(args) == 0 {
+		return p
+	}
+	obj, ok := args[0].(amf.Object)
+	if !ok {
+		return p
+	}
+
+	meta := make(amf.Object, len(obj))
+	for k, v := range obj {
+		meta[k] = v
+	}
+	fields := videoMetaFields
+	if f.opts.OnlyVideo {
+		fields = audioMetaFields
+	}
+	for _, field := range fields {
+		delete(meta, field)
+	}
+	if f.opts.OnlyAudio {
+		meta["hasVideo"] = false
+	} else {
+		meta["hasAudio"] = false
+	}
+
+	args[0] = meta
+	data, err := amf.EncodeDataMessage(amf.SetDataFrame, append([]interface{}{amf.OnMetaData}, args...)...)
+	if err != nil {
+		log.Errorf("playFilter reformMetadata %s error: %v", f.Info().Key, err)
+		return p
+	}
+	np := *p
+	np.Data = data
+	return &np
+}
@@ -0,0 +1,196 @@
+package rtmp
+
+import (
+	"av"
+	"protocol/amf"
+	"testing"
+	"time"
+)
+
+//testWriter 记录收到的数据包
+type testWriter struct {
+	av.RWBaser
+	info    av.Info
+	packets []*av.Packet
+}
+
+func newTestWriter() *testWriter {
+	return &testWriter{RWBaser: av.NewRWBaser(time.Second * 10), info: av.Info{Key: "live/test", UID: "player"}}
+}
+
+func (w *testWriter) Info() av.Info { return w.info }
+func (w *testWriter) Close(error)   {}
+
+func (w *testWriter) Write(p *av.Packet) error {
+	w.packets = append(w.packets, p)
+	return nil
+}
+
+func TestParsePlayOptions(t *testing.T) {
+	tests := []struct {
+		url  string
+		want PlayOptions
+	}{
+		{"http://127.0.0.1:8011/live/test.flv", PlayOptions{}},
+		{"http://127.0.0.1:8011/live/test.flv?only_audio=1", PlayOptions{OnlyAudio: true}},
+		{"http://127.0.0.1:8011/live/test.flv?only_audio", PlayOptions{OnlyAudio: true}},
+		{"http://127.0.0.1:8011/live/test.flv?only_video=true&gop=0", PlayOptions{OnlyVideo: true, NoGop: true}},
+		{"rtmp://127.0.0.1:1935/live/test?start_from_keyframe=1", PlayOptions{StartFromKeyframe: true}},
+		//不能解析的值不开启
+		{"http://127.0.0.1:8011/live/test.flv?only_audio=yes&gop=false", PlayOptions{}},
+		{"http://127.0.0.1:8011/live/test.flv?only_video=0&gop=1", PlayOptions{}},
+		//重复的参数使用第一个值
+		{"http://127.0.0.1:8011/live/test.flv?only_audio=1&only_audio=0&gop=0&gop=1", PlayOptions{OnlyAudio: true, NoGop: true}},
+		{"http://127.0.0.1:8011/live/test.flv?only_video=0&only_video=1", PlayOptions{}},
+		//同时指定只要音频和只要视频时都不过滤
+		{"http://127.0.0.1:8011/live/test.flv?only_audio=1&only_video=1&gop=0", PlayOptions{NoGop: true}},
+		{"http://127.0.0.1:8011/live/%zz.flv?only_audio=1", PlayOptions{}},
+	}
+	for _, tt := range tests {
+		if got := ParsePlayOptions(tt.url); got != tt.want {
+			t.Errorf("ParsePlayOptions(%s) = %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+	if !(PlayOptions{}).IsZero() || (PlayOptions{NoGop: true}).IsZero() {
+		t.Error("IsZero")
+	}
+}
+
+//kinds 数据包的类型: m为metadata, V和A为序列头, K为关键帧, v和a为其他音视频
+func kinds(packets []*av.Packet) string {
+	s := ""
+	for _, p := range packets {
+		switch {
+		case p.IsMetadata:
+			s += "m"
+		case p.IsVideo && p.Header.(testVideoHeader).seq:
+			s += "V"
+		case p.IsVideo && p.Header.(testVideoHeader).key:
+			s += "K"
+		case p.IsVideo:
+			s += "v"
+		case p.Header.(testAudioHeader).seq:
+			s += "A"
+		default:
+			s += "a"
+		}
+	}
+	return s
+}
+
+func TestPlayFilter(t *testing.T) {
+	//从gop中间开始的数据
+	packets := []*av.Packet{
+		videoPacket(0, true, true),
+		audioPacket(0, true),
+		audioPacket(10, false),
+		videoPacket(20, false, false),
+		audioPacket(30, false),
+		videoPacket(40, true, false),
+		audioPacket(50, false),
+		videoPacket(60, false, false),
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/live/test.flv", "VAavaKav"},
+		{"/live/test.flv?only_audio=1", "Aaaa"},
+		{"/live/test.flv?only_video=1", "VvKv"},
+		{"/live/test.flv?gop=0", "VAKav"},
+		{"/live/test.flv?start_from_keyframe=1", "VAKav"},
+		{"/live/test.flv?only_video=1&gop=0", "VKv"},
+		//只要音频时不等待关键帧
+		{"/live/test.flv?only_audio=1&gop=0", "Aaaa"},
+	}
+	for _, tt := range tests {
+		w := newTestWriter()
+		f := newPlayFilter(w, ParsePlayOptions(tt.url))
+		for _, p := range packets {
+			if err := f.Write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := kinds(w.packets); got != tt.want {
+			t.Errorf("%s: packets %s, want %s", tt.url, got, tt.want)
+		}
+	}
+
+	//没有视频时不等待关键帧
+	w := newTestWriter()
+	f := newPlayFilter(w, PlayOptions{NoGop: true})
+	for _, p := range []*av.Packet{audioPacket(0, true), audioPacket(10, false), audioPacket(20, false)} {
+		f.Write(p)
+	}
+	if got := kinds(w.packets); got != "Aaa" {
+		t.Errorf("audio only stream packets %s", got)
+	}
+}
+
+func TestPlayFilterMetadata(t *testing.T) {
+	data, err := amf.EncodeDataMessage(amf.SetDataFrame, amf.OnMetaData, amf.Object{
+		"duration":        0.0,
+		"width":           1280.0,
+		"height":          720.0,
+		"videocodecid":    7.0,
+		"framerate":       25.0,
+		"audiocodecid":    10.0,
+		"audiosamplerate": 44100.0,
+		"stereo":          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := &av.Packet{IsMetadata: true, Data: data}
+
+	decode := func(p *av.Packet) amf.Object {
+		name, args, err := amf.DecodeDataMessage(p.Data)
+		if err != nil || name != amf.OnMetaData || len(args) == 0 {
+			t.Fatalf("decode metadata %s %v", name, err)
+		}
+		obj, ok := args[0].(amf.Object)
+		if !ok {
+			t.Fatalf("metadata %T", args[0])
+		}
+		return obj
+	}
+
+	w := newTestWriter()
+	newPlayFilter(w, PlayOptions{OnlyAudio: true}).Write(meta)
+	obj := decode(w.packets[0])
+	for _, field := range []string{"width", "height", "videocodecid", "framerate"} {
+		if _, ok := obj[field]; ok {
+			t.Errorf("only_audio metadata has %s", field)
+		}
+	}
+	if obj["hasVideo"] != false || obj["audiocodecid"] != 10.0 || obj["stereo"] != true || obj["duration"] != 0.0 {
+		t.Errorf("only_audio metadata %v", obj)
+	}
+
+	w = newTestWriter()
+	newPlayFilter(w, PlayOptions{OnlyVideo: true}).Write(meta)
+	obj = decode(w.packets[0])
+	for _, field := range []string{"audiocodecid", "audiosamplerate", "stereo"} {
+		if _, ok := obj[field]; ok {
+			t.Errorf("only_video metadata has %s", field)
+		}
+	}
+	if obj["hasAudio"] != false || obj["width"] != 1280.0 || obj["videocodecid"] != 7.0 {
+		t.Errorf("only_video metadata %v", obj)
+	}
+
+	//共享的数据包不被修改
+	if len(decode(meta)) != 8 {
+		t.Error("shared metadata modified")
+	}
+
+	//其他数据消息和不过滤时原样发送
+	cue, _ := amf.EncodeDataMessage("onCuePoint", amf.Object{"name": "ad"})
+	w = newTestWriter()
+	f := newPlayFilter(w, PlayOptions{OnlyAudio: true})
+	f.Write(&av.Packet{IsMetadata: true, Data: cue})
+	newPlayFilter(w, PlayOptions{NoGop: true}).Write(meta)
+	if len(w.packets) != 2 || string(w.packets[0].Data) != string(cue) || w.packets[1] != meta {
+		t.Error("data message changed")
+	}
+}
@@ -0,0 +1,287 @@
+package rtmp
+
+import (
+	"av"
+	"configure"
+	"errors"
+	log "logging"
+	"protocol/record"
+	"time"
+)
+
+const (
+	RecordSourceAuto     = "auto"     //engineEnable开启时推流自动录制
+	RecordSourceApi      = "api"      //接口启动
+	RecordSourceSchedule = "schedule" //定时录制
+
+	//检查定时录制的间隔
+	scheduleInterval = 30 * time.Second
+)
+
+//RecordState 发布者的录制状态
+type RecordState struct {
+	Key        string `json:"key"`
+	Url        string `json:"url"`
+	LiveRoomId string `json:"liveRoomId"`
+	PushId     int    `json:"pushId"`
+	Recording  bool   `json:"recording"`
+	Source     string `json:"source"` //auto/api/schedule
+	Format     string `json:"format"`
+	File       string `json:"file"`  //当前正在录制的文件
+	Start      string `json:"start"` //启动录制的时间
+	Until      string `json:"until"` //自动停止的时间
+}
+
+//RecordState 得到当前的录制状态
+func (s *Stream) RecordState() RecordState {
+
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+
+	state := RecordState{
+		Key:        s.info.Key,
+		Url:        s.info.URL,
+		LiveRoomId: s.liveRoomId,
+		PushId:     s.pushId,
+	}
+	if s.recorder == nil {
+		return state
+	}
+	state.Recording = true
+	state.Source = s.recordSource
+	state.File = s.recorder.File()
+	state.Start = s.recordStart.Format(record.TimeFormat)
+	if s.recordTarget != nil {
+		state.Format = s.recordTarget.Format
+	}
+	if !s.recordUntil.IsZero() {
+		state.Until = s.recordUntil.Format(record.TimeFormat)
+	}
+	return state
+}
+
+//Recording 是否正在录制, 返回录制来源
+func (s *Stream) Recording() (bool, string) {
+
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	return s.recorder != nil, s.recordSource
+}
+
+//推流时启动录制, 房间配置了定时录制时只在时段内录制, 否则由engineEnable决定
+func (rs *RtmpStream) autoRecord(stream *Stream, info av.Info) {
+
+	err, liveRoomId, _ := rs.GetPushIdFromUrl(info.URL)
+	if err != nil {
+		return
+	}
+
+	source := RecordSourceAuto
+	if schedules := rs.getSchedules(liveRoomId); len(schedules) > 0 {
+
+		if !inSchedule(schedules, time.Now()) {
+			log.Infof("RtmpStream autoRecord Not In Schedule URL=%s", info.URL)
+			return
+		}
+		source = RecordSourceSchedule
+	} else if "enable" != configure.GetEngineEnable() {
+		return
+	}
+
+	if err := rs.startRecord(stream, info, source, 0); err != nil {
+		log.Errorf("RtmpStream HandleReader Start Record Failed URL=%s error=%v", info.URL, err)
+	}
+}
+
+//检查保存目录后启动录制
+func (rs *RtmpStream) startRecord(stream *Stream, info av.Info, source string, duration time.Duration) error {
+
+	err, target := rs.getRecordPath(info.URL)
+	if err != nil {
+		return err
+	}
+	if !rs.checkRecordSpace(target.Dir) {
+		return errors.New("Record Space Not Enough")
+	}
+
+	log.Infof("RtmpStream Start Record URL=%s Dir=%s Format=%s Source=%s Duration=%v", info.URL, target.Dir, target.Format, source, duration)
+	stream.StartRecord(info, target, source, duration)
+	return nil
+}
+
+//按流名称key或直播房间和推流ID查找发布者, pushId小于0表示房间内所有推流点
+func (rs *RtmpStream) findRecordStreams(key string, liveRoomId string, pushId int) []*Stream {
+
+	var streams []*Stream
+	for item := range rs.streams.IterBuffered() {
+
+		s, ok := item.Val.(*Stream)
+		if !ok || s.GetReader() == nil {
+			continue
+		}
+		if key != "" {
+			if item.Key == key {
+				streams = append(streams, s)
+			}
+			continue
+		}
+		if s.liveRoomId == liveRoomId && (pushId < 0 || s.pushId == pushId) {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+//StartRecording 启动指定发布者的录制, 已经在录制时重新开始
+//duration(秒)大于0时录制duration后自动停止
+func (rs *RtmpStream) StartRecording(key string, liveRoomId string, pushId int, duration int) (error, []RecordState) {
+
+	streams := rs.findRecordStreams(key, liveRoomId, pushId)
+	if len(streams) == 0 {
+		return errors.New("Not Found Publisher"), nil
+	}
+
+	states := make([]RecordState, 0, len(streams))
+	for _, s := range streams {
+
+		r := s.GetReader()
+		if r == nil {
+			continue
+		}
+		if err := rs.startRecord(s, r.Info(), RecordSourceApi, time.Duration(duration)*time.Second); err != nil {
+			return err, states
+		}
+		states = append(states, s.RecordState())
+	}
+	return nil, states
+}
+
+//StopRecording 停止指定发布者的录制
+func (rs *RtmpStream) StopRecording(key string, liveRoomId string, pushId int) (error, []RecordState) {
+
+	streams := rs.findRecordStreams(key, liveRoomId, pushId)
+	if len(streams) == 0 {
+		return errors.New("Not Found Publisher"), nil
+	}
+
+	states := make([]RecordState, 0, len(streams))
+	for _, s := range streams {
+
+		log.Infof("RtmpStream Stop Record Key=%s", s.info.Key)
+		s.StopRecord()
+		states = append(states, s.RecordState())
+	}
+	return nil, states
+}
+
+//RecordStates 得到所有发布者的录制状态
+func (rs *RtmpStream) RecordStates() []RecordState {
+
+	states := make([]RecordState, 0)
+	for item := range rs.streams.IterBuffered() {
+
+		if s, ok := item.Val.(*Stream); ok && s.GetReader() != nil {
+			states = append(states, s.RecordState())
+		}
+	}
+	return states
+}
+
+//得到房间的定时录制配置
+func (rs *RtmpStream) getSchedules(liveRoomId string) []configure.ScheduleInfo {
+
+	for _, v := range configure.LiveRtmpcfg.Lives {
+
+		if v.LiveId == liveRoomId {
+			return v.Schedules
+		}
+	}
+	return nil
+}
+
+//定时录制, 进入时段时启动录制, 离开时段时停止定时启动的录制
+//接口启动的录制不受时段影响
+func (rs *RtmpStream) checkSchedules() {
+
+	for {
+
+		time.Sleep(scheduleInterval)
+
+		now := time.Now()
+		for item := range rs.streams.IterBuffered() {
+
+			s, ok := item.Val.(*Stream)
+			if !ok || s.GetReader() == nil || s.liveRoomId == "" {
+				continue
+			}
+			schedules := rs.getSchedules(s.liveRoomId)
+			if len(schedules) == 0 {
+				continue
+			}
+
+			in := inSchedule(schedules, now)
+			recording, source := s.Recording()
+			if in && !recording {
+
+				if err := rs.startRecord(s, s.GetReader().Info(), RecordSourceSchedule, 0); err != nil {
+					log.Errorf("RtmpStream Schedule Start Record Failed Key=%s error=%v", item.Key, err)
+				}
+			} else if !in && recording && source == RecordSourceSchedule {
+
+				log.Infof("RtmpStream Schedule Stop Record Key=%s", item.Key)
+				s.StopRecord()
+			}
+		}
+	}
+}
+
+//t是否在任意一个录制时段内
+func inSchedule(schedules []configure.ScheduleInfo, t time.Time) bool {
+
+	for _, schedule := range schedules {
+
+		if matchSchedule(schedule, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSchedule(schedule configure.ScheduleInfo, t time.Time) bool {
+
+	start, errStart := time.Parse("15:04", schedule.Start)
+	finish, errFinish := time.Parse("15:04", schedule.Finish)
+	if errStart != nil || errFinish != nil {
+		log.Errorf("Invalid Record Schedule Start=%s Finish=%s", schedule.Start, schedule.Finish)
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	finishMinute := finish.Hour()*60 + finish.Minute()
+
+	//跨过午夜的时段, 午夜之后的部分属于前一天
+	day := t
+	if finishMinute > startMinute {
+		if minute < startMinute || minute >= finishMinute {
+			return false
+		}
+	} else if minute < finishMinute {
+		day = t.AddDate(0, 0, -1)
+	} else if minute < startMinute {
+		return false
+	}
+
+	if len(schedule.Days) == 0 {
+		return true
+	}
+	weekday := int(day.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	for _, d := range schedule.Days {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
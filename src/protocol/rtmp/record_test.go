@@ -0,0 +1,212 @@
+package rtmp
+
+import (
+	"av"
+	cmap "concurrent-map"
+	"configure"
+	"io/ioutil"
+	"os"
+	"protocol/catalog"
+	"testing"
+	"time"
+)
+
+//testVideoHeader 测试用的视频包头
+type testVideoHeader struct {
+	key bool
+	seq bool
+}
+
+func (h testVideoHeader) IsKeyFrame() bool       { return h.key }
+func (h testVideoHeader) IsSeq() bool            { return h.seq }
+func (h testVideoHeader) CodecID() uint8         { return av.VIDEO_H264 }
+func (h testVideoHeader) CompositionTime() int32 { return 0 }
+
+//testAudioHeader 测试用的AAC音频包头
+type testAudioHeader struct {
+	seq bool
+}
+
+func (h testAudioHeader) SoundFormat() uint8 { return av.SOUND_AAC }
+func (h testAudioHeader) AACPacketType() uint8 {
+	if h.seq {
+		return av.AAC_SEQHDR
+	}
+	return av.AAC_RAW
+}
+
+func videoPacket(ts uint32, key, seq bool) *av.Packet {
+	return &av.Packet{IsVideo: true, TimeStamp: ts, Header: testVideoHeader{key: key, seq: seq}, Data: []byte{0x17, 0x01}}
+}
+
+func audioPacket(ts uint32, seq bool) *av.Packet {
+	return &av.Packet{IsAudio: true, TimeStamp: ts, Header: testAudioHeader{seq: seq}, Data: []byte{0xaf, 0x01}}
+}
+
+//testReader 测试用的发布者, 不产生数据
+type testReader struct {
+	info av.Info
+}
+
+func (r *testReader) Info() av.Info         { return r.info }
+func (r *testReader) Close(error)           {}
+func (r *testReader) Alive() bool           { return true }
+func (r *testReader) Read(*av.Packet) error { return nil }
+
+func TestMatchSchedule(t *testing.T) {
+	//2024-01-01为星期一
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	sunday := time.Date(2023, 12, 31, 23, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		schedule configure.ScheduleInfo
+		t        time.Time
+		want     bool
+	}{
+		{"every day in", configure.ScheduleInfo{Start: "09:00", Finish: "18:00"}, at(1, 9, 0), true},
+		{"every day before", configure.ScheduleInfo{Start: "09:00", Finish: "18:00"}, at(1, 8, 59), false},
+		{"every day finish", configure.ScheduleInfo{Start: "09:00", Finish: "18:00"}, at(1, 18, 0), false},
+		{"weekday friday", configure.ScheduleInfo{Days: []int{1, 2, 3, 4, 5}, Start: "09:00", Finish: "18:00"}, at(5, 10, 0), true},
+		{"weekday saturday", configure.ScheduleInfo{Days: []int{1, 2, 3, 4, 5}, Start: "09:00", Finish: "18:00"}, at(6, 10, 0), false},
+		{"sunday is 7", configure.ScheduleInfo{Days: []int{7}, Start: "09:00", Finish: "18:00"}, at(7, 10, 0), true},
+		{"midnight before", configure.ScheduleInfo{Start: "22:00", Finish: "02:00"}, at(1, 23, 30), true},
+		{"midnight after", configure.ScheduleInfo{Start: "22:00", Finish: "02:00"}, at(1, 1, 59), true},
+		{"midnight finish", configure.ScheduleInfo{Start: "22:00", Finish: "02:00"}, at(1, 2, 0), false},
+		{"midnight outside", configure.ScheduleInfo{Start: "22:00", Finish: "02:00"}, at(1, 12, 0), false},
+		//星期日晚上开始的时段, 星期一凌晨属于星期日
+		{"sunday night", configure.ScheduleInfo{Days: []int{7}, Start: "22:00", Finish: "02:00"}, sunday, true},
+		{"sunday night monday morning", configure.ScheduleInfo{Days: []int{7}, Start: "22:00", Finish: "02:00"}, at(1, 1, 0), true},
+		{"sunday night sunday morning", configure.ScheduleInfo{Days: []int{7}, Start: "22:00", Finish: "02:00"}, sunday.Add(-22 * time.Hour), false},
+		{"monday night monday morning", configure.ScheduleInfo{Days: []int{1}, Start: "22:00", Finish: "02:00"}, at(1, 1, 0), false},
+		{"monday night tuesday morning", configure.ScheduleInfo{Days: []int{1}, Start: "22:00", Finish: "02:00"}, at(2, 1, 0), true},
+		{"invalid", configure.ScheduleInfo{Start: "9:00:00", Finish: "18:00"}, at(1, 10, 0), false},
+	}
+	for _, tt := range tests {
+		if got := matchSchedule(tt.schedule, tt.t); got != tt.want {
+			t.Errorf("%s: matchSchedule(%v, %s) = %v", tt.name, tt.schedule, tt.t.Format("Mon 15:04"), got)
+		}
+	}
+
+	schedules := []configure.ScheduleInfo{{Start: "09:00", Finish: "12:00"}, {Start: "14:00", Finish: "18:00"}}
+	if !inSchedule(schedules, at(1, 15, 0)) || inSchedule(schedules, at(1, 13, 0)) {
+		t.Error("inSchedule")
+	}
+}
+
+//newRecordStream 房间room1中推流ID为1的发布者, 录制到dir
+func newRecordStream(dir string) (*RtmpStream, *Stream) {
+	info := av.Info{Key: "live/room1", URL: "rtmp://127.0.0.1/live/room1", UID: "publisher"}
+	rs := &RtmpStream{
+		streams: cmap.New(),
+		liveRooms: configure.LiveRooms{Rooms: []*configure.LiveRoom{{
+			LiveRoomId: "room1",
+			ProjectId:  1,
+			Urls:       []*configure.PushStreamUrl{{PushId: 1, PushUrl: info.URL, SavePath: dir, VideoName: "camera"}},
+		}}},
+		catalog: catalog.NewCatalog(dir+"/catalog.json", 0),
+		journal: catalog.NewJournal(dir + "/journal.json"),
+	}
+	s := NewStream(rs)
+	s.info = info
+	s.r = &testReader{info: info}
+	s.liveRoomId = "room1"
+	s.pushId = 1
+	rs.streams.Set(info.Key, s)
+	return rs, s
+}
+
+//waitRecording 等待录制状态变为want
+func waitRecording(s *Stream, want bool) bool {
+	for i := 0; i < 200; i++ {
+		if recording, _ := s.Recording(); recording == want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRecordApi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rs, s := newRecordStream(dir)
+
+	if err, _ := rs.StartRecording("live/none", "", 0, 0); err == nil {
+		t.Fatal("record started without publisher")
+	}
+
+	err, states := rs.StartRecording("", "room1", -1, 60)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("start recording: %v %v", err, states)
+	}
+	state := states[0]
+	if !state.Recording || state.Source != RecordSourceApi || state.Format != "flv" || state.Until == "" || state.PushId != 1 {
+		t.Fatalf("record state %+v", state)
+	}
+	if _, err := os.Stat(dir + "/room1/1"); err != nil {
+		t.Fatal(err)
+	}
+	if states := rs.RecordStates(); len(states) != 1 || !states[0].Recording {
+		t.Fatalf("record states %+v", states)
+	}
+
+	err, states = rs.StopRecording("live/room1", "", 0)
+	if err != nil || len(states) != 1 || states[0].Recording || states[0].Source != "" {
+		t.Fatalf("stop recording: %v %+v", err, states)
+	}
+	if s.ws.Count() != 0 {
+		t.Fatal("recorder not removed")
+	}
+}
+
+//录制时长到了以后自动停止
+func TestRecordAutoStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rs, s := newRecordStream(dir)
+
+	if err := rs.startRecord(s, s.info, RecordSourceApi, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if state := s.RecordState(); !state.Recording || state.Until == "" {
+		t.Fatalf("record state %+v", state)
+	}
+	if !waitRecording(s, false) {
+		t.Fatal("record not stopped")
+	}
+	if state := s.RecordState(); state.Until != "" || s.ws.Count() != 0 {
+		t.Fatalf("record state %+v", state)
+	}
+}
+
+//录制器写入出错时清除录制状态
+func TestRecordWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, s := newRecordStream(dir)
+
+	target := &RecordTarget{Dir: dir + "/missing", VideoName: "camera", Format: "flv", LiveRoomId: "room1", ProjectId: 1, PushId: 1}
+	s.StartRecord(s.info, target, RecordSourceApi, 0)
+	s.recordLock.Lock()
+	recorder := s.recorder
+	s.recordLock.Unlock()
+
+	recorder.Write(videoPacket(0, true, false))
+	if !waitRecording(s, false) {
+		t.Fatal("recording after write error")
+	}
+	if s.ws.Count() != 0 {
+		t.Fatal("recorder not removed")
+	}
+}
@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"fmt"
+	log "logging"
+	"os"
+	"path"
+	"protocol/catalog"
+	"protocol/record"
+	"strings"
+	"time"
+)
+
+const (
+	EventRecordRecovered = "record_recovered"      //恢复了异常退出时没有完成的录制
+	EventRecoverFailed   = "record_recover_failed" //恢复失败, 文件保留原名
+)
+
+//RecoverEvent 录制恢复事件
+type RecoverEvent struct {
+	Type       string  `json:"type"`
+	LiveRoomId string  `json:"liveRoomId"`
+	ProjectId  int     `json:"projectId"`
+	PushId     int     `json:"pushId"`
+	Orphan     string  `json:"orphan"` //恢复前的文件
+	File       string  `json:"file"`   //恢复后的文件
+	Start      string  `json:"start"`
+	Finish     string  `json:"finish"`
+	Duration   float64 `json:"duration"`
+	Message    string  `json:"message"`
+	Time       string  `json:"time"`
+}
+
+//恢复录制日志中上次异常退出时没有完成的录制, 返回处理过的文件
+func (rs *RtmpStream) recoverRecords() map[string]bool {
+
+	recovered := make(map[string]bool)
+	for _, e := range rs.journal.Orphans() {
+
+		recovered[e.File] = true
+		rs.recoverRecord(e)
+	}
+	return recovered
+}
+
+//截掉不完整的结尾, 由最后的时间戳得到结束时间, 改名为 名称_起始时间_结束时间 并加入索引
+func (rs *RtmpStream) recoverRecord(e catalog.Entry) {
+
+	orphan := e.File
+	defer rs.journal.End(orphan)
+
+	event := RecoverEvent{
+		Type:       EventRecordRecovered,
+		LiveRoomId: e.LiveRoomId,
+		ProjectId:  e.ProjectId,
+		PushId:     e.PushId,
+		Orphan:     orphan,
+		Start:      e.Start,
+	}
+	fail := func(err error) {
+
+		log.Errorf("RtmpStream recoverRecord %s error: %v", orphan, err)
+		event.Type = EventRecoverFailed
+		event.Message = err.Error()
+		event.Time = time.Now().Format(record.TimeFormat)
+		rs.notify(event)
+	}
+
+	if _, err := os.Stat(orphan); err != nil {
+
+		//创建文件之前退出, 没有需要恢复的文件
+		if os.IsNotExist(err) {
+			return
+		}
+		fail(err)
+		return
+	}
+
+	start, err := time.ParseInLocation(record.TimeFormat, e.Start, time.Local)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	duration, err := record.Recover(e.Format, orphan)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	finish := start.Add(time.Duration(duration) * time.Millisecond)
+	ext := path.Ext(orphan)
+	dst := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(orphan, ext), finish.Format(record.TimeFormat), ext)
+	if err := os.Rename(orphan, dst); err != nil {
+		fail(err)
+		return
+	}
+
+	e.File = dst
+	e.Addr = strings.TrimSuffix(e.Addr, path.Base(orphan)) + path.Base(dst)
+	e.Finish = finish.Format(record.TimeFormat)
+	e.Duration = float64(duration) / 1000
+	rs.catalog.Add(e)
+	rs.uploadRecord(e)
+
+	log.Infof("RtmpStream recoverRecord %s -> %s Duration=%.3f", orphan, dst, e.Duration)
+	event.File = dst
+	event.Finish = e.Finish
+	event.Duration = e.Duration
+	event.Time = time.Now().Format(record.TimeFormat)
+	rs.notify(event)
+}
@@ -16,6 +16,7 @@ import (
 	_ "reflect"
 	_ "strconv"
 	"strings"
+	"sync"
 	"time"
 	"utils/uid"
 )
@@ -56,7 +57,7 @@ func (c *Client) Dial(url string, method string) error {
 		log.Infof("---->>>>client Dial method is av.PLAY NewVirReader url=%s, method=%s", url, method)
 		c.handler.HandleReader(reader)
 
-		if c.getter != nil {
+		if c.getter != nil && hlsOnPublish(c.handler, reader.Info()) {
 
 			log.Infof("---->>>>client Dial method is av.PLAY getter != nil")
 			writer := c.getter.GetWriter(reader.Info())
@@ -105,6 +106,12 @@ func (s *Server) Serve(listener net.Listener) (err error) {
 
 func (s *Server) ExecPush(key string) {
 
+	execPush(key)
+}
+
+//执行配置的推流钩子, RTMP推流和HTTP-FLV推流相同
+func execPush(key string) {
+
 	execList := configure.GetExecPush()
 
 	for _, execItem := range execList {
@@ -161,8 +168,14 @@ func (s *Server) handleConn(conn *core.Conn) error {
 		return errors.New("Get rtmp Stream information error")
 	}
 
+	//观看者的play流名称可以带观看参数(only_audio, gop=0等), 查找推流点时去掉
+	pushUrl := url
+	if pos := strings.Index(pushUrl, "?"); pos >= 0 && !connServer.IsPublisher() {
+		pushUrl = pushUrl[:pos]
+	}
+
 	//判断推流点地址是否已经被允许
-	err, pushStream := rtmpStream.FindPushStream(url)
+	err, pushStream := rtmpStream.FindPushStream(pushUrl)
 	if err != nil {
 
 		conn.Close()
@@ -171,7 +184,7 @@ func (s *Server) handleConn(conn *core.Conn) error {
 	}
 
 	//查询项目ID和推流ID
-	errProject, projectId, pushId := rtmpStream.GetProjectPushIdFromUrl(url)
+	errProject, projectId, pushId := rtmpStream.GetProjectPushIdFromUrl(pushUrl)
 	if errProject != nil {
 		conn.Close()
 		log.Error("Not Found projectId and pushId url=%s", url)
@@ -186,12 +199,11 @@ func (s *Server) handleConn(conn *core.Conn) error {
 		s.handler.HandleReader(reader)
 		log.Infof("---->>>> Server handleConn New Publisher: %s", reader.Info().String())
 
-		//		if s.getter != nil {
-		//			writeType := reflect.TypeOf(s.getter)
-		//			log.Infof("handleConn:writeType=%v", writeType)
-		//			writer := s.getter.GetWriter(reader.Info())
-		//			s.handler.HandleWriter(writer)
-		//		}
+		//HLS切片, ondemand模式在第一次请求播放列表时开始
+		if s.getter != nil && hlsOnPublish(s.handler, reader.Info()) {
+			writer := s.getter.GetWriter(reader.Info())
+			s.handler.HandleWriter(writer)
+		}
 		s.ExecPush(reader.Info().Key)
 
 	} else {
@@ -205,6 +217,7 @@ func (s *Server) handleConn(conn *core.Conn) error {
 	return nil
 }
 
+//没有RTMP连接的发布者(HTTP-FLV推流)返回的*core.Conn为nil, 使用前需要检查
 type GetInFo interface {
 	GetInfo() (string, string, string, *core.Conn) //app string, name string, url string, *core.Conn
 }
@@ -216,6 +229,23 @@ type StreamReadWriteCloser interface {
 	Read(c *core.ChunkStream) error
 }
 
+//没有RTMP连接的发布者(HTTP-FLV推流)提供对端地址, 用于发布者统计
+type PeerAddr interface {
+	PeerAddr() string
+}
+
+//得到连接的对端地址, 没有RTMP连接时使用PeerAddr
+func peerIP(conn StreamReadWriteCloser) string {
+
+	if _, _, _, c := conn.GetInfo(); c != nil {
+		return c.RemoteAddr().String()
+	}
+	if peer, ok := conn.(PeerAddr); ok {
+		return peer.PeerAddr()
+	}
+	return ""
+}
+
 type StaticsBW struct {
 	StreamId               uint32
 	PeerIP                 string
@@ -236,7 +266,8 @@ type VirWriter struct {
 	av.RWBaser
 	conn        StreamReadWriteCloser
 	packetQueue chan *av.Packet
-	WriteBWInfo StaticsBW
+	statsLock   sync.Mutex
+	WriteBWInfo StaticsBW //由statsLock保护, 其他协程使用WriteStatics读取
 
 	projectId  int
 	pushId     int
@@ -281,11 +312,20 @@ func (v *VirWriter) CheckAudio() {
 	}
 }
 
+//WriteStatics 得到观看者统计信息的副本
+func (v *VirWriter) WriteStatics() StaticsBW {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.WriteBWInfo
+}
+
 func (v *VirWriter) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
-	_, _, _, conn := v.conn.GetInfo()
-	v.WriteBWInfo.PeerIP = conn.RemoteAddr().String()
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+
+	v.WriteBWInfo.PeerIP = peerIP(v.conn)
 	v.WriteBWInfo.StreamId = streamid
 	if isVideoFlag {
 		v.WriteBWInfo.VideoDatainBytes = v.WriteBWInfo.VideoDatainBytes + length
@@ -474,8 +514,9 @@ type VirReader struct {
 	av.RWBaser
 	demuxer    *flv.Demuxer
 	conn       StreamReadWriteCloser
-	ReadBWInfo StaticsBW
-	limitAudio bool //是否被限制语音
+	statsLock  sync.Mutex
+	ReadBWInfo StaticsBW //由statsLock保护, 其他协程使用ReadStatics读取
+	limitAudio bool      //是否被限制语音
 }
 
 func NewVirReader(conn StreamReadWriteCloser) *VirReader {
@@ -488,12 +529,21 @@ func NewVirReader(conn StreamReadWriteCloser) *VirReader {
 	}
 }
 
+//ReadStatics 得到发布者统计信息的副本
+func (v *VirReader) ReadStatics() StaticsBW {
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+	return v.ReadBWInfo
+}
+
 func (v *VirReader) SaveStatics(streamid uint32, length uint64, isVideoFlag bool) {
 	nowInMS := int64(time.Now().UnixNano() / 1e6)
 
-	_, _, _, conn := v.conn.GetInfo()
+	v.statsLock.Lock()
+	defer v.statsLock.Unlock()
+
+	v.ReadBWInfo.PeerIP = peerIP(v.conn)
 	v.ReadBWInfo.StreamId = streamid
-	v.ReadBWInfo.PeerIP = conn.RemoteAddr().String()
 	if isVideoFlag {
 		v.ReadBWInfo.VideoDatainBytes = v.ReadBWInfo.VideoDatainBytes + length
 	} else {
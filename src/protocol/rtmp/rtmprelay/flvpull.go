@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	log "logging"
+	"net/http"
 	"protocol/httpflvclient"
 	"protocol/rtmp/core"
 	"time"
@@ -13,6 +14,7 @@ import (
 type FlvPull struct {
 	FlvUrl        string
 	RtmpUrl       string
+	Header        http.Header //拉流请求附加的头
 	flvclient     *httpflvclient.HttpFlvClient
 	rtmpclient    *core.ConnClient
 	isStart       bool
@@ -237,6 +239,9 @@ func (self *FlvPull) Start() error {
 		errString := fmt.Sprintf("FlvPull(%s) error", self.FlvUrl)
 		return errors.New(errString)
 	}
+	for k, v := range self.Header {
+		self.flvclient.Header[k] = v
+	}
 
 	self.rtmpclient = core.NewConnClient()
 
@@ -0,0 +1,384 @@
+package rtmprelay
+
+import (
+	"av"
+	"bytes"
+	"common/hls"
+	"common/httputils"
+	"container/ts"
+	"errors"
+	"fmt"
+	log "logging"
+	"net/url"
+	"protocol/rtmp/core"
+	"time"
+)
+
+const (
+	hlsPullTimeout    = 5                //下载超时(秒)
+	hlsPullRetryCount = 3                //分片下载重试次数
+	hlsPullRetryWait  = 2 * time.Second  //下载失败和RTMP重连的间隔
+	hlsPullLiveEdge   = 3                //开始拉取时从倒数第几个分片开始
+	hlsPullMaxJump    = 5000             //时间戳跳变超过5秒认为不连续(毫秒)
+	hlsPullGap        = 40               //不连续时和上一个时间戳的间隔(毫秒)
+	hlsPullMaxLag     = 10 * time.Second //推送和时间戳相差超过10秒时重新计时
+)
+
+//hlsTimeline 把分片中的时间戳转换为连续的RTMP时间戳
+//分片不连续, 源重启或时间戳回绕时接着上一个时间戳继续
+type hlsTimeline struct {
+	offset  int64
+	last    int64
+	started bool
+}
+
+func (t *hlsTimeline) discontinue() {
+	t.started = false
+}
+
+func (t *hlsTimeline) timestamp(ts uint32) uint32 {
+	v := int64(ts)
+	if !t.started || v+t.offset < t.last-hlsPullMaxJump || v+t.offset > t.last+hlsPullMaxJump {
+		gap := int64(hlsPullGap)
+		if t.last == 0 {
+			gap = 0
+		}
+		t.offset = t.last + gap - v
+		t.started = true
+	}
+	out := v + t.offset
+	if out < 0 {
+		out = 0
+	}
+	if out > t.last {
+		t.last = out
+	}
+	return uint32(out)
+}
+
+//HlsPull 拉取HLS直播流(可以是主播放列表), 解析TS后推送到本地RTMP
+type HlsPull struct {
+	HlsUrl      string
+	RtmpUrl     string
+	rtmpclient  *core.ConnClient
+	lastConnect time.Time
+	demuxer     *ts.Demuxer
+	timeline    hlsTimeline
+	nextSeq     int64 //下一个要拉取的分片序号, -1表示还没有开始
+	paceTime    time.Time
+	paceTs      int64
+	videoHdr    *core.ChunkStream
+	audioHdr    *core.ChunkStream
+	isStart     bool
+	stopChan    chan struct{}
+}
+
+func NewHlsPull(hlsurl *string, rtmpurl *string) *HlsPull {
+	return &HlsPull{
+		HlsUrl:  *hlsurl,
+		RtmpUrl: *rtmpurl,
+		isStart: false,
+	}
+}
+
+func (self *HlsPull) Start() error {
+	if self.isStart {
+		errString := fmt.Sprintf("HlsPull(%s->%s) has already started.", self.HlsUrl, self.RtmpUrl)
+		return errors.New(errString)
+	}
+	if _, err := url.Parse(self.HlsUrl); err != nil {
+		return err
+	}
+
+	self.rtmpclient = core.NewConnClient()
+	self.lastConnect = time.Now()
+	err := self.rtmpclient.Start(self.RtmpUrl, "publish")
+	if err != nil {
+		log.Errorf("rtmpclient.Start url=%v error=%v", self.RtmpUrl, err)
+		self.rtmpclient = nil
+		return err
+	}
+
+	self.demuxer = ts.NewDemuxer()
+	self.timeline = hlsTimeline{}
+	self.nextSeq = -1
+	self.paceTime = time.Time{}
+	self.videoHdr = nil
+	self.audioHdr = nil
+	self.stopChan = make(chan struct{})
+	self.isStart = true
+
+	go self.run(self.stopChan)
+
+	return nil
+}
+
+func (self *HlsPull) Stop() {
+	if !self.isStart {
+		log.Errorf("HlsPull(%s->%s) has already stoped.", self.HlsUrl, self.RtmpUrl)
+		return
+	}
+	self.isStart = false
+	close(self.stopChan)
+	log.Infof("HlsPull(%s->%s) stoped.", self.HlsUrl, self.RtmpUrl)
+}
+
+func (self *HlsPull) IsStart() bool {
+	return self.isStart
+}
+
+//wait 等待d, 停止时返回false
+func (self *HlsPull) wait(stop chan struct{}, d time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (self *HlsPull) run(stop chan struct{}) {
+	defer func() {
+		if self.rtmpclient != nil {
+			self.rtmpclient.Close(nil)
+			self.rtmpclient = nil
+		}
+	}()
+
+	mediaUrl := ""
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		m3u8, playlistUrl, err := self.playlist(mediaUrl)
+		if err != nil {
+			log.Errorf("HlsPull(%s) playlist error=%v", self.HlsUrl, err)
+			//重新从主播放列表选择, 之后的分片按不连续处理
+			mediaUrl = ""
+			self.discontinue()
+			if !self.wait(stop, hlsPullRetryWait) {
+				return
+			}
+			continue
+		}
+		mediaUrl = playlistUrl
+
+		n := self.pullSegments(stop, m3u8, mediaUrl)
+		interval := time.Duration(m3u8.TargetDuration) * time.Second / 2
+		if n == 0 && len(m3u8.TsEntries) > 0 {
+			interval = time.Duration(m3u8.TsEntries[len(m3u8.TsEntries)-1].Duration) * time.Millisecond / 2
+		}
+		if interval < time.Second/2 {
+			interval = time.Second / 2
+		}
+		if !self.wait(stop, interval) {
+			return
+		}
+	}
+}
+
+//playlist 下载媒体播放列表, mediaUrl为空时从HlsUrl开始, 主播放列表选择码率最高的流
+func (self *HlsPull) playlist(mediaUrl string) (*hls.M3u8, string, error) {
+	if mediaUrl == "" {
+		mediaUrl = self.HlsUrl
+	}
+	m3u8, err := hls.NewStream("", mediaUrl, "").SetTimeout(hlsPullTimeout).DownloadM3u8()
+	if err != nil {
+		return nil, "", err
+	}
+	if !m3u8.IsTop() {
+		return m3u8, mediaUrl, nil
+	}
+
+	var best *hls.M3u8Entry
+	for _, entry := range m3u8.M3u8Entries {
+		if best == nil || entry.Bandwidth > best.Bandwidth {
+			best = entry
+		}
+	}
+	variantUrl, err := resolveUrl(mediaUrl, best.Raw)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Infof("HlsPull(%s) variant %s bandwidth=%d", self.HlsUrl, variantUrl, best.Bandwidth)
+	m3u8, err = hls.NewStream("", variantUrl, "").SetTimeout(hlsPullTimeout).DownloadM3u8()
+	if err != nil {
+		return nil, "", err
+	}
+	if m3u8.IsTop() {
+		return nil, "", fmt.Errorf("nested master playlist %s", variantUrl)
+	}
+	return m3u8, variantUrl, nil
+}
+
+//resolveUrl 播放列表中的相对地址转为绝对地址
+func resolveUrl(base string, ref string) (string, error) {
+	baseUrl, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseUrl.ResolveReference(refUrl).String(), nil
+}
+
+//pullSegments 拉取播放列表中新的分片, 返回拉取的个数
+func (self *HlsPull) pullSegments(stop chan struct{}, m3u8 *hls.M3u8, mediaUrl string) int {
+	first := m3u8.Sequence
+	last := first + int64(len(m3u8.TsEntries))
+	if self.nextSeq < first || self.nextSeq > last {
+		//第一次拉取, 落后太多或者源重启后序号变小, 从直播点开始
+		if self.nextSeq >= 0 {
+			log.Warningf("HlsPull(%s) sequence %d not in [%d, %d)", self.HlsUrl, self.nextSeq, first, last)
+			self.discontinue()
+		}
+		self.nextSeq = last - hlsPullLiveEdge
+		if self.nextSeq < first {
+			self.nextSeq = first
+		}
+	}
+
+	n := 0
+	for _, entry := range m3u8.TsEntries[self.nextSeq-first:] {
+		select {
+		case <-stop:
+			return n
+		default:
+		}
+		self.nextSeq++
+		if entry.Discontinuity {
+			self.discontinue()
+		}
+		tsUrl, err := resolveUrl(mediaUrl, entry.Raw)
+		if err != nil {
+			log.Errorf("HlsPull(%s) ts %s error=%v", self.HlsUrl, entry.Raw, err)
+			self.discontinue()
+			continue
+		}
+		data, err := self.download(stop, tsUrl)
+		if err != nil {
+			log.Errorf("HlsPull(%s) download %s error=%v", self.HlsUrl, tsUrl, err)
+			self.discontinue()
+			continue
+		}
+		if !self.publish(stop, data) {
+			return n
+		}
+		n++
+	}
+	return n
+}
+
+func (self *HlsPull) download(stop chan struct{}, tsUrl string) ([]byte, error) {
+	var err error
+	for i := 0; i < hlsPullRetryCount; i++ {
+		buf := new(bytes.Buffer)
+		if _, err = httputils.DownloadBuffer(tsUrl, hlsPullTimeout, buf); err == nil {
+			return buf.Bytes(), nil
+		}
+		if !self.wait(stop, hlsPullRetryWait) {
+			break
+		}
+	}
+	return nil, err
+}
+
+//discontinue 分片不连续, 重新解析PAT/PMT并接着之前的时间戳
+func (self *HlsPull) discontinue() {
+	self.demuxer.Reset()
+	self.timeline.discontinue()
+	self.paceTime = time.Time{}
+}
+
+//publish 解析一个分片并推送, 停止时返回false
+func (self *HlsPull) publish(stop chan struct{}, data []byte) bool {
+	packets, err := self.demuxer.Demux(data)
+	if err != nil {
+		log.Warningf("HlsPull(%s) demux error=%v", self.HlsUrl, err)
+	}
+	packets = append(packets, self.demuxer.Flush()...)
+	for _, p := range packets {
+		p.TimeStamp = self.timeline.timestamp(p.TimeStamp)
+		if !self.pace(stop, p.TimeStamp) {
+			return false
+		}
+		self.write(p)
+	}
+	return true
+}
+
+//pace 按时间戳的速度推送, 超前时等待
+func (self *HlsPull) pace(stop chan struct{}, timestamp uint32) bool {
+	ahead := time.Duration(int64(timestamp)-self.paceTs)*time.Millisecond - time.Since(self.paceTime)
+	if self.paceTime.IsZero() || ahead > hlsPullMaxLag || ahead < -hlsPullMaxLag {
+		self.paceTime = time.Now()
+		self.paceTs = int64(timestamp)
+		return true
+	}
+	if ahead > 0 {
+		return self.wait(stop, ahead)
+	}
+	return true
+}
+
+func (self *HlsPull) write(p *av.Packet) {
+	if len(p.Data) < 2 {
+		return
+	}
+	cs := &core.ChunkStream{
+		TypeID:    av.TAG_AUDIO,
+		Data:      p.Data,
+		Length:    uint32(len(p.Data)),
+		Timestamp: p.TimeStamp,
+	}
+	if p.IsVideo {
+		cs.TypeID = av.TAG_VIDEO
+	}
+	if p.Data[1] == 0x00 {
+		if p.IsVideo {
+			self.videoHdr = cs
+		} else {
+			self.audioHdr = cs
+		}
+	}
+
+	if self.rtmpclient == nil && !self.reconnect() {
+		return
+	}
+	cs.StreamID = self.rtmpclient.GetStreamId()
+	if err := self.rtmpclient.Write(*cs); err != nil {
+		log.Errorf("HlsPull(%s) rtmp write error=%v", self.RtmpUrl, err)
+		self.rtmpclient.Close(nil)
+		self.rtmpclient = nil
+	}
+}
+
+//reconnect 重新连接本地RTMP, 成功后先发送sequence header
+func (self *HlsPull) reconnect() bool {
+	if time.Since(self.lastConnect) < hlsPullRetryWait {
+		return false
+	}
+	self.lastConnect = time.Now()
+	rtmpclient := core.NewConnClient()
+	if err := rtmpclient.Start(self.RtmpUrl, "publish"); err != nil {
+		log.Errorf("HlsPull rtmpclient.Start url=%v error=%v", self.RtmpUrl, err)
+		return false
+	}
+	for _, hdr := range []*core.ChunkStream{self.videoHdr, self.audioHdr} {
+		if hdr == nil {
+			continue
+		}
+		hdr.StreamID = rtmpclient.GetStreamId()
+		if err := rtmpclient.Write(*hdr); err != nil {
+			rtmpclient.Close(nil)
+			return false
+		}
+	}
+	self.rtmpclient = rtmpclient
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	log "logging"
+	"net/http"
 	"reflect"
 )
 
@@ -12,10 +13,15 @@ import (
    "static_pull":[{"type":"http-flv",
                    "source":"http://pull99.a8.com/live/1500365043587794.flv",
                    "app":"live",
-                   "stream":"1500365043587794"},
+                   "stream":"1500365043587794",
+                   "headers":{"Referer":"http://www.a8.com/"}},
                    {"type":"rtmp",
                    "source":"rtmp://pull99.a8.com/live/1500365043587794",
                    "app":"live",
+                   "stream":"1500365043587794"},
+                   {"type":"hls",
+                   "source":"http://pull99.a8.com/live/1500365043587794/index.m3u8",
+                   "app":"live",
                    "stream":"1500365043587794"}
                  ],
 */
@@ -23,6 +29,7 @@ import (
 const (
 	RtmpType    = 1
 	HttpflvType = 2
+	HlsType     = 3
 )
 
 type staticPullInfo struct {
@@ -61,7 +68,15 @@ func NewStaticPullManager(listenPort int, pullinfos []configure.StaticPullInfo)
 			staticpull.PullObj = NewRtmpRelay(&staticpull.SourceUrl, &rtmpurl, &liveId, &pushid, -1)
 		} else if pullinfo.Type == "http-flv" {
 			staticpull.Streamtype = HttpflvType
-			staticpull.PullObj = NewFlvPull(&staticpull.SourceUrl, &rtmpurl)
+			flvpull := NewFlvPull(&staticpull.SourceUrl, &rtmpurl)
+			flvpull.Header = make(http.Header)
+			for k, v := range pullinfo.Headers {
+				flvpull.Header.Set(k, v)
+			}
+			staticpull.PullObj = flvpull
+		} else if pullinfo.Type == "hls" {
+			staticpull.Streamtype = HlsType
+			staticpull.PullObj = NewHlsPull(&staticpull.SourceUrl, &rtmpurl)
 		} else {
 			log.Errorf("not support type(%d)", pullinfo.Type)
 			return nil
@@ -87,6 +102,9 @@ func (self *StaticPullManager) Start() error {
 		} else if obj, ok := pullobj.PullObj.(*RtmpRelay); ok {
 			err := obj.Start()
 			log.Infof("static rtmp pull start:%s, error=%v", pullobj.SourceUrl, err)
+		} else if obj, ok := pullobj.PullObj.(*HlsPull); ok {
+			err := obj.Start()
+			log.Infof("static hls pull start:%s, error=%v", pullobj.SourceUrl, err)
 		} else {
 			log.Errorf("Unknow type=%v", reflect.TypeOf(pullobj.PullObj))
 		}
@@ -108,6 +126,9 @@ func (self *StaticPullManager) Stop() {
 		} else if obj, ok := pullobj.PullObj.(RtmpRelay); ok {
 			obj.Stop()
 			log.Infof("static rtmp pull stop:%s", pullobj.SourceUrl)
+		} else if obj, ok := pullobj.PullObj.(*HlsPull); ok {
+			obj.Stop()
+			log.Infof("static hls pull stop:%s", pullobj.SourceUrl)
 		}
 	}
 	self.IsStartFlag = false
@@ -0,0 +1,179 @@
+package rtmp
+
+import (
+	"bytes"
+	"configure"
+	"encoding/json"
+	"fmt"
+	log "logging"
+	"net/http"
+	"path"
+	"protocol/catalog"
+	"protocol/storage"
+	"time"
+)
+
+//启动录制清理
+func (rs *RtmpStream) startJanitor() {
+
+	interval := time.Duration(configure.GetRecordJanitorInterval()) * time.Second
+	rs.janitor = catalog.NewJanitor(rs.catalog, interval, configure.GetRecordCriticalFreePercent(),
+		rs.retentionRules, rs.sendAlert)
+	rs.janitor.Start()
+}
+
+//得到每个推流点的保存规则
+func (rs *RtmpStream) retentionRules() []catalog.Rule {
+
+	var rules []catalog.Rule
+	for _, v := range rs.liveRooms.Rooms {
+
+		for _, value := range v.Urls {
+
+			retention := value.Retention
+			rule := catalog.Rule{
+				LiveRoomId:     v.LiveRoomId,
+				PushId:         value.PushId,
+				Path:           value.SavePath,
+				MaxAge:         time.Duration(retention.MaxAge) * time.Hour,
+				MaxSize:        retention.MaxSize * 1024 * 1024,
+				MinFreePercent: retention.MinFreePercent,
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+//得到推流点的保存规则, 推流点优先, 其次是房间, 最后是全局配置
+func getRetention(live configure.Live, url configure.Url) configure.RetentionInfo {
+
+	if url.Retention != nil {
+		return *url.Retention
+	}
+	if live.Retention != nil {
+		return *live.Retention
+	}
+	return configure.GetRecordRetention()
+}
+
+//检查保存目录的剩余空间, 低于临界值时拒绝录制
+func (rs *RtmpStream) checkRecordSpace(dir string) bool {
+
+	critical := configure.GetRecordCriticalFreePercent()
+	if critical <= 0 {
+		return true
+	}
+
+	free := catalog.FreePercent(dir)
+	if free >= critical {
+		return true
+	}
+
+	message := fmt.Sprintf("free %.2f%% below critical %.2f%%, record refused", free, critical)
+	rs.sendAlert(catalog.NewAlert(catalog.AlertRecordRefused, dir, free, message))
+	return false
+}
+
+//发送告警事件到notifyUrl
+func (rs *RtmpStream) sendAlert(alert catalog.Alert) {
+
+	log.Errorf("RtmpStream Alert Type=%s Path=%s Free=%.2f%% %s", alert.Type, alert.Path, alert.FreePercent, alert.Message)
+	rs.notify(alert)
+}
+
+//以JSON格式POST事件到notifyUrl, 未配置时不发送
+func (rs *RtmpStream) notify(event interface{}) {
+
+	notifyUrl := configure.GetNotifyUrl()
+	if notifyUrl == "" {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	go func() {
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(notifyUrl, "application/json", bytes.NewReader(data))
+		if err != nil {
+
+			log.Errorf("RtmpStream notify Url=%s error=%v", notifyUrl, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+//StorageUsage 得到每个保存目录的使用情况
+func (rs *RtmpStream) StorageUsage() []catalog.Usage {
+
+	usages := make([]catalog.Usage, 0)
+	paths := make(map[string]bool)
+	for _, v := range rs.liveRooms.Rooms {
+
+		for _, value := range v.Urls {
+
+			if value.SavePath == "" || paths[value.SavePath] {
+				continue
+			}
+			paths[value.SavePath] = true
+			usages = append(usages, rs.catalog.Usage(value.SavePath))
+		}
+	}
+	return usages
+}
+
+//启动录制上传, 本地存储时不需要上传
+func (rs *RtmpStream) startUpload() {
+
+	cfg := configure.GetStorage()
+	if cfg.Type != storage.TypeS3 {
+		return
+	}
+
+	backend, err := storage.NewS3(storage.S3Config{
+		Endpoint:  cfg.Endpoint,
+		Region:    cfg.Region,
+		Bucket:    cfg.Bucket,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+		PathStyle: cfg.PathStyle,
+		PublicUrl: cfg.PublicUrl,
+		PartSize:  cfg.PartSize * 1024 * 1024,
+	})
+	if err != nil {
+		log.Errorf("RtmpStream startUpload error: %v", err)
+		return
+	}
+
+	rs.storagePrefix = cfg.Prefix
+	rs.uploader = storage.NewQueue(cfg.Queue, backend, cfg.Workers, cfg.DeleteLocal, cfg.MaxRetry, rs.onUploadDone)
+	log.Infof("RtmpStream startUpload endpoint=%s bucket=%s", cfg.Endpoint, cfg.Bucket)
+}
+
+//录制完成后加入上传队列
+func (rs *RtmpStream) uploadRecord(e catalog.Entry) {
+
+	if rs.uploader == nil || e.Remote {
+		return
+	}
+
+	date := e.Start
+	if len(date) > 8 {
+		date = date[:8]
+	}
+	key := storage.Key(rs.storagePrefix, e.LiveRoomId, e.ProjectId, e.PushId, date, path.Base(e.File))
+	rs.uploader.Add(e.File, key)
+}
+
+//上传完成, 回看地址改为对象地址
+func (rs *RtmpStream) onUploadDone(task storage.Task, url string, deleted bool) {
+
+	if err := rs.catalog.SetAddr(task.File, url, deleted); err != nil {
+		log.Errorf("RtmpStream onUploadDone %s error: %v", task.File, err)
+	}
+}
@@ -4,22 +4,26 @@ import (
 	"av"
 	cmap "concurrent-map"
 	"configure"
-	"crypto/md5"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	log "logging"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
+	"protocol/amf"
+	"protocol/catalog"
+	"protocol/clip"
+	"protocol/hls"
+	"protocol/record"
 	"protocol/rtmp/cache"
 	"protocol/rtmp/rtmprelay"
+	"protocol/storage"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	_ "syscall"
 	"time"
 )
@@ -28,72 +32,48 @@ var (
 	EmptyID = ""
 )
 
+const (
+	maxInjectNum = 64
+
+	//旧版本保存录制md5的文件, 启动时导入到录制索引
+	legacyMd5File = "replay.json"
+)
+
 type RtmpStream struct {
 	streams   cmap.ConcurrentMap  //流管理（包括发布者和观看者）
 	liveRooms configure.LiveRooms //直播房间管理
-	md5s      configure.Md5s
+	catalog   *catalog.Catalog    //录制索引
+	journal   *catalog.Journal    //正在录制的文件
+	janitor   *catalog.Janitor    //录制清理
+	vod       *hls.VodIndexer     //录制点播
+	clips     *clip.Manager       //直播剪辑
+
+	uploader      *storage.Queue //录制上传队列, 本地存储时为nil
+	storagePrefix string         //对象名称前缀模板
+
+	hlsServer *hls.Server //HLS观看会话, 没有开启HLS时为nil
 }
 
 func NewRtmpStream() *RtmpStream {
 
 	ret := &RtmpStream{
 		streams: cmap.New(),
+		catalog: catalog.NewCatalog(configure.GetRecordCatalog(), configure.GetRecordChecksumWorkers()),
+		journal: catalog.NewJournal(configure.GetRecordJournal()),
+		vod:     hls.NewVodIndexer(float64(configure.GetRecordVodDuration())),
+		clips:   clip.NewManager(configure.GetClipDir()),
 	}
 
 	ret.initLiveRooms()
-	ret.loadReplayConfig()
+	ret.startUpload()
+	go ret.importRecords()
+	ret.startJanitor()
 	go ret.checkPublisher()
-	go ret.checkMediaFile()
+	go ret.checkSchedules()
 
 	return ret
 }
 
-func (rs *RtmpStream) loadReplayConfig() error {
-
-	//读取配置文件
-	log.Infof("---->>>> Start Load Replay Configure File")
-	data, err := ioutil.ReadFile("replay.json")
-	if err != nil {
-
-		log.Errorf("loadReplayConfig error=%v", err)
-		return err
-	}
-	log.Infof("---->>>> Load Replay Configure Data: \r\n%s", string(data))
-
-	//读取Json配置
-	log.Infof("---->>>> Load Replay Configure Unmarshal")
-	err = json.Unmarshal(data, &rs.md5s)
-	if err != nil {
-		log.Errorf("---->>>> Load Replay Configure Unmarshal error:%v", err)
-		return err
-	}
-	log.Infof("---->>>> Load Replay Configure Json data:%v", rs.md5s)
-
-	return nil
-}
-
-func (rs *RtmpStream) writeReplayConfig() error {
-
-	//读取配置文件
-	log.Infof("---->>>> Start Write Replay Configure File")
-
-	data, err := json.Marshal(rs.md5s)
-	if err != nil {
-		log.Errorf("writeReplayConfig Marshal error=%v", err)
-		return err
-	}
-
-	err = ioutil.WriteFile("replay.json", data, os.ModeAppend)
-	if err != nil {
-
-		log.Errorf("writeReplayConfig WriteFile error=%v", err)
-		return err
-	}
-
-	log.Infof("---->>>> Write Replay Configure Data: \r\n%s", string(data))
-	return nil
-}
-
 func (rs *RtmpStream) pathExists(path string) (bool, error) {
 
 	_, err := os.Stat(path)
@@ -106,12 +86,24 @@ func (rs *RtmpStream) pathExists(path string) (bool, error) {
 	return false, err
 }
 
-func (rs *RtmpStream) getFilePath(url string) (error, string) {
+//RecordTarget 录制文件的保存位置和所属推流点
+type RecordTarget struct {
+	Dir        string //保存目录
+	VideoName  string //文件名前缀
+	Format     string //录制格式
+	LiveRoomId string
+	ProjectId  int
+	PushId     int
+	SaveUrl    string //回看地址的root
+}
+
+//得到录制文件的保存目录, 文件名前缀和录制格式
+func (rs *RtmpStream) getRecordPath(url string) (error, *RecordTarget) {
 
 	//获取此pushID所对应文件保存地址
 	err, pushUrl, liveRoomId, projectId := rs.GetPushFromUrl(url)
 	if err != nil {
-		return err, ""
+		return err, nil
 	}
 
 	//得到数据目录
@@ -125,7 +117,7 @@ func (rs *RtmpStream) getFilePath(url string) (error, string) {
 	if err != nil {
 
 		log.Errorf("Check Path Failed! [%v]\n", err)
-		return errors.New("Check Path Failed"), ""
+		return errors.New("Check Path Failed"), nil
 	}
 
 	//目录不存在则创建目录
@@ -136,28 +128,164 @@ func (rs *RtmpStream) getFilePath(url string) (error, string) {
 		if err != nil {
 
 			log.Errorf("MkAll Path Failed [%v]\n", err)
-			return errors.New("MkAll Path Failed"), ""
+			return errors.New("MkAll Path Failed"), nil
 		}
 	}
 
-	//创建FFMpeg保存的文件名称
-	timeNow := time.Now()
-	timeString := timeNow.Format("20060102T150405")
-	outFile := fmt.Sprintf("%s/%s_%s.ts", outPath, pushUrl.VideoName, timeString)
+	//录制格式, 未配置或不支持时使用flv
+	format := pushUrl.RecordFormat
+	if !record.ValidFormat(format) {
+		if format != "" {
+			log.Errorf("Unsupported Record Format=%s Url=%s, Use flv", format, url)
+		}
+		format = record.FormatFlv
+	}
 
-	for {
+	target := &RecordTarget{
+		Dir:        outPath,
+		VideoName:  pushUrl.VideoName,
+		Format:     format,
+		LiveRoomId: liveRoomId,
+		ProjectId:  projectId,
+		PushId:     pushUrl.PushId,
+		SaveUrl:    pushUrl.SaveUrl,
+	}
+	return nil, target
+}
 
-		fileExists, _ := rs.pathExists(outFile)
-		if !fileExists {
+//录制文件的索引信息
+func (target *RecordTarget) entry(seg record.SegmentInfo) catalog.Entry {
 
-			return nil, outFile
-		} else {
+	fileName := path.Base(seg.File)
+	return catalog.Entry{
+		LiveRoomId: target.LiveRoomId,
+		ProjectId:  target.ProjectId,
+		PushId:     target.PushId,
+		VideoName:  target.VideoName,
+		File:       seg.File,
+		Addr:       target.SaveUrl + "/" + target.LiveRoomId + "/" + strconv.Itoa(target.ProjectId) + "/" + fileName,
+		Format:     seg.Format,
+		Start:      seg.Start.Format(record.TimeFormat),
+	}
+}
+
+//录制分段开始, 写入录制日志
+func (rs *RtmpStream) onRecordStart(target *RecordTarget, seg record.SegmentInfo) {
 
-			time.Sleep(time.Duration(1) * time.Second)
-			outFile = fmt.Sprintf("%s/%s_%s.ts", outPath, pushUrl.VideoName, time.Now().Format("20060102T150405"))
+	rs.journal.Begin(target.entry(seg))
+}
+
+//录制分段完成, 加入录制索引
+func (rs *RtmpStream) onRecordDone(target *RecordTarget, seg record.SegmentInfo) {
+
+	entry := target.entry(seg)
+	entry.Finish = seg.Finish.Format(record.TimeFormat)
+	entry.Size = seg.Size
+	entry.Duration = float64(seg.Duration) / 1000
+	entry.VideoCodec = seg.VideoCodec
+	entry.AudioCodec = seg.AudioCodec
+	rs.catalog.Add(entry)
+	rs.journal.End(seg.Temp)
+	rs.uploadRecord(entry)
+}
+
+//启动时把录制目录中还没有索引的文件加入录制索引
+//目录格式: savePath/liveRoomId/projectId/videoName_起始时间_结束时间.后缀
+func (rs *RtmpStream) importRecords() {
+
+	//先恢复上次异常退出时没有完成的录制
+	recovered := rs.recoverRecords()
+
+	var entries []catalog.Entry
+	for _, v := range rs.liveRooms.Rooms {
+
+		for _, value := range v.Urls {
+
+			roomDir := value.SavePath + "/" + v.LiveRoomId
+			projects, err := ioutil.ReadDir(roomDir)
+			if err != nil {
+				continue
+			}
+
+			for _, project := range projects {
+
+				projectId, err := strconv.Atoi(project.Name())
+				if err != nil || !project.IsDir() {
+					continue
+				}
+
+				projectDir := roomDir + "/" + project.Name()
+				files, err := ioutil.ReadDir(projectDir)
+				if err != nil {
+					continue
+				}
+
+				for _, file := range files {
+
+					filePath := projectDir + "/" + file.Name()
+					if file.IsDir() || rs.catalog.Exist(filePath) {
+						continue
+					}
+
+					//得到后缀和文件名
+					suffix := path.Ext(file.Name())
+					arr := strings.Split(strings.TrimSuffix(file.Name(), suffix), "_")
+					if len(arr) == 2 && arr[0] == value.VideoName && !rs.journal.Active(filePath) && !recovered[filePath] {
+
+						//没有结束时间且不在录制中, 是没有日志的异常退出文件
+						rs.recoverRecord(catalog.Entry{
+							LiveRoomId: v.LiveRoomId,
+							ProjectId:  projectId,
+							PushId:     value.PushId,
+							VideoName:  value.VideoName,
+							File:       filePath,
+							Addr:       value.SaveUrl + "/" + v.LiveRoomId + "/" + project.Name() + "/" + file.Name(),
+							Format:     strings.TrimPrefix(suffix, "."),
+							Start:      arr[1],
+						})
+						continue
+					}
+					if len(arr) != 3 || arr[0] != value.VideoName {
+						continue
+					}
+					start, errStart := time.ParseInLocation(record.TimeFormat, arr[1], time.Local)
+					finish, errFinish := time.ParseInLocation(record.TimeFormat, arr[2], time.Local)
+					if errStart != nil || errFinish != nil {
+						continue
+					}
+
+					entries = append(entries, catalog.Entry{
+						LiveRoomId: v.LiveRoomId,
+						ProjectId:  projectId,
+						PushId:     value.PushId,
+						VideoName:  value.VideoName,
+						File:       filePath,
+						Addr:       value.SaveUrl + "/" + v.LiveRoomId + "/" + project.Name() + "/" + file.Name(),
+						Format:     strings.TrimPrefix(suffix, "."),
+						Start:      arr[1],
+						Finish:     arr[2],
+						Size:       file.Size(),
+						Duration:   finish.Sub(start).Seconds(),
+					})
+				}
+			}
+		}
+	}
+
+	//一次性导入旧版本replay.json中的md5
+	if n, err := catalog.ImportLegacyMd5(legacyMd5File, entries); err != nil {
+		log.Errorf("RtmpStream importRecords Import %s Error: %v", legacyMd5File, err)
+	} else if n > 0 {
+		log.Infof("RtmpStream importRecords Import %d Md5 From %s", n, legacyMd5File)
+	}
+
+	if len(entries) > 0 {
+		log.Infof("RtmpStream importRecords %d Files", len(entries))
+		rs.catalog.Add(entries...)
+		for _, e := range entries {
+			rs.uploadRecord(e)
 		}
 	}
-	return errors.New("Get FFMpeg File Failed"), ""
 }
 
 func (rs *RtmpStream) StreamExist(key string) bool {
@@ -176,6 +304,71 @@ func (rs *RtmpStream) StreamExist(key string) bool {
 	return false
 }
 
+//得到发布者的视频和音频码率(kbps), HLS主播放列表使用
+func (rs *RtmpStream) GetBandwidth(key string) (uint64, uint64) {
+
+	i, ok := rs.streams.Get(key)
+	if !ok {
+		return 0, 0
+	}
+	s, ok := i.(*Stream)
+	if !ok {
+		return 0, 0
+	}
+	if v, ok := s.GetReader().(*VirReader); ok {
+		stats := v.ReadStatics()
+		return stats.VideoSpeedInBytesperMS, stats.AudioSpeedInBytesperMS
+	}
+	return 0, 0
+}
+
+//设置HLS服务, 观看者统计和踢出时包括HLS会话, 按需切片时由HLS服务请求开始切片
+func (rs *RtmpStream) SetHlsServer(server *hls.Server) {
+	rs.hlsServer = server
+	server.SetActivateFunc(rs.activateHls)
+}
+
+//得到HLS观看会话
+func (rs *RtmpStream) GetHlsSessions() []hls.SessionStat {
+
+	if rs.hlsServer == nil {
+		return nil
+	}
+	return rs.hlsServer.Sessions()
+}
+
+//踢出HLS观看会话, id为空时踢出流的所有会话
+func (rs *RtmpStream) KickHlsSessions(key string, id string) int {
+
+	if rs.hlsServer == nil {
+		return 0
+	}
+	return rs.hlsServer.KickSessions(key, id)
+}
+
+//踢出流的观看者, 包括RTMP, HTTP-FLV观看者和HLS会话
+//id为观看者的UID或HLS会话ID, 为空时踢出流的所有观看者, 返回踢出的个数
+func (rs *RtmpStream) KickPlayers(key string, id string) int {
+
+	n := 0
+	if item, ok := rs.streams.Get(key); ok {
+		for w := range item.(*Stream).GetWs().IterBuffered() {
+			pw, ok := w.Val.(*PackWriterCloser)
+			if !ok || pw.GetWriter() == nil {
+				continue
+			}
+			//HLS等内部的观看者不踢出
+			info := pw.GetWriter().Info()
+			if info.IsInterval() || (id != "" && info.UID != id) {
+				continue
+			}
+			pw.GetWriter().Close(errors.New("Force Close Player Conn"))
+			n++
+		}
+	}
+	return n + rs.KickHlsSessions(key, id)
+}
+
 //rtmp://10.10.60.62:1935/live/01/12/Camera_1
 func (rs *RtmpStream) parserUrl(Url string) (string, int, string, string) {
 
@@ -229,6 +422,7 @@ func (rs *RtmpStream) HandleReader(r av.ReadCloser) {
 		//发布者地址有流再次推送过来
 		log.Infof("RtmpStream HandleReader TransStop Old Stream")
 		stream.TransStop()
+		stream.StopRecord()
 		id := stream.ID()
 
 		if id != EmptyID && id != info.UID {
@@ -240,23 +434,6 @@ func (rs *RtmpStream) HandleReader(r av.ReadCloser) {
 			rs.streams.Set(info.Key, ns)
 		}
 
-		//判断是否启动FFmpeg
-		if stream.cmdExec != nil {
-			log.Infof("RtmpStream HandleReader Repeat come into HandleReader repeat process = %p", stream.cmdExec.Process)
-		}
-
-		if "enable" == configure.GetEngineEnable() {
-
-			log.Infof("RtmpStream HandleReader configure.GetEngineEnable() = enable Startffmpeg %s", info.URL)
-
-			if err, currFile := rs.getFilePath(info.URL); err == nil {
-
-				log.Infof("RtmpStream HandleReader Start FFMpeg URL=%s File=%s", info.URL, currFile)
-				go stream.Startffmpeg(info.URL, currFile)
-			}
-			log.Error("RtmpStream HandleReader Start FFMpeg Failed URL=%s", info.URL)
-		}
-
 	} else {
 
 		//创建发布者
@@ -264,23 +441,11 @@ func (rs *RtmpStream) HandleReader(r av.ReadCloser) {
 		stream = NewStream(rs)
 		rs.streams.Set(info.Key, stream)
 		stream.info = info
-
-		if stream.cmdExec != nil {
-			log.Infof("RtmpStream HandleReader first come into HandleReader first process = %p ", stream.cmdExec.Process)
-		}
-
-		if "enable" == configure.GetEngineEnable() {
-
-			//liveRoomId, projectId, date, cameraType := rs.parserUrl(info.URL)
-			if err, currFile := rs.getFilePath(info.URL); err == nil {
-
-				log.Infof("RtmpStream HandleReader Start FFMpeg URL=%s File=%s", info.URL, currFile)
-				go stream.Startffmpeg(info.URL, currFile)
-			}
-			log.Error("RtmpStream HandleReader Start FFMpeg Failed URL=%s", info.URL)
-		}
 	}
 
+	//启动录制, 房间配置了定时录制时按时段录制
+	rs.autoRecord(stream, info)
+
 	//根据Url地址得到pushId
 	err, liveRoomId, pushId := rs.GetPushIdFromUrl(info.URL)
 	if err != nil {
@@ -319,6 +484,68 @@ func (rs *RtmpStream) GetStreams() cmap.ConcurrentMap {
 	return rs.streams
 }
 
+//InjectData 向直播流注入数据消息, RTMP/FLV观看者收到script tag, HLS写入ID3
+func (rs *RtmpStream) InjectData(key string, handler string, args ...interface{}) error {
+
+	item, ok := rs.streams.Get(key)
+	if !ok {
+		return fmt.Errorf("stream %s not exist", key)
+	}
+	stream, ok := item.(*Stream)
+	if !ok || stream.GetReader() == nil {
+		return fmt.Errorf("stream %s has no publisher", key)
+	}
+
+	if handler == "" {
+		handler = amf.OnTextData
+	}
+	if handler == amf.OnMetaData || handler == amf.SetDataFrame {
+		return fmt.Errorf("handler %s not allowed", handler)
+	}
+
+	data, err := amf.EncodeDataMessage(handler, args...)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("RtmpStream InjectData key=%s handler=%s", key, handler)
+	return stream.Inject(data)
+}
+
+//SendCuePoint 向直播流插入广告标记, out为true表示广告开始, duration为广告时长(秒)
+func (rs *RtmpStream) SendCuePoint(key string, out bool, duration float64) error {
+
+	item, ok := rs.streams.Get(key)
+	if !ok {
+		return fmt.Errorf("stream %s not exist", key)
+	}
+	stream, ok := item.(*Stream)
+	if !ok || stream.GetReader() == nil {
+		return fmt.Errorf("stream %s has no publisher", key)
+	}
+
+	//检查和设置广告状态时持有cueLock, 同时请求的广告开始/结束只有一个成功
+	stream.cueLock.Lock()
+	defer stream.cueLock.Unlock()
+
+	id := stream.cueId
+	if out {
+		if stream.isCueOut() {
+			return fmt.Errorf("stream %s already in cue out", key)
+		}
+		id = uint32(time.Now().Unix())
+	} else if !stream.isCueOut() {
+		return fmt.Errorf("stream %s not in cue out", key)
+	}
+
+	cue := amf.NewCuePoint(out, id, float64(atomic.LoadUint32(&stream.lastTimeStamp))/1000, duration)
+	if err := rs.InjectData(key, amf.OnCuePoint, cue); err != nil {
+		return err
+	}
+	stream.setCue(out, id, duration)
+	return nil
+}
+
 func (rs *RtmpStream) CheckProjectExits(projectId int) bool {
 
 	log.Infof("RtmpStream CheckProjectExits projectId=%d", projectId)
@@ -657,123 +884,6 @@ func (rs *RtmpStream) getFileSize(path string) int64 {
 	return info.Size()
 }
 
-func (rs *RtmpStream) getFileMd5(filename string, md5str *string) error {
-
-	f, err := os.Open(filename)
-	if err != nil {
-
-		errString := "Open File Failed err:" + err.Error()
-		return errors.New(errString)
-	}
-
-	defer f.Close()
-
-	md5hash := md5.New()
-	if _, err := io.Copy(md5hash, f); err != nil {
-
-		errString := "Copy Data Failed err:" + err.Error()
-		return errors.New(errString)
-	}
-
-	md5hash.Sum(nil)
-	*md5str = fmt.Sprintf("%x", md5hash.Sum(nil))
-	return nil
-}
-
-func (rs *RtmpStream) findFileMD5(path string, size int64) (bool, string) {
-
-	for _, v := range rs.md5s.Files {
-
-		if (v.FilePath == path) && (v.Size == size) {
-
-			return true, v.MD5
-		}
-	}
-	return false, ""
-}
-
-//得到路径下所有文件
-func (rs *RtmpStream) getDirFiles(pathDir string) (error, []string, []int64, []string, []string, []string) {
-
-	log.Infof("getDirFiles path=%s", pathDir)
-
-	//得到指定目录下的所有文件
-	var dirFiles []string
-	var dirFilesSize []int64
-	var dirFilesMd5 []string
-	var startTimers []string
-	var finishTimers []string
-	files, err := ioutil.ReadDir(pathDir)
-	if err != nil {
-
-		log.Error("getDirFiles Failed ReadDir err=%s", err.Error())
-		return errors.New("Read Dir Failed"), dirFiles, dirFilesSize, dirFilesMd5, startTimers, finishTimers
-	}
-
-	// 获取文件，并输出它们的名字
-	for _, file := range files {
-
-		filePath := pathDir + "/" + file.Name()
-		fileSize := rs.getFileSize(filePath)
-		dirFilesSize = append(dirFilesSize, fileSize)
-
-		//分解文件的起始和终止时间
-		nameWithSuffix := path.Base(filePath)
-		//得到后缀
-		suffix := path.Ext(nameWithSuffix)
-		//得到文件名不带后缀
-		nameOnly := strings.TrimSuffix(nameWithSuffix, suffix)
-
-		arr := strings.Split(nameOnly, "_")
-
-		if len(arr) != 3 {
-
-			log.Error("Replay File=%s Name Split Failed")
-			continue
-
-		}
-		startTimer := arr[1]
-		startTimers = append(startTimers, startTimer)
-
-		finishTimer := arr[2]
-		finishTimers = append(finishTimers, finishTimer)
-
-		log.Infof("Replay File=%s Start Timer=%s Finish Timer=%s", filePath, startTimer, finishTimer)
-
-		exits, md5str := rs.findFileMD5(filePath, fileSize)
-		if exits {
-
-			dirFilesMd5 = append(dirFilesMd5, md5str)
-
-		} else {
-
-			//得到文件的md5
-			log.Infof("Begin Get %s File MD5", filePath)
-			md5Err := rs.getFileMd5(filePath, &md5str)
-			if md5Err != nil {
-				md5str = ""
-			}
-			log.Infof("Get Md5 %s File Md5 %s", filePath, md5str)
-			dirFilesMd5 = append(dirFilesMd5, md5str)
-
-			//记录新的文件MD5
-			fileMd5 := &configure.FileToMd5{
-				FilePath: filePath,
-				Size:     fileSize,
-				MD5:      md5str,
-				Start:    startTimer,
-				Finish:   finishTimer,
-			}
-			rs.md5s.Files = append(rs.md5s.Files, fileMd5)
-		}
-		dirFiles = append(dirFiles, file.Name())
-
-	}
-	//会写文件
-	rs.writeReplayConfig()
-	return nil, dirFiles, dirFilesSize, dirFilesMd5, startTimers, finishTimers
-}
-
 func (rs *RtmpStream) initLiveRooms() {
 
 	log.Infof("RtmpStream initLiveRooms")
@@ -795,6 +905,8 @@ func (rs *RtmpStream) initLiveRooms() {
 			pushUrl.VideoName = v.VideoName
 			pushUrl.SaveUrl = v.SaveUrl
 			pushUrl.RequestUrl = v.RequestUrl
+			pushUrl.RecordFormat = v.RecordFormat
+			pushUrl.Retention = getRetention(value, v)
 			pushUrl.LimitAudio = false
 
 			liveRoom.Urls = append(liveRoom.Urls, pushUrl)
@@ -846,6 +958,29 @@ func (rs *RtmpStream) SetStartState(projectId int, liveRoomId string, pushId int
 	return errors.New("SetStartState Not Found LiveRoomid/PushId/Url")
 }
 
+//从录制索引中得到推流点的回看列表
+func (rs *RtmpStream) getReplays(liveRoomId string, projectId int, pushId int) []*configure.Replay {
+
+	query := catalog.NewQuery()
+	query.LiveRoomId = liveRoomId
+	query.ProjectId = projectId
+	query.PushId = pushId
+
+	replays := make([]*configure.Replay, 0)
+	for _, e := range rs.catalog.Find(query) {
+
+		replay := &configure.Replay{
+			Addr:   e.Addr,
+			Size:   e.Size,
+			Md5:    e.Md5,
+			Start:  e.Start,
+			Finish: e.Finish,
+		}
+		replays = append(replays, replay)
+	}
+	return replays
+}
+
 //获得当前所有的直播房间结构
 func (rs *RtmpStream) GetRtmpList() (error, configure.LiveRooms) {
 
@@ -859,26 +994,7 @@ func (rs *RtmpStream) GetRtmpList() (error, configure.LiveRooms) {
 
 		for _, value := range v.Urls {
 
-			checkDir := value.SavePath + "/" + v.LiveRoomId + "/" + strconv.Itoa(v.ProjectId)
-			err, dirFiles, dirFilesSize, dirFilesMd5, dirFilesStart, dirFilesFinish := rs.getDirFiles(checkDir)
-			if err != nil {
-
-				return nil, currentLiveRooms
-			}
-			value.Replays = value.Replays[0:0]
-
-			for index, w := range dirFiles {
-
-				replay := &configure.Replay{
-					Addr:   value.SaveUrl + "/" + v.LiveRoomId + "/" + strconv.Itoa(v.ProjectId) + "/" + w,
-					Size:   dirFilesSize[index],
-					Md5:    dirFilesMd5[index],
-					Start:  dirFilesStart[index],
-					Finish: dirFilesFinish[index],
-				}
-				value.Replays = append(value.Replays, replay)
-			}
-
+			value.Replays = rs.getReplays(v.LiveRoomId, v.ProjectId, value.PushId)
 		}
 	}
 
@@ -908,27 +1024,8 @@ func (rs *RtmpStream) GetSingleRtmpList(projectId int) (error, configure.LiveRoo
 			for _, value := range v.Urls {
 
 				pushStreamUrl := value
+				pushStreamUrl.Replays = rs.getReplays(v.LiveRoomId, v.ProjectId, value.PushId)
 				liveRoom.Urls = append(liveRoom.Urls, pushStreamUrl)
-
-				checkDir := value.SavePath + "/" + v.LiveRoomId + "/" + strconv.Itoa(v.ProjectId)
-				err, dirFiles, dirFilesSize, dirFilesMd5, dirFilesStart, dirFilesFinish := rs.getDirFiles(checkDir)
-				if err != nil {
-
-					return nil, currentLiveRooms
-				}
-
-				for index, w := range dirFiles {
-
-					replay := &configure.Replay{
-						Addr:   value.SaveUrl + "/" + v.LiveRoomId + "/" + strconv.Itoa(v.ProjectId) + "/" + w,
-						Size:   dirFilesSize[index],
-						Md5:    dirFilesMd5[index],
-						Start:  dirFilesStart[index],
-						Finish: dirFilesFinish[index],
-					}
-					pushStreamUrl.Replays = append(pushStreamUrl.Replays, replay)
-				}
-
 			}
 		}
 	}
@@ -952,42 +1049,21 @@ func (rs *RtmpStream) GetProjectReplayList(projectId int) configure.ReplayRooms
 			LiveRoomId: v.LiveRoomId,
 		}
 
-		hased := false
-
-		log.Infof("pool liveRoomId=%s", replayRoom.LiveRoomId)
 		for _, value := range v.Urls {
 
-			checkDir := value.SavePath + "/" + v.LiveRoomId + "/" + strconv.Itoa(projectId)
-			log.Infof("pool Get Replay File Begin UrlDir=%s", checkDir)
-
-			err, dirFiles, dirFilesSize, dirFilesMd5, dirFilesStart, dirFilesFinish := rs.getDirFiles(checkDir)
-			if err != nil {
-
+			replays := rs.getReplays(v.LiveRoomId, projectId, value.PushId)
+			if len(replays) == 0 {
 				continue
 			}
-			log.Infof("pool Get Replay File End UrlDir=%s", checkDir)
 
-			hased = true
 			replayStream := &configure.ReplayStreamUrl{
-				PushId: value.PushId,
+				PushId:  value.PushId,
+				Replays: replays,
 			}
 			replayRoom.Urls = append(replayRoom.Urls, replayStream)
-
-			for index, w := range dirFiles {
-
-				replay := &configure.Replay{
-					Addr:   value.SaveUrl + "/" + v.LiveRoomId + "/" + strconv.Itoa(projectId) + "/" + w,
-					Size:   dirFilesSize[index],
-					Md5:    dirFilesMd5[index],
-					Start:  dirFilesStart[index],
-					Finish: dirFilesFinish[index],
-				}
-				replayStream.Replays = append(replayStream.Replays, replay)
-			}
-
 		}
 
-		if hased {
+		if len(replayRoom.Urls) > 0 {
 			replayRooms.Rooms = append(replayRooms.Rooms, replayRoom)
 		}
 	}
@@ -996,6 +1072,12 @@ func (rs *RtmpStream) GetProjectReplayList(projectId int) configure.ReplayRooms
 	return replayRooms
 }
 
+//QueryRecords 分页查询录制索引
+func (rs *RtmpStream) QueryRecords(query catalog.Query) (int, []catalog.Entry) {
+
+	return rs.catalog.Query(query)
+}
+
 func (rs *RtmpStream) checkViewers(Url string) {
 
 	//统计观看者相关信息
@@ -1008,7 +1090,7 @@ func (rs *RtmpStream) checkViewers(Url string) {
 					case *VirWriter:
 						v := pw.GetWriter().(*VirWriter)
 
-						log.Infof(">>>>Current Viewers Url=%s PeerIp=%s\n", v.Info().URL, v.WriteBWInfo.PeerIP)
+						log.Infof(">>>>Current Viewers Url=%s PeerIp=%s\n", v.Info().URL, v.WriteStatics().PeerIP)
 					}
 				}
 			}
@@ -1035,7 +1117,7 @@ func (rs *RtmpStream) checkPublisher() {
 					case *VirReader:
 						v := s.GetReader().(*VirReader)
 
-						log.Infof("Current Publisher Url=%s PeerIp=%s\n", v.Info().URL, v.ReadBWInfo.PeerIP)
+						log.Infof("Current Publisher Url=%s PeerIp=%s\n", v.Info().URL, v.ReadStatics().PeerIP)
 
 						rs.checkViewers(v.Info().URL)
 					}
@@ -1053,11 +1135,8 @@ func (rs *RtmpStream) checkPublisher() {
 			if v.CheckAlive() == 0 {
 				log.Infof("RtmpStream checkAlive remove %s", item.Key)
 
-				//查看对应的切片机起来没，起来的话，关闭切片机
-				if v.FFmpeg {
-					v.FFmpeg = false
-					v.Stopffmpeg()
-				}
+				//停止录制
+				v.StopRecord()
 
 				rs.streams.Remove(item.Key)
 			}
@@ -1065,50 +1144,43 @@ func (rs *RtmpStream) checkPublisher() {
 	}
 }
 
-///定期清空不存在的文件
-func (rs *RtmpStream) checkMediaFile() {
-
-	for {
-
-		time.Sleep(time.Duration(5) * time.Second)
-
-		log.Infof("Server checkMediaFile ---->>>>")
-
-		for i := 0; i < len(rs.md5s.Files); {
-
-			filePath := rs.md5s.Files[i].FilePath
-			exits, _ := rs.pathExists(filePath)
-			if !exits {
-
-				rs.md5s.Files = append(rs.md5s.Files[:i], rs.md5s.Files[i+1:]...)
-				log.Infof("checkMediaFile Delete Not Found File=%s", filePath)
-			} else {
-				i++
-			}
-		}
-		rs.writeReplayConfig()
-
-	}
-}
-
 type Stream struct {
 	isStart    bool
-	FFmpeg     bool
 	cache      *cache.Cache
-	r          av.ReadCloser
+	readerLock sync.RWMutex
+	r          av.ReadCloser //发布者, 由readerLock保护
 	ws         cmap.ConcurrentMap
 	info       av.Info
-	cmdExec    *exec.Cmd
 	liveRoomId string
 	pushId     int
 	limitAudio bool
 	rtmpStream *RtmpStream
-	saveFile   string
+	recorder   *record.Recorder
+	recordUID  string       //录制所属发布者的UID
+	clipBuffer *clip.Buffer //直播剪辑缓存
+
+	recordLock   sync.Mutex
+	recordSource string        //录制来源: auto/api/schedule
+	recordTarget *RecordTarget //录制文件的保存位置
+	recordStart  time.Time     //启动录制的时间
+	recordUntil  time.Time     //自动停止时间, 为零表示不自动停止
+	recordTimer  *time.Timer   //自动停止
+
+	injectQueue   chan av.Packet //外部注入的数据消息
+	lastTimeStamp uint32         //最近一个音视频包的时间戳, 使用atomic读写
+	lastStreamID  uint32         //使用atomic读写
+
+	cueLock sync.Mutex
+	cueOut  bool      //是否处于广告中
+	cueId   uint32    //当前广告ID
+	cueEnd  time.Time //广告预计结束时间
 }
 
 type PackWriterCloser struct {
 	init bool
 	w    av.WriteCloser
+	fw   av.WriteCloser //按观看参数过滤后的写入, 没有观看参数时就是w
+	opts PlayOptions
 }
 
 func (p *PackWriterCloser) GetWriter() av.WriteCloser {
@@ -1116,22 +1188,28 @@ func (p *PackWriterCloser) GetWriter() av.WriteCloser {
 }
 
 func NewStream(rs *RtmpStream) *Stream {
-	return &Stream{
-		cache:      cache.NewCache(),
-		ws:         cmap.New(),
-		FFmpeg:     false,
-		rtmpStream: rs,
+	s := &Stream{
+		cache:       cache.NewCache(),
+		ws:          cmap.New(),
+		rtmpStream:  rs,
+		injectQueue: make(chan av.Packet, maxInjectNum),
 	}
+	if buffer := configure.GetClipBuffer(); buffer > 0 {
+		s.clipBuffer = clip.NewBuffer(time.Duration(buffer) * time.Second)
+	}
+	return s
 }
 
 func (s *Stream) ID() string {
-	if s.r != nil {
-		return s.r.Info().UID
+	if r := s.GetReader(); r != nil {
+		return r.Info().UID
 	}
 	return EmptyID
 }
 
 func (s *Stream) GetReader() av.ReadCloser {
+	s.readerLock.RLock()
+	defer s.readerLock.RUnlock()
 	return s.r
 }
 
@@ -1148,175 +1226,104 @@ func (s *Stream) Copy(dst *Stream) {
 	}
 }
 
-func (s *Stream) Startffmpeg(Url string, SaveFile string) {
-
-	time.Sleep(time.Duration(3) * time.Second)
-
-	log.Infof("Startffmpeg---->>>>")
+//StartRecord 启动录制, 录制器作为观看者加入
+//source为录制来源, duration大于0时录制duration后自动停止
+func (s *Stream) StartRecord(info av.Info, target *RecordTarget, source string, duration time.Duration) {
 
-	//停止原有的拉流FFMpeg进程
-	input := Url
-	cmd := ""
-	cmd += "a="
-	cmd += input
-	cmd += ";b=`ps  -ef |grep $a|grep -v grep`;if [ \"x$b\" != \"x\" ];then  ps  -ef|grep $a|grep -v grep|cut -c 9-15 | xargs kill -9 ;fi"
-	log.Infof("Stop Old FFMpeg Process When Start FFMpeg cmd---->>>>\n %s", cmd)
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
 
-	//执行进程停止
-	lsCmd := exec.Command("/bin/sh", "-c", cmd)
-	lsCmd.Run()
+	s.stopRecord()
 
-	args := configure.GetFfmpeg() + " -v verbose -i " + Url + " -codec copy " + SaveFile + "\n"
+	rs := s.rtmpStream
+	recorder := record.NewRecorder(info, target.Dir, target.VideoName, target.Format,
+		configure.GetRecordSegmentDuration(), configure.GetRecordSegmentSize(),
+		func(seg record.SegmentInfo) {
+			rs.onRecordStart(target, seg)
+		},
+		func(seg record.SegmentInfo) {
+			rs.onRecordDone(target, seg)
+		})
+	//写入出错时录制器自己关闭, 清除录制状态
+	recorder.OnClose(func() {
 
-	log.Infof("Startffmpeg %s", args)
+		s.recordLock.Lock()
+		defer s.recordLock.Unlock()
 
-	cmdExec := exec.Command("/bin/sh", "-c", args)
-
-	err := cmdExec.Start()
-	if err != nil {
-
-		log.Error("Startffmpeg Failed")
-		return
+		if s.recorder == recorder {
+			log.Errorf("Stream Record Closed On Error %s", info.URL)
+			s.stopRecord()
+		}
+	})
+	s.recorder = recorder
+	s.recordUID = info.UID
+	s.recordSource = source
+	s.recordTarget = target
+	s.recordStart = time.Now()
+	if duration > 0 {
+
+		s.recordUntil = s.recordStart.Add(duration)
+		s.recordTimer = time.AfterFunc(duration, func() {
+
+			s.recordLock.Lock()
+			defer s.recordLock.Unlock()
+
+			//只停止本次启动的录制
+			if s.recorder == recorder {
+				log.Infof("Stream Record Auto Stop %s", info.URL)
+				s.stopRecord()
+			}
+		})
 	}
+	s.AddWriter(recorder)
+}
 
-	s.saveFile = SaveFile
-	s.FFmpeg = true
-	err = cmdExec.Wait()
-}
-
-/*
-启动FFMpeg
-
-参数：
-Url: rtmp的地址
-SaveFile: 保存的文件
-
-FFmpeg指令拼接:
-
-ffmpeg -v verbose -i rtmp://10.10.60.62:1935/live/01/12/Camera_2 -codec copy C:\1.ts
-
-*/
-//func (s *Stream) Startffmpeg(Url string, SaveFile string) {
-
-//	time.Sleep(time.Duration(3) * time.Second)
-
-//	//停止原有的拉流FFMpeg进程
-//	input := Url
-//	cmd := ""
-//	cmd += "a="
-//	cmd += input
-//	cmd += ";b=`ps  -ef |grep $a|grep -v grep`;if [ \"x$b\" != \"x\" ];then  ps  -ef|grep $a|grep -v grep|cut -c 9-15 | xargs kill -9 ;fi"
-//	//log.Infof("Stop Old FFMpeg Process When Start FFMpeg cmd---->>>>\n %s", cmd)
-
-//	//执行进程停止
-//	lsCmd := exec.Command("/bin/sh", "-c", cmd)
-//	lsCmd.Run()
-//	lsCmd.Run()
-
-//	//设置输出
-//	null, _ := os.Open(os.DevNull)
-//	attr := &os.ProcAttr{
-//		Dir:   "/opt/",
-//		Files: []*os.File{null, null, null},
-//		Sys: &syscall.SysProcAttr{
-//			Credential: &syscall.Credential{
-//				Uid: 0,
-//				Gid: 0,
-//			},
-//			Setpgid: true,
-//		},
-//	}
-
-//	args := " -v verbose -i " + Url + " -codec copy " + SaveFile + "\n"
-//	var proc *os.Process
-//	var err error
-//	var tryCount int
-//	proc = nil
-//	err = nil
-//	tryCount = 0
-
-//	//启动FFMpeg
-//	for {
-//		proc, err = os.StartProcess(configure.GetFfmpeg(), strings.Fields(args), attr)
-//		if nil == err {
-
-//			log.Infof("Start FFMpeg Success")
-//			break
-//		} else {
-//			tryCount++
-//			time.Sleep(time.Second)
-//			if 5 == tryCount {
-
-//				log.Error("Failed to Start FFMpeg With 5 Errors")
-//				return
-//			}
-//			log.Error("Start FFMpeg failed!")
-//		}
-//	}
-//	null.Close()
-
-//	//检测FFMpeg是否被正常启动
-//	s.process = proc
-//	err = syscall.Kill(s.process.Pid, 0)
-//	if err == nil {
-
-//		log.Infof("Start FFMpeg Success Pid=%d args=%s", s.process.Pid, args)
-
-//		s.FFmpeg = true
-//		s.process.Wait()
-
-//	} else {
-//		log.Error("Start FFMpeg Failed Check Process Is Deaded Pid=%d args=%s", s.process.Pid, args)
-//	}
-//}
-
-func (s *Stream) Stopffmpeg() {
-
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error("rtmp Stopffmpeg  panic: ", r)
-		}
-	}()
+//StopRecord 停止录制, 当前分段写完后改名为 名称_起始时间_结束时间
+func (s *Stream) StopRecord() {
 
-	//终止FFMpeg
-	if nil != s.cmdExec {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
 
-		log.Infof("kill s.process: ", s.cmdExec.Process)
-		s.cmdExec.Process.Kill()
-	}
+	s.stopRecord()
+}
 
-	s.FFmpeg = false
-	s.cmdExec = nil
+//调用者持有recordLock
+func (s *Stream) stopRecord() {
 
-	//修改文件名称为结束时间
-	curPath, _ := filepath.Split(s.saveFile)
+	if s.recordTimer != nil {
+		s.recordTimer.Stop()
+		s.recordTimer = nil
+	}
+	s.recordUntil = time.Time{}
 
-	//得到文件名带后缀
-	nameWithSuffix := path.Base(s.saveFile)
-	//得到后缀
-	suffix := path.Ext(nameWithSuffix)
-	//得到文件名不带后缀
-	nameOnly := strings.TrimSuffix(nameWithSuffix, suffix)
+	recorder := s.recorder
+	if recorder == nil {
+		return
+	}
+	s.recorder = nil
+	s.recordSource = ""
+	s.recordTarget = nil
 
-	//添加结束时间
-	newName := nameOnly + "_" + time.Now().Format("20060102T150405") + suffix
+	s.ws.Remove(recorder.Info().UID)
+	recorder.Close(errors.New("stop record"))
+}
 
-	//得到新的文件名
-	newMediaFile := curPath + "/" + newName
+//stopRecordFor 发布者断开时停止其录制, 重新推流后启动的录制不受影响
+func (s *Stream) stopRecordFor(uid string) {
 
-	//重命名
-	err := os.Rename(s.saveFile, newMediaFile)
-	if err != nil {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
 
-		log.Error("Media File ReName Failed %s", s.saveFile)
-		return
+	if s.recorder != nil && s.recordUID == uid {
+		s.stopRecord()
 	}
-	log.Infof("Media File ReName Success %s", newMediaFile)
 }
 
 func (s *Stream) AddReader(r av.ReadCloser, liveRoomId string, pushId int) {
 
+	s.readerLock.Lock()
 	s.r = r
+	s.readerLock.Unlock()
 	s.liveRoomId = liveRoomId
 	s.pushId = pushId
 	log.Infof("Stream AddReader Info=%s liveRoomId=%s pushId=%d", s.info.String(), liveRoomId, pushId)
@@ -1327,7 +1334,11 @@ func (s *Stream) AddWriter(w av.WriteCloser) {
 
 	info := w.Info()
 	log.Infof("AddWriter:%v", s.info)
-	pw := &PackWriterCloser{w: w}
+	pw := &PackWriterCloser{w: w, fw: w, opts: ParsePlayOptions(info.URL)}
+	if !pw.opts.IsZero() {
+		log.Infof("AddWriter %s play options %+v", info.UID, pw.opts)
+		pw.fw = newPlayFilter(w, pw.opts)
+	}
 	s.ws.Set(info.UID, pw)
 
 	log.Infof("AddWriter ws Count:%v", s.ws.Count())
@@ -1472,6 +1483,8 @@ func (s *Stream) TransStart() {
 	var p av.Packet
 
 	log.Infof("TransStart:%v", s.info)
+	r := s.GetReader()
+	readerUID := r.Info().UID
 
 	//根据是否进行转推
 	ret := s.StartStaticPush()
@@ -1484,59 +1497,153 @@ func (s *Stream) TransStart() {
 	for {
 		if !s.isStart {
 			log.Info("Stream stop: call closeInter", s.info)
+			s.stopRecordFor(readerUID)
 			s.closeInter()
 			return
 		}
 
 		//从网络中读取视频数据
 		for {
-			err := s.r.Read(&p)
+			err := r.Read(&p)
 			if err != nil {
 				log.Error("Stream Read error:", s.info, err)
 				s.isStart = false
+				s.stopRecordFor(readerUID)
 				s.closeInter()
 				return
 			}
 			break
 		}
 
-		if s.IsSendStaticPush() {
-
-			log.Info("---->>>>Stream IsSendStaticPush")
-			s.SendStaticPush(p)
-		} else if s.IsSubSendStaticPush() {
+		if !p.IsMetadata {
+			atomic.StoreUint32(&s.lastTimeStamp, p.TimeStamp)
+			atomic.StoreUint32(&s.lastStreamID, p.StreamID)
+		}
+		s.transPacket(p)
 
-			log.Info("---->>>>Stream IsSubSendStaticPush")
-			s.SendSubStaticPush(p)
+		//转发外部注入的数据消息
+		for len(s.injectQueue) > 0 {
+			s.transPacket(<-s.injectQueue)
 		}
+	}
+}
 
-		s.cache.Write(p)
+//Inject 注入数据消息(script data),时间戳使用当前流的时间戳
+func (s *Stream) Inject(data []byte) error {
 
-		if s.ws.IsEmpty() {
-			continue
-		}
+	if !s.isStart {
+		return errors.New("stream not start")
+	}
 
-		for item := range s.ws.IterBuffered() {
-			v := item.Val.(*PackWriterCloser)
-			if !v.init {
-				//log.Infof("cache.send: %v", v.w.Info())
-				if err := s.cache.Send(v.w); err != nil {
-					log.Infof("[%s] send cache packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
-					continue
-				}
-				v.init = true
-			} else {
-				new_packet := p
-				//writeType := reflect.TypeOf(v.w)
-				//log.Infof("w.Write: type=%v, %v", writeType, v.w.Info())
-				if err := v.w.Write(&new_packet); err != nil {
-					//log.Infof("[%s] write packet error: %v, remove", v.w.Info(), err)
-					s.ws.Remove(item.Key)
-				}
+	p := av.Packet{
+		IsMetadata: true,
+		TimeStamp:  atomic.LoadUint32(&s.lastTimeStamp),
+		StreamID:   atomic.LoadUint32(&s.lastStreamID),
+		Data:       data,
+	}
+
+	select {
+	case s.injectQueue <- p:
+	default:
+		return errors.New("inject queue full")
+	}
+	return nil
+}
+
+//checkCuePoint 检测onCuePoint广告标记
+func (s *Stream) checkCuePoint(p av.Packet) {
+
+	name, args, err := amf.DecodeDataMessage(p.Data)
+	if err != nil || name != amf.OnCuePoint {
+		return
+	}
+
+	cue, err := amf.ParseCuePoint(args)
+	if err != nil {
+		log.Errorf("Stream checkCuePoint %s error: %v", s.info.Key, err)
+		return
+	}
+
+	s.cueLock.Lock()
+	s.setCue(cue.Out, cue.Id, cue.Duration)
+	s.cueLock.Unlock()
+	log.Infof("Stream checkCuePoint %s out=%v id=%d duration=%f", s.info.Key, cue.Out, cue.Id, cue.Duration)
+}
+
+//setCue 设置广告状态, 需要持有cueLock
+func (s *Stream) setCue(out bool, id uint32, duration float64) {
+	s.cueOut = out
+	s.cueId = id
+	s.cueEnd = time.Time{}
+	if out && duration > 0 {
+		s.cueEnd = time.Now().Add(time.Duration(duration * float64(time.Second)))
+	}
+}
+
+//IsCueOut 是否处于广告中, 带时长的广告到期后自动结束
+func (s *Stream) IsCueOut() bool {
+	s.cueLock.Lock()
+	defer s.cueLock.Unlock()
+	return s.isCueOut()
+}
+
+//isCueOut 需要持有cueLock
+func (s *Stream) isCueOut() bool {
+	if s.cueOut && !s.cueEnd.IsZero() && time.Now().After(s.cueEnd) {
+		return false
+	}
+	return s.cueOut
+}
+
+//transPacket 将数据包转发给转推和所有观看者
+func (s *Stream) transPacket(p av.Packet) {
+
+	if p.IsMetadata {
+		s.checkCuePoint(p)
+	}
+
+	if s.IsSendStaticPush() {
+
+		log.Info("---->>>>Stream IsSendStaticPush")
+		s.SendStaticPush(p)
+	} else if s.IsSubSendStaticPush() {
+
+		log.Info("---->>>>Stream IsSubSendStaticPush")
+		s.SendSubStaticPush(p)
+	}
+
+	s.cache.Write(p)
+	if s.clipBuffer != nil {
+		s.clipBuffer.Write(p)
+	}
+
+	if s.ws.IsEmpty() {
+		return
+	}
+
+	for item := range s.ws.IterBuffered() {
+		v := item.Val.(*PackWriterCloser)
+		if !v.init {
+			//log.Infof("cache.send: %v", v.w.Info())
+			send := s.cache.Send
+			if v.opts.NoGop {
+				send = s.cache.SendSeq
+			}
+			if err := send(v.fw); err != nil {
+				log.Infof("[%s] send cache packet error: %v, remove", v.w.Info(), err)
+				s.ws.Remove(item.Key)
+				continue
+			}
+			v.init = true
+		} else {
+			new_packet := p
+			//writeType := reflect.TypeOf(v.w)
+			//log.Infof("w.Write: type=%v, %v", writeType, v.w.Info())
+			if err := v.fw.Write(&new_packet); err != nil {
+				//log.Infof("[%s] write packet error: %v, remove", v.w.Info(), err)
+				s.ws.Remove(item.Key)
 			}
 		}
-
 	}
 }
 
@@ -1544,8 +1651,8 @@ func (s *Stream) TransStop() {
 
 	log.Infof("TransStop: %s", s.info.Key)
 
-	if s.isStart && s.r != nil {
-		s.r.Close(errors.New("stop old"))
+	if r := s.GetReader(); s.isStart && r != nil {
+		r.Close(errors.New("stop old"))
 	}
 
 	s.isStart = false
@@ -1553,13 +1660,13 @@ func (s *Stream) TransStop() {
 
 func (s *Stream) CheckAlive() (n int) {
 
-	if s.r != nil && s.isStart {
+	if r := s.GetReader(); r != nil && s.isStart {
 
-		if s.r.Alive() {
+		if r.Alive() {
 			n++
 		} else {
 			log.Error("CheckAlive Read Failed Timeout %s", s.info.String())
-			s.r.Close(errors.New("read timeout"))
+			r.Close(errors.New("read timeout"))
 		}
 	}
 
@@ -1598,7 +1705,8 @@ func (s *Stream) ExecPushDone(key string) {
 }
 func (s *Stream) closeInter() {
 
-	if s.r != nil {
+	r := s.GetReader()
+	if r != nil {
 
 		//停止发布者
 		if s.IsSendStaticPush() {
@@ -1607,21 +1715,12 @@ func (s *Stream) closeInter() {
 			s.StopSubStaticPush()
 		}
 
-		//停止发布者所启动的ffmpeg
-		log.Infof("Stream closeInter Check FFMpeg ")
-		if s.FFmpeg {
-
-			log.Infof("Stream Kill Publisher Start FFMpeg")
-
-			s.FFmpeg = false
-			s.Stopffmpeg()
-		}
 
-		log.Infof("Stream closeInter Close Publisher: [%s]", s.r.Info().String())
-		s.rtmpStream.GetStreams().Remove(s.r.Info().Key)
+		log.Infof("Stream closeInter Close Publisher: [%s]", r.Info().String())
+		s.rtmpStream.GetStreams().Remove(r.Info().Key)
 
 	}
-	s.ExecPushDone(s.r.Info().Key)
+	s.ExecPushDone(r.Info().Key)
 
 	//删除观看者
 	for item := range s.ws.IterBuffered() {
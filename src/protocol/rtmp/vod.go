@@ -0,0 +1,82 @@
+package rtmp
+
+import (
+	"errors"
+	"protocol/catalog"
+	"protocol/hls"
+	"protocol/record"
+	"time"
+)
+
+//VodPlaylist 得到一个推流点在[start, finish]内的点播播放列表, 跨越多个连续的录制
+//只有TS格式的录制可以按字节范围点播, start/finish为空表示不限制
+func (rs *RtmpStream) VodPlaylist(liveRoomId string, pushId int, start, finish string) (error, []byte) {
+
+	query := catalog.NewQuery()
+	query.LiveRoomId = liveRoomId
+	query.PushId = pushId
+	query.Start = start
+	query.Finish = finish
+
+	return rs.vodPlaylist(query)
+}
+
+//DayPlaylist 得到一个项目中一个推流点全天的回看播放列表, date格式为20060102
+func (rs *RtmpStream) DayPlaylist(projectId int, liveRoomId string, pushId int, date string) (error, []byte) {
+
+	day, err := time.ParseInLocation("20060102", date, time.Local)
+	if err != nil {
+		return err, nil
+	}
+
+	query := catalog.NewQuery()
+	query.ProjectId = projectId
+	query.LiveRoomId = liveRoomId
+	query.PushId = pushId
+	query.Start = day.Format(record.TimeFormat)
+	query.Finish = day.Add(24*time.Hour - time.Second).Format(record.TimeFormat)
+
+	return rs.vodPlaylist(query)
+}
+
+func (rs *RtmpStream) vodPlaylist(query catalog.Query) (error, []byte) {
+
+	var start, finish time.Time
+	var err error
+	if query.Start != "" {
+		if start, err = time.ParseInLocation(record.TimeFormat, query.Start, time.Local); err != nil {
+			return err, nil
+		}
+	}
+	if query.Finish != "" {
+		if finish, err = time.ParseInLocation(record.TimeFormat, query.Finish, time.Local); err != nil {
+			return err, nil
+		}
+	}
+
+	//录制按起始时间排序
+	var files []hls.VodFile
+	for _, e := range rs.catalog.Find(query) {
+
+		//本地文件已删除的录制无法扫描分片
+		if e.Format != record.FormatTs || e.Remote {
+			continue
+		}
+
+		fileStart, err := time.ParseInLocation(record.TimeFormat, e.Start, time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, hls.VodFile{
+			File:  e.File,
+			Uri:   e.Addr,
+			Start: fileStart,
+		})
+	}
+	if len(files) == 0 {
+		return errors.New("no ts record found"), nil
+	}
+
+	body, err := rs.vod.Playlist(files, start, finish)
+	return err, body
+}
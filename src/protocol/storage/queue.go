@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	log "logging"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueueNum = 4096
+
+	minBackoff = 5 * time.Second
+	maxBackoff = 10 * time.Minute
+)
+
+//Queue 上传队列, 任务保存在文件中, 失败后按指数退避重试
+type Queue struct {
+	mutex       sync.Mutex
+	file        string
+	backend     Backend
+	tasks       map[string]*Task
+	pending     chan string
+	deleteLocal bool
+	maxRetry    int
+	onDone      func(task Task, url string, deleted bool)
+	saveLock    sync.Mutex
+}
+
+//NewQueue 加载队列文件file, 启动workers个上传协程
+//deleteLocal为true时上传并校验成功后删除本地文件, maxRetry为0表示一直重试
+func NewQueue(file string, backend Backend, workers int, deleteLocal bool, maxRetry int, onDone func(task Task, url string, deleted bool)) *Queue {
+	q := &Queue{
+		file:        file,
+		backend:     backend,
+		tasks:       make(map[string]*Task),
+		pending:     make(chan string, maxQueueNum),
+		deleteLocal: deleteLocal,
+		maxRetry:    maxRetry,
+		onDone:      onDone,
+	}
+	if err := q.load(); err != nil {
+		log.Errorf("Upload Queue load %s error: %v", file, err)
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+
+	//继续上次没有完成的上传
+	q.mutex.Lock()
+	for file := range q.tasks {
+		q.push(file)
+	}
+	q.mutex.Unlock()
+	return q
+}
+
+func (q *Queue) load() error {
+	data, err := ioutil.ReadFile(q.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var tasks []*Task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		q.tasks[task.File] = task
+	}
+	log.Infof("Upload Queue load %d tasks from %s", len(tasks), q.file)
+	return nil
+}
+
+//save 写入临时文件后改名
+func (q *Queue) save() {
+	q.saveLock.Lock()
+	defer q.saveLock.Unlock()
+
+	q.mutex.Lock()
+	tasks := make([]*Task, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		tasks = append(tasks, task)
+	}
+	data, err := json.MarshalIndent(tasks, "", "\t")
+	q.mutex.Unlock()
+	if err != nil {
+		log.Errorf("Upload Queue save error: %v", err)
+		return
+	}
+
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Upload Queue save %s error: %v", q.file, err)
+		return
+	}
+	if err := os.Rename(tmp, q.file); err != nil {
+		log.Errorf("Upload Queue save %s error: %v", q.file, err)
+	}
+}
+
+//Add 加入上传任务, 同一个文件只上传一次
+func (q *Queue) Add(file string, key string) {
+	q.mutex.Lock()
+	if _, ok := q.tasks[file]; ok {
+		q.mutex.Unlock()
+		return
+	}
+	q.tasks[file] = &Task{File: file, Key: key}
+	q.push(file)
+	q.mutex.Unlock()
+
+	log.Infof("Upload Queue add %s key=%s", file, key)
+	q.save()
+}
+
+//Pending 等待上传的任务数
+func (q *Queue) Pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.tasks)
+}
+
+func (q *Queue) push(file string) {
+	select {
+	case q.pending <- file:
+	default:
+		//队列满时任务仍在文件中, 重启后继续
+		log.Errorf("Upload Queue full, delay %s", file)
+	}
+}
+
+func (q *Queue) worker() {
+	for file := range q.pending {
+		q.mutex.Lock()
+		task, ok := q.tasks[file]
+		q.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		q.upload(task)
+	}
+}
+
+func (q *Queue) upload(task *Task) {
+	//上传协程独占task, 修改task时加锁避免与save冲突
+	q.mutex.Lock()
+	t := *task
+	q.mutex.Unlock()
+
+	save := func() {
+		q.mutex.Lock()
+		*task = t
+		q.mutex.Unlock()
+		q.save()
+	}
+
+	url, err := q.backend.Upload(&t, save)
+	if err != nil {
+		t.Attempts++
+		t.Error = err.Error()
+		save()
+
+		if q.maxRetry > 0 && t.Attempts >= q.maxRetry {
+			log.Errorf("Upload %s failed after %d attempts: %v", t.File, t.Attempts, err)
+			q.remove(t.File)
+			return
+		}
+		delay := backoff(t.Attempts)
+		log.Errorf("Upload %s attempt %d error: %v, retry after %v", t.File, t.Attempts, err, delay)
+		time.AfterFunc(delay, func() {
+			q.pending <- t.File
+		})
+		return
+	}
+
+	deleted := false
+	if q.deleteLocal && url != "" {
+		if err := os.Remove(t.File); err != nil {
+			log.Errorf("Upload remove local %s error: %v", t.File, err)
+		} else {
+			deleted = true
+		}
+	}
+	log.Infof("Upload %s done url=%s deleted=%v", t.File, url, deleted)
+
+	q.remove(t.File)
+	if q.onDone != nil {
+		q.onDone(t, url, deleted)
+	}
+}
+
+func (q *Queue) remove(file string) {
+	q.mutex.Lock()
+	delete(q.tasks, file)
+	q.mutex.Unlock()
+	q.save()
+}
+
+//backoff 第attempts次失败后的重试间隔
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
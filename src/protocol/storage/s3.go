@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minPartSize = 5 * 1024 * 1024
+)
+
+var errNoSuchUpload = errors.New("no such upload")
+
+//S3Config S3兼容的对象存储
+type S3Config struct {
+	Endpoint  string //http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool   //使用 endpoint/bucket/key 形式的地址, MinIO需要
+	PublicUrl string //对象访问地址的root, 为空时使用endpoint
+	PartSize  int64  //分片上传的分片大小, 小于分片大小的文件直接PUT
+}
+
+//S3 S3兼容的对象存储, 大文件分片上传, 上传进度保存在Task中可以断点续传
+type S3 struct {
+	cfg    S3Config
+	scheme string
+	host   string
+	signer *signer
+	client *http.Client
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %s", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket is empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize < minPartSize {
+		cfg.PartSize = minPartSize
+	}
+	return &S3{
+		cfg:    cfg,
+		scheme: u.Scheme,
+		host:   u.Host,
+		signer: &signer{
+			accessKey: cfg.AccessKey,
+			secretKey: cfg.SecretKey,
+			region:    cfg.Region,
+			service:   "s3",
+		},
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+//objectUrl 请求地址
+func (s *S3) objectUrl(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: s.scheme, Host: s.host, Path: "/" + key}
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + s.host
+	}
+	u.RawPath = escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	return u
+}
+
+//Url 对象的访问地址
+func (s *S3) Url(key string) string {
+	if s.cfg.PublicUrl != "" {
+		return strings.TrimSuffix(s.cfg.PublicUrl, "/") + "/" + escape(key, false)
+	}
+	u := s.objectUrl(key, nil)
+	return u.String()
+}
+
+func (s *S3) do(method string, key string, query url.Values, body []byte) (*http.Response, []byte, error) {
+	u := s.objectUrl(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	hash := emptyHash
+	if len(body) > 0 {
+		hash = sha256Hex(body)
+	}
+	s.signer.sign(req, hash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.Unmarshal(data, &e)
+		if e.Code == "NoSuchUpload" {
+			return resp, data, errNoSuchUpload
+		}
+		return resp, data, fmt.Errorf("s3 %s %s status %d %s %s", method, key, resp.StatusCode, e.Code, e.Message)
+	}
+	return resp, data, nil
+}
+
+//Upload 上传文件, 每完成一个分片调用save保存进度
+func (s *S3) Upload(task *Task, save func()) (string, error) {
+	f, err := os.Open(task.File)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	task.Size = info.Size()
+
+	var etag string
+	if task.Size <= s.cfg.PartSize {
+		etag, err = s.put(f, task)
+	} else {
+		etag, err = s.multipart(f, task, save)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.verify(task, etag); err != nil {
+		return "", err
+	}
+	return s.Url(task.Key), nil
+}
+
+func (s *S3) put(f *os.File, task *Task) (string, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	resp, _, err := s.do(http.MethodPut, task.Key, nil, data)
+	if err != nil {
+		return "", err
+	}
+	if got := trimEtag(resp.Header.Get("ETag")); got != etag {
+		return "", fmt.Errorf("s3 put %s etag %s, want %s", task.Key, got, etag)
+	}
+	return etag, nil
+}
+
+func (s *S3) multipart(f *os.File, task *Task, save func()) (string, error) {
+	//分片大小改变时不能继续之前的上传
+	if task.UploadId != "" && task.PartSize != s.cfg.PartSize {
+		s.abort(task)
+	}
+	if task.UploadId == "" {
+		_, data, err := s.do(http.MethodPost, task.Key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return "", err
+		}
+		var result struct {
+			UploadId string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(data, &result); err != nil || result.UploadId == "" {
+			return "", fmt.Errorf("s3 create multipart upload %s error: %v", task.Key, err)
+		}
+		task.UploadId = result.UploadId
+		task.PartSize = s.cfg.PartSize
+		task.Parts = nil
+		save()
+	}
+
+	buf := make([]byte, s.cfg.PartSize)
+	count := int((task.Size + s.cfg.PartSize - 1) / s.cfg.PartSize)
+	for number := len(task.Parts) + 1; number <= count; number++ {
+		offset := int64(number-1) * s.cfg.PartSize
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		part := buf[:n]
+		sum := md5.Sum(part)
+		etag := hex.EncodeToString(sum[:])
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {task.UploadId},
+		}
+		resp, _, err := s.do(http.MethodPut, task.Key, query, part)
+		if err == errNoSuchUpload {
+			//上传已过期, 下次重新开始
+			task.UploadId = ""
+			task.Parts = nil
+			save()
+			return "", err
+		}
+		if err != nil {
+			return "", err
+		}
+		if got := trimEtag(resp.Header.Get("ETag")); got != etag {
+			return "", fmt.Errorf("s3 upload part %d of %s etag %s, want %s", number, task.Key, got, etag)
+		}
+		task.Parts = append(task.Parts, Part{Number: number, ETag: etag})
+		save()
+	}
+
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+	all := md5.New()
+	for _, part := range task.Parts {
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>\"%s\"</ETag></Part>", part.Number, part.ETag)
+		sum, _ := hex.DecodeString(part.ETag)
+		all.Write(sum)
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	_, data, err := s.do(http.MethodPost, task.Key, url.Values{"uploadId": {task.UploadId}}, complete.Bytes())
+	if err == errNoSuchUpload {
+		task.UploadId = ""
+		task.Parts = nil
+		save()
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	//完成分片上传时可能返回200和错误信息
+	if bytes.Contains(data, []byte("<Error>")) {
+		return "", fmt.Errorf("s3 complete multipart upload %s error: %s", task.Key, data)
+	}
+
+	task.UploadId = ""
+	task.Parts = nil
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(all.Sum(nil)), count), nil
+}
+
+//abort 放弃之前的分片上传
+func (s *S3) abort(task *Task) {
+	s.do(http.MethodDelete, task.Key, url.Values{"uploadId": {task.UploadId}}, nil)
+	task.UploadId = ""
+	task.Parts = nil
+}
+
+//verify 检查对象的大小和ETag与本地文件一致
+func (s *S3) verify(task *Task, etag string) error {
+	resp, _, err := s.do(http.MethodHead, task.Key, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength != task.Size {
+		return fmt.Errorf("s3 verify %s size %d, want %d", task.Key, resp.ContentLength, task.Size)
+	}
+	if got := trimEtag(resp.Header.Get("ETag")); got != etag {
+		return fmt.Errorf("s3 verify %s etag %s, want %s", task.Key, got, etag)
+	}
+	return nil
+}
+
+func trimEtag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, "\""))
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeLocal = "local"
+	TypeS3    = "s3"
+
+	DefaultPrefix = "{room}/{project}/{push}/{date}"
+)
+
+//Backend 录制文件的保存位置
+type Backend interface {
+	//Upload 保存task.File, 返回访问地址, save用于保存上传进度
+	Upload(task *Task, save func()) (string, error)
+}
+
+//Part 分片上传中已完成的分片
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+//Task 一个上传任务, 进度保存在上传队列文件中, 重启后继续上传
+type Task struct {
+	File     string `json:"file"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	UploadId string `json:"uploadId"` //未完成的分片上传
+	PartSize int64  `json:"partSize"`
+	Parts    []Part `json:"parts"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+//Local 本地文件系统, 文件已经在本地, 不需要上传
+type Local struct {
+}
+
+func (l *Local) Upload(task *Task, save func()) (string, error) {
+	return "", nil
+}
+
+//Key 由前缀模板得到对象名称, 模板支持{room}, {project}, {push}, {date}
+func Key(prefix string, liveRoomId string, projectId int, pushId int, date string, name string) string {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	key := strings.NewReplacer(
+		"{room}", liveRoomId,
+		"{project}", strconv.Itoa(projectId),
+		"{push}", strconv.Itoa(pushId),
+		"{date}", date,
+	).Replace(prefix)
+	key = strings.Trim(key, "/")
+	if key == "" {
+		return name
+	}
+	return key + "/" + name
+}
@@ -0,0 +1,292 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//WebSocket帧类型(RFC 6455)
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+const (
+	acceptGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxMessageSize = 64 * 1024 //客户端消息的最大长度, 观看端只发送控制帧
+	closeTimeout   = time.Second
+	writeTimeout   = 10 * time.Second //每一帧的写入超时, 与HTTP-FLV观看者的超时相同
+)
+
+var (
+	ErrNotWebSocket  = errors.New("not websocket request")
+	ErrBadFrame      = errors.New("bad websocket frame")
+	ErrFrameTooLarge = errors.New("websocket frame too large")
+	ErrClosed        = errors.New("websocket closed")
+)
+
+//Conn 服务端的WebSocket连接, 写入是并发安全的, 读取只能在一个goroutine中
+type Conn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	lock         sync.Mutex
+	closed       bool
+	writeTimeout time.Duration
+}
+
+//IsWebSocket 是否是WebSocket升级请求
+func IsWebSocket(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header[name] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//acceptKey Sec-WebSocket-Accept
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//Upgrade 完成握手并接管HTTP连接, 失败时已经返回HTTP错误
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !IsWebSocket(r) || key == "" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrNotWebSocket
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	//flv.js等播放器可能带子协议, 原样返回第一个
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + strings.TrimSpace(strings.Split(protocol, ",")[0]) + "\r\n"
+	}
+	resp += "\r\n"
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: rw.Reader, writeTimeout: writeTimeout}, nil
+}
+
+//Write 一次写入作为一个二进制消息
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//WriteMessage 写入一个不分片的消息, 服务端的帧不加掩码
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	err := c.writeFrame(opcode, data, c.writeTimeout)
+	//超时时可能只写了半个帧, 连接不能再使用
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.closed = true
+		c.conn.Close()
+	}
+	return err
+}
+
+//writeFrame 写入一个帧, timeout为这一帧的写入超时
+func (c *Conn) writeFrame(opcode byte, data []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+//ReadMessage 读取一个消息, 分片的消息合并后返回
+//收到Ping时回复Pong, 收到Close时回复Close并返回ErrClosed, 控制帧同样返回给调用者
+//分片的消息中间可以有控制帧, 这时处理控制帧后继续读取消息
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, err
+			}
+			if message != nil {
+				continue
+			}
+			return op, data, nil
+		case OpPong:
+			if message != nil {
+				continue
+			}
+			return op, data, nil
+		case OpClose:
+			c.lock.Lock()
+			if !c.closed {
+				c.writeFrame(OpClose, nil, closeTimeout)
+				c.closed = true
+			}
+			c.lock.Unlock()
+			return op, data, ErrClosed
+		case OpContinuation:
+			if message == nil {
+				return 0, nil, ErrBadFrame
+			}
+		default:
+			if message != nil {
+				return 0, nil, ErrBadFrame
+			}
+			opcode = op
+			message = []byte{}
+		}
+		if len(message)+len(data) > maxMessageSize {
+			return 0, nil, ErrFrameTooLarge
+		}
+		message = append(message, data...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+//readFrame 读取一个帧, 客户端的帧必须加掩码
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		return false, 0, nil, ErrBadFrame
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	//控制帧不能分片, 长度不超过125
+	if opcode >= OpClose && (!fin || length > 125) {
+		return false, 0, nil, ErrBadFrame
+	}
+	if length > maxMessageSize {
+		return false, 0, nil, ErrFrameTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	return fin, opcode, data, nil
+}
+
+//SetWriteTimeout 每一帧的写入超时, 为0时不超时, 超时后关闭连接
+func (c *Conn) SetWriteTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeTimeout = timeout
+}
+
+//SetReadDeadline 读取超时, 用于Ping/Pong保活
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//Close 发送Close帧后关闭连接
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		c.writeFrame(OpClose, nil, closeTimeout)
+		c.closed = true
+	}
+	return c.conn.Close()
+}
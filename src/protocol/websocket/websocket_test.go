@@ -0,0 +1,220 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//客户端帧, 必须加掩码
+func clientFrame(opcode byte, data []byte) []byte {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b := []byte{0x80 | opcode, 0x80 | byte(len(data))}
+	b = append(b, mask...)
+	for i, v := range data {
+		b = append(b, v^mask[i%4])
+	}
+	return b
+}
+
+//读取服务端帧, 服务端的帧不加掩码
+func serverFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("bad server frame header %x", header)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(br, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(br, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br, data); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, data
+}
+
+func TestConn(t *testing.T) {
+	small := bytes.Repeat([]byte{1}, 200)
+	large := bytes.Repeat([]byte{2}, 70000)
+	done := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.Write(small)
+		conn.Write(large)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	if plain, err := http.Get(ts.URL); err != nil || plain.StatusCode != http.StatusBadRequest {
+		t.Fatal("plain request upgraded")
+	}
+	<-done
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /live/test.flv HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//RFC 6455中的示例
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake %d %s", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	for _, want := range [][]byte{small, large} {
+		op, data := serverFrame(t, br)
+		if op != OpBinary || !bytes.Equal(data, want) {
+			t.Fatalf("binary message opcode %d length %d", op, len(data))
+		}
+	}
+
+	c.Write(clientFrame(OpPing, []byte("ping")))
+	if op, data := serverFrame(t, br); op != OpPong || string(data) != "ping" {
+		t.Fatalf("pong opcode %d %q", op, data)
+	}
+
+	c.Write(clientFrame(OpClose, nil))
+	if op, _ := serverFrame(t, br); op != OpClose {
+		t.Fatalf("close opcode %d", op)
+	}
+	if err := <-done; err != ErrClosed {
+		t.Fatalf("server read error %v", err)
+	}
+}
+
+//客户端不读取时写入超时, 超时后关闭连接
+func TestWriteTimeout(t *testing.T) {
+	done := make(chan error, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetWriteTimeout(100 * time.Millisecond)
+		data := make([]byte, 1024*1024)
+		for i := 0; i < 256; i++ {
+			if _, err = conn.Write(data); err != nil {
+				break
+			}
+		}
+		done <- err
+		_, err = conn.Write(data)
+		done <- err
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /live/test.flv HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("write error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write timeout not applied")
+	}
+	if err := <-done; err != ErrClosed {
+		t.Fatalf("write after timeout %v", err)
+	}
+}
+
+//分片消息中间的Ping回复Pong后继续读取, 消息完整返回
+func TestFragmentedMessage(t *testing.T) {
+	type message struct {
+		op   byte
+		data string
+	}
+	messages := make(chan message, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- message{op, string(data)}
+		}
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /live/test.flv HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(c)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake %v", err)
+	}
+
+	first := clientFrame(OpText, []byte("hello "))
+	first[0] &^= 0x80
+	middle := clientFrame(OpContinuation, []byte("web"))
+	middle[0] &^= 0x80
+	c.Write(first)
+	c.Write(clientFrame(OpPing, []byte("ping")))
+	c.Write(middle)
+	c.Write(clientFrame(OpPong, nil))
+	c.Write(clientFrame(OpContinuation, []byte("socket")))
+	c.Write(clientFrame(OpPing, []byte("after")))
+
+	if op, data := serverFrame(t, br); op != OpPong || string(data) != "ping" {
+		t.Fatalf("pong opcode %d %q", op, data)
+	}
+	if m := <-messages; m.op != OpText || m.data != "hello websocket" {
+		t.Fatalf("message %+v", m)
+	}
+	//不在分片消息中的控制帧返回给调用者
+	if m := <-messages; m.op != OpPing || m.data != "after" {
+		t.Fatalf("message %+v", m)
+	}
+}